@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"http-attenuator/broker"
+	"http-attenuator/data"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// The broker path that the admin API lives under.  An upstream
+	// called 'admin' is hidden by it
+	ADMIN_PREFIX = "admin"
+
+	// How long a drain waits for the requests in flight to finish
+	DEFAULT_DRAIN_TIMEOUT_MILLIS = 30000
+)
+
+// isAdmin is true if the broker path is for the admin API
+func isAdmin(serviceAndUri string) bool {
+	serviceAndUri = strings.TrimLeft(serviceAndUri, "/")
+	return serviceAndUri == ADMIN_PREFIX || strings.HasPrefix(serviceAndUri, ADMIN_PREFIX+"/")
+}
+
+// AdminHandler lets us look at (and change) the state of the
+// upstreams and their backends:
+//
+//	GET /api/v1/broker/admin
+//	GET /api/v1/broker/admin/:upstream
+//	GET /api/v1/broker/admin/:upstream/:backend
+//	GET /api/v1/broker/admin/:upstream/:backend/healthchecks
+//	PUT /api/v1/broker/admin/:upstream/:backend/enable
+//	PUT /api/v1/broker/admin/:upstream/:backend/disable
+//	PUT /api/v1/broker/admin/:upstream/:backend/drain[?timeout_millis=30000]
+//	PUT /api/v1/broker/admin/:upstream/:backend/weight (with a rollout)
+//
+// Every call needs an "Authorization: Bearer {admin_token}" header, and
+// the API is turned off if the broker doesn't have an admin_token
+func AdminHandler(c *gin.Context) {
+	serviceBroker := broker.GetServiceBroker()
+	if serviceBroker == nil {
+		err := fmt.Errorf("AdminHandler(%s): the broker is not running", c.Request.URL)
+		abortWithError(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	if !isAuthorised(c, serviceBroker.GetAdminToken()) {
+		return
+	}
+
+	fields := strings.Split(strings.Trim(c.Param("serviceAndUri"), "/"), "/")[1:]
+	switch c.Request.Method {
+	case http.MethodGet:
+		getAdmin(c, serviceBroker, fields)
+
+	case http.MethodPut, http.MethodPost:
+		if len(fields) != 3 {
+			err := fmt.Errorf("AdminHandler(%s): expected /admin/:upstream/:backend/:action", c.Request.URL)
+			abortWithError(c, http.StatusNotFound, err)
+			return
+		}
+		changeBackend(c, serviceBroker, fields[0], fields[1], fields[2])
+
+	default:
+		err := fmt.Errorf("AdminHandler(%s): method %s not allowed", c.Request.URL, c.Request.Method)
+		abortWithError(c, http.StatusMethodNotAllowed, err)
+	}
+}
+
+// isAuthorised checks the bearer token of the caller, and tells them
+// if it isn't the admin token
+func isAuthorised(c *gin.Context, adminToken string) bool {
+	if adminToken == "" {
+		err := fmt.Errorf("isAuthorised(%s): the admin API is turned off (there is no %s)", c.Request.URL, data.CONF_BROKER_ADMIN_TOKEN)
+		abortWithError(c, http.StatusForbidden, err)
+		return false
+	}
+	token, isBearer := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !isBearer || token == "" {
+		err := fmt.Errorf("isAuthorised(%s): the admin API needs a bearer token", c.Request.URL)
+		c.Header("WWW-Authenticate", "Bearer")
+		abortWithError(c, http.StatusUnauthorized, err)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		err := fmt.Errorf("isAuthorised(%s): the bearer token is not the admin token", c.Request.URL)
+		abortWithError(c, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+func getAdmin(c *gin.Context, serviceBroker broker.ServiceBroker, fields []string) {
+	switch len(fields) {
+	case 0:
+		statuses := make(map[string]data.UpstreamStatus)
+		for upstreamName, upstream := range serviceBroker.GetUpstreams() {
+			statuses[upstreamName] = upstream.GetStatus()
+		}
+		c.JSON(http.StatusOK, statuses)
+
+	case 1:
+		upstream := getUpstream(c, serviceBroker, fields[0])
+		if upstream == nil {
+			return
+		}
+		c.JSON(http.StatusOK, upstream.GetStatus())
+
+	case 2:
+		backend := getBackend(c, serviceBroker, fields[0], fields[1])
+		if backend == nil {
+			return
+		}
+		c.JSON(http.StatusOK, backend.GetStatus())
+
+	case 3:
+		if fields[2] != "healthchecks" {
+			err := fmt.Errorf("getAdmin(%s): unknown resource '%s'", c.Request.URL, fields[2])
+			abortWithError(c, http.StatusNotFound, err)
+			return
+		}
+		backend := getBackend(c, serviceBroker, fields[0], fields[1])
+		if backend == nil {
+			return
+		}
+		c.JSON(http.StatusOK, backend.GetHealthcheckHistory())
+
+	default:
+		err := fmt.Errorf("getAdmin(%s): expected /admin[/:upstream[/:backend[/healthchecks]]]", c.Request.URL)
+		abortWithError(c, http.StatusNotFound, err)
+	}
+}
+
+func changeBackend(c *gin.Context, serviceBroker broker.ServiceBroker, upstreamName string, backendName string, action string) {
+	backend := getBackend(c, serviceBroker, upstreamName, backendName)
+	if backend == nil {
+		return
+	}
+
+	var err error
+	switch action {
+	case "weight":
+		// e.g. {"to": 50} or {"from": 5, "to": 50, "duration_millis": 1800000}
+		rollout := &data.RolloutImpl{}
+		if err = c.ShouldBindJSON(rollout); err != nil {
+			err = fmt.Errorf("changeBackend(%s): bad rollout: %s", c.Request.URL, err.Error())
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+		if err = serviceBroker.GetUpstream(upstreamName).Rollout(backendName, rollout); err != nil {
+			err = fmt.Errorf("changeBackend(%s): %s", c.Request.URL, err.Error())
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+
+	case "enable":
+		err = backend.Enable()
+
+	case "disable":
+		err = backend.Disable()
+
+	case "drain":
+		timeoutMillis := int64(DEFAULT_DRAIN_TIMEOUT_MILLIS)
+		if timeout := c.Query("timeout_millis"); timeout != "" {
+			timeoutMillis, err = strconv.ParseInt(timeout, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("changeBackend(%s): bad timeout_millis: %s", c.Request.URL, err.Error())
+				abortWithError(c, http.StatusBadRequest, err)
+				return
+			}
+		}
+		ctx, cancelFunc := context.WithTimeout(c.Request.Context(), time.Duration(timeoutMillis)*time.Millisecond)
+		defer cancelFunc()
+		if err = backend.Drain(ctx); err != nil && backend.GetState() == data.DRAINING {
+			// It is still draining, and will be disabled once
+			// it has finished
+			log.Println(err)
+			c.JSON(http.StatusAccepted, backend.GetStatus())
+			return
+		}
+
+	default:
+		err = fmt.Errorf("changeBackend(%s): unknown action '%s'", c.Request.URL, action)
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("changeBackend(%s): %s", c.Request.URL, err.Error())
+		abortWithError(c, http.StatusConflict, err)
+		return
+	}
+
+	log.Printf("%s.%s: %s (%s)", upstreamName, backendName, action, backend.GetState())
+	c.JSON(http.StatusOK, backend.GetStatus())
+}
+
+func getUpstream(c *gin.Context, serviceBroker broker.ServiceBroker, upstreamName string) data.Upstream {
+	upstream := serviceBroker.GetUpstream(upstreamName)
+	if upstream == nil {
+		err := fmt.Errorf("getUpstream(%s): No upstream for '%s'", c.Request.URL, upstreamName)
+		abortWithError(c, http.StatusNotFound, err)
+	}
+	return upstream
+}
+
+func getBackend(c *gin.Context, serviceBroker broker.ServiceBroker, upstreamName string, backendName string) data.UpstreamBackend {
+	upstream := getUpstream(c, serviceBroker, upstreamName)
+	if upstream == nil {
+		return nil
+	}
+	backend := upstream.GetBackend(backendName)
+	if backend == nil {
+		err := fmt.Errorf("getBackend(%s): No backend for '%s.%s'", c.Request.URL, upstreamName, backendName)
+		abortWithError(c, http.StatusNotFound, err)
+	}
+	return backend
+}
+
+// abortWithError logs the error, and tells the caller about it
+func abortWithError(c *gin.Context, statusCode int, err error) {
+	log.Println(err)
+	c.Writer.Header().Add(data.HEADER_X_FAULTMONKEY_ERROR, err.Error())
+	c.AbortWithError(statusCode, err)
+}
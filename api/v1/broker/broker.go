@@ -7,5 +7,19 @@ import (
 )
 
 func BrokerHandler(c *gin.Context) {
+	// The admin and jobs APIs share the broker path (gin won't let
+	// them have routes of their own next to the catch-all)
+	if isAdmin(c.Param("serviceAndUri")) {
+		AdminHandler(c)
+		return
+	}
+	if isJobs(c.Param("serviceAndUri")) {
+		JobsHandler(c)
+		return
+	}
+	if isAsync(c) {
+		enqueueJob(c)
+		return
+	}
 	broker.GetServiceBroker().Handle(c)
 }
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"fmt"
+	"http-attenuator/broker"
+	"http-attenuator/data"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// The broker path that the jobs API lives under.  An upstream
+	// called 'jobs' is hidden by it
+	JOBS_PREFIX = "jobs"
+)
+
+// isJobs is true if the broker path is for the jobs API
+func isJobs(serviceAndUri string) bool {
+	serviceAndUri = strings.TrimLeft(serviceAndUri, "/")
+	return serviceAndUri == JOBS_PREFIX || strings.HasPrefix(serviceAndUri, JOBS_PREFIX+"/")
+}
+
+// isAsync is true if the caller doesn't want to wait for the response
+func isAsync(c *gin.Context) bool {
+	return c.Query("async") == "true"
+}
+
+// enqueueJob puts the request on the queue for the job workers, and
+// tells the caller where to find the response:
+//
+//	POST /api/v1/broker/:upstream/...?async=true[&callback=https://...]
+//
+// The callback can also be given in HEADER_X_FAULTMONKEY_CALLBACK
+func enqueueJob(c *gin.Context) {
+	workers := broker.GetJobWorkers()
+	serviceBroker := broker.GetServiceBroker()
+	if workers == nil || serviceBroker == nil {
+		err := fmt.Errorf("enqueueJob(%s): the job workers are not running", c.Request.URL)
+		abortWithError(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	if data.IsWebSocketUpgrade(c.Request) {
+		err := fmt.Errorf("enqueueJob(%s): a WebSocket can't be asynchronous", c.Request.URL)
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	serviceAndUri := strings.TrimLeft(c.Param("serviceAndUri"), "/")
+	upstreamName := strings.Split(serviceAndUri, "/")[0]
+	if getUpstream(c, serviceBroker, upstreamName) == nil {
+		return
+	}
+
+	// The async flag (and the callback) are for us, not the upstream
+	query := c.Request.URL.Query()
+	callback := query.Get("callback")
+	if callback == "" {
+		callback = c.Request.Header.Get(data.HEADER_X_FAULTMONKEY_CALLBACK)
+	}
+	if callback != "" {
+		callbackUrl, err := url.Parse(callback)
+		if err == nil {
+			err = workers.CheckCallback(callbackUrl)
+		}
+		if err != nil {
+			err = fmt.Errorf("enqueueJob(%s): the callback '%s' can't be used: %s", c.Request.URL, callback, err.Error())
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+	query.Del("async")
+	query.Del("callback")
+	target := url.URL{
+		Path:     "/" + serviceAndUri,
+		RawQuery: query.Encode(),
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		err = fmt.Errorf("enqueueJob(%s): reading the body: %s", c.Request.URL, err.Error())
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	headers := c.Request.Header.Clone()
+	headers.Del(data.HEADER_X_FAULTMONKEY_CALLBACK)
+
+	id := uuid.NewString()
+	if headers.Get(data.HEADER_X_REQUEST_ID) == "" {
+		headers.Set(data.HEADER_X_REQUEST_ID, id)
+	}
+	route := strings.TrimSuffix(c.Request.URL.Path, c.Param("serviceAndUri"))
+	job := &data.Job{
+		Id:        id,
+		Upstream:  upstreamName,
+		Method:    c.Request.Method,
+		Url:       target.String(),
+		StatusUrl: fmt.Sprintf("%s/%s/%s", route, JOBS_PREFIX, id),
+		Callback:  callback,
+		Request: &data.JobMessage{
+			Headers: headers,
+			Body:    body,
+		},
+	}
+	if err := workers.Enqueue(job); err != nil {
+		err = fmt.Errorf("enqueueJob(%s): %s", c.Request.URL, err.Error())
+		abortWithError(c, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	log.Printf("%s: job %s queued", upstreamName, id)
+	c.Header("Location", job.StatusUrl)
+	c.Header(data.HEADER_X_FAULTMONKEY_JOB, id)
+	c.JSON(http.StatusAccepted, job.GetSummary())
+}
+
+// JobsHandler lets callers see how their asynchronous requests are
+// getting on:
+//
+//	GET    /api/v1/broker/jobs/:id
+//	DELETE /api/v1/broker/jobs/:id
+//
+// Until the job is done, a GET is a 202 with the job.  After that,
+// it is the response that the upstream sent back (or a 504, if the job
+// was still running at its deadline)
+func JobsHandler(c *gin.Context) {
+	fields := strings.Split(strings.Trim(c.Param("serviceAndUri"), "/"), "/")[1:]
+	if len(fields) != 1 {
+		err := fmt.Errorf("JobsHandler(%s): expected /jobs/:id", c.Request.URL)
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+	job, err := broker.GetJob(fields[0])
+	if err != nil {
+		err = fmt.Errorf("JobsHandler(%s): %s", c.Request.URL, err.Error())
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if job == nil {
+		err := fmt.Errorf("JobsHandler(%s): no job '%s'", c.Request.URL, fields[0])
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet:
+		c.Header(data.HEADER_X_FAULTMONKEY_JOB, job.Id)
+		if !job.IsFinished() {
+			c.JSON(http.StatusAccepted, job.GetSummary())
+			return
+		}
+		for h, v := range job.Response.Headers {
+			if h == "Content-Length" {
+				continue
+			}
+			for _, headerVal := range v {
+				c.Writer.Header().Add(h, headerVal)
+			}
+		}
+		c.Status(job.Response.StatusCode)
+		c.Writer.Write(job.Response.Body)
+
+	case http.MethodDelete:
+		if err := broker.DeleteJob(job.Id); err != nil {
+			err = fmt.Errorf("JobsHandler(%s): %s", c.Request.URL, err.Error())
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, job.GetSummary())
+
+	default:
+		err := fmt.Errorf("JobsHandler(%s): method %s not allowed", c.Request.URL, c.Request.Method)
+		abortWithError(c, http.StatusMethodNotAllowed, err)
+	}
+}
@@ -2,20 +2,70 @@ package api
 
 import (
 	"fmt"
+	"http-attenuator/data"
 	config "http-attenuator/facade/config"
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 )
 
+var reloadFunc func() error
+var reloadFuncMutex sync.RWMutex
+
+// RegisterReloadFunc sets the function that reloads the config (this
+// avoids an import loop with cmd)
+func RegisterReloadFunc(f func() error) {
+	reloadFuncMutex.Lock()
+	defer reloadFuncMutex.Unlock()
+	reloadFunc = f
+}
+
+func getReloadFunc() func() error {
+	reloadFuncMutex.RLock()
+	defer reloadFuncMutex.RUnlock()
+	return reloadFunc
+}
+
+// POST /api/v1/config/reload
+//
+// If the config file is not valid, then the old config carries on
+// and we say why
+func ReloadConfigHandler(c *gin.Context) {
+	reload := getReloadFunc()
+	if reload == nil {
+		err := fmt.Errorf("ReloadConfigHandler(%s): reloading is not supported", c.Request.URL)
+		log.Println(err)
+		c.AbortWithError(http.StatusNotImplemented, err)
+		return
+	}
+
+	if err := reload(); err != nil {
+		log.Println(err)
+		c.Writer.Header().Add(data.HEADER_X_FAULTMONKEY_ERROR, err.Error())
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity,
+			map[string]string{
+				"error": err.Error(),
+			},
+		)
+		return
+	}
+
+	c.JSON(http.StatusOK,
+		map[string]string{
+			"status": "reloaded",
+		},
+	)
+}
+
 // PUT /api/v1/config/:name/:value
 func SetConfigHandler(c *gin.Context) {
 	// Extract the service from the URL
 	name := c.Param("name")
 	if name == "" {
-		err := fmt.Errorf("SetConfigHandler(%s): no config parameter")
+		err := fmt.Errorf("SetConfigHandler(%s): no config parameter", c.Request.URL)
 		log.Println(err)
 		c.AbortWithError(http.StatusNotFound, err)
 		return
@@ -23,7 +73,7 @@ func SetConfigHandler(c *gin.Context) {
 
 	value := c.Param("value")
 	if value == "" {
-		err := fmt.Errorf("SetConfigHandler(%s): no config value")
+		err := fmt.Errorf("SetConfigHandler(%s): no config value", c.Request.URL)
 		log.Println(err)
 		c.AbortWithError(http.StatusBadRequest, err)
 		return
@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"http-attenuator/data"
 	"http-attenuator/util"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -41,6 +41,23 @@ var gatewayResponses = promauto.NewCounterVec(
 	[]string{"tag", "host", "method", "code"},
 )
 
+var gatewayConfig *data.GatewayImpl
+var gatewayConfigMutex sync.RWMutex
+
+// RegisterGateway sets the gateway config (for the per-domain
+// attenuators etc)
+func RegisterGateway(gateway *data.GatewayImpl) {
+	gatewayConfigMutex.Lock()
+	defer gatewayConfigMutex.Unlock()
+	gatewayConfig = gateway
+}
+
+func getGateway() *data.GatewayImpl {
+	gatewayConfigMutex.RLock()
+	defer gatewayConfigMutex.RUnlock()
+	return gatewayConfig
+}
+
 func GatewayHandler(c *gin.Context) {
 	nowMillis := time.Now().UTC().UnixMilli()
 	host := ""
@@ -92,17 +109,57 @@ func GatewayHandler(c *gin.Context) {
 		c.Request.Method,
 	).Inc()
 	request := *c.Request
-	request.URL = hostAndQueryUrl
+	request.URL = data.WebSocketURL(hostAndQueryUrl)
 	request.Host = hostAndQueryUrl.Host
 
 	//http: Request.RequestURI can't be set in client requests.
 	//http://golang.org/src/pkg/net/http/client.go
 	request.RequestURI = ""
 
+	// A sample of the requests to the domain get a pathology instead
+	faultInjection := getGateway().GetFaultInjection(request.URL.Host)
+	if resp, injected, err := faultInjection.Do(request.Context(), &request); injected {
+		data.WriteResponse(c, resp, err)
+		gatewayResponses.WithLabelValues(
+			c.Request.Header.Get(data.HEADER_X_FAULTMONKEY_TAG),
+			hostAndQueryUrl.Host,
+			c.Request.Method,
+			fmt.Sprint(c.Writer.Status()),
+		).Inc()
+		return
+	}
+
+	// Don't hit the host if it has told us to back off
+	if err := data.WaitForHost(request.Context(), request.URL.Host); err != nil {
+		log.Printf("%s: waiting for backoff: %s", hostAndQuery, err.Error())
+		c.Writer.Header().Add(data.HEADER_X_FAULTMONKEY_ERROR, err.Error())
+		gatewayResponses.WithLabelValues(
+			c.Request.Header.Get(data.HEADER_X_FAULTMONKEY_TAG),
+			hostAndQueryUrl.Host,
+			c.Request.Method,
+			fmt.Sprint(http.StatusServiceUnavailable),
+		).Inc()
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
+
+	// Wait on the attenuator for the domain
+	throttle := getGateway().GetThrottle(request.URL.Host)
+	if err := data.WaitForThrottle(request.Context(), throttle); err != nil {
+		log.Printf("%s: waiting for attenuator: %s", hostAndQuery, err.Error())
+		c.Writer.Header().Add(data.HEADER_X_FAULTMONKEY_ERROR, err.Error())
+		gatewayResponses.WithLabelValues(
+			c.Request.Header.Get(data.HEADER_X_FAULTMONKEY_TAG),
+			hostAndQueryUrl.Host,
+			c.Request.Method,
+			fmt.Sprint(http.StatusServiceUnavailable),
+		).Inc()
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
+
 	// Make the request
-	//
-	// TODO(john): put it through the attenuator / circuit breaker etc
-	client := util.GetHttpClient(nil)
+	client := util.GetStreamingHttpClient(nil)
 	resp, err := client.Do(&request)
 	if err != nil {
 		log.Printf("%s: %s", hostAndQuery, err.Error())
@@ -119,6 +176,10 @@ func GatewayHandler(c *gin.Context) {
 
 	defer resp.Body.Close()
 
+	// If the host is telling us to back off, then everybody
+	// talking to it needs to back off
+	data.Backoff(request.URL.Host, resp.StatusCode, resp.Header, throttle)
+
 	// Send the status
 	gatewayResponses.WithLabelValues(
 		c.Request.Header.Get(data.HEADER_X_FAULTMONKEY_TAG),
@@ -126,6 +187,15 @@ func GatewayHandler(c *gin.Context) {
 		c.Request.Method,
 		fmt.Sprint(resp.StatusCode),
 	).Inc()
+
+	// The caller and the host talk to each other directly once they
+	// have switched to a WebSocket
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if err := data.ProxyWebSocket(c, "gateway."+hostAndQueryUrl.Host, resp, nil); err != nil {
+			log.Printf("%s: websocket: %s", hostAndQuery, err.Error())
+		}
+		return
+	}
 	c.Status(resp.StatusCode)
 
 	// Send the headers
@@ -135,6 +205,8 @@ func GatewayHandler(c *gin.Context) {
 		}
 	}
 
-	// Send the body
-	io.Copy(c.Writer, resp.Body)
+	// Send the body (as it arrives, if it is streamed)
+	if err := data.CopyResponseBody(c.Writer, resp); err != nil {
+		log.Printf("%s: sending the response: %s", hostAndQuery, err.Error())
+	}
 }
@@ -16,6 +16,9 @@ import (
 
 type ServiceBroker interface {
 	Handle(c *gin.Context)
+	GetUpstream(serviceName string) data.Upstream
+	GetUpstreams() map[string]data.Upstream
+	GetAdminToken() string
 }
 
 type ServiceBrokerImpl struct {
@@ -60,17 +63,22 @@ var brokerResponses = promauto.NewCounterVec(
 )
 
 var serviceBrokerInstance ServiceBroker
-var serviceBrokerOnce sync.Once
+var serviceBrokerMutex sync.RWMutex
 
+// RegisterServiceBroker makes the broker the live one, replacing
+// any broker from an older config.  Requests that are already in
+// flight carry on with the broker they started with
 func RegisterServiceBroker(broker data.Broker) {
-	serviceBrokerOnce.Do(func() {
-		serviceBrokerInstance = &ServiceBrokerImpl{
-			BrokerImpl: *broker.(*data.BrokerImpl),
-		}
-	})
+	serviceBrokerMutex.Lock()
+	defer serviceBrokerMutex.Unlock()
+	serviceBrokerInstance = &ServiceBrokerImpl{
+		BrokerImpl: *broker.(*data.BrokerImpl),
+	}
 }
 
 func GetServiceBroker() ServiceBroker {
+	serviceBrokerMutex.RLock()
+	defer serviceBrokerMutex.RUnlock()
 	return serviceBrokerInstance
 }
 
@@ -143,14 +151,25 @@ func (sb *ServiceBrokerImpl) Handle(c *gin.Context) {
 		log.Println(err)
 		brokerErrors.WithLabelValues(
 			c.Request.Header.Get(data.HEADER_X_FAULTMONKEY_TAG),
-			upstream.GetName(), // upstream
-			"",                 // backend
+			fields[0], // upstream
+			"",        // backend
 			c.Request.Method,
 		).Inc()
 		c.AbortWithError(http.StatusNotFound, err)
 		return
 	}
 
+	// The backend gets the rest of the path (and the query), so strip
+	// off the route and the name of the service
+	route := strings.TrimSuffix(c.Request.URL.Path, c.Param("serviceAndUri"))
+	routeSegments := 0
+	for _, segment := range strings.Split(route, "/") {
+		if segment != "" {
+			routeSegments++
+		}
+	}
+	c.Request.URL = data.StripPathSegments(c.Request.URL, routeSegments+1)
+
 	upstream.Handle(c)
 }
 
@@ -0,0 +1,374 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"http-attenuator/client"
+	"http-attenuator/data"
+	keyvalue "http-attenuator/facade/keyvalue"
+	"http-attenuator/facade/queue"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var brokerJobs = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "broker_jobs",
+		Help:      "The number of asynchronous broker jobs, keyed by upstream and status (queued/running/done/failed)",
+	},
+	[]string{"upstream", "status"},
+)
+var brokerJobsLatency = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "broker_jobs_latency",
+		Help:      "The time from queueing an asynchronous broker job to it being done, keyed by upstream",
+	},
+	[]string{"upstream"},
+)
+var brokerJobCallbacks = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "broker_job_callbacks",
+		Help:      "The number of callbacks for asynchronous broker jobs, keyed by upstream and response code",
+	},
+	[]string{"upstream", "code"},
+)
+
+const (
+	// Jobs are kept in the key/value store under this prefix
+	JOB_KEY_PREFIX = "broker.job."
+)
+
+// JobWorkers takes the asynchronous requests off the queue, and runs
+// them through the live service broker (so they get the attenuation,
+// failover etc of the upstream)
+type JobWorkers struct {
+	async   *data.AsyncImpl
+	engine  *gin.Engine
+	stop    chan interface{}
+	stopped sync.Once
+}
+
+var jobWorkersInstance *JobWorkers
+var jobWorkersMutex sync.RWMutex
+
+// StartJobWorkers starts the worker pool, which takes over from any
+// pool that was already running
+func StartJobWorkers(async *data.AsyncImpl) (*JobWorkers, error) {
+	if err := queue.Queue().CreateTopic(async.Topic); err != nil {
+		return nil, fmt.Errorf("StartJobWorkers(%s): %s", async.Topic, err.Error())
+	}
+
+	// The jobs are replayed through an engine of their own, with the
+	// upstream first in the path
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	engine.Any("/*serviceAndUri", func(c *gin.Context) {
+		serviceBroker := GetServiceBroker()
+		if serviceBroker == nil {
+			c.AbortWithError(http.StatusServiceUnavailable, fmt.Errorf("%s: the broker is not running", c.Request.URL))
+			return
+		}
+		serviceBroker.Handle(c)
+	})
+	workers := &JobWorkers{
+		async:  async,
+		engine: engine,
+		stop:   make(chan interface{}),
+	}
+	for i := 0; i < async.Workers; i++ {
+		go workers.work()
+	}
+
+	jobWorkersMutex.Lock()
+	defer jobWorkersMutex.Unlock()
+	if jobWorkersInstance != nil {
+		jobWorkersInstance.Stop()
+	}
+	jobWorkersInstance = workers
+	log.Printf("Started %d job workers on '%s'", async.Workers, async.Topic)
+	return workers, nil
+}
+
+// GetJobWorkers returns the worker pool that is running (if any)
+func GetJobWorkers() *JobWorkers {
+	jobWorkersMutex.RLock()
+	defer jobWorkersMutex.RUnlock()
+	return jobWorkersInstance
+}
+
+// Stop tells the workers to stop once they have finished the job they
+// are on (or have been given the next one)
+func (w *JobWorkers) Stop() {
+	w.stopped.Do(func() {
+		close(w.stop)
+	})
+}
+
+// CheckCallback returns an error if the job workers won't POST to the
+// callback
+func (w *JobWorkers) CheckCallback(callbackUrl *url.URL) error {
+	return w.async.CheckCallback(callbackUrl)
+}
+
+// Enqueue saves the job and puts it on the queue for the workers
+func (w *JobWorkers) Enqueue(job *data.Job) error {
+	job.Status = data.JOB_QUEUED
+	job.CreatedMillis = time.Now().UTC().UnixMilli()
+	credentials, err := w.async.SealCredentials(job.Request)
+	if err != nil {
+		return fmt.Errorf("Enqueue(%s): %s", job.Id, err.Error())
+	}
+	job.Credentials = credentials
+	if err := w.SaveJob(job); err != nil {
+		return err
+	}
+	if err := queue.Queue().PutTopic(w.async.Topic, &data.BaseMessage{Id: job.Id}, false); err != nil {
+		return fmt.Errorf("Enqueue(%s): %s", job.Id, err.Error())
+	}
+	brokerJobs.WithLabelValues(job.Upstream, data.JOB_QUEUED).Inc()
+	return nil
+}
+
+func (w *JobWorkers) work() {
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		msg, err := queue.Queue().FetchTopic(w.async.Topic, true)
+		if err != nil {
+			log.Printf("JobWorkers(%s): %s", w.async.Topic, err.Error())
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if msg == nil {
+			continue
+		}
+		if err := w.Run(msg.GetId()); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Run sends the job to its upstream, and keeps the response for the
+// caller (POSTing it to the callback, if there is one)
+func (w *JobWorkers) Run(id string) error {
+	job, err := GetJob(id)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return fmt.Errorf("Run(%s): the job has gone (was it deleted?)", id)
+	}
+	job.Status = data.JOB_RUNNING
+	job.StartedMillis = time.Now().UTC().UnixMilli()
+	job.DeadlineMillis = job.StartedMillis + w.async.TimeoutMillis + data.JOB_DEADLINE_GRACE_MILLIS
+	if err := w.SaveJob(job); err != nil {
+		return err
+	}
+	brokerJobs.WithLabelValues(job.Upstream, data.JOB_RUNNING).Inc()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(w.async.TimeoutMillis)*time.Millisecond)
+	defer cancel()
+	writer := newJobResponseWriter()
+	req, err := http.NewRequestWithContext(ctx, job.Method, job.Url, bytes.NewReader(job.Request.Body))
+	if err != nil {
+		err = fmt.Errorf("Run(%s): %s", id, err.Error())
+		writer.Header().Add(data.HEADER_X_FAULTMONKEY_ERROR, err.Error())
+		writer.WriteHeader(http.StatusBadRequest)
+	} else {
+		req.Header = job.Request.Headers.Clone()
+		if err := w.async.OpenCredentials(job.Credentials, req.Header); err != nil {
+			// The backend can still say no
+			log.Printf("Run(%s): running the job without its credentials: %s", id, err.Error())
+		}
+		w.engine.ServeHTTP(writer, req)
+	}
+
+	// The request (and the credentials) aren't needed any more
+	job.Status = data.JOB_DONE
+	job.FinishedMillis = time.Now().UTC().UnixMilli()
+	job.Request = nil
+	job.Credentials = nil
+	job.Response = &data.JobMessage{
+		StatusCode: writer.status,
+		Headers:    writer.header,
+		Body:       writer.body.Bytes(),
+	}
+	if err := w.SaveJob(job); err != nil {
+		return err
+	}
+	brokerJobs.WithLabelValues(job.Upstream, data.JOB_DONE).Inc()
+	brokerJobsLatency.WithLabelValues(job.Upstream).Add(float64(job.FinishedMillis - job.CreatedMillis))
+	log.Printf("%s: job %s done (%d)", job.Upstream, id, writer.status)
+
+	if job.Callback == "" {
+		return nil
+	}
+	w.callback(job)
+	return w.SaveJob(job)
+}
+
+// callback POSTs the response to the job's callback, with its status
+// code in a header (as the callback has a status code of its own).
+// The callback can get the same job more than once, as it is retried
+// even if the POST may have got there
+func (w *JobWorkers) callback(job *data.Job) {
+	// The host is checked again, in case it resolves to somewhere else
+	// now (and so is each address we connect to)
+	callbackUrl, err := url.Parse(job.Callback)
+	if err == nil {
+		err = w.CheckCallback(callbackUrl)
+	}
+	if err != nil {
+		job.CallbackError = fmt.Sprintf("callback(%s): %s", job.Id, err.Error())
+		log.Println(job.CallbackError)
+		return
+	}
+	headers := make(http.Header)
+	for _, name := range []string{"Content-Type", data.HEADER_X_REQUEST_ID, data.HEADER_X_FAULTMONKEY_UPSTREAM, data.HEADER_X_FAULTMONKEY_BACKEND} {
+		if value := job.Response.Headers.Get(name); value != "" {
+			headers.Set(name, value)
+		}
+	}
+	headers.Set(data.HEADER_X_FAULTMONKEY_JOB, job.Id)
+	headers.Set(data.HEADER_X_FAULTMONKEY_JOB_STATUS_CODE, fmt.Sprint(job.Response.StatusCode))
+
+	var resp *data.GatewayResponse
+	gwr, err := data.NewGatewayRequest(job.Id, http.MethodPost, callbackUrl, headers, job.Response.Body)
+	if err == nil {
+		var callbackClient client.HttpClient
+		callbackClient, err = client.NewHttpClientBuilder().
+			Retries(w.async.CallbackRetries).
+			RetryNonIdempotent().
+			TimeoutMillis(w.async.CallbackTimeoutMillis).
+			NoRedirects().
+			DialControl(w.async.CallbackDialControl).
+			Build()
+		if err == nil {
+			resp, err = callbackClient.Do(context.Background(), gwr)
+		}
+	}
+	if resp != nil {
+		job.CallbackStatusCode = resp.StatusCode
+		brokerJobCallbacks.WithLabelValues(job.Upstream, fmt.Sprint(resp.StatusCode)).Inc()
+	}
+	if err != nil {
+		job.CallbackError = fmt.Sprintf("callback(%s): %s", job.Id, err.Error())
+		log.Println(job.CallbackError)
+	}
+}
+
+// SaveJob writes the job to the key/value store, where it is kept for
+// the retention of the workers
+func (w *JobWorkers) SaveJob(job *data.Job) error {
+	kv, err := keyvalue.GetKeyValue()
+	if err != nil {
+		return fmt.Errorf("SaveJob(%s): %s", job.Id, err.Error())
+	}
+	jobJson, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("SaveJob(%s): %s", job.Id, err.Error())
+	}
+	retention := time.Duration(w.async.RetentionMillis) * time.Millisecond
+	if err := kv.SetWithExpiry(JOB_KEY_PREFIX+job.Id, string(jobJson), retention); err != nil {
+		return fmt.Errorf("SaveJob(%s): %s", job.Id, err.Error())
+	}
+	return nil
+}
+
+// GetJob reads the job from the key/value store, and is nil if there
+// isn't one.  A job that is still running after its deadline is
+// returned as failed
+func GetJob(id string) (*data.Job, error) {
+	kv, err := keyvalue.GetKeyValue()
+	if err != nil {
+		return nil, fmt.Errorf("GetJob(%s): %s", id, err.Error())
+	}
+	jobJson, err := kv.GetString(JOB_KEY_PREFIX + id)
+	if err != nil {
+		return nil, fmt.Errorf("GetJob(%s): %s", id, err.Error())
+	}
+	if jobJson == "" {
+		return nil, nil
+	}
+	job := &data.Job{}
+	if err := json.Unmarshal([]byte(jobJson), job); err != nil {
+		return nil, fmt.Errorf("GetJob(%s): %s", id, err.Error())
+	}
+	if job.CheckDeadline(time.Now().UTC().UnixMilli()) {
+		log.Printf("%s: job %s is past its deadline", job.Upstream, id)
+		brokerJobs.WithLabelValues(job.Upstream, data.JOB_FAILED).Inc()
+		if workers := GetJobWorkers(); workers != nil {
+			if err := workers.SaveJob(job); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return job, nil
+}
+
+// DeleteJob forgets about the job
+func DeleteJob(id string) error {
+	kv, err := keyvalue.GetKeyValue()
+	if err != nil {
+		return fmt.Errorf("DeleteJob(%s): %s", id, err.Error())
+	}
+	if err := kv.Delete(JOB_KEY_PREFIX + id); err != nil {
+		return fmt.Errorf("DeleteJob(%s): %s", id, err.Error())
+	}
+	return nil
+}
+
+// jobResponseWriter holds on to the response to a job
+type jobResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newJobResponseWriter() *jobResponseWriter {
+	return &jobResponseWriter{
+		header: make(http.Header),
+	}
+}
+
+func (w *jobResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *jobResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(p)
+}
+
+func (w *jobResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+// Flush is a no-op, and is only here because streamed responses are
+// flushed as they go
+func (w *jobResponseWriter) Flush() {
+}
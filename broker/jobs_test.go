@@ -0,0 +1,346 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"http-attenuator/client"
+	"http-attenuator/data"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const jobsTestConfig = `
+config:
+  broker:
+    async:
+      workers: 2
+      topic: %s
+      callback_retries: 1
+    upstream:
+      llm:
+        rule: random
+        backends:
+          openai:
+            url: %s
+            weight: 1
+`
+
+// startJobsTestWorkers runs a broker with an upstream whose backend
+// echoes the request, and the job workers for it
+func startJobsTestWorkers(t *testing.T) *JobWorkers {
+	gin.SetMode(gin.TestMode)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Test-Authorization", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s?%s %s", r.Method, r.URL.Path, r.URL.RawQuery, string(body))
+	}))
+	t.Cleanup(backend.Close)
+
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	config := fmt.Sprintf(jobsTestConfig, t.Name(), backend.URL)
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	appConfig, err := data.BuildConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterServiceBroker(appConfig.Config.Broker)
+	workers, err := StartJobWorkers(appConfig.Config.Broker.GetAsync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(workers.Stop)
+	return workers
+}
+
+func newTestJob(callback string) *data.Job {
+	headers := make(http.Header)
+	headers.Set(data.HEADER_X_REQUEST_ID, "abc")
+	return &data.Job{
+		Id:       fmt.Sprintf("job-%d", time.Now().UnixNano()),
+		Upstream: "llm",
+		Method:   http.MethodPost,
+		Url:      "/llm/chat?model=gpt",
+		Callback: callback,
+		Request: &data.JobMessage{
+			Headers: headers,
+			Body:    []byte("hello"),
+		},
+	}
+}
+
+// waitForJob polls for the job until it is done
+func waitForJob(t *testing.T, id string) *data.Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job != nil && job.Status == data.JOB_DONE {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected job %s to be done", id)
+	return nil
+}
+
+func TestJobRun(t *testing.T) {
+	workers := startJobsTestWorkers(t)
+	job := newTestJob("")
+	job.Request.Headers.Set("Authorization", "Bearer secret")
+	job.Request.Headers.Set("Cookie", "session=secret")
+	if err := workers.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Request.Headers.Get("Authorization") != "" || job.Request.Headers.Get("Cookie") != "" {
+		t.Errorf("Expected the credentials not to be kept as they are, but got %v", job.Request.Headers)
+	}
+	if len(job.Credentials) == 0 || strings.Contains(string(job.Credentials), "secret") {
+		t.Errorf("Expected the credentials to be encrypted, but got '%s'", string(job.Credentials))
+	}
+
+	done := waitForJob(t, job.Id)
+	if done.Request != nil || done.Credentials != nil {
+		t.Errorf("Expected the request not to be kept once the job is done, but got %+v", done.Request)
+	}
+	if auth := done.Response.Headers.Get("X-Test-Authorization"); auth != "Bearer secret" {
+		t.Errorf("Expected the backend to get the caller's credentials, but got '%s'", auth)
+	}
+	if done.Response.StatusCode != http.StatusCreated {
+		t.Errorf("Expected a 201, but got %d", done.Response.StatusCode)
+	}
+	if body := string(done.Response.Body); body != "POST /chat?model=gpt hello" {
+		t.Errorf("Expected the request to be sent to the backend, but got '%s'", body)
+	}
+	if done.Response.Headers.Get(data.HEADER_X_FAULTMONKEY_BACKEND) != "openai" {
+		t.Errorf("Expected the response to be from openai, but got %v", done.Response.Headers)
+	}
+	if done.StartedMillis == 0 || done.FinishedMillis < done.StartedMillis {
+		t.Errorf("Expected the job to have been timed, but got %+v", done)
+	}
+
+	if err := DeleteJob(job.Id); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, _ := GetJob(job.Id); deleted != nil {
+		t.Error("Expected the job to have been deleted")
+	}
+}
+
+func TestJobCallback(t *testing.T) {
+	workers := startJobsTestWorkers(t)
+	// The callback is on a loopback address, which has to be allowed
+	workers.async.CallbackAllow = []string{"127.0.0.1"}
+	callbacks := make(chan *http.Request, 1)
+	callbackBodies := make(chan string, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		callbacks <- r
+		callbackBodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(callback.Close)
+
+	job := newTestJob(callback.URL + "/done")
+	if err := workers.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-callbacks:
+		if r.Method != http.MethodPost || r.URL.Path != "/done" {
+			t.Errorf("Expected a POST to /done, but got %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get(data.HEADER_X_FAULTMONKEY_JOB) != job.Id || r.Header.Get(data.HEADER_X_FAULTMONKEY_JOB_STATUS_CODE) != "201" {
+			t.Errorf("Expected the job and its status code, but got %v", r.Header)
+		}
+		if r.Header.Get(data.HEADER_X_REQUEST_ID) != "abc" {
+			t.Errorf("Expected the request id to be passed on, but got %v", r.Header)
+		}
+		if body := <-callbackBodies; body != "POST /chat?model=gpt hello" {
+			t.Errorf("Expected the response to be POSTed, but got '%s'", body)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the callback to be POSTed")
+	}
+
+	// The outcome of the callback is saved after it has been made
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if done, _ := GetJob(job.Id); done != nil && done.CallbackStatusCode != 0 {
+			if done.CallbackStatusCode != http.StatusNoContent || done.CallbackError != "" {
+				t.Errorf("Expected the callback to get a 204, but got %d (%s)", done.CallbackStatusCode, done.CallbackError)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the outcome of the callback to be saved")
+}
+
+func TestJobCallbackInternal(t *testing.T) {
+	workers := startJobsTestWorkers(t)
+	called := make(chan interface{}, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- r
+	}))
+	t.Cleanup(callback.Close)
+
+	job := newTestJob(callback.URL + "/done")
+	if err := workers.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+	done := waitForJob(t, job.Id)
+
+	// The callback error is saved with the rest of the job
+	deadline := time.Now().Add(5 * time.Second)
+	for done.CallbackError == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		done, _ = GetJob(job.Id)
+	}
+	if done.CallbackError == "" {
+		t.Error("Expected the loopback callback to be refused")
+	}
+	select {
+	case <-called:
+		t.Error("Expected the callback not to be POSTed")
+	default:
+	}
+}
+
+func TestCheckCallback(t *testing.T) {
+	async := &data.AsyncImpl{}
+	async.Backpatch()
+	for _, callback := range []string{"http://127.0.0.1/", "http://localhost:8080/", "http://10.0.0.1/", "http://169.254.169.254/", "http://[::1]/", "http://100.64.0.1/", "ftp://1.1.1.1/"} {
+		callbackUrl, _ := url.Parse(callback)
+		if err := async.CheckCallback(callbackUrl); err == nil {
+			t.Errorf("Expected %s to be refused", callback)
+		}
+	}
+	if callbackUrl, _ := url.Parse("https://1.1.1.1/done"); async.CheckCallback(callbackUrl) != nil {
+		t.Error("Expected a public address to be allowed")
+	}
+
+	async.CallbackAllow = []string{"localhost", ".Example.com"}
+	async.Backpatch()
+	for callback, allowed := range map[string]bool{
+		"http://localhost:8080/":          true,
+		"https://hooks.example.com/":      true,
+		"https://hooks.example.com.evil/": false,
+		"https://1.1.1.1/done":            false,
+	} {
+		callbackUrl, _ := url.Parse(callback)
+		if err := async.CheckCallback(callbackUrl); (err == nil) != allowed {
+			t.Errorf("Expected %s to be allowed=%t, but got %v", callback, allowed, err)
+		}
+	}
+}
+
+func TestCallbackDialControl(t *testing.T) {
+	async := &data.AsyncImpl{}
+	async.Backpatch()
+	for address, allowed := range map[string]bool{
+		"127.0.0.1:80":        false,
+		"[::1]:80":            false,
+		"169.254.169.254:80":  false,
+		"100.64.1.1:80":       false,
+		"198.18.0.1:443":      false,
+		"[64:ff9b::a00:1]:80": false,
+		"1.1.1.1:443":         true,
+	} {
+		if err := async.CallbackDialControl("tcp", address, nil); (err == nil) != allowed {
+			t.Errorf("Expected %s to be allowed=%t, but got %v", address, allowed, err)
+		}
+	}
+
+	// Even if the host looked fine when it was checked, the client
+	// doesn't connect to an internal address
+	called := make(chan interface{}, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- r
+	}))
+	t.Cleanup(callback.Close)
+	callbackUrl, _ := url.Parse(callback.URL)
+	gwr, _ := data.NewGatewayRequest("abc", http.MethodPost, callbackUrl, make(http.Header), nil)
+	callbackClient, err := client.NewHttpClientBuilder().DialControl(async.CallbackDialControl).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := callbackClient.Do(context.Background(), gwr); err == nil {
+		t.Error("Expected the connection to a loopback address to be refused")
+	}
+	select {
+	case <-called:
+		t.Error("Expected the callback not to be POSTed")
+	default:
+	}
+}
+
+func TestJobRetention(t *testing.T) {
+	workers := startJobsTestWorkers(t)
+	workers.async.RetentionMillis = 1
+	job := newTestJob("")
+	if err := workers.SaveJob(job); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if expired, _ := GetJob(job.Id); expired != nil {
+		t.Errorf("Expected the job to have expired, but got %+v", expired)
+	}
+}
+
+func TestJobDeadline(t *testing.T) {
+	workers := startJobsTestWorkers(t)
+
+	// The worker running the job has gone away
+	job := newTestJob("")
+	job.Status = data.JOB_RUNNING
+	job.StartedMillis = time.Now().UTC().UnixMilli() - 2000
+	job.DeadlineMillis = job.StartedMillis + 1000
+	if err := workers.SaveJob(job); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := GetJob(job.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.Status != data.JOB_FAILED || !failed.IsFinished() {
+		t.Fatalf("Expected the job to have failed, but got %+v", failed)
+	}
+	if failed.Response.StatusCode != http.StatusGatewayTimeout || failed.Response.Headers.Get(data.HEADER_X_FAULTMONKEY_ERROR) == "" {
+		t.Errorf("Expected a 504, but got %+v", failed.Response)
+	}
+	if failed.FinishedMillis != job.DeadlineMillis {
+		t.Errorf("Expected the job to have finished at its deadline, but got %d", failed.FinishedMillis)
+	}
+}
+
+func TestJobUnknownUpstream(t *testing.T) {
+	workers := startJobsTestWorkers(t)
+	job := newTestJob("")
+	job.Url = "/nope/chat"
+	if err := workers.Enqueue(job); err != nil {
+		t.Fatal(err)
+	}
+
+	done := waitForJob(t, job.Id)
+	if done.Response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404, but got %d", done.Response.StatusCode)
+	}
+}
@@ -3,7 +3,9 @@ package client
 import (
 	"context"
 	"fmt"
+	"http-attenuator/data"
 	p "http-attenuator/facade/pulse"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,6 +21,20 @@ var attenuatedRequestsWaitTime = promauto.NewCounterVec(
 	[]string{"name"},
 )
 
+// The host pulses are kept apart from the named pulses of the
+// attenuators, and are forgotten once they have been idle (and
+// unpaused) for a while, or there are too many of them
+var hostPulseIdleTimeout = 10 * time.Minute
+var maxHostPulses = 10000
+
+type hostPulse struct {
+	pulse    p.Pulse
+	lastUsed time.Time
+}
+
+var hostPulses = make(map[string]*hostPulse)
+var hostPulsesMutex sync.Mutex
+
 type AttenuatorImpl struct {
 	Name        string  `json:"name"`
 	MaxHertz    float64 `json:"max_hertz"`
@@ -27,25 +43,27 @@ type AttenuatorImpl struct {
 	pulse       p.Pulse
 }
 
+// NewAttenuator builds an attenuator that shares the registered pulse
+// with the same name, if it has the same config.
+//
+// Otherwise it gets a pulse of its own, which isn't registered until
+// the attenuator is activated, so that building (and then rejecting)
+// a reloaded config doesn't change the attenuators that are live
 func NewAttenuator(name string, maxHertz float64, maxInflight int) (Attenuator, error) {
+	if maxInflight <= 0 {
+		return nil, fmt.Errorf("%s: cannot have an attenuator queue size of %d", name, maxInflight)
+	}
+
 	pulse := p.GetPulse(name)
-	var err error
-	if pulse == nil {
+	if pulse == nil || !hasPulseConfig(pulse, maxHertz, maxInflight) {
 		// TODO(john): hook this up and encapsulate it behind the pulse
 		// factory, so we can use redis
-		pulse, err = p.NewPulse(name, maxInflight, maxHertz)
-		if err != nil {
-			return nil, err
-		}
+		pulse = p.NewUnregisteredPulse(name, maxInflight, maxHertz)
 	}
 	if pulse == nil {
 		return nil, fmt.Errorf("Unable to get pulse '%s'", name)
 	}
 
-	if maxInflight <= 0 {
-		return nil, fmt.Errorf("%s: cannot have an attenuator queue size of %d", name, maxInflight)
-	}
-
 	a := &AttenuatorImpl{
 		Name:        name,
 		MaxHertz:    maxHertz,
@@ -57,6 +75,77 @@ func NewAttenuator(name string, maxHertz float64, maxInflight int) (Attenuator,
 	return a, nil
 }
 
+// hasPulseConfig is true if the pulse beats at maxHertz and allows
+// maxInflight requests
+func hasPulseConfig(pulse p.Pulse, maxHertz float64, maxInflight int) bool {
+	configured, ok := pulse.(interface {
+		GetMaxHertz() float64
+		GetMaxInflight() int
+	})
+	if !ok {
+		return true
+	}
+	return configured.GetMaxHertz() == maxHertz && configured.GetMaxInflight() == maxInflight
+}
+
+// GetHostPulse returns the pulse shared by all requests to a host,
+// creating it if it does not already exist.
+//
+// Host pulses have no heartbeat of their own, they only exist so
+// that they can be paused when the host tells us to back off
+func GetHostPulse(host string) data.Pulse {
+	hostPulsesMutex.Lock()
+	defer hostPulsesMutex.Unlock()
+
+	now := time.Now()
+	if existing, exists := hostPulses[host]; exists {
+		existing.lastUsed = now
+		return existing.pulse
+	}
+
+	expireHostPulses(now)
+	pulse := p.NewUnregisteredPulse(host, 0, 0)
+	hostPulses[host] = &hostPulse{
+		pulse:    pulse,
+		lastUsed: now,
+	}
+	return pulse
+}
+
+// expireHostPulses forgets the host pulses that haven't been used for
+// a while (unless they are paused) and, if there are still too many,
+// the ones that were used longest ago.  The caller holds the mutex
+func expireHostPulses(now time.Time) {
+	for host, existing := range hostPulses {
+		if now.Sub(existing.lastUsed) > hostPulseIdleTimeout && !isPaused(existing.pulse) {
+			forgetHostPulse(host)
+		}
+	}
+	for len(hostPulses) >= maxHostPulses {
+		oldest := ""
+		for host, existing := range hostPulses {
+			if oldest == "" || existing.lastUsed.Before(hostPulses[oldest].lastUsed) {
+				oldest = host
+			}
+		}
+		forgetHostPulse(oldest)
+	}
+}
+
+func forgetHostPulse(host string) {
+	if stoppable, ok := hostPulses[host].pulse.(interface{ Stop() }); ok {
+		stoppable.Stop()
+	}
+	delete(hostPulses, host)
+}
+
+// isPaused is true if the pulse (which has no queue) has been told to
+// back off
+func isPaused(pulse p.Pulse) bool {
+	saturable, ok := pulse.(interface{ IsSaturated() bool })
+	return ok && saturable.IsSaturated()
+}
+
 func (a *AttenuatorImpl) String() string {
 	return fmt.Sprintf("%s (%.2fHz, %d max)", a.Name, a.MaxHertz, a.MaxInflight)
 }
@@ -73,7 +162,50 @@ func (a *AttenuatorImpl) GetMaxInflight() int {
 	return a.MaxInflight
 }
 
-// TODO(john)
+// Stop stops the pulse once nothing else can use it, i.e. it has
+// been replaced by the pulse of a newer attenuator with the same name
+// (or it was never activated)
+func (a *AttenuatorImpl) Stop() {
+	if a.pulse == nil || p.GetPulse(a.PulseName) == a.pulse {
+		return
+	}
+	if stoppable, ok := a.pulse.(interface{ Stop() }); ok {
+		stoppable.Stop()
+	}
+}
+
+// Activate registers the pulse (in place of the old one with the same
+// name), once the config the attenuator belongs to is the live one
+func (a *AttenuatorImpl) Activate() {
+	if a.pulse != nil && p.GetPulse(a.PulseName) != a.pulse {
+		p.RegisterPulse(a.PulseName, a.pulse)
+	}
+}
+
+// IsSaturated is true if the next request would have to wait, i.e.
+// the pulse has been paused or its queue is full
+func (a *AttenuatorImpl) IsSaturated() bool {
+	saturable, ok := a.pulse.(interface{ IsSaturated() bool })
+	return ok && saturable.IsSaturated()
+}
+
+// SetPauseUntil stops the attenuator from giving out green lights
+// until the wallclock time
+func (a *AttenuatorImpl) SetPauseUntil(wallclock time.Time) {
+	if a.pulse != nil {
+		a.pulse.SetPauseUntil(wallclock)
+	}
+}
+
+// NewThrottle builds an attenuator for the data package
+func NewThrottle(name string, maxHertz float64, maxInflight int) (data.Throttle, error) {
+	a, err := NewAttenuator(name, maxHertz, maxInflight)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
 func (a *AttenuatorImpl) WaitForGreen(ctx context.Context, cancelFunc context.CancelFunc) error {
 	if cancelFunc != nil {
 		defer cancelFunc()
@@ -87,8 +219,17 @@ func (a *AttenuatorImpl) WaitForGreen(ctx context.Context, cancelFunc context.Ca
 		attenuatedRequestsWaitTime.WithLabelValues(a.Name).Add(float64(time.Now().UTC().UnixMilli() - nowMillis))
 	}()
 
+	if contextPulse, ok := a.pulse.(data.ContextPulse); ok {
+		err := contextPulse.WaitForNextContext(ctx)
+		if err != nil && ctx.Err() != nil {
+			return NewErrWaitTimeout(fmt.Sprintf("%s.WaitForGreen(): timeout", a.Name))
+		}
+		return err
+	}
+
+	// Don't close the channel, the pulse may still be waiting after
+	// we have given up on it
 	errChan := make(chan error, 1)
-	defer close(errChan)
 	go func() {
 		errChan <- a.pulse.WaitForNext()
 	}()
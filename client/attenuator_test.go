@@ -3,16 +3,18 @@ package client
 import (
 	"context"
 	"http-attenuator/data"
+	p "http-attenuator/facade/pulse"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestWaitTimeoutWithTimeoutHappy(t *testing.T) {
 	// The pulse ticks every second
 	a, err := NewAttenuator(
-		"wibble", // name
-		100,      // 100Hz
-		1,        // max 1 in flight
+		"wibble-100hz", // name
+		100,            // 100Hz
+		1,              // max 1 in flight
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -31,9 +33,9 @@ func TestWaitTimeoutWithTimeoutHappy(t *testing.T) {
 
 func TestWaitTimeoutWithNoTimeout(t *testing.T) {
 	a, err := NewAttenuator(
-		"wibble", // name
-		10,       // 10Hz
-		1,        // max 1 in flight
+		"wibble-10hz", // name
+		10,            // 10Hz
+		1,             // max 1 in flight
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -53,9 +55,9 @@ func TestWaitTimeoutWithNoTimeout(t *testing.T) {
 func TestWaitTimeoutWhenTimeout(t *testing.T) {
 	// The pulse ticks every second
 	a, err := NewAttenuator(
-		"wibble", // name
-		1,        // 1Hz
-		1,        // max 1 in flight
+		"wibble-1hz", // name
+		1,            // 1Hz
+		1,            // max 1 in flight
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -252,3 +254,158 @@ func TestSimpleGetSync(t *testing.T) {
 // 		t.Fatalf("Expected %d times in ~%dms, but was %d times in %d seconds", iterations, expectedDuration, count, (end-start)/1000)
 // 	}
 // }
+
+func TestNewAttenuatorReplacesChangedPulse(t *testing.T) {
+	old, err := NewAttenuator("reloaded", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.(*AttenuatorImpl).Activate()
+	same, err := NewAttenuator("reloaded", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.(*AttenuatorImpl).pulse != old.(*AttenuatorImpl).pulse {
+		t.Error("Expected an attenuator with the same config to share the pulse")
+	}
+
+	// The pulse is still registered, so stopping the old attenuator
+	// leaves it alone
+	old.(*AttenuatorImpl).Stop()
+
+	changed, err := NewAttenuator("reloaded", 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.(*AttenuatorImpl).pulse == old.(*AttenuatorImpl).pulse {
+		t.Fatal("Expected a new pulse when the hertz changes")
+	}
+
+	// ... which isn't live until the attenuator is activated
+	if p.GetPulse("reloaded") != old.(*AttenuatorImpl).pulse {
+		t.Fatal("Expected the old pulse to stay registered until the new attenuator is activated")
+	}
+	changed.(*AttenuatorImpl).Activate()
+	if p.GetPulse("reloaded") != changed.(*AttenuatorImpl).pulse {
+		t.Fatal("Expected the new pulse to be registered once the attenuator is activated")
+	}
+
+	// Now that it has been replaced, stopping the old attenuator
+	// lets anything waiting on the old pulse through
+	old.(*AttenuatorImpl).Stop()
+	ctx, cancelFunc := data.NewContext(context.Background(), 100, map[any]any{})
+	if err := old.WaitForGreen(ctx, cancelFunc); err != nil {
+		t.Errorf("Expected a stopped pulse to give a green light, but got %s", err.Error())
+	}
+	ctx, cancelFunc = data.NewContext(context.Background(), 100, map[any]any{})
+	if err := changed.WaitForGreen(ctx, cancelFunc); err != nil {
+		t.Errorf("Expected the new pulse to be running, but got %s", err.Error())
+	}
+}
+
+func TestRejectedAttenuatorLeavesLivePulse(t *testing.T) {
+	live, err := NewAttenuator("rejected", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.(*AttenuatorImpl).Activate()
+
+	// A reload that is rejected builds an attenuator, and then
+	// stops it without activating it
+	rejected, err := NewAttenuator("rejected", 0.01, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected.(*AttenuatorImpl).Stop()
+	if p.GetPulse("rejected") != live.(*AttenuatorImpl).pulse {
+		t.Error("Expected the live pulse to stay registered")
+	}
+	ctx, cancelFunc := data.NewContext(context.Background(), 100, map[any]any{})
+	if err := rejected.WaitForGreen(ctx, cancelFunc); err != nil {
+		t.Errorf("Expected the pulse of the rejected attenuator to be stopped, but got %s", err.Error())
+	}
+}
+
+func TestAttenuatorIsSaturated(t *testing.T) {
+	a, err := NewAttenuator(
+		"wibble-saturated", // name
+		10,                 // 10Hz
+		1,                  // max 1 in flight
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attenuator := a.(*AttenuatorImpl)
+	if attenuator.IsSaturated() {
+		t.Error("Expected a new attenuator not to be saturated")
+	}
+
+	// A paused attenuator would make the next request wait
+	attenuator.SetPauseUntil(time.Now().Add(time.Minute))
+	if !attenuator.IsSaturated() {
+		t.Error("Expected a paused attenuator to be saturated")
+	}
+}
+
+func TestHostPulses(t *testing.T) {
+	defer func(idleTimeout time.Duration, max int) {
+		hostPulseIdleTimeout = idleTimeout
+		maxHostPulses = max
+	}(hostPulseIdleTimeout, maxHostPulses)
+	hostPulseIdleTimeout = time.Millisecond
+	maxHostPulses = 2
+
+	// Host pulses don't share the registry with the named attenuators
+	pulse := GetHostPulse("pulse-test.com")
+	if GetHostPulse("pulse-test.com") != pulse {
+		t.Error("Expected the host to keep its pulse")
+	}
+	if p.GetPulse("pulse-test.com") != nil {
+		t.Error("Expected the host pulse to be kept out of the pulse registry")
+	}
+
+	// A paused pulse is kept while it is idle, an unpaused one isn't
+	pulse.SetPauseUntil(time.Now().Add(time.Minute))
+	idle := GetHostPulse("idle.com")
+	time.Sleep(5 * time.Millisecond)
+	GetHostPulse("another.com")
+	if GetHostPulse("pulse-test.com") != pulse {
+		t.Error("Expected the paused host pulse to be kept")
+	}
+	if GetHostPulse("idle.com") == idle {
+		t.Error("Expected the idle host pulse to be forgotten")
+	}
+
+	// There are never more than the max
+	for _, host := range []string{"a.com", "b.com", "c.com"} {
+		GetHostPulse(host)
+	}
+	hostPulsesMutex.Lock()
+	defer hostPulsesMutex.Unlock()
+	if len(hostPulses) > maxHostPulses {
+		t.Errorf("Expected at most %d host pulses, but got %d", maxHostPulses, len(hostPulses))
+	}
+}
+
+func TestWaitForPulseGivesUp(t *testing.T) {
+	pulse := p.NewUnregisteredPulse("abandoned", 1, 2)
+	t.Cleanup(pulse.(*p.PulseImpl).Stop)
+
+	// A caller that gives up lets go of its slot ...
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelFunc()
+	if err := data.WaitForPulse(ctx, pulse); err == nil {
+		t.Fatal("Expected the wait to time out")
+	}
+	if pulse.(*p.PulseImpl).IsSaturated() {
+		t.Error("Expected the caller that gave up not to hold on to its slot")
+	}
+
+	// ... and doesn't take the next heartbeat from the one that
+	// is still waiting
+	ctx, cancelFunc = context.WithTimeout(context.Background(), 700*time.Millisecond)
+	defer cancelFunc()
+	if err := data.WaitForPulse(ctx, pulse); err != nil {
+		t.Errorf("Expected the next heartbeat, but got %s", err.Error())
+	}
+}
@@ -1,17 +1,22 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"http-attenuator/data"
 	"http-attenuator/util"
-	"io/ioutil"
+	"io"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -74,6 +79,38 @@ var httpClientRequestsLatency = promauto.NewCounterVec(
 	},
 	[]string{"host", "method", "uri"},
 )
+var httpClientAttempts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "http_client_attempts",
+		Help:      "The http_client attempts, keyed by host, method, URI (without query string) and attempt number",
+	},
+	[]string{"host", "method", "uri", "attempt"},
+)
+var httpClientAttemptsLatency = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "http_client_attempts_latency",
+		Help:      "The http_client latency in millis of each attempt, keyed by host, method, URI (without query string) and attempt number",
+	},
+	[]string{"host", "method", "uri", "attempt"},
+)
+var httpClientRetries = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "http_client_retries",
+		Help:      "The http_client retries, keyed by host, method and URI (without query string)",
+	},
+	[]string{"host", "method", "uri"},
+)
+var httpClientRetryWait = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "http_client_retry_wait",
+		Help:      "The http_client time in millis spent backing off between retries, keyed by host, method and URI (without query string)",
+	},
+	[]string{"host", "method", "uri"},
+)
 
 type httpClientBuilder struct {
 	impl HttpClientImpl
@@ -87,6 +124,19 @@ func NewHttpClientBuilder() HttpClientBuilder {
 
 func (cb *httpClientBuilder) Attenuator(attenuator Attenuator) HttpClientBuilder {
 	cb.impl.attenuator = attenuator
+	if attenuator != nil {
+		cb.impl.AttenuatorName = attenuator.GetName()
+	}
+	return cb
+}
+
+func (cb *httpClientBuilder) AttenuatorName(name string) HttpClientBuilder {
+	cb.impl.AttenuatorName = name
+	return cb
+}
+
+func (cb *httpClientBuilder) CircuitBreaker(circuitBreaker data.CircuitBreaker) HttpClientBuilder {
+	cb.impl.circuitBreaker = circuitBreaker
 	return cb
 }
 
@@ -95,6 +145,17 @@ func (cb *httpClientBuilder) Retries(retries int) HttpClientBuilder {
 	return cb
 }
 
+func (cb *httpClientBuilder) RetryNonIdempotent() HttpClientBuilder {
+	cb.impl.RetryNonIdempotent = true
+	return cb
+}
+
+func (cb *httpClientBuilder) Backoff(initialMillis int64, maxMillis int64) HttpClientBuilder {
+	cb.impl.BackoffMillis = initialMillis
+	cb.impl.MaxBackoffMillis = maxMillis
+	return cb
+}
+
 func (cb *httpClientBuilder) TimeoutMillis(timeoutMillis int64) HttpClientBuilder {
 	cb.impl.TimeoutMillis = timeoutMillis
 	return cb
@@ -115,8 +176,26 @@ func (cb *httpClientBuilder) RecordResponse(recordResponseRoot string) HttpClien
 	return cb
 }
 
+func (cb *httpClientBuilder) NoRedirects() HttpClientBuilder {
+	cb.impl.NoRedirects = true
+	return cb
+}
+
+func (cb *httpClientBuilder) DialControl(control func(network string, address string, c syscall.RawConn) error) HttpClientBuilder {
+	cb.impl.dialControl = control
+	return cb
+}
+
 func (cb *httpClientBuilder) Build() (HttpClient, error) {
 	defensiveCopy := cb.impl
+	if defensiveCopy.attenuator == nil {
+		// Look the attenuator up in the registry
+		attenuator, err := data.GetThrottleRegistry().ResolveThrottle(defensiveCopy.AttenuatorName)
+		if err != nil {
+			return nil, fmt.Errorf("Build(): %s", err.Error())
+		}
+		defensiveCopy.attenuator = attenuator
+	}
 	if defensiveCopy.req != nil {
 		// take a defensive clone of the request
 		defensiveCopy.req = defensiveCopy.req.Clone(defensiveCopy.req.Context())
@@ -130,45 +209,148 @@ func (cb *httpClientBuilder) Request(req *http.Request) HttpClientBuilder {
 }
 
 func (c *HttpClientImpl) Do(ctx context.Context, req *data.GatewayRequest) (*data.GatewayResponse, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	c.recordRequest(ctx, req)
 
-	// Wait on the attenuator
-
 	netClient := util.GetHttpClient(nil)
+	if c.dialControl != nil {
+		netClient = util.GetControlledHttpClient(c.dialControl)
+	}
 	netClient.Timeout = time.Duration(c.TimeoutMillis * int64(time.Millisecond))
+	if c.NoRedirects {
+		netClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	host := req.GetUrl().Host
+	method := strings.ToUpper(req.GetRequest().Method)
+	uri := req.GetUrl().Path
+	httpClientRequests.WithLabelValues(host, method, uri).Inc()
+
+	nowMillis := time.Now().UTC().UnixMilli()
+	attemptDurations := make([]int64, 0, c.Retries+1)
+	var resp *data.GatewayResponse
+	var err error
+	for attempt := 1; ; attempt++ {
+		if c.circuitBreaker != nil && !c.circuitBreaker.Allow() {
+			err = NewErrCircuitOpen(fmt.Sprintf("%s: circuit breaker is %s", req.GetUrl().String(), c.circuitBreaker.GetState()))
+			if resp == nil {
+				resp = data.NewGatewayResponse(req.Id, http.StatusServiceUnavailable, []byte{}, http.Header{}, err)
+			}
+			break
+		}
+
+		var retry bool
+		resp, retry, err = c.doAttempt(ctx, netClient, req, attempt)
+		if c.circuitBreaker != nil {
+			c.circuitBreaker.Done(err == nil && resp.StatusCode < 500)
+		}
+		attemptDurations = append(attemptDurations, resp.DurationMillis)
+		if !retry || attempt > c.Retries {
+			break
+		}
+
+		// Back off before trying again, unless doing so would take
+		// us past the deadline of the caller
+		backoff := c.backoff(attempt)
+		if deadline, hasDeadline := ctx.Deadline(); hasDeadline && time.Now().Add(backoff).After(deadline) {
+			log.Printf("%s: not retrying, backoff of %s would exceed the deadline", req.GetUrl().String(), backoff)
+			break
+		}
+		httpClientRetries.WithLabelValues(host, method, uri).Inc()
+		httpClientRetryWait.WithLabelValues(host, method, uri).Add(float64(backoff.Milliseconds()))
+		select {
+		case <-ctx.Done():
+			// The caller has given up on us
+		case <-time.After(backoff):
+			continue
+		}
+		break
+	}
+
+	resp.Attempts = len(attemptDurations)
+	resp.AttemptDurationMillis = attemptDurations
+	resp.DurationMillis = (time.Now().UTC().UnixMilli() - nowMillis)
+	if err != nil {
+		httpClientRequestsFailures.WithLabelValues(host, method, uri).Inc()
+		return resp, err
+	}
+	c.recordResponse(ctx, resp)
+	return resp, err
+}
+
+// doAttempt makes a single attempt at the request, returning the
+// response and whether or not it is worth retrying
+func (c *HttpClientImpl) doAttempt(ctx context.Context, netClient *http.Client, req *data.GatewayRequest, attempt int) (*data.GatewayResponse, bool, error) {
+	host := req.GetUrl().Host
+	method := strings.ToUpper(req.GetRequest().Method)
+	uri := req.GetUrl().Path
+	httpClientAttempts.WithLabelValues(host, method, uri, fmt.Sprint(attempt)).Inc()
+	httpClientRequestBytes.WithLabelValues(host, method, uri).Add(float64(len(req.Body)))
 
-	httpClientRequests.WithLabelValues(req.GetUrl().Host, req.GetRequest().Method, req.GetUrl().Path).Inc()
-	httpClientRequestBytes.WithLabelValues(req.GetUrl().Host, req.GetRequest().Method, req.GetUrl().Path).Add(float64(len(req.Body)))
 	nowMillis := time.Now().UTC().UnixMilli()
-	request, err := http.NewRequest(strings.ToUpper(req.GetRequest().Method), req.GetUrl().String(), nil)
+	defer func() {
+		httpClientAttemptsLatency.WithLabelValues(host, method, uri, fmt.Sprint(attempt)).Add(float64(time.Now().UTC().UnixMilli() - nowMillis))
+	}()
+
+	// Don't hit the host if it has told us to back off
+	if err := data.WaitForHost(ctx, host); err != nil {
+		resp := data.NewGatewayResponse(req.Id, http.StatusServiceUnavailable, []byte{}, http.Header{}, err)
+		resp.DurationMillis = (time.Now().UTC().UnixMilli() - nowMillis)
+		return resp, false, err
+	}
+
+	// Wait on the attenuator
+	waitMillis := time.Now().UTC().UnixMilli()
+	err := data.WaitForThrottle(ctx, c.attenuator)
+	httpClientRequestsWaiting.WithLabelValues(host, method, uri).Add(float64(time.Now().UTC().UnixMilli() - waitMillis))
+	if err != nil {
+		resp := data.NewGatewayResponse(req.Id, http.StatusServiceUnavailable, []byte{}, http.Header{}, err)
+		resp.DurationMillis = (time.Now().UTC().UnixMilli() - nowMillis)
+		return resp, false, err
+	}
+
+	// The body is replayed from the buffered copy on every attempt
+	request, err := http.NewRequestWithContext(ctx, method, req.GetUrl().String(), bytes.NewReader(req.Body))
 	if err != nil {
 		resp := data.NewGatewayResponse(req.Id, http.StatusBadRequest, []byte{}, http.Header{}, err)
 		resp.DurationMillis = (time.Now().UTC().UnixMilli() - nowMillis)
-		httpClientRequestsFailures.WithLabelValues(req.GetUrl().Host, req.GetRequest().Method, req.GetUrl().Path).Inc()
-		return resp, err
+		return resp, false, err
 	}
 	request.Header = req.Headers
 
 	response, err := netClient.Do(request)
 	if err != nil {
-		resp, e := data.NewGatewayResponse(req.Id, http.StatusBadRequest, []byte{}, http.Header{}, err), err
+		resp := data.NewGatewayResponse(req.Id, http.StatusBadRequest, []byte{}, http.Header{}, err)
 		resp.DurationMillis = (time.Now().UTC().UnixMilli() - nowMillis)
-		httpClientRequestsFailures.WithLabelValues(req.GetUrl().Host, req.GetRequest().Method, req.GetUrl().Path).Inc()
-		return resp, e
+		log.Printf("%s: attempt %d: %s", req.GetUrl().String(), attempt, err.Error())
+
+		// Transport errors are worth retrying (unless it is the
+		// caller who has given up), but a non-idempotent request may
+		// already have been processed unless we never connected
+		retry := ctx.Err() == nil && (c.RetryNonIdempotent || data.IsIdempotent(method) || isDialError(err))
+		return resp, retry, err
 	}
-	httpClientRequestsLatency.WithLabelValues(req.GetUrl().Host, req.GetRequest().Method, req.GetUrl().Path).Add(float64(time.Now().UTC().UnixMilli() - nowMillis))
+	httpClientRequestsLatency.WithLabelValues(host, method, uri).Add(float64(time.Now().UTC().UnixMilli() - nowMillis))
 	if response == nil {
 		e := fmt.Errorf("ERROR: %s: Got nil response from server", req.GetUrl().String())
 		resp := data.NewGatewayResponse(req.Id, http.StatusBadRequest, []byte{}, http.Header{}, e)
 		resp.DurationMillis = (time.Now().UTC().UnixMilli() - nowMillis)
-		httpClientRequestsFailures.WithLabelValues(req.GetUrl().Host, req.GetRequest().Method, req.GetUrl().Path).Inc()
-		return resp, e
+		return resp, true, e
 	}
 
-	responseBytes, err := ioutil.ReadAll(response.Body)
+	responseBytes, err := io.ReadAll(response.Body)
 	response.Body.Close()
-	httpClientResponseBytes.WithLabelValues(req.GetUrl().Host, req.GetRequest().Method, req.GetUrl().Path).Add(float64(len(responseBytes)))
-	httpClientResponses.WithLabelValues(req.GetUrl().Host, req.GetRequest().Method, req.GetUrl().Path, fmt.Sprint(response.StatusCode)).Inc()
+	httpClientResponseBytes.WithLabelValues(host, method, uri).Add(float64(len(responseBytes)))
+	httpClientResponses.WithLabelValues(host, method, uri, fmt.Sprint(response.StatusCode)).Inc()
+	data.Backoff(host, response.StatusCode, response.Header, c.attenuator)
+
+	// The success functions get a response with a body they can read
+	response.Body = io.NopCloser(bytes.NewReader(responseBytes))
+	success, retry := c.isSuccess(response)
 
 	resp := data.NewGatewayResponse(
 		req.Id,
@@ -178,8 +360,64 @@ func (c *HttpClientImpl) Do(ctx context.Context, req *data.GatewayRequest) (*dat
 		err,
 	)
 	resp.DurationMillis = (time.Now().UTC().UnixMilli() - nowMillis)
-	c.recordResponse(ctx, resp)
-	return resp, err
+	return resp, !success && retry && err == nil, err
+}
+
+// isDialError is true if we couldn't connect to the server, so the
+// request can't have been sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isSuccess evaluates every SuccessFunc against the response.
+//
+// The response is only a success if all of them agree that it is,
+// and it is retried if any of the ones that do not agree ask for it
+func (c *HttpClientImpl) isSuccess(response *http.Response) (bool, bool) {
+	successFuncs := c.Success
+	if len(successFuncs) == 0 {
+		successFuncs = []data.SuccessFunc{data.DefaultSuccess}
+	}
+
+	success := true
+	retry := false
+	for _, fSuccess := range successFuncs {
+		s, r := fSuccess(response)
+		if !s {
+			success = false
+			retry = retry || r
+		}
+	}
+
+	return success, retry
+}
+
+// backoff returns how long to wait before the next attempt.
+//
+// This is exponential (doubling each time, capped at the maximum)
+// with jitter so that clients do not retry in lockstep
+func (c *HttpClientImpl) backoff(attempt int) time.Duration {
+	initialMillis := c.BackoffMillis
+	if initialMillis <= 0 {
+		initialMillis = DEFAULT_BACKOFF_MILLIS
+	}
+	maxMillis := c.MaxBackoffMillis
+	if maxMillis <= 0 {
+		maxMillis = DEFAULT_MAX_BACKOFF_MILLIS
+	}
+
+	backoffMillis := initialMillis
+	for i := 1; i < attempt && backoffMillis < maxMillis; i++ {
+		backoffMillis *= 2
+	}
+	if backoffMillis > maxMillis {
+		backoffMillis = maxMillis
+	}
+
+	// Somewhere between half and all of the backoff
+	jitterMillis := rand.Int63n(backoffMillis/2 + 1)
+	return time.Duration(backoffMillis-jitterMillis) * time.Millisecond
 }
 
 func (c *HttpClientImpl) recordRequest(ctx context.Context, req *data.GatewayRequest) (err error) {
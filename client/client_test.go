@@ -1,7 +1,222 @@
 package client
 
-import "testing"
+import (
+	"context"
+	"http-attenuator/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
-func TestFoo(t *testing.T) {
-	panic("HOOK UP THE CIRCUIT BREAKER")
+func TestCircuitBreakerStopsRequests(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	circuitBreaker := &data.CircuitBreakerImpl{
+		FailureThreshold: 2,
+		OpenMillis:       60000,
+	}
+	if err := circuitBreaker.Backpatch("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	httpClient, _ := NewHttpClientBuilder().CircuitBreaker(circuitBreaker).Retries(0).Build()
+	requestUrl, _ := url.Parse(server.URL)
+
+	for i := 0; i < 3; i++ {
+		req, _ := data.NewGatewayRequest("", "GET", requestUrl, http.Header{}, nil)
+		resp, err := httpClient.Do(context.Background(), req)
+		if i < 2 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Errorf("Expected %d, but got %d", http.StatusInternalServerError, resp.StatusCode)
+			}
+			continue
+		}
+
+		// The circuit should now be open
+		if _, isCircuitOpen := err.(*ErrCircuitOpen); !isCircuitOpen {
+			t.Errorf("Expected ErrCircuitOpen, but got %v", err)
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected %d, but got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected 2 calls to reach the server, but got %d", calls.Load())
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	httpClient, err := NewHttpClientBuilder().Retries(3).Backoff(1, 10).TimeoutMillis(1000).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestUrl, _ := url.Parse(server.URL)
+	req, err := data.NewGatewayRequest("", "GET", requestUrl, http.Header{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := httpClient.Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp.Attempts != 3 {
+		t.Errorf("Expected 3 attempts, but got %d", resp.Attempts)
+	}
+	if len(resp.AttemptDurationMillis) != 3 {
+		t.Errorf("Expected 3 attempt durations, but got %d", len(resp.AttemptDurationMillis))
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	httpClient, _ := NewHttpClientBuilder().Retries(2).Backoff(1, 10).TimeoutMillis(1000).Build()
+	requestUrl, _ := url.Parse(server.URL)
+	req, _ := data.NewGatewayRequest("", "GET", requestUrl, http.Header{}, nil)
+
+	resp, err := httpClient.Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected %d, but got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 calls (1 + 2 retries), but got %d", calls.Load())
+	}
+}
+
+func TestNoRetryWhenSuccessFuncSaysNo(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+
+	httpClient, _ := NewHttpClientBuilder().
+		Retries(5).
+		Backoff(1, 10).
+		Success(
+			func(resp *http.Response) (bool, bool) {
+				// consider a 405 successful
+				return resp.StatusCode == http.StatusMethodNotAllowed, true
+			},
+		).
+		Build()
+	requestUrl, _ := url.Parse(server.URL)
+	req, _ := data.NewGatewayRequest("", "POST", requestUrl, http.Header{}, []byte("{}"))
+
+	resp, err := httpClient.Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Attempts != 1 || calls.Load() != 1 {
+		t.Errorf("Expected a single attempt, but got %d (%d calls)", resp.Attempts, calls.Load())
+	}
+}
+
+func TestRetryRespectsDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	httpClient, _ := NewHttpClientBuilder().Retries(10).Backoff(200, 1000).TimeoutMillis(1000).Build()
+	requestUrl, _ := url.Parse(server.URL)
+	req, _ := data.NewGatewayRequest("", "GET", requestUrl, http.Header{}, nil)
+
+	ctx, cancelFunc := data.NewContext(context.Background(), 150, map[any]any{})
+	defer cancelFunc()
+	start := time.Now()
+	resp, _ := httpClient.Do(ctx, req)
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected Do() to give up at the deadline, but it took %s", time.Since(start))
+	}
+	if resp.Attempts >= 10 {
+		t.Errorf("Expected fewer than 10 attempts, but got %d", resp.Attempts)
+	}
+}
+
+func TestNoRetryForNonIdempotentAfterConnecting(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request got here, but the caller never hears back
+		calls.Add(1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+	requestUrl, _ := url.Parse(server.URL)
+
+	httpClient, _ := NewHttpClientBuilder().Retries(2).Backoff(1, 10).TimeoutMillis(1000).Build()
+	req, _ := data.NewGatewayRequest("", "POST", requestUrl, http.Header{}, []byte("once"))
+	if _, err := httpClient.Do(context.Background(), req); err == nil {
+		t.Fatal("Expected a transport error")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected the POST not to be retried, but got %d calls", calls.Load())
+	}
+
+	// Unless the caller says that it is safe
+	calls.Store(0)
+	httpClient, _ = NewHttpClientBuilder().Retries(2).Backoff(1, 10).TimeoutMillis(1000).RetryNonIdempotent().Build()
+	httpClient.Do(context.Background(), req)
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 calls (1 + 2 retries), but got %d", calls.Load())
+	}
+
+	// Idempotent requests are always retried
+	calls.Store(0)
+	httpClient, _ = NewHttpClientBuilder().Retries(2).Backoff(1, 10).TimeoutMillis(1000).Build()
+	req, _ = data.NewGatewayRequest("", "PUT", requestUrl, http.Header{}, []byte("again"))
+	httpClient.Do(context.Background(), req)
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 calls (1 + 2 retries), but got %d", calls.Load())
+	}
+}
+
+func TestRetryNonIdempotentWhenDialFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	requestUrl, _ := url.Parse(server.URL)
+	server.Close()
+
+	httpClient, _ := NewHttpClientBuilder().Retries(2).Backoff(1, 10).TimeoutMillis(1000).Build()
+	req, _ := data.NewGatewayRequest("", "POST", requestUrl, http.Header{}, []byte("never sent"))
+	resp, err := httpClient.Do(context.Background(), req)
+	if err == nil {
+		t.Fatal("Expected a transport error")
+	}
+	if resp.Attempts != 3 {
+		t.Errorf("Expected a POST that never connected to be retried, but got %d attempts", resp.Attempts)
+	}
 }
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"http-attenuator/data"
 	"net/http"
+	"syscall"
+	"time"
 )
 
 // HttpClient handles all of the retry logic etc
@@ -23,15 +25,26 @@ type HttpClient interface {
 type HttpClientImpl struct {
 	// The attenuator for this client.
 	//
-	// This gets looked up in the attenuator registry
-	//
-	// TODO(john): make this hierarchical (so we can [e.g.] default to a global or service level)
+	// This gets looked up in the attenuator registry, and falls back
+	// to the default attenuator if it is not set
 	AttenuatorName string `json:"attenuator"`
 
 	// The maximum number of retries
 	Retries int `json:"retries"`
 
-	// The HTTP-level timeout in milliseconds
+	// Whether or not non-idempotent requests (e.g. POST) are retried
+	// after a transport error, when the request may already have got
+	// to the server.  They are always retried if we couldn't connect
+	RetryNonIdempotent bool `json:"retry_non_idempotent"`
+
+	// The initial and maximum backoff between retries in milliseconds.
+	//
+	// The backoff doubles on each retry (with some jitter) until it
+	// reaches the maximum
+	BackoffMillis    int64 `json:"backoff_millis"`
+	MaxBackoffMillis int64 `json:"max_backoff_millis"`
+
+	// The HTTP-level timeout in milliseconds (per attempt)
 	TimeoutMillis int64 `json:"timeout_millis"`
 
 	// Functions to execute to determine whether or not a request
@@ -42,21 +55,44 @@ type HttpClientImpl struct {
 	RecordRequestRoot  string `json:"record_request_root"`
 	RecordResponseRoot string `json:"record_response_root"`
 
+	// Don't follow redirects (e.g. for callbacks, which could be sent
+	// somewhere they shouldn't go)
+	NoRedirects bool `json:"no_redirects"`
+
+	// If this is set, then it is called with the address of each
+	// connection before it is made, and can refuse it
+	dialControl func(network string, address string, c syscall.RawConn) error
+
 	// Underlying http request
 	req *http.Request
 
 	// attenuator instance
 	// If this is nil, there is no attenuation
-	attenuator Attenuator
+	attenuator data.Throttle
+
+	// circuit breaker instance
+	// If this is nil, there is no circuit breaker
+	circuitBreaker data.CircuitBreaker
 }
 
+const (
+	DEFAULT_BACKOFF_MILLIS     int64 = 100
+	DEFAULT_MAX_BACKOFF_MILLIS int64 = 10000
+)
+
 type HttpClientBuilder interface {
 	Attenuator(attenuator Attenuator) HttpClientBuilder
+	AttenuatorName(name string) HttpClientBuilder
+	CircuitBreaker(circuitBreaker data.CircuitBreaker) HttpClientBuilder
 	Retries(retries int) HttpClientBuilder
+	RetryNonIdempotent() HttpClientBuilder
+	Backoff(initialMillis int64, maxMillis int64) HttpClientBuilder
 	TimeoutMillis(timeoutMillis int64) HttpClientBuilder
 	Success(fSuccess ...data.SuccessFunc) HttpClientBuilder
 	RecordRequest(recordRequestRoot string) HttpClientBuilder
 	RecordResponse(recordResponseRoot string) HttpClientBuilder
+	NoRedirects() HttpClientBuilder
+	DialControl(control func(network string, address string, c syscall.RawConn) error) HttpClientBuilder
 	Build() (HttpClient, error)
 }
 
@@ -74,6 +110,20 @@ func NewErrWaitTimeout(msg string) *ErrWaitTimeout {
 	}
 }
 
+type ErrCircuitOpen struct {
+	msg string
+}
+
+func (e *ErrCircuitOpen) Error() string {
+	return e.msg
+}
+
+func NewErrCircuitOpen(msg string) *ErrCircuitOpen {
+	return &ErrCircuitOpen{
+		msg: msg,
+	}
+}
+
 type Attenuator interface {
 	fmt.Stringer
 	//DoSync(req *data.GatewayRequest) (*data.GatewayResponse, error)
@@ -81,4 +131,5 @@ type Attenuator interface {
 	GetMaxHertz() float64
 	GetMaxInflight() int
 	WaitForGreen(ctx context.Context, cancelFunc context.CancelFunc) error
+	SetPauseUntil(wallclock time.Time)
 }
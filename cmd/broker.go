@@ -31,14 +31,12 @@ func RunBroker(cmd *cobra.Command, args []string) {
 
 	// Register the service broker so it can be picked up by the API
 	// handler
-	broker.RegisterServiceBroker(appConfig.Config.Broker)
+	registerServiceBroker(appConfig)
 
-	// All upstream handlers use the service broker
-	//
-	// TODO(john): there's too much heavy-lifting going on to avoid
-	// import loops.  This needs to be fixed.
-	for _, upstreamService := range appConfig.Config.Broker.UpstreamFromConfig {
-		upstreamService.HandlerFunc = broker.GetServiceBroker().Handle
+	// The workers for the asynchronous requests use the queue (and
+	// the key/value store) for the jobs
+	if _, err := broker.StartJobWorkers(appConfig.Config.Broker.GetAsync()); err != nil {
+		log.Printf("ERROR|cmd.RunBroker()|Could not start the job workers|%s", err.Error())
 	}
 
 	ginRouter, err := api.NewRouter()
@@ -56,6 +54,9 @@ func RunBroker(cmd *cobra.Command, args []string) {
 		go runProxy()
 	}
 
+	// Pick up any changes to the config
+	watchConfig()
+
 	err = ginRouter.Run(brokerAddress)
 	if err != nil {
 		log.Printf("FATAL|cmd.runServer()|Could not start service broker|%s", err.Error())
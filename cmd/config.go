@@ -40,6 +40,9 @@ func RunConfig(cmd *cobra.Command, args []string) {
 		go runProxy()
 	}
 
+	// Pick up any changes to the config
+	watchConfig()
+
 	err = ginRouter.Run(configAddress)
 	if err != nil {
 		log.Printf("FATAL|cmd.runServer()|Could not start config API|%s", err.Error())
@@ -47,5 +50,7 @@ func RunConfig(cmd *cobra.Command, args []string) {
 }
 
 func configEndpoints(ginRouter *gin.Engine) {
+	config.RegisterReloadFunc(ReloadConfig)
+	ginRouter.POST("/api/v1/config/reload", config.ReloadConfigHandler)
 	ginRouter.PUT("/api/v1/config/:name/:value", config.SetConfigHandler)
 }
@@ -40,6 +40,9 @@ func RunGateway(cmd *cobra.Command, args []string) {
 		go runProxy()
 	}
 
+	// Pick up any changes to the config
+	watchConfig()
+
 	err = ginRouter.Run(gatewayAddress)
 	if err != nil {
 		log.Printf("FATAL|cmd.runServer()|Could not start server|%s", err.Error())
@@ -47,6 +50,9 @@ func RunGateway(cmd *cobra.Command, args []string) {
 }
 
 func gatewayEndpoints(ginRouter *gin.Engine) {
+	if appConfig != nil {
+		gateway.RegisterGateway(appConfig.Config.GetGateway())
+	}
 	ginRouter.GET("/api/v1/gateway/*hostAndQuery", gateway.GatewayHandler)
 	ginRouter.DELETE("/api/v1/gateway/*hostAndQuery", gateway.GatewayHandler)
 	ginRouter.OPTIONS("/api/v1/gateway/*hostAndQuery", gateway.GatewayHandler)
@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"fmt"
+	gateway "http-attenuator/api/v1/gateway"
+	"http-attenuator/broker"
+	"http-attenuator/data"
+	"http-attenuator/evt"
+	"http-attenuator/server"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+var configReloads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "config_reloads",
+		Help:      "The number of times the config has been reloaded, keyed by result (ok/error)",
+	},
+	[]string{"result"},
+)
+
+// How long the old config is kept going (after a reload) for the
+// requests that are still in flight
+const RETIRE_TIMEOUT = 30 * time.Second
+
+var reloadMutex sync.Mutex
+var watchOnce sync.Once
+
+// These say which parts of the config are live, and so have to be
+// swapped in on a reload
+var faultMonkey server.FaultMonkey
+var healthchecksEnabled bool
+
+// ReloadConfig reads the config file again.
+//
+// If the new config is valid, then it replaces the live one (keeping
+// the backends that have been disabled, and the weights that have
+// been changed, at runtime).  The old one is retired once the
+// requests that are in flight have finished.  The job workers are not
+// restarted, so a change to async: needs a restart.
+//
+// If it isn't valid, then the live config carries on (untouched) and
+// the error is returned
+func ReloadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	configFile := viper.ConfigFileUsed()
+	log.Printf("INFO|cmd.ReloadConfig()|Reloading config from %s|", configFile)
+	newConfig, newServer, err := buildConfig(configFile)
+	if err != nil {
+		configReloads.WithLabelValues("error").Inc()
+		err = fmt.Errorf("cmd.ReloadConfig(%s): keeping the old config: %s", configFile, err.Error())
+		log.Println(err)
+		return err
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		log.Printf("cmd.ReloadConfig(%s): %s", configFile, err.Error())
+	}
+
+	if appConfig != nil {
+		newConfig.CarryOver(appConfig)
+		warnAsyncChanged(appConfig, newConfig)
+	}
+	activateConfig(newConfig, newServer)
+	oldConfig := appConfig
+	appConfig = newConfig
+	if oldConfig != nil {
+		go oldConfig.Retire(RETIRE_TIMEOUT)
+	}
+
+	configReloads.WithLabelValues("ok").Inc()
+	log.Printf("INFO|cmd.ReloadConfig()|Reloaded config from %s|", configFile)
+	return nil
+}
+
+// warnAsyncChanged logs a change to the async config, which only gets
+// picked up when the job workers are started (with the broker)
+func warnAsyncChanged(oldConfig *data.AppConfig, newConfig *data.AppConfig) {
+	if oldConfig.Config.Broker == nil || newConfig.Config.Broker == nil || broker.GetJobWorkers() == nil {
+		return
+	}
+	if !reflect.DeepEqual(oldConfig.Config.Broker.GetAsync(), newConfig.Config.Broker.GetAsync()) {
+		log.Printf("WARN|cmd.ReloadConfig()|The async config has changed, but the job workers only pick it up when the broker is restarted|")
+	}
+}
+
+// buildConfig builds (and validates) everything that a reload swaps
+// in, without touching the live config.  If it fails, then whatever
+// the new config started is stopped again
+func buildConfig(configFile string) (*data.AppConfig, *data.Server, error) {
+	newConfig, err := data.BuildConfig(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newServer, err := buildLiveParts(newConfig)
+	if err != nil {
+		newConfig.Retire(0)
+		return nil, nil, err
+	}
+	return newConfig, newServer, nil
+}
+
+// buildLiveParts builds the parts of the new config that depend on
+// what is running (i.e. the broker, healthchecks and server)
+func buildLiveParts(newConfig *data.AppConfig) (*data.Server, error) {
+	if broker.GetServiceBroker() != nil && newConfig.Config.Broker == nil {
+		return nil, fmt.Errorf("the broker is running, but there is no broker config")
+	}
+	if err := setHealthchecks(newConfig); err != nil {
+		return nil, err
+	}
+	if faultMonkey == nil {
+		return nil, nil
+	}
+	return buildServer(newConfig)
+}
+
+// activateConfig makes the new config the live one
+func activateConfig(newConfig *data.AppConfig, newServer *data.Server) {
+	newConfig.Activate()
+	if broker.GetServiceBroker() != nil {
+		registerServiceBroker(newConfig)
+	}
+	if healthchecksEnabled {
+		startHealthchecks(newConfig)
+	}
+	gateway.RegisterGateway(newConfig.Config.GetGateway())
+	if faultMonkey != nil {
+		faultMonkey.SetServer(newServer)
+	}
+}
+
+// registerServiceBroker registers the service broker so it can be
+// picked up by the API handler
+func registerServiceBroker(appConfig *data.AppConfig) {
+	broker.RegisterServiceBroker(appConfig.Config.Broker)
+	serviceBroker := broker.GetServiceBroker()
+
+	// All upstream handlers use the service broker
+	//
+	// TODO(john): there's too much heavy-lifting going on to avoid
+	// import loops.  This needs to be fixed.
+	for _, upstreamService := range appConfig.Config.Broker.UpstreamFromConfig {
+		upstreamService.HandlerFunc = serviceBroker.Handle
+	}
+}
+
+// setHealthchecks parses the health checks of all of the backends
+func setHealthchecks(appConfig *data.AppConfig) error {
+	if appConfig.Config.Broker == nil {
+		return nil
+	}
+	for _, upstreamService := range appConfig.Config.Broker.UpstreamFromConfig {
+		for _, upstreamBackend := range upstreamService.Backends {
+			healthCheck, err := evt.ParseEVT(upstreamBackend.Healthcheck)
+			if err != nil {
+				return err
+			}
+			upstreamBackend.SetHealthcheck(healthCheck)
+		}
+	}
+	return nil
+}
+
+// startHealthchecks starts the health checks of all of the backends
+func startHealthchecks(appConfig *data.AppConfig) {
+	healthchecksEnabled = true
+	if appConfig.Config.Broker == nil {
+		return
+	}
+	for _, upstreamService := range appConfig.Config.Broker.UpstreamFromConfig {
+		for _, upstreamBackend := range upstreamService.Backends {
+			upstreamBackend.Start()
+		}
+	}
+}
+
+// buildServer configures the server for running.
+//
+// This takes care of any backpatching, config validation etc.
+func buildServer(appConfig *data.AppConfig) (*data.Server, error) {
+	serverBuilder, err := server.NewServerBuilder().FromConfig(appConfig)
+	if err != nil {
+		return nil, err
+	}
+	return serverBuilder.Build()
+}
+
+// watchConfig reloads the config when the file changes, or when we
+// get a SIGHUP
+func watchConfig() {
+	watchOnce.Do(func() {
+		viper.OnConfigChange(func(e fsnotify.Event) {
+			log.Printf("INFO|cmd.watchConfig()|%s|", e.String())
+			ReloadConfig()
+		})
+		viper.WatchConfig()
+
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go func() {
+			for range hangups {
+				ReloadConfig()
+			}
+		}()
+	})
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"http-attenuator/client"
 	"http-attenuator/data"
 	"log"
 	"os"
@@ -38,6 +39,7 @@ func init() {
 	rootCmd.AddCommand(proxyCmd)
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(serverCmd)
+	rootCmd.AddCommand(weightCmd)
 
 	// Microservices
 }
@@ -46,6 +48,13 @@ func initConfig() {
 	if configFile, isSet := os.LookupEnv("CONFIG_FILE"); isSet {
 		cfgFile = configFile
 	}
+	// Everything that talks to the same host shares a pulse, so
+	// that we all back off together when told to
+	data.SetHostPulseFactory(client.GetHostPulse)
+
+	// The attenuators in the config are built by the client
+	data.SetThrottleFactory(client.NewThrottle)
+
 	if cfgFile != "" {
 		err := LoadConfig(cfgFile)
 		if err != nil {
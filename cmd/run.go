@@ -2,10 +2,7 @@ package cmd
 
 import (
 	"http-attenuator/api"
-	"http-attenuator/broker"
 	"http-attenuator/data"
-	"http-attenuator/evt"
-	"http-attenuator/server"
 	"log"
 
 	"github.com/spf13/cobra"
@@ -32,38 +29,20 @@ func RunRun(cmd *cobra.Command, args []string) {
 	// Configure the server for running.
 	//
 	// This takes care of any backpatching, config validation etc.
-	serverBuilder, err := server.NewServerBuilder().FromConfig(appConfig)
-	if err != nil {
-		log.Fatalf("cmd.runServer(): %s", err.Error())
-	}
-	serverInstance, err := serverBuilder.Build()
+	serverInstance, err := buildServer(appConfig)
 	if err != nil {
 		log.Fatalf("cmd.runServer(): %s", err.Error())
 	}
 
 	// Register the service broker so it can be picked up by the API
 	// handler
-	broker.RegisterServiceBroker(appConfig.Config.Broker)
-
-	// All upstream handlers use the service broker
-	//
-	// TODO(john): there's too much heavy-lifting going on to avoid
-	// import loops.  This needs to be fixed.
-	for _, upstreamService := range appConfig.Config.Broker.UpstreamFromConfig {
-		upstreamService.HandlerFunc = broker.GetServiceBroker().Handle
-	}
+	registerServiceBroker(appConfig)
 
 	// Finally, deal with the health checks
-	for _, upstreamService := range appConfig.Config.Broker.UpstreamFromConfig {
-		for _, upstreamBackend := range upstreamService.Backends {
-			healthCheck, err := evt.ParseEVT(upstreamBackend.Healthcheck)
-			if err != nil {
-				log.Fatal(err)
-			}
-			upstreamBackend.SetHealthcheck(healthCheck)
-			upstreamBackend.Start()
-		}
+	if err = setHealthchecks(appConfig); err != nil {
+		log.Fatal(err)
 	}
+	startHealthchecks(appConfig)
 
 	ginRouter, err := api.NewRouter()
 	if err != nil {
@@ -80,6 +59,9 @@ func RunRun(cmd *cobra.Command, args []string) {
 		go runProxy()
 	}
 
+	// Pick up any changes to the config
+	watchConfig()
+
 	err = ginRouter.Run(runAddress)
 	if err != nil {
 		log.Printf("FATAL|cmd.runServer()|Could not start attenuator|%s", err.Error())
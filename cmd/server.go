@@ -35,11 +35,7 @@ func RunServer(cmd *cobra.Command, args []string) {
 	// Configure the server for running.
 	//
 	// This takes care of any backpatching, config validation etc.
-	serverBuilder, err := server.NewServerBuilder().FromConfig(appConfig)
-	if err != nil {
-		log.Fatalf("cmd.runServer(): %s", err.Error())
-	}
-	serverInstance, err := serverBuilder.Build()
+	serverInstance, err := buildServer(appConfig)
 	if err != nil {
 		log.Fatalf("cmd.runServer(): %s", err.Error())
 	}
@@ -52,6 +48,9 @@ func RunServer(cmd *cobra.Command, args []string) {
 	// Add the server endpoint
 	serverEndpoints(ginRouter, serverInstance)
 
+	// Pick up any changes to the config
+	watchConfig()
+
 	err = ginRouter.Run(serverInstance.Listen)
 	if err != nil {
 		log.Printf("FATAL|cmd.runServer()|Could not start server|%s", err.Error())
@@ -59,6 +58,6 @@ func RunServer(cmd *cobra.Command, args []string) {
 }
 
 func serverEndpoints(ginRouter *gin.Engine, serverInstance *data.Server) {
-	faultMonkey := server.NewFaultMonkey(serverInstance)
+	faultMonkey = server.NewFaultMonkey(serverInstance)
 	ginRouter.Use(faultMonkey.Handle)
 }
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"http-attenuator/data"
+	"http-attenuator/util"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var weightCmd = &cobra.Command{
+	Use:   "weight UPSTREAM BACKEND WEIGHT",
+	Short: "Changes the weight of a backend in a running broker (e.g. for a canary rollout)",
+	Args:  cobra.ExactArgs(3),
+	Run:   RunWeight,
+}
+
+var weightBroker string
+var weightToken string
+var weightFrom int
+var weightOver time.Duration
+var weightStep time.Duration
+var weightWatch time.Duration
+var weightBaseline string
+var weightMaxErrorRateDelta float64
+var weightMinRequests int64
+var weightRollback bool
+
+func init() {
+	weightCmd.PersistentFlags().StringVarP(&weightBroker, "broker", "b", "", "address of the broker (default is config.broker.listen)")
+	weightCmd.PersistentFlags().StringVarP(&weightToken, "token", "t", "", "admin token of the broker (default is config.broker.admin_token, or $"+data.ENV_ADMIN_TOKEN+")")
+	weightCmd.PersistentFlags().IntVar(&weightFrom, "from", -1, "weight to start the ramp from (default is the current weight)")
+	weightCmd.PersistentFlags().DurationVar(&weightOver, "over", 0, "ramp up (or down) to the weight over this long, e.g. 30m")
+	weightCmd.PersistentFlags().DurationVar(&weightStep, "step", 0, "how often the ramp changes the weight (default is 10s)")
+	weightCmd.PersistentFlags().DurationVar(&weightWatch, "watch", 0, "how long to keep checking for a rollback after the ramp")
+	weightCmd.PersistentFlags().BoolVar(&weightRollback, "rollback", false, "set the weight to 0 if the backend has too many errors")
+	weightCmd.PersistentFlags().StringVar(&weightBaseline, "baseline", "", "backend to compare errors to (default is all of the others)")
+	weightCmd.PersistentFlags().Float64Var(&weightMaxErrorRateDelta, "max-error-rate-delta", 0, "roll back when the error rate is this much worse than the baseline (default is 0.05)")
+	weightCmd.PersistentFlags().Int64Var(&weightMinRequests, "min-requests", 0, "requests needed before rolling back (default is 20)")
+}
+
+func RunWeight(cmd *cobra.Command, args []string) {
+	weight, err := strconv.Atoi(args[2])
+	if err != nil {
+		log.Fatalf("cmd.RunWeight(): bad weight '%s': %s", args[2], err.Error())
+	}
+
+	rollout := &data.RolloutImpl{
+		To:             weight,
+		DurationMillis: weightOver.Milliseconds(),
+		StepMillis:     weightStep.Milliseconds(),
+		WatchMillis:    weightWatch.Milliseconds(),
+	}
+	if weightFrom >= 0 {
+		rollout.From = &weightFrom
+	}
+	if weightRollback || weightBaseline != "" {
+		rollout.Rollback = &data.RollbackImpl{
+			Baseline:          weightBaseline,
+			MaxErrorRateDelta: weightMaxErrorRateDelta,
+			MinRequests:       weightMinRequests,
+		}
+	}
+	body, err := json.Marshal(rollout)
+	if err != nil {
+		log.Fatalf("cmd.RunWeight(): %s", err.Error())
+	}
+
+	brokerAddress := weightBroker
+	if brokerAddress == "" {
+		brokerAddress = viper.GetString(data.CONF_BROKER_LISTEN)
+	}
+	if brokerAddress == "" {
+		brokerAddress = "localhost:8888"
+	}
+	if !strings.Contains(brokerAddress, "://") {
+		brokerAddress = "http://" + strings.Replace(brokerAddress, "0.0.0.0", "localhost", 1)
+	}
+
+	url := fmt.Sprintf("%s/api/v1/broker/admin/%s/%s/weight", brokerAddress, args[0], args[1])
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("cmd.RunWeight(): %s", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token := weightToken
+	if token == "" {
+		token = viper.GetString(data.CONF_BROKER_ADMIN_TOKEN)
+	}
+	if token == "" {
+		token = os.Getenv(data.ENV_ADMIN_TOKEN)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := util.GetHttpClient(nil).Do(req)
+	if err != nil {
+		log.Fatalf("cmd.RunWeight(): %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("cmd.RunWeight(): %s: %s %s", url, resp.Status, resp.Header.Get(data.HEADER_X_FAULTMONKEY_ERROR))
+	}
+	fmt.Println(string(respBody))
+}
@@ -0,0 +1,365 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	DEFAULT_ASYNC_WORKERS                 = 4
+	DEFAULT_ASYNC_TOPIC                   = "broker.jobs"
+	DEFAULT_ASYNC_TIMEOUT_MILLIS          = 300000
+	DEFAULT_ASYNC_CALLBACK_RETRIES        = 3
+	DEFAULT_ASYNC_CALLBACK_TIMEOUT_MILLIS = 10000
+	DEFAULT_ASYNC_RETENTION_MILLIS        = 86400000
+
+	// How long after its timeout a running job is given up on (its
+	// worker has probably gone away)
+	JOB_DEADLINE_GRACE_MILLIS = 5000
+
+	// Where a job has got to
+	JOB_QUEUED  = "queued"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+
+	// The key that the credentials of a job are encrypted with can
+	// come from the environment, rather than being in the config file
+	ENV_JOB_CREDENTIALS_KEY = "FAULTMONKEY_JOB_CREDENTIALS_KEY"
+)
+
+// The headers of the caller that are never kept (as they are) with a
+// job.  The backend still gets them, as it would if the request
+// wasn't async, but they are encrypted until the job runs and
+// forgotten once it has
+var jobCredentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+}
+
+// AsyncImpl is how the broker runs the requests that the caller
+// doesn't wait for (?async=true), e.g.
+//
+//	async:
+//	  workers: 4
+//	  timeout_millis: 300000
+//
+// The jobs are put on a topic of the queue, and the worker pool takes
+// them off and sends them to the upstream.  The workers (and the
+// topic) are only set up when the broker starts
+type AsyncImpl struct {
+	Workers int    `yaml:"workers,omitempty" json:"workers,omitempty"`
+	Topic   string `yaml:"topic,omitempty" json:"topic,omitempty"`
+
+	// How long a job has to get a response from the upstream
+	TimeoutMillis int64 `yaml:"timeout_millis,omitempty" json:"timeout_millis,omitempty"`
+
+	// How long a job (and its response) is kept for after it was last
+	// saved, if nobody deletes it
+	RetentionMillis int64 `yaml:"retention_millis,omitempty" json:"retention_millis,omitempty"`
+
+	// How many times we retry the callback (if there is one), and how
+	// long each attempt has
+	CallbackRetries       int   `yaml:"callback_retries,omitempty" json:"callback_retries,omitempty"`
+	CallbackTimeoutMillis int64 `yaml:"callback_timeout_millis,omitempty" json:"callback_timeout_millis,omitempty"`
+
+	// The hosts that callbacks can go to, e.g. hooks.example.com (or
+	// .example.com for any host under it).  Without it, a callback can
+	// go to any host that isn't a private, loopback or link-local
+	// address
+	CallbackAllow []string `yaml:"callback_allow,omitempty" json:"callback_allow,omitempty"`
+
+	// The key the caller's credentials are encrypted with while the
+	// job is waiting to run.  Every instance that shares the queue
+	// needs the same key.  Without one, a key is made up when the
+	// broker starts, so only that instance can run its jobs with
+	// their credentials
+	CredentialsKey string `yaml:"credentials_key,omitempty" json:"-"`
+
+	// This is backpatched
+	credentialsCipher cipher.AEAD
+}
+
+func (a *AsyncImpl) Backpatch() error {
+	if a.Workers < 0 || a.TimeoutMillis < 0 || a.RetentionMillis < 0 || a.CallbackRetries < 0 || a.CallbackTimeoutMillis < 0 {
+		return fmt.Errorf("Backpatch(async): async limits can't be negative")
+	}
+	if a.Workers == 0 {
+		a.Workers = DEFAULT_ASYNC_WORKERS
+	}
+	if a.Topic == "" {
+		a.Topic = DEFAULT_ASYNC_TOPIC
+	}
+	if a.TimeoutMillis == 0 {
+		a.TimeoutMillis = DEFAULT_ASYNC_TIMEOUT_MILLIS
+	}
+	if a.RetentionMillis == 0 {
+		a.RetentionMillis = DEFAULT_ASYNC_RETENTION_MILLIS
+	}
+	if a.CallbackRetries == 0 {
+		a.CallbackRetries = DEFAULT_ASYNC_CALLBACK_RETRIES
+	}
+	if a.CallbackTimeoutMillis == 0 {
+		a.CallbackTimeoutMillis = DEFAULT_ASYNC_CALLBACK_TIMEOUT_MILLIS
+	}
+	for i, host := range a.CallbackAllow {
+		a.CallbackAllow[i] = strings.ToLower(strings.TrimSpace(host))
+	}
+	return a.backpatchCredentialsCipher()
+}
+
+func (a *AsyncImpl) backpatchCredentialsCipher() error {
+	if a.CredentialsKey == "" {
+		a.CredentialsKey = os.Getenv(ENV_JOB_CREDENTIALS_KEY)
+	}
+	var key [32]byte
+	if a.CredentialsKey != "" {
+		key = sha256.Sum256([]byte(a.CredentialsKey))
+	} else if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("Backpatch(async): %s", err.Error())
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return fmt.Errorf("Backpatch(async): %s", err.Error())
+	}
+	a.credentialsCipher, err = cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("Backpatch(async): %s", err.Error())
+	}
+	return nil
+}
+
+// SealCredentials takes the caller's credentials out of the request,
+// and returns them encrypted (nil if there aren't any)
+func (a *AsyncImpl) SealCredentials(m *JobMessage) ([]byte, error) {
+	credentials := make(http.Header)
+	for _, name := range jobCredentialHeaders {
+		if values := m.Headers.Values(name); len(values) > 0 {
+			credentials[http.CanonicalHeaderKey(name)] = values
+		}
+		m.Headers.Del(name)
+	}
+	if len(credentials) == 0 {
+		return nil, nil
+	}
+	if a.credentialsCipher == nil {
+		return nil, fmt.Errorf("SealCredentials(): async has not been backpatched")
+	}
+
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return nil, fmt.Errorf("SealCredentials(): %s", err.Error())
+	}
+	nonce := make([]byte, a.credentialsCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("SealCredentials(): %s", err.Error())
+	}
+	return a.credentialsCipher.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// OpenCredentials decrypts the credentials sealed by SealCredentials,
+// and adds them to the headers
+func (a *AsyncImpl) OpenCredentials(sealed []byte, headers http.Header) error {
+	if len(sealed) == 0 {
+		return nil
+	}
+	if a.credentialsCipher == nil {
+		return fmt.Errorf("OpenCredentials(): async has not been backpatched")
+	}
+	nonceSize := a.credentialsCipher.NonceSize()
+	if len(sealed) < nonceSize {
+		return fmt.Errorf("OpenCredentials(): the credentials are too short")
+	}
+	plaintext, err := a.credentialsCipher.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		// e.g. the job was queued by an instance with another key
+		return fmt.Errorf("OpenCredentials(): %s", err.Error())
+	}
+	credentials := make(http.Header)
+	if err := json.Unmarshal(plaintext, &credentials); err != nil {
+		return fmt.Errorf("OpenCredentials(): %s", err.Error())
+	}
+	for name, values := range credentials {
+		headers[name] = values
+	}
+	return nil
+}
+
+// CheckCallback returns an error if we shouldn't POST to the callback,
+// i.e. it isn't in callback_allow or (if there is no callback_allow)
+// the host resolves to an address inside the network
+func (a *AsyncImpl) CheckCallback(callbackUrl *url.URL) error {
+	host := strings.ToLower(callbackUrl.Hostname())
+	if (callbackUrl.Scheme != "http" && callbackUrl.Scheme != "https") || host == "" {
+		return fmt.Errorf("CheckCallback(%s): the callback must be an http(s) URL", callbackUrl)
+	}
+	if len(a.CallbackAllow) > 0 {
+		for _, allowed := range a.CallbackAllow {
+			if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("CheckCallback(%s): %s is not in callback_allow", callbackUrl, host)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("CheckCallback(%s): %s", callbackUrl, err.Error())
+	}
+	for _, ip := range ips {
+		if isInternalIP(ip) {
+			return fmt.Errorf("CheckCallback(%s): %s is an internal address (%s)", callbackUrl, host, ip)
+		}
+	}
+	return nil
+}
+
+// CallbackDialControl refuses a connection for a callback to an
+// internal address (unless there is a callback_allow).  The host was
+// checked when the job was queued, but it could resolve to somewhere
+// else by the time we connect to it, so the address we are actually
+// connecting to is checked as well
+func (a *AsyncImpl) CallbackDialControl(network string, address string, c syscall.RawConn) error {
+	if len(a.CallbackAllow) > 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("CallbackDialControl(%s): %s", address, err.Error())
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isInternalIP(ip) {
+		return fmt.Errorf("CallbackDialControl(%s): %s is an internal address", address, host)
+	}
+	return nil
+}
+
+// The ranges that are inside the network (or reserved), on top of the
+// ones that net.IP knows about
+var internalNetworks = parseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved (and broadcast)
+	"64:ff9b::/96",   // NAT64, which can reach the IPv4 ranges
+	"64:ff9b:1::/48", // local-use NAT64
+	"2002::/16",      // 6to4, which can reach the IPv4 ranges
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// isInternalIP is true for an address that a callback shouldn't go to
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Job is an asynchronous broker request, which is kept (as JSON) in
+// the key/value store so that any instance can pick it up or answer
+// a poll for it
+type Job struct {
+	Id       string `json:"id"`
+	Status   string `json:"status"`
+	Upstream string `json:"upstream"`
+	Method   string `json:"method"`
+
+	// The path (and query) of the request, starting with the upstream
+	Url string `json:"url"`
+
+	// Where the caller polls for the result, and where we POST it
+	// when the job is done (if anywhere)
+	StatusUrl string `json:"status_url"`
+	Callback  string `json:"callback,omitempty"`
+
+	CreatedMillis  int64 `json:"created"`
+	StartedMillis  int64 `json:"started,omitempty"`
+	FinishedMillis int64 `json:"finished,omitempty"`
+
+	// When a running job is given up on
+	DeadlineMillis int64 `json:"deadline,omitempty"`
+
+	// How the callback went
+	CallbackStatusCode int    `json:"callback_status_code,omitempty"`
+	CallbackError      string `json:"callback_error,omitempty"`
+
+	Request  *JobMessage `json:"request,omitempty"`
+	Response *JobMessage `json:"response,omitempty"`
+
+	// The caller's credentials (encrypted), until the job has run
+	Credentials []byte `json:"credentials,omitempty"`
+}
+
+// JobMessage is the request we were given, or the (normalised)
+// response the upstream sent back
+type JobMessage struct {
+	StatusCode int         `json:"status_code,omitempty"`
+	Headers    http.Header `json:"headers"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// IsFinished is true if the job has a response for the caller
+func (j *Job) IsFinished() bool {
+	return j.Status == JOB_DONE || j.Status == JOB_FAILED
+}
+
+// CheckDeadline fails the job if it is still running after its
+// deadline (e.g. because the worker running it has crashed), and
+// returns whether it did
+func (j *Job) CheckDeadline(nowMillis int64) bool {
+	if j.Status != JOB_RUNNING || j.DeadlineMillis == 0 || nowMillis <= j.DeadlineMillis {
+		return false
+	}
+	err := fmt.Sprintf("job %s didn't finish by its deadline (did its worker stop?)", j.Id)
+	headers := make(http.Header)
+	headers.Set("Content-Type", "text/plain")
+	headers.Set(HEADER_X_FAULTMONKEY_ERROR, err)
+	j.Status = JOB_FAILED
+	j.FinishedMillis = j.DeadlineMillis
+	j.Request = nil
+	j.Credentials = nil
+	j.Response = &JobMessage{
+		StatusCode: http.StatusGatewayTimeout,
+		Headers:    headers,
+		Body:       []byte(err),
+	}
+	return true
+}
+
+// GetSummary is the job without the request and the response, which
+// is what the caller sees while it is waiting
+func (j *Job) GetSummary() *Job {
+	summary := *j
+	summary.Request = nil
+	summary.Response = nil
+	summary.Credentials = nil
+	return &summary
+}
@@ -0,0 +1,96 @@
+package data
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BackendError is returned when we could not get a response from
+// a backend
+type BackendError struct {
+	// The status code to send back to the caller
+	StatusCode int
+
+	// The class of error (e.g. 'circuitbreaker', or whatever the
+	// ErrorClassifier says)
+	Class string
+
+	err error
+}
+
+func NewBackendError(statusCode int, class string, err error) *BackendError {
+	return &BackendError{
+		StatusCode: statusCode,
+		Class:      class,
+		err:        err,
+	}
+}
+
+func (e *BackendError) Error() string {
+	return e.err.Error()
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.err
+}
+
+// cancelOnClose cancels the context of a request once the caller
+// has finished with the body of the response
+type cancelOnClose struct {
+	io.ReadCloser
+	cancelFunc context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancelFunc()
+	return c.ReadCloser.Close()
+}
+
+// cancelOnCloseConn is the same, for the connection to a backend
+// that has switched protocols (e.g. to a WebSocket)
+type cancelOnCloseConn struct {
+	io.ReadWriteCloser
+	cancelFunc context.CancelFunc
+}
+
+func (c *cancelOnCloseConn) Close() error {
+	defer c.cancelFunc()
+	return c.ReadWriteCloser.Close()
+}
+
+// WriteResponse sends the response (or the error) from a backend
+// back to the caller, and closes the body of the response
+func WriteResponse(c *gin.Context, resp *http.Response, err error) {
+	if err != nil {
+		statusCode := http.StatusBadGateway
+		if backendError, isBackendError := err.(*BackendError); isBackendError {
+			statusCode = backendError.StatusCode
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		c.Writer.Header().Add(HEADER_X_FAULTMONKEY_ERROR, err.Error())
+		c.AbortWithError(statusCode, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Send the status
+	c.Status(resp.StatusCode)
+
+	// Send the headers
+	for h, v := range resp.Header {
+		for _, headerVal := range v {
+			c.Writer.Header().Add(h, headerVal)
+		}
+	}
+
+	// Send the body (as it arrives, if it is streamed)
+	if err := CopyResponseBody(c.Writer, resp); err != nil {
+		log.Printf("%s: sending the response: %s", c.Request.URL.String(), err.Error())
+	}
+}
@@ -0,0 +1,248 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var backoffResponses = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "backoff_responses",
+		Help:      "The number of responses that told us to back off, keyed by host and status code",
+	},
+	[]string{"host", "code"},
+)
+var backoffMillis = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "backoff_millis",
+		Help:      "The backoff in millis requested by responses, keyed by host and status code",
+	},
+	[]string{"host", "code"},
+)
+
+const (
+	// If we get a 429 without being told how long to back off
+	// for, then we back off for this long
+	DEFAULT_429_BACKOFF_MILLIS = 1000
+
+	// Never back off for longer than this, no matter what the
+	// server tells us
+	MAX_BACKOFF_MILLIS = 10 * 60 * 1000
+
+	// RateLimit-Reset values bigger than this are an epoch time
+	// (in seconds) rather than a delta
+	rateLimitResetEpochThreshold = 1000000000
+)
+
+// Pulse is what we need from a facade/pulse.Pulse.
+//
+// It is declared here (rather than importing facade/pulse) because
+// facade/pulse imports data.
+type Pulse interface {
+	// wait for the next heartbeat
+	WaitForNext() error
+
+	// pause heartbeats for a specified amount of time
+	SetPauseForDuration(duration time.Duration)
+
+	Pausable
+}
+
+// Pausable is anything that can be told to back off
+type Pausable interface {
+	// pause hartbeats until a particular wallclock time is reached
+	SetPauseUntil(wallclock time.Time)
+}
+
+// HostPulseFactory returns the pulse shared by everything that talks
+// to a given host, creating it if necessary
+type HostPulseFactory func(host string) Pulse
+
+// When each host told us to back off until
+var backoffUntil = make(map[string]time.Time)
+var backoffUntilMutex sync.RWMutex
+
+// IsBackingOff returns whether or not the host has told us to back
+// off (and the time has not passed yet)
+func IsBackingOff(host string) bool {
+	backoffUntilMutex.RLock()
+	defer backoffUntilMutex.RUnlock()
+	until, exists := backoffUntil[strings.ToLower(host)]
+	return exists && time.Now().Before(until)
+}
+
+func setBackoffUntil(host string, until time.Time) {
+	backoffUntilMutex.Lock()
+	defer backoffUntilMutex.Unlock()
+	host = strings.ToLower(host)
+	if until.After(backoffUntil[host]) {
+		backoffUntil[host] = until
+	}
+
+	// Forget the hosts whose back off is over, so that the map
+	// doesn't grow forever
+	now := time.Now()
+	for h, hostUntil := range backoffUntil {
+		if now.After(hostUntil) {
+			delete(backoffUntil, h)
+		}
+	}
+}
+
+var hostPulseFactory HostPulseFactory
+var hostPulseFactoryMutex sync.RWMutex
+
+// SetHostPulseFactory is backpatched at startup (this avoids an
+// import loop with facade/pulse)
+func SetHostPulseFactory(factory HostPulseFactory) {
+	hostPulseFactoryMutex.Lock()
+	defer hostPulseFactoryMutex.Unlock()
+	hostPulseFactory = factory
+}
+
+// GetHostPulse returns the pulse for the host, or nil if there is
+// no host pulse factory
+func GetHostPulse(host string) Pulse {
+	hostPulseFactoryMutex.RLock()
+	defer hostPulseFactoryMutex.RUnlock()
+	if hostPulseFactory == nil || host == "" {
+		return nil
+	}
+	return hostPulseFactory(strings.ToLower(host))
+}
+
+// ContextPulse is a Pulse that can stop waiting when the context is
+// done, without using up the heartbeat of another caller
+type ContextPulse interface {
+	WaitForNextContext(ctx context.Context) error
+}
+
+// WaitForPulse waits for a green light from the pulse, giving up
+// if the context is done first
+func WaitForPulse(ctx context.Context, pulse Pulse) error {
+	if pulse == nil {
+		return nil
+	}
+	if contextPulse, ok := pulse.(ContextPulse); ok {
+		return contextPulse.WaitForNextContext(ctx)
+	}
+
+	// The pulse carries on waiting after we have given up on it
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- pulse.WaitForNext()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+
+	case err := <-errChan:
+		return err
+	}
+}
+
+// WaitForHost waits until we are allowed to send requests to the host
+// (i.e. it has not told us to back off)
+func WaitForHost(ctx context.Context, host string) error {
+	return WaitForPulse(ctx, GetHostPulse(host))
+}
+
+// ParseBackoff works out when we can next send a request, based on
+// the status code and headers of a response.
+//
+// It only applies to 429 and 503 responses, and understands:
+//
+//	Retry-After: seconds, or an HTTP-date
+//
+//	X-Backoff-Millis: millis
+//
+//	RateLimit-Reset: seconds (or an epoch time in seconds)
+//
+// If more than one is present, then the latest wins.
+func ParseBackoff(statusCode int, headers http.Header, now time.Time) (time.Time, bool) {
+	if statusCode != http.StatusTooManyRequests && statusCode != http.StatusServiceUnavailable {
+		return time.Time{}, false
+	}
+
+	var until time.Time
+	extend := func(t time.Time) {
+		if t.After(until) {
+			until = t
+		}
+	}
+
+	if retryAfter := strings.TrimSpace(headers.Get(HEADER_RETRY_AFTER)); retryAfter != "" {
+		if seconds, err := strconv.ParseInt(retryAfter, 10, 64); err == nil {
+			extend(now.Add(time.Duration(seconds) * time.Second))
+		} else if wallclock, err := http.ParseTime(retryAfter); err == nil {
+			extend(wallclock)
+		}
+	}
+	if backoff := strings.TrimSpace(headers.Get(HEADER_X_BACKOFF_MILLIS)); backoff != "" {
+		if millis, err := strconv.ParseInt(backoff, 10, 64); err == nil {
+			extend(now.Add(time.Duration(millis) * time.Millisecond))
+		}
+	}
+	if reset := strings.TrimSpace(headers.Get(HEADER_RATELIMIT_RESET)); reset != "" {
+		if seconds, err := strconv.ParseInt(reset, 10, 64); err == nil {
+			if seconds > rateLimitResetEpochThreshold {
+				extend(time.Unix(seconds, 0))
+			} else {
+				extend(now.Add(time.Duration(seconds) * time.Second))
+			}
+		}
+	}
+
+	if !until.After(now) {
+		if statusCode != http.StatusTooManyRequests {
+			// A 503 without any backoff headers is just a failure
+			return time.Time{}, false
+		}
+		until = now.Add(DEFAULT_429_BACKOFF_MILLIS * time.Millisecond)
+	}
+	if latest := now.Add(MAX_BACKOFF_MILLIS * time.Millisecond); until.After(latest) {
+		until = latest
+	}
+
+	return until, true
+}
+
+// Backoff pauses the pulse of the host (and anything else that is
+// passed in, e.g. attenuators) if the response tells us to back off.
+//
+// It returns the time we are backing off until, if any
+func Backoff(host string, statusCode int, headers http.Header, pausables ...Pausable) (time.Time, bool) {
+	now := time.Now().UTC()
+	until, shouldBackoff := ParseBackoff(statusCode, headers, now)
+	if !shouldBackoff {
+		return until, false
+	}
+
+	backoffResponses.WithLabelValues(host, fmt.Sprint(statusCode)).Inc()
+	backoffMillis.WithLabelValues(host, fmt.Sprint(statusCode)).Add(float64(until.Sub(now).Milliseconds()))
+	log.Printf("%s: HTTP %d, backing off until %s", host, statusCode, until.Format(time.RFC3339))
+
+	setBackoffUntil(host, until)
+	if hostPulse := GetHostPulse(host); hostPulse != nil {
+		hostPulse.SetPauseUntil(until)
+	}
+	for _, pausable := range pausables {
+		if pausable != nil {
+			pausable.SetPauseUntil(until)
+		}
+	}
+
+	return until, true
+}
@@ -0,0 +1,129 @@
+package data
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseBackoffRetryAfterSeconds(t *testing.T) {
+	now := time.Now().UTC()
+	until, shouldBackoff := ParseBackoff(
+		http.StatusTooManyRequests,
+		http.Header{HEADER_RETRY_AFTER: []string{"120"}},
+		now,
+	)
+	if !shouldBackoff {
+		t.Fatal("Expected to back off")
+	}
+	if until.Sub(now) != 120*time.Second {
+		t.Errorf("Expected 120s backoff, but got %s", until.Sub(now))
+	}
+}
+
+func TestParseBackoffRetryAfterDate(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	expected := now.Add(90 * time.Second)
+	until, shouldBackoff := ParseBackoff(
+		http.StatusServiceUnavailable,
+		http.Header{HEADER_RETRY_AFTER: []string{expected.Format(http.TimeFormat)}},
+		now,
+	)
+	if !shouldBackoff {
+		t.Fatal("Expected to back off")
+	}
+	if !until.Equal(expected) {
+		t.Errorf("Expected backoff until %s, but got %s", expected, until)
+	}
+}
+
+func TestParseBackoffLatestWins(t *testing.T) {
+	now := time.Now().UTC()
+	headers := http.Header{}
+	headers.Set(HEADER_RETRY_AFTER, "10")
+	headers.Set(HEADER_X_BACKOFF_MILLIS, "60000")
+	headers.Set(HEADER_RATELIMIT_RESET, "30")
+	until, _ := ParseBackoff(http.StatusTooManyRequests, headers, now)
+	if until.Sub(now) != 60*time.Second {
+		t.Errorf("Expected 60s backoff, but got %s", until.Sub(now))
+	}
+}
+
+func TestParseBackoffRateLimitResetEpoch(t *testing.T) {
+	now := time.Now().UTC()
+	expected := now.Add(45 * time.Second).Truncate(time.Second)
+	headers := http.Header{}
+	headers.Set(HEADER_RATELIMIT_RESET, fmt.Sprint(expected.Unix()))
+	until, _ := ParseBackoff(http.StatusTooManyRequests, headers, now)
+	if !until.Equal(expected) {
+		t.Errorf("Expected backoff until %s, but got %s", expected, until)
+	}
+}
+
+func TestParseBackoffDefaults(t *testing.T) {
+	now := time.Now().UTC()
+
+	// A 429 with no headers gets the default backoff
+	until, shouldBackoff := ParseBackoff(http.StatusTooManyRequests, http.Header{}, now)
+	if !shouldBackoff || until.Sub(now) != DEFAULT_429_BACKOFF_MILLIS*time.Millisecond {
+		t.Errorf("Expected default backoff, but got %v (%s)", shouldBackoff, until.Sub(now))
+	}
+
+	// A 503 with no headers is not a backoff
+	if _, shouldBackoff := ParseBackoff(http.StatusServiceUnavailable, http.Header{}, now); shouldBackoff {
+		t.Error("Did not expect a 503 without headers to back off")
+	}
+
+	// Anything else is never a backoff
+	if _, shouldBackoff := ParseBackoff(http.StatusOK, http.Header{HEADER_RETRY_AFTER: []string{"10"}}, now); shouldBackoff {
+		t.Error("Did not expect a 200 to back off")
+	}
+
+	// Silly values get capped
+	until, _ = ParseBackoff(http.StatusTooManyRequests, http.Header{HEADER_RETRY_AFTER: []string{"999999"}}, now)
+	if until.Sub(now) != MAX_BACKOFF_MILLIS*time.Millisecond {
+		t.Errorf("Expected backoff to be capped, but got %s", until.Sub(now))
+	}
+}
+
+type pausedPulse struct {
+	until time.Time
+}
+
+func (p *pausedPulse) WaitForNext() error {
+	return nil
+}
+
+func (p *pausedPulse) SetPauseForDuration(duration time.Duration) {
+	p.until = time.Now().UTC().Add(duration)
+}
+
+func (p *pausedPulse) SetPauseUntil(wallclock time.Time) {
+	p.until = wallclock
+}
+
+func TestBackoffPausesHostPulse(t *testing.T) {
+	hostPulse := &pausedPulse{}
+	SetHostPulseFactory(func(host string) Pulse {
+		if host != "example.com" {
+			t.Errorf("Expected pulse for 'example.com', but got '%s'", host)
+		}
+		return hostPulse
+	})
+	defer SetHostPulseFactory(nil)
+
+	otherPulse := &pausedPulse{}
+	until, shouldBackoff := Backoff(
+		"Example.com",
+		http.StatusTooManyRequests,
+		http.Header{HEADER_RETRY_AFTER: []string{"5"}},
+		otherPulse,
+	)
+	if !shouldBackoff {
+		t.Fatal("Expected to back off")
+	}
+	if !hostPulse.until.Equal(until) || !otherPulse.until.Equal(until) {
+		t.Errorf("Expected both pulses to be paused until %s, but got %s and %s", until, hostPulse.until, otherPulse.until)
+	}
+}
@@ -1,10 +1,22 @@
 package data
 
-import "github.com/gin-gonic/gin"
+import (
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// The admin API token can come from the environment, rather than
+	// being in the config file
+	ENV_ADMIN_TOKEN = "FAULTMONKEY_ADMIN_TOKEN"
+)
 
 type Broker interface {
 	Handler
 	GetUpstream(serviceName string) Upstream
+	GetUpstreams() map[string]Upstream
+	GetAdminToken() string
 }
 
 type BrokerImpl struct {
@@ -16,8 +28,17 @@ type BrokerImpl struct {
 	// Hosts map[string]*ServerHost
 	UpstreamFromConfig map[string]*UpstreamImpl `yaml:"upstream" json:"upstream"`
 
+	// The bearer token for the admin API, which is turned off if
+	// there isn't one
+	AdminToken string `yaml:"admin_token,omitempty" json:"-"`
+
+	// How requests with ?async=true are run
+	Async *AsyncImpl `yaml:"async,omitempty" json:"async,omitempty"`
+
 	// These are backpatched
-	upstream map[string]Upstream
+	upstream         map[string]Upstream
+	throttleRegistry ThrottleRegistry
+	profileRegistry  ProfileRegistry
 }
 
 func (b *BrokerImpl) GetName() string {
@@ -32,10 +53,39 @@ func (b *BrokerImpl) GetUpstream(serviceName string) Upstream {
 	return b.upstream[serviceName]
 }
 
+// GetAdminToken returns the bearer token for the admin API (or "" if
+// it is turned off)
+func (b *BrokerImpl) GetAdminToken() string {
+	return b.AdminToken
+}
+
+// GetAsync returns the config for the asynchronous requests
+func (b *BrokerImpl) GetAsync() *AsyncImpl {
+	return b.Async
+}
+
+// GetUpstreams returns all of the upstreams, keyed by name.  Don't
+// change the map
+func (b *BrokerImpl) GetUpstreams() map[string]Upstream {
+	return b.upstream
+}
+
 func (b *BrokerImpl) Backpatch() error {
+	if b.AdminToken == "" {
+		b.AdminToken = os.Getenv(ENV_ADMIN_TOKEN)
+	}
+	if b.Async == nil {
+		b.Async = &AsyncImpl{}
+	}
+	if err := b.Async.Backpatch(); err != nil {
+		return err
+	}
+
 	b.upstream = make(map[string]Upstream)
 	for upstreamServiceName, upstreamService := range b.UpstreamFromConfig {
 		upstreamService.serviceName = upstreamServiceName
+		upstreamService.throttleRegistry = b.throttleRegistry
+		upstreamService.profileRegistry = b.profileRegistry
 		err := upstreamService.Backpatch()
 		if err != nil {
 			return err
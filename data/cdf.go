@@ -2,6 +2,7 @@ package data
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -50,11 +51,67 @@ func ChooseFromCDF(probability float64, cdf []HasCDF) HasCDF {
 	return cdf[rand.Intn(len(cdf))]
 }
 
+// ChooseWeighted chooses from the items in proportion to their
+// weights.
+//
+// Unlike ChooseFromCDF() it does not rely on the backpatched cdf
+// values, so it can be used on any subset of the items
+func ChooseWeighted(probability float64, items []HasCDF) HasCDF {
+	if len(items) == 0 {
+		return nil
+	}
+
+	totalWeight := 0
+	for _, item := range items {
+		totalWeight += item.GetWeight()
+	}
+	if totalWeight <= 0 {
+		return items[int(probability*float64(len(items)))%len(items)]
+	}
+
+	threshold := probability * float64(totalWeight)
+	cumulativeWeight := 0
+	for _, item := range items {
+		cumulativeWeight += item.GetWeight()
+		if float64(cumulativeWeight) > threshold {
+			return item
+		}
+	}
+
+	return items[len(items)-1]
+}
+
 func Choose(rule string, cdf []HasCDF, rng *rand.Rand) HasCDF {
+	return ChooseWithKey(rule, "", cdf, rng)
+}
+
+// ChooseWithKey is Choose() for rules that need a key (i.e. hash)
+func ChooseWithKey(rule string, key string, cdf []HasCDF, rng *rand.Rand) HasCDF {
+	if len(cdf) == 0 {
+		return nil
+	}
+
 	var choice HasCDF
 	switch rule {
 	case "weighted":
-		choice = ChooseFromCDF(rng.Float64(), cdf)
+		choice = ChooseWeighted(rng.Float64(), cdf)
+
+	case "cheapest":
+		choice = ChooseCheapest(cdf, rng)
+
+	case "least_latency":
+		choice = ChooseLeastLatency(cdf, rng)
+
+	case "priority":
+		choice = ChoosePriority(cdf, rng)
+
+	case "hash":
+		// Without a key, there is nothing to be sticky about
+		if key == "" {
+			choice = ChooseWeighted(rng.Float64(), cdf)
+		} else {
+			choice = ChooseHashed(key, cdf)
+		}
 
 	case "uniform", "random":
 		fallthrough
@@ -65,3 +122,34 @@ func Choose(rule string, cdf []HasCDF, rng *rand.Rand) HasCDF {
 
 	return choice
 }
+
+// lockedSource makes a rand.Source safe to use from more than one
+// goroutine
+type lockedSource struct {
+	mutex sync.Mutex
+	src   rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.src.Seed(seed)
+}
+
+// NewLockedRand returns a *rand.Rand that can be shared between
+// goroutines (e.g. by all of the requests to an upstream)
+func NewLockedRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
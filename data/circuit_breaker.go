@@ -0,0 +1,323 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var circuitBreakerTransitions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "circuitbreaker_transitions",
+		Help:      "The number of circuit breaker state changes, keyed by circuit breaker name and new state",
+	},
+	[]string{"name", "state"},
+)
+var circuitBreakerRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "circuitbreaker_rejections",
+		Help:      "The number of requests rejected by a circuit breaker, keyed by circuit breaker name and state",
+	},
+	[]string{"name", "state"},
+)
+
+const (
+	DEFAULT_CIRCUITBREAKER_FAILURE_THRESHOLD = 5
+	DEFAULT_CIRCUITBREAKER_WINDOW            = 20
+	DEFAULT_CIRCUITBREAKER_OPEN_MILLIS       = 30000
+	DEFAULT_CIRCUITBREAKER_HALF_OPEN_PROBES  = 1
+)
+
+type CircuitState int
+
+const (
+	CLOSED CircuitState = iota
+	OPEN
+	HALF_OPEN
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case OPEN:
+		return "OPEN"
+
+	case HALF_OPEN:
+		return "HALF_OPEN"
+
+	default:
+		return "CLOSED"
+	}
+}
+
+// CircuitBreaker stops us from sending requests to something that
+// is failing.
+//
+// Callers must call Allow() before making a request and, if it
+// returns true, Done() once the outcome is known.
+type CircuitBreaker interface {
+	GetState() CircuitState
+
+	// Allow reserves a slot for a request.  It returns false if
+	// the circuit is open or we are at max_concurrent
+	Allow() bool
+
+	// Done releases the slot reserved by Allow() and records the
+	// outcome of the request
+	Done(success bool)
+
+	// Cancel releases the slot reserved by Allow() without recording
+	// an outcome (e.g. because the caller gave up on the request)
+	Cancel()
+
+	// IsSaturated is true if there are max_concurrent requests
+	// in flight
+	IsSaturated() bool
+}
+
+type CircuitBreakerImpl struct {
+	// The maximum number of requests in flight at any one time
+	// (0 means unlimited)
+	MaxConcurrent int `yaml:"max_concurrent" json:"max_concurrent"`
+
+	// The maximum request rate.  If there is no attenuator configured
+	// then this is used to create one
+	MaxHertz float64 `yaml:"max_hertz" json:"max_hertz"`
+
+	// The (per request) timeout
+	TimeoutMillis int64 `yaml:"timeout_millis" json:"timeout_millis"`
+
+	// Deprecated: retries are ignored (a warning is logged), the
+	// failover of the upstream sends a failed request to another
+	// backend instead.  It is still accepted so that old configs load
+	Retries int `yaml:"retries,omitempty" json:"retries,omitempty"`
+
+	// The circuit trips after this many consecutive failures
+	FailureThreshold int `yaml:"failure_threshold" json:"failure_threshold"`
+
+	// ... or when the proportion of failures in the last 'window'
+	// requests reaches 'error_rate' (0 means this is not used).
+	//
+	// We need at least 'min_requests' in the window before we
+	// take any notice of the error rate
+	ErrorRate   float64 `yaml:"error_rate" json:"error_rate"`
+	Window      int     `yaml:"window" json:"window"`
+	MinRequests int     `yaml:"min_requests" json:"min_requests"`
+
+	// How long the circuit stays open before we start probing
+	OpenMillis int64 `yaml:"open_millis" json:"open_millis"`
+
+	// The number of probe requests allowed while half-open.  This
+	// many need to succeed before the circuit closes again
+	HalfOpenProbes int `yaml:"half_open_probes" json:"half_open_probes"`
+
+	// These are backpatched
+	name          string
+	onStateChange func(state CircuitState)
+
+	mutex               sync.Mutex
+	state               CircuitState
+	openedAt            time.Time
+	inflight            int
+	consecutiveFailures int
+	probesInflight      int
+	probeSuccesses      int
+	outcomes            []bool
+	nextOutcome         int
+	outcomesRecorded    int
+}
+
+func (cb *CircuitBreakerImpl) Backpatch(name string, onStateChange func(state CircuitState)) error {
+	if cb.Retries != 0 {
+		log.Printf("%s: circuitbreaker retries are deprecated, and ignored (use a failover on the upstream instead)", name)
+	}
+	if cb.ErrorRate < 0 || cb.ErrorRate > 1 {
+		return fmt.Errorf("%s: circuitbreaker error_rate must be between 0 and 1, but is %.2f", name, cb.ErrorRate)
+	}
+	if cb.FailureThreshold <= 0 {
+		cb.FailureThreshold = DEFAULT_CIRCUITBREAKER_FAILURE_THRESHOLD
+	}
+	if cb.Window <= 0 {
+		cb.Window = DEFAULT_CIRCUITBREAKER_WINDOW
+	}
+	if cb.MinRequests <= 0 || cb.MinRequests > cb.Window {
+		cb.MinRequests = cb.Window / 2
+	}
+	if cb.OpenMillis <= 0 {
+		cb.OpenMillis = DEFAULT_CIRCUITBREAKER_OPEN_MILLIS
+	}
+	if cb.HalfOpenProbes <= 0 {
+		cb.HalfOpenProbes = DEFAULT_CIRCUITBREAKER_HALF_OPEN_PROBES
+	}
+
+	cb.name = name
+	cb.onStateChange = onStateChange
+	cb.outcomes = make([]bool, cb.Window)
+	return nil
+}
+
+func (cb *CircuitBreakerImpl) GetState() CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.checkOpenExpired()
+	return cb.state
+}
+
+func (cb *CircuitBreakerImpl) IsSaturated() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.MaxConcurrent > 0 && cb.inflight >= cb.MaxConcurrent
+}
+
+func (cb *CircuitBreakerImpl) Allow() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.checkOpenExpired()
+
+	switch cb.state {
+	case OPEN:
+		circuitBreakerRejections.WithLabelValues(cb.name, cb.state.String()).Inc()
+		return false
+
+	case HALF_OPEN:
+		if cb.probesInflight >= cb.HalfOpenProbes {
+			circuitBreakerRejections.WithLabelValues(cb.name, cb.state.String()).Inc()
+			return false
+		}
+		cb.probesInflight++
+	}
+
+	if cb.MaxConcurrent > 0 && cb.inflight >= cb.MaxConcurrent {
+		if cb.state == HALF_OPEN {
+			cb.probesInflight--
+		}
+		circuitBreakerRejections.WithLabelValues(cb.name, "SATURATED").Inc()
+		return false
+	}
+	cb.inflight++
+	return true
+}
+
+func (cb *CircuitBreakerImpl) Done(success bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.inflight > 0 {
+		cb.inflight--
+	}
+
+	switch cb.state {
+	case HALF_OPEN:
+		if cb.probesInflight > 0 {
+			cb.probesInflight--
+		}
+		if !success {
+			// The probe failed, so back to square one
+			cb.transition(OPEN)
+			return
+		}
+		cb.probeSuccesses++
+		if cb.probeSuccesses >= cb.HalfOpenProbes {
+			cb.transition(CLOSED)
+		}
+
+	case CLOSED:
+		cb.record(success)
+		if cb.shouldTrip() {
+			cb.transition(OPEN)
+		}
+
+	default:
+		// Requests that were already in flight when the circuit
+		// opened don't tell us anything new
+	}
+}
+
+func (cb *CircuitBreakerImpl) Cancel() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.inflight > 0 {
+		cb.inflight--
+	}
+	if cb.state == HALF_OPEN && cb.probesInflight > 0 {
+		cb.probesInflight--
+	}
+}
+
+// record keeps track of consecutive failures and the outcomes
+// in the error rate window
+func (cb *CircuitBreakerImpl) record(success bool) {
+	if success {
+		cb.consecutiveFailures = 0
+	} else {
+		cb.consecutiveFailures++
+	}
+
+	cb.outcomes[cb.nextOutcome] = success
+	cb.nextOutcome = (cb.nextOutcome + 1) % len(cb.outcomes)
+	if cb.outcomesRecorded < len(cb.outcomes) {
+		cb.outcomesRecorded++
+	}
+}
+
+func (cb *CircuitBreakerImpl) shouldTrip() bool {
+	if cb.consecutiveFailures >= cb.FailureThreshold {
+		return true
+	}
+	if cb.ErrorRate <= 0 || cb.outcomesRecorded < cb.MinRequests {
+		return false
+	}
+
+	failures := 0
+	for i := 0; i < cb.outcomesRecorded; i++ {
+		if !cb.outcomes[i] {
+			failures++
+		}
+	}
+	return float64(failures)/float64(cb.outcomesRecorded) >= cb.ErrorRate
+}
+
+// checkOpenExpired moves an open circuit to half-open once it has
+// been open for long enough.
+//
+// The caller must hold the mutex
+func (cb *CircuitBreakerImpl) checkOpenExpired() {
+	if cb.state != OPEN {
+		return
+	}
+	if time.Since(cb.openedAt) >= time.Duration(cb.OpenMillis)*time.Millisecond {
+		cb.transition(HALF_OPEN)
+	}
+}
+
+// transition changes state and resets the counters for the new
+// state.
+//
+// The caller must hold the mutex
+func (cb *CircuitBreakerImpl) transition(state CircuitState) {
+	if cb.state == state {
+		return
+	}
+	cb.state = state
+	cb.probesInflight = 0
+	cb.probeSuccesses = 0
+	switch state {
+	case OPEN:
+		cb.openedAt = time.Now()
+
+	case CLOSED:
+		cb.consecutiveFailures = 0
+		cb.nextOutcome = 0
+		cb.outcomesRecorded = 0
+	}
+
+	circuitBreakerTransitions.WithLabelValues(cb.name, state.String()).Inc()
+	if cb.onStateChange != nil {
+		// Don't call back with the mutex held
+		go cb.onStateChange(state)
+	}
+}
@@ -0,0 +1,170 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestCircuitBreaker(t *testing.T, cb *CircuitBreakerImpl) *CircuitBreakerImpl {
+	if err := cb.Backpatch("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	return cb
+}
+
+func TestCircuitBreakerTripsOnConsecutiveFailures(t *testing.T) {
+	cb := newTestCircuitBreaker(t, &CircuitBreakerImpl{
+		FailureThreshold: 3,
+	})
+
+	for i := 0; i < 3; i++ {
+		if cb.GetState() != CLOSED {
+			t.Fatalf("Expected CLOSED after %d failures, but got %s", i, cb.GetState())
+		}
+		if !cb.Allow() {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+		cb.Done(false)
+	}
+	if cb.GetState() != OPEN {
+		t.Errorf("Expected OPEN, but got %s", cb.GetState())
+	}
+	if cb.Allow() {
+		t.Error("Expected an open circuit to reject requests")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsConsecutiveFailures(t *testing.T) {
+	cb := newTestCircuitBreaker(t, &CircuitBreakerImpl{
+		FailureThreshold: 2,
+	})
+
+	for _, success := range []bool{false, true, false, true, false} {
+		cb.Allow()
+		cb.Done(success)
+	}
+	if cb.GetState() != CLOSED {
+		t.Errorf("Expected CLOSED, but got %s", cb.GetState())
+	}
+}
+
+func TestCircuitBreakerTripsOnErrorRate(t *testing.T) {
+	cb := newTestCircuitBreaker(t, &CircuitBreakerImpl{
+		FailureThreshold: 100,
+		ErrorRate:        0.5,
+		Window:           10,
+		MinRequests:      10,
+	})
+
+	// Alternate success and failure, so we never get consecutive failures
+	for i := 0; i < 9; i++ {
+		cb.Allow()
+		cb.Done(i%2 == 0)
+	}
+	if cb.GetState() != CLOSED {
+		t.Fatalf("Expected CLOSED before min_requests, but got %s", cb.GetState())
+	}
+	cb.Allow()
+	cb.Done(false)
+	if cb.GetState() != OPEN {
+		t.Errorf("Expected OPEN at 50%% errors, but got %s", cb.GetState())
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	cb := newTestCircuitBreaker(t, &CircuitBreakerImpl{
+		FailureThreshold: 1,
+		OpenMillis:       10,
+		HalfOpenProbes:   1,
+	})
+
+	cb.Allow()
+	cb.Done(false)
+	if cb.GetState() != OPEN {
+		t.Fatalf("Expected OPEN, but got %s", cb.GetState())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if cb.GetState() != HALF_OPEN {
+		t.Fatalf("Expected HALF_OPEN, but got %s", cb.GetState())
+	}
+
+	// Only one probe at a time
+	if !cb.Allow() {
+		t.Fatal("Expected the probe to be allowed")
+	}
+	if cb.Allow() {
+		t.Error("Expected a second probe to be rejected")
+	}
+
+	// A failed probe re-opens the circuit
+	cb.Done(false)
+	if cb.GetState() != OPEN {
+		t.Fatalf("Expected OPEN after failed probe, but got %s", cb.GetState())
+	}
+
+	// A successful probe closes it
+	time.Sleep(20 * time.Millisecond)
+	cb.Allow()
+	cb.Done(true)
+	if cb.GetState() != CLOSED {
+		t.Errorf("Expected CLOSED after successful probe, but got %s", cb.GetState())
+	}
+}
+
+func TestCircuitBreakerMaxConcurrent(t *testing.T) {
+	cb := newTestCircuitBreaker(t, &CircuitBreakerImpl{
+		MaxConcurrent: 2,
+	})
+
+	if !cb.Allow() || !cb.Allow() {
+		t.Fatal("Expected two requests to be allowed")
+	}
+	if !cb.IsSaturated() {
+		t.Error("Expected circuit breaker to be saturated")
+	}
+	if cb.Allow() {
+		t.Error("Expected a third concurrent request to be rejected")
+	}
+	cb.Done(true)
+	if !cb.Allow() {
+		t.Error("Expected a request to be allowed once one has finished")
+	}
+}
+
+func TestChooseBackendSkipsOpenCircuits(t *testing.T) {
+	upstream := newTestUpstream(t, "test", &UpstreamImpl{
+		Rule: "weighted",
+		Backends: map[string]*UpstreamBackendImpl{
+			"good": {
+				Url:    "http://good",
+				Weight: 1,
+			},
+			"bad": {
+				Url:            "http://bad",
+				Weight:         100,
+				CircuitBreaker: &CircuitBreakerImpl{FailureThreshold: 1, OpenMillis: 60000},
+			},
+		},
+	})
+	upstream.Backends["bad"].CircuitBreaker.Allow()
+	upstream.Backends["bad"].CircuitBreaker.Done(false)
+	if upstream.Backends["bad"].GetState() != CIRCUIT_OPEN {
+		t.Fatalf("Expected CIRCUIT_OPEN, but got %s", upstream.Backends["bad"].GetState())
+	}
+
+	for i := 0; i < 100; i++ {
+		backend := upstream.ChooseBackend("", "")
+		if backend == nil || backend.GetName() != "good" {
+			t.Fatalf("Expected 'good' to be chosen, but got %v", backend)
+		}
+	}
+}
+
+func TestCircuitBreakerRetriesDeprecated(t *testing.T) {
+	cb := &CircuitBreakerImpl{
+		Retries: 3,
+	}
+	if err := cb.Backpatch("test", nil); err != nil {
+		t.Errorf("Expected circuitbreaker retries to be accepted (and ignored), but got %s", err.Error())
+	}
+}
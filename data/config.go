@@ -2,7 +2,6 @@ package data
 
 import (
 	"fmt"
-	"math/rand"
 	"os"
 	"sort"
 	"time"
@@ -14,6 +13,7 @@ const (
 	CONF_ATTENUATOR_LISTEN        = "config.attenuator.listen"
 	CONF_ATTENUATOR_QUEUESIZE     = "config.attenuator.queue_size"
 	CONF_BILLING_ENABLE           = "config.billing.enable"
+	CONF_BROKER_ADMIN_TOKEN       = "config.broker.admin_token"
 	CONF_BROKER_LISTEN            = "config.broker.listen"
 	CONF_BROKER_UPSTREAM          = "config.broker.upstream"
 	CONF_CONFIG_LISTEN            = "config.config.listen"
@@ -36,7 +36,19 @@ const (
 	CONF_SERVER_LISTEN            = "config.server.listen"
 )
 
+// LoadConfig builds the config, and makes it the live one
 func LoadConfig(configFile string) (*AppConfig, error) {
+	appConfig, err := BuildConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	appConfig.Activate()
+	return appConfig, nil
+}
+
+// BuildConfig reads and validates the config, without touching the
+// live one (so that a bad config can be rejected on a reload)
+func BuildConfig(configFile string) (*AppConfig, error) {
 	configBytes, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, fmt.Errorf("LoadCOnfig(%s): %s", configFile, err.Error())
@@ -45,6 +57,7 @@ func LoadConfig(configFile string) (*AppConfig, error) {
 	appConfig := AppConfig{
 		Config: Config{
 			pathologyProfiles: make(map[string]PathologyProfile),
+			profileRegistry:   NewProfileRegistry(),
 		},
 	}
 	err = yaml.Unmarshal(configBytes, &appConfig)
@@ -56,7 +69,7 @@ func LoadConfig(configFile string) (*AppConfig, error) {
 		profileInstance := &PathologyProfileImpl{
 			PathologyProfileFromConfig: profile,
 			pathologyCdf:               make([]HasCDF, 0),
-			rng:                        rand.New(rand.NewSource(time.Now().UnixNano())),
+			rng:                        NewLockedRand(time.Now().UnixNano()),
 		}
 		appConfig.Config.pathologyProfiles[profileName] = profileInstance
 		totalProfileWeight := 0
@@ -112,7 +125,7 @@ func LoadConfig(configFile string) (*AppConfig, error) {
 	for name, profile := range appConfig.Config.pathologyProfiles {
 		// backpatch the name
 		profile.(*PathologyProfileImpl).name = name
-		GetProfileRegistry().Register(profile)
+		appConfig.Config.profileRegistry.Register(profile)
 
 		// Backpatch the CDF for the pathologies in the profiles
 		totalWeight := 0
@@ -133,11 +146,42 @@ func LoadConfig(configFile string) (*AppConfig, error) {
 	// Backpatch the servers with the actual pathology profile instance
 	// to be used
 	for _, serverHost := range appConfig.Config.Server.Hosts {
-		serverHost.pathologyProfile = GetProfileRegistry().GetPathologyProfile(serverHost.PathologyProfileName)
+		serverHost.pathologyProfile = appConfig.Config.profileRegistry.GetPathologyProfile(serverHost.PathologyProfileName)
+	}
+
+	// Build the attenuators before anything that refers to them.
+	// They go in a registry of their own until the config is live,
+	// and anything that has been started is stopped again if the
+	// config is rejected
+	throttleRegistry := NewThrottleRegistry()
+	appConfig.Config.Attenuators.registry = throttleRegistry
+	err = appConfig.Config.Attenuators.Backpatch()
+	if err != nil {
+		appConfig.Retire(0)
+		return nil, fmt.Errorf("LoadConfig(%s): %s", configFile, err.Error())
 	}
 
 	// Backpatch the broker config
-	appConfig.Config.Broker.Backpatch()
+	if appConfig.Config.Broker != nil {
+		appConfig.Config.Broker.throttleRegistry = throttleRegistry
+		appConfig.Config.Broker.profileRegistry = appConfig.Config.profileRegistry
+		err = appConfig.Config.Broker.Backpatch()
+		if err != nil {
+			appConfig.Retire(0)
+			return nil, fmt.Errorf("LoadConfig(%s): %s", configFile, err.Error())
+		}
+	}
+
+	// Backpatch the gateway config
+	if appConfig.Config.Gateway != nil {
+		appConfig.Config.Gateway.throttleRegistry = throttleRegistry
+		appConfig.Config.Gateway.profileRegistry = appConfig.Config.profileRegistry
+	}
+	err = appConfig.Config.Gateway.Backpatch()
+	if err != nil {
+		appConfig.Retire(0)
+		return nil, fmt.Errorf("LoadConfig(%s): %s", configFile, err.Error())
+	}
 
 	return &appConfig, nil
 }
@@ -150,15 +194,22 @@ type Config struct {
 	PathologiesFromConfig map[string]PathologyProfileFromConfig `yaml:"pathologies" json:"pathologies"`
 	Server                Server                                `yaml:"server" json:"server"`
 	Broker                *BrokerImpl                           `yaml:"broker" json:"broker"`
+	Gateway               *GatewayImpl                          `yaml:"gateway,omitempty" json:"gateway,omitempty"`
+	Attenuators           AttenuatorsFromConfig                 `yaml:"attenuator" json:"attenuator"`
 
 	// These are backpatched
 	pathologyProfiles map[string]PathologyProfile
+	profileRegistry   ProfileRegistry
 }
 
 func (c *Config) GetBroker() Broker {
 	return c.Broker
 }
 
+func (c *Config) GetGateway() *GatewayImpl {
+	return c.Gateway
+}
+
 func (c *Config) GetPathologyProfile(name string) PathologyProfile {
 	return c.pathologyProfiles[name]
 }
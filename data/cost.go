@@ -1,11 +1,60 @@
 package data
 
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamBackendCost = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_backend_cost",
+		Help:      "The cost of the requests sent to backends, keyed by upstream, backend and coin",
+	},
+	[]string{"upstream", "backend", "coin"},
+)
+
 // CostFromConfig is what gets read from config.
 // Key is the name(s) of the 'coins'
 type CostFromConfig map[string]int
 
+// GetTotal is the total of all of the coins
+func (c CostFromConfig) GetTotal() int {
+	total := 0
+	for _, amount := range c {
+		total += amount
+	}
+	return total
+}
+
+// HasCost is used by the cheapest rule to rank things
+type HasCost interface {
+	GetCostPerRequest() int
+}
+
+// IsAvailable is used by the cheapest and hash rules to skip things that
+// are unhealthy (or otherwise can't take a request right now)
+type IsAvailable interface {
+	IsAvailable() bool
+}
+
+// HasState is used to make sure that things that have been disabled
+// (or are draining) are never chosen
+type HasState interface {
+	GetState() BackendState
+}
+
 type Cost interface {
 	Charge() (bool, error)
+
+	// The coins (and how many of them) that this costs
+	GetCoins() CostFromConfig
+
+	// The total of all of the coins
+	GetTotal() int
 }
 
 type CostImpl struct {
@@ -21,3 +70,85 @@ func NewCost(coins CostFromConfig) Cost {
 func (c *CostImpl) Charge() (bool, error) {
 	return false, nil
 }
+
+func (c *CostImpl) GetCoins() CostFromConfig {
+	return c.coins
+}
+
+func (c *CostImpl) GetTotal() int {
+	return c.coins.GetTotal()
+}
+
+func isAvailable(item HasCDF) bool {
+	a, hasAvailability := item.(IsAvailable)
+	return !hasAvailability || a.IsAvailable()
+}
+
+// onlyAvailable returns the items that are available
+func onlyAvailable(items []HasCDF) []HasCDF {
+	available := make([]HasCDF, 0, len(items))
+	for _, item := range items {
+		if isAvailable(item) {
+			available = append(available, item)
+		}
+	}
+	return available
+}
+
+// isDisabled is true for an item that has been disabled (or is
+// draining), which never gets traffic
+func isDisabled(item HasCDF) bool {
+	s, hasState := item.(HasState)
+	return hasState && isAdminState(s.GetState())
+}
+
+// filterAvailable returns the items that are available or, if nothing
+// is available, the ones that haven't been disabled (or drained)
+func filterAvailable(items []HasCDF) []HasCDF {
+	available := onlyAvailable(items)
+	if len(available) > 0 {
+		return available
+	}
+	for _, item := range items {
+		if !isDisabled(item) {
+			available = append(available, item)
+		}
+	}
+	return available
+}
+
+// ChooseCheapest returns the cheapest item that is available.  If
+// nothing is available, then it returns the cheapest item that hasn't
+// been disabled (or nil, if they all have).
+//
+// Items that cost the same share the load
+func ChooseCheapest(items []HasCDF, rng *rand.Rand) HasCDF {
+	if len(items) == 0 {
+		return nil
+	}
+
+	sorted := make([]HasCDF, len(items))
+	copy(sorted, items)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return getCostPerRequest(sorted[i]) < getCostPerRequest(sorted[j])
+	})
+
+	available := filterAvailable(sorted)
+	if len(available) == 0 {
+		return nil
+	}
+
+	// Share the load between the ones that are cheapest
+	cheapest := 1
+	for cheapest < len(available) && getCostPerRequest(available[cheapest]) == getCostPerRequest(available[0]) {
+		cheapest++
+	}
+	return available[rng.Intn(cheapest)]
+}
+
+func getCostPerRequest(item HasCDF) int {
+	if c, hasCost := item.(HasCost); hasCost {
+		return c.GetCostPerRequest()
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newCostTestBackend(name string, url string, cost int) *UpstreamBackendImpl {
+	return &UpstreamBackendImpl{
+		backendName: name,
+		Url:         url,
+		Cost:        CostFromConfig{"cents": cost},
+	}
+}
+
+func TestChooseCheapest(t *testing.T) {
+	cheap := newCostTestBackend("cheap", "https://cheap.com", 1)
+	medium := newCostTestBackend("medium", "https://medium.com", 5)
+	expensive := newCostTestBackend("expensive", "https://expensive.com", 10)
+	items := []HasCDF{expensive, cheap, medium}
+	rng := rand.New(rand.NewSource(1))
+
+	if choice := Choose("cheapest", items, rng); choice != cheap {
+		t.Fatalf("Expected 'cheap', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+
+	// Fall back to the next cheapest when the cheapest is unhealthy ...
+	cheap.SetState(UNHEALTHY)
+	if choice := Choose("cheapest", items, rng); choice != medium {
+		t.Fatalf("Expected 'medium', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+
+	// ... or it has told us to back off
+	setBackoffUntil("medium.com", time.Now().Add(time.Minute))
+	if choice := Choose("cheapest", items, rng); choice != expensive {
+		t.Fatalf("Expected 'expensive', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+
+	// If nothing is available, we use the cheapest that hasn't been
+	// disabled ...
+	expensive.SetState(DISABLED)
+	if choice := Choose("cheapest", items, rng); choice != cheap {
+		t.Fatalf("Expected 'cheap', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+
+	// ... and never one that has been disabled (or is draining)
+	cheap.SetState(DISABLED)
+	medium.SetState(DRAINING)
+	if choice := Choose("cheapest", items, rng); choice != nil {
+		t.Fatalf("Expected nothing, but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+}
+
+// saturatedThrottle always has a full queue
+type saturatedThrottle struct{}
+
+func (s saturatedThrottle) GetName() string {
+	return "saturated"
+}
+
+func (s saturatedThrottle) WaitForGreen(ctx context.Context, cancelFunc context.CancelFunc) error {
+	return nil
+}
+
+func (s saturatedThrottle) SetPauseUntil(wallclock time.Time) {
+}
+
+func (s saturatedThrottle) IsSaturated() bool {
+	return true
+}
+
+func TestChooseCheapestSaturatedThrottle(t *testing.T) {
+	cheap := newCostTestBackend("cheap", "https://cheap.com", 1)
+	cheap.throttle = saturatedThrottle{}
+	expensive := newCostTestBackend("expensive", "https://expensive.com", 10)
+	rng := rand.New(rand.NewSource(1))
+
+	if choice := Choose("cheapest", []HasCDF{cheap, expensive}, rng); choice != expensive {
+		t.Fatalf("Expected 'expensive', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+}
+
+func TestChooseCheapestSharesLoad(t *testing.T) {
+	first := newCostTestBackend("first", "https://first.com", 1)
+	second := newCostTestBackend("second", "https://second.com", 1)
+	expensive := newCostTestBackend("expensive", "https://expensive.com", 2)
+	items := []HasCDF{first, second, expensive}
+	rng := rand.New(rand.NewSource(1))
+
+	chosen := make(map[HasCDF]int)
+	for i := 0; i < 100; i++ {
+		chosen[Choose("cheapest", items, rng)]++
+	}
+	if chosen[first] == 0 || chosen[second] == 0 || chosen[expensive] != 0 {
+		t.Errorf("Expected the cheapest backends to share the load, but got first=%d, second=%d, expensive=%d", chosen[first], chosen[second], chosen[expensive])
+	}
+}
+
+func TestBackendCostHeader(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	upstream := newTestUpstream(t, "cost", &UpstreamImpl{
+		Rule: "cheapest",
+		Backends: map[string]*UpstreamBackendImpl{
+			"backend": {
+				Url:  server,
+				Cost: CostFromConfig{"cents": 2, "credits": 1},
+			},
+		},
+	})
+
+	w := doTestRequest(upstream, http.MethodGet, "/api/v1/broker/cost", "")
+	if cost := w.Header().Get(HEADER_X_FAULTMONKEY_BACKEND_COST); cost != "3" {
+		t.Errorf("Expected %s to be '3', but got '%s'", HEADER_X_FAULTMONKEY_BACKEND_COST, cost)
+	}
+}
@@ -1,11 +1,19 @@
 package data
 
+import "context"
+
 type EVT interface {
 	GetName() string
 	GetType() string
 	Run() EVTResult
 }
 
+// EVTWithContext is an EVT that can be cancelled (e.g. when it
+// takes too long)
+type EVTWithContext interface {
+	RunContext(ctx context.Context) EVTResult
+}
+
 type EVTImpl struct {
 	evtType string
 }
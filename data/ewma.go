@@ -0,0 +1,211 @@
+package data
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamBackendLatencyEWMA = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_backend_latency_ewma",
+		Help:      "The (peak) exponentially weighted moving average of the latency of a backend in millis, keyed by upstream/backend",
+	},
+	[]string{"upstream", "backend"},
+)
+var upstreamBackendErrorRateEWMA = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_backend_error_rate_ewma",
+		Help:      "The exponentially weighted moving average of the error rate of a backend, keyed by upstream/backend",
+	},
+	[]string{"upstream", "backend"},
+)
+
+const (
+	// How quickly old latencies are forgotten
+	DEFAULT_EWMA_DECAY_MILLIS = 10000
+
+	// Stops a backend that always fails from having an infinite score
+	minEWMASuccessRate = 0.01
+)
+
+// HasLatency is used by the least_latency rule to compare things
+type HasLatency interface {
+	// GetLatencyScore is lower for things that are better (faster)
+	GetLatencyScore() float64
+}
+
+// LatencyEWMA keeps a peak-EWMA of the latency (and an EWMA of the
+// error rate) of something.
+//
+// Peak-EWMA means that the average jumps straight up to a latency
+// that is worse than the average, and decays back down over time.
+// This makes us quick to avoid backends that slow down, and cautious
+// about going back to them
+type LatencyEWMA struct {
+	decay time.Duration
+
+	mutex       sync.Mutex
+	latency     float64
+	errorRate   float64
+	inflight    int
+	lastUpdated time.Time
+	sampled     bool
+	samples     int64
+
+	// for the gauges
+	upstreamName string
+	backendName  string
+}
+
+func NewLatencyEWMA(upstreamName string, backendName string, decayMillis int64) *LatencyEWMA {
+	if decayMillis <= 0 {
+		decayMillis = DEFAULT_EWMA_DECAY_MILLIS
+	}
+	return &LatencyEWMA{
+		decay:        time.Duration(decayMillis) * time.Millisecond,
+		upstreamName: upstreamName,
+		backendName:  backendName,
+	}
+}
+
+// Start records that a request is in flight
+func (e *LatencyEWMA) Start() {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.inflight++
+}
+
+// Done records the outcome of a request started with Start()
+func (e *LatencyEWMA) Done(latencyMillis int64, success bool) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.inflight > 0 {
+		e.inflight--
+	}
+
+	now := time.Now()
+	errorSample := float64(0)
+	if !success {
+		errorSample = 1
+	}
+	latency := float64(latencyMillis)
+	if !e.sampled {
+		e.latency = latency
+		e.errorRate = errorSample
+		e.sampled = true
+	} else {
+		alpha := e.alpha(now)
+		if latency > alpha*e.latency {
+			e.latency = latency
+		} else {
+			e.latency = alpha*e.latency + (1-alpha)*latency
+		}
+		e.errorRate = alpha*e.errorRate + (1-alpha)*errorSample
+	}
+	e.lastUpdated = now
+	e.samples++
+
+	upstreamBackendLatencyEWMA.WithLabelValues(e.upstreamName, e.backendName).Set(e.latency)
+	upstreamBackendErrorRateEWMA.WithLabelValues(e.upstreamName, e.backendName).Set(e.errorRate)
+}
+
+// alpha is the weight of the old average, which depends on how long
+// ago it was updated
+func (e *LatencyEWMA) alpha(now time.Time) float64 {
+	return math.Exp(-float64(now.Sub(e.lastUpdated)) / float64(e.decay))
+}
+
+// decayedLatency is the peak latency, decayed by however long it has
+// been since the last sample.  Otherwise a backend that had one slow
+// response would keep its score until it got another sample, which
+// it never would if it kept losing to the other backends
+func (e *LatencyEWMA) decayedLatency(now time.Time) float64 {
+	return e.alpha(now) * e.latency
+}
+
+// Cancel records that a request started with Start() is no longer
+// in flight, without recording an outcome
+func (e *LatencyEWMA) Cancel() {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.inflight > 0 {
+		e.inflight--
+	}
+}
+
+// GetLatency returns the (decayed) average latency and error rate
+func (e *LatencyEWMA) GetLatency() (float64, float64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.sampled {
+		return 0, 0
+	}
+	return e.decayedLatency(time.Now()), e.errorRate
+}
+
+// GetErrorRate returns the average error rate, and how many
+// requests it is based on
+func (e *LatencyEWMA) GetErrorRate() (float64, int64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.errorRate, e.samples
+}
+
+// GetLatencyScore is the (decayed) average latency, scaled up by the number of
+// requests in flight and the error rate.
+//
+// Something we haven't sampled yet has a score of 0, so that it gets
+// tried
+func (e *LatencyEWMA) GetLatencyScore() float64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.sampled {
+		return 0
+	}
+	successRate := math.Max(1-e.errorRate, minEWMASuccessRate)
+	return e.decayedLatency(time.Now()) * float64(e.inflight+1) / successRate
+}
+
+// ChooseLeastLatency uses the power of two choices: it picks two
+// items at random, and returns the one with the lower latency score.
+//
+// This avoids everybody herding on to whatever is fastest right now
+func ChooseLeastLatency(items []HasCDF, rng *rand.Rand) HasCDF {
+	if len(items) == 0 {
+		return nil
+	}
+	if len(items) == 1 {
+		return items[0]
+	}
+
+	i := rng.Intn(len(items))
+	j := rng.Intn(len(items) - 1)
+	if j >= i {
+		j++
+	}
+	first, firstHasLatency := items[i].(HasLatency)
+	second, secondHasLatency := items[j].(HasLatency)
+	if !firstHasLatency || !secondHasLatency {
+		return items[i]
+	}
+	if second.GetLatencyScore() < first.GetLatencyScore() {
+		return items[j]
+	}
+	return items[i]
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestLatencyEWMAPeak(t *testing.T) {
+	ewma := NewLatencyEWMA("test", "peak", 1000)
+
+	ewma.Start()
+	ewma.Done(100, true)
+	if latency, _ := ewma.GetLatency(); latency > 100 || latency < 99 {
+		t.Fatalf("Expected the first latency to be used as is, but got %.2f", latency)
+	}
+
+	// A slower response takes effect straight away
+	ewma.Start()
+	ewma.Done(500, true)
+	if latency, _ := ewma.GetLatency(); latency > 500 || latency < 495 {
+		t.Fatalf("Expected the peak latency of 500, but got %.2f", latency)
+	}
+
+	// ... but faster ones only decay it
+	time.Sleep(10 * time.Millisecond)
+	ewma.Start()
+	ewma.Done(100, true)
+	latency, _ := ewma.GetLatency()
+	if latency <= 100 || latency >= 500 {
+		t.Fatalf("Expected the latency to decay towards 100, but got %.2f", latency)
+	}
+}
+
+func TestLatencyEWMAScore(t *testing.T) {
+	healthy := NewLatencyEWMA("test", "healthy", 1000)
+	failing := NewLatencyEWMA("test", "failing", 1000)
+	if healthy.GetLatencyScore() != 0 {
+		t.Fatalf("Expected a backend without samples to score 0, but got %.2f", healthy.GetLatencyScore())
+	}
+
+	healthy.Start()
+	healthy.Done(100, true)
+	failing.Start()
+	failing.Done(100, false)
+	if failing.GetLatencyScore() <= healthy.GetLatencyScore() {
+		t.Errorf("Expected errors to make the score worse, but got %.2f <= %.2f", failing.GetLatencyScore(), healthy.GetLatencyScore())
+	}
+
+	// Requests in flight make the score worse too
+	before := healthy.GetLatencyScore()
+	healthy.Start()
+	if healthy.GetLatencyScore() <= before {
+		t.Errorf("Expected requests in flight to make the score worse, but got %.2f <= %.2f", healthy.GetLatencyScore(), before)
+	}
+	healthy.Cancel()
+	if healthy.GetLatencyScore() > before {
+		t.Errorf("Expected the score to go back to %.2f, but got %.2f", before, healthy.GetLatencyScore())
+	}
+}
+
+func TestLatencyEWMARecovers(t *testing.T) {
+	fast := &UpstreamBackendImpl{backendName: "fast", ewma: NewLatencyEWMA("test", "fast", 10)}
+	spiked := &UpstreamBackendImpl{backendName: "spiked", ewma: NewLatencyEWMA("test", "spiked", 10)}
+	fast.ewma.Start()
+	fast.ewma.Done(10, true)
+	spiked.ewma.Start()
+	spiked.ewma.Done(5000, true)
+
+	// The spike decays even though there are no more samples, so
+	// the backend gets traffic again
+	time.Sleep(100 * time.Millisecond)
+	fast.ewma.Start()
+	fast.ewma.Done(10, true)
+	if spiked.GetLatencyScore() >= fast.GetLatencyScore() {
+		t.Fatalf("Expected the spike to have decayed below %.2f, but got %.2f", fast.GetLatencyScore(), spiked.GetLatencyScore())
+	}
+	rng := rand.New(rand.NewSource(1))
+	if choice := Choose("least_latency", []HasCDF{fast, spiked}, rng); choice != spiked {
+		t.Errorf("Expected the backend to recover from its spike, but got %s", choice.(*UpstreamBackendImpl).GetName())
+	}
+}
+
+func TestChooseLeastLatency(t *testing.T) {
+	fast := &UpstreamBackendImpl{backendName: "fast", ewma: NewLatencyEWMA("test", "fast", 1000)}
+	slow := &UpstreamBackendImpl{backendName: "slow", ewma: NewLatencyEWMA("test", "slow", 1000)}
+	fast.ewma.Start()
+	fast.ewma.Done(10, true)
+	slow.ewma.Start()
+	slow.ewma.Done(1000, true)
+
+	rng := rand.New(rand.NewSource(1))
+	items := []HasCDF{slow, fast}
+	for i := 0; i < 100; i++ {
+		if choice := Choose("least_latency", items, rng); choice != fast {
+			t.Fatalf("Expected the fast backend, but got %s", choice.(*UpstreamBackendImpl).GetName())
+		}
+	}
+
+	// With more than two backends, the slowest one never wins, but
+	// the others share the load
+	medium := &UpstreamBackendImpl{backendName: "medium", ewma: NewLatencyEWMA("test", "medium", 1000)}
+	medium.ewma.Start()
+	medium.ewma.Done(100, true)
+	items = append(items, medium)
+	chosen := make(map[HasCDF]int)
+	for i := 0; i < 1000; i++ {
+		chosen[Choose("least_latency", items, rng)]++
+	}
+	if chosen[slow] != 0 {
+		t.Errorf("Expected the slow backend never to be chosen, but it was chosen %d times", chosen[slow])
+	}
+	if chosen[medium] == 0 || chosen[fast] <= chosen[medium] {
+		t.Errorf("Expected the fast backend to be preferred, but got fast=%d, medium=%d", chosen[fast], chosen[medium])
+	}
+}
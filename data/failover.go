@@ -0,0 +1,166 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamFailovers = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_failovers",
+		Help:      "The number of requests that failed over to another backend, keyed by upstream, the backend that failed and why",
+	},
+	[]string{"upstream", "backend", "reason"},
+)
+
+const (
+	DEFAULT_FAILOVER_MAX_ATTEMPTS = 1
+)
+
+var defaultFailoverStatusCodes = []int{
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// FailoverImpl is the failover config of an upstream.
+//
+// If a backend fails, then the request is sent to another backend
+// (chosen by the rule of the upstream)
+type FailoverImpl struct {
+	// The maximum number of other backends we try
+	MaxAttempts int `yaml:"max_attempts" json:"max_attempts"`
+
+	// The response codes that we fail over on (the default is 502,
+	// 503 and 504)
+	StatusCodes []int `yaml:"status_codes" json:"status_codes"`
+
+	// The classes of error that we fail over on.  These are the
+	// classes from the ErrorClassifier as well as 'circuitbreaker',
+	// 'backoff', 'attenuator', 'transform' and 'schema'.  If this is
+	// empty, we fail over on any error
+	ErrorClasses []string `yaml:"error_classes" json:"error_classes"`
+
+	// Whether or not non-idempotent requests (e.g. POST) can fail over.
+	// They could end up being processed more than once
+	NonIdempotent bool `yaml:"non_idempotent" json:"non_idempotent"`
+
+	// These are backpatched
+	statusCodes  map[int]bool
+	errorClasses map[string]bool
+}
+
+func (f *FailoverImpl) Backpatch(upstreamName string) error {
+	if f.MaxAttempts < 0 {
+		return fmt.Errorf("%s: failover max_attempts cannot be %d", upstreamName, f.MaxAttempts)
+	}
+	if f.MaxAttempts == 0 {
+		f.MaxAttempts = DEFAULT_FAILOVER_MAX_ATTEMPTS
+	}
+	if len(f.StatusCodes) == 0 {
+		f.StatusCodes = defaultFailoverStatusCodes
+	}
+	f.statusCodes = make(map[int]bool)
+	for _, code := range f.StatusCodes {
+		f.statusCodes[code] = true
+	}
+	f.errorClasses = make(map[string]bool)
+	for _, class := range f.ErrorClasses {
+		f.errorClasses[strings.ToLower(class)] = true
+	}
+
+	return nil
+}
+
+func (f *FailoverImpl) CanFailover(method string) bool {
+	return f.NonIdempotent || IsIdempotent(method)
+}
+
+// ShouldFailover returns whether or not the outcome of a request is
+// worth trying on another backend (and if so, why)
+func (f *FailoverImpl) ShouldFailover(resp *http.Response, err error) (bool, string) {
+	if err != nil {
+		class := ""
+		if backendError, isBackendError := err.(*BackendError); isBackendError {
+			class = backendError.Class
+		}
+		if len(f.errorClasses) == 0 || f.errorClasses[strings.ToLower(class)] {
+			if class == "" {
+				class = "error"
+			}
+			return true, class
+		}
+		return false, ""
+	}
+
+	if f.statusCodes[resp.StatusCode] {
+		return true, fmt.Sprint(resp.StatusCode)
+	}
+	return false, ""
+}
+
+// handleFailover sends the request to the backend and, if it fails,
+// to other backends until one of them succeeds or we run out of
+// attempts
+func (u *UpstreamImpl) handleFailover(c *gin.Context, backend UpstreamBackend, hashKey string) {
+	body, err := ReadBody(c.Request)
+	if err != nil {
+		err = fmt.Errorf("Handle(%s): %s", c.Request.URL, err.Error())
+		log.Println(err)
+		WriteResponse(c, nil, NewBackendError(http.StatusBadRequest, "body", err))
+		return
+	}
+
+	tried := make([]UpstreamBackend, 0, u.Failover.MaxAttempts+1)
+	triedNames := make([]string, 0, u.Failover.MaxAttempts+1)
+	var resp *http.Response
+	for {
+		tried = append(tried, backend)
+		triedNames = append(triedNames, backend.GetName())
+
+		req := CloneRequest(c.Request, body)
+		req.Header.Set(HEADER_X_FAULTMONKEY_BACKEND, backend.GetName())
+		resp, err = backend.Do(c.Request.Context(), req)
+		if c.Request.Context().Err() != nil {
+			// The caller has gone away
+			break
+		}
+		shouldFailover, reason := u.Failover.ShouldFailover(resp, err)
+		if !shouldFailover || len(tried) > u.Failover.MaxAttempts {
+			break
+		}
+
+		next := u.chooseBackendExcluding(hashKey, tried...)
+		if next == nil {
+			break
+		}
+		log.Printf("%s: %s failed (%s), failing over to %s", u.GetName(), backend.GetName(), reason, next.GetName())
+		upstreamFailovers.WithLabelValues(u.GetName(), backend.GetName(), reason).Inc()
+		upstreamRequests.WithLabelValues(
+			c.Request.Header.Get(HEADER_X_FAULTMONKEY_TAG),
+			u.GetName(),
+			next.GetName(),
+			c.Request.Method,
+		).Inc()
+		if resp != nil {
+			resp.Body.Close()
+		}
+		backend = next
+	}
+
+	// Make sure the caller knows which backend actually served the
+	// request, and which ones were tried
+	c.Writer.Header().Set(HEADER_X_FAULTMONKEY_BACKENDS_TRIED, strings.Join(triedNames, ","))
+	if err == nil {
+		resp.Header.Del(HEADER_X_FAULTMONKEY_BACKEND)
+	}
+	c.Writer.Header().Set(HEADER_X_FAULTMONKEY_BACKEND, backend.GetName())
+	WriteResponse(c, resp, err)
+}
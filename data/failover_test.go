@@ -0,0 +1,128 @@
+package data
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newFailoverTestUpstream(t *testing.T, failover *FailoverImpl, failingCode int) *UpstreamImpl {
+	failing := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(failingCode)
+	})
+	working := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// Echo the body, so we know it was replayed
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	return newTestUpstream(t, "failover", &UpstreamImpl{
+		Rule:     "weighted",
+		Failover: failover,
+		Backends: map[string]*UpstreamBackendImpl{
+			// The failing backend is always chosen first
+			"failing": {
+				Url:    failing,
+				Weight: 1,
+			},
+			"working": {
+				Url:    working,
+				Weight: 0,
+			},
+		},
+	})
+}
+
+func doFailoverTestRequest(upstream *UpstreamImpl, method string, body string) *httptest.ResponseRecorder {
+	return doTestRequest(upstream, method, "/api/v1/broker/failover", body)
+}
+
+func TestFailover(t *testing.T) {
+	upstream := newFailoverTestUpstream(t, &FailoverImpl{}, http.StatusServiceUnavailable)
+
+	w := doFailoverTestRequest(upstream, http.MethodPut, "wibble")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, but got %d", w.Code)
+	}
+	if w.Body.String() != "wibble" {
+		t.Errorf("Expected the body to be replayed, but got '%s'", w.Body.String())
+	}
+	if backend := w.Header().Values(HEADER_X_FAULTMONKEY_BACKEND); len(backend) != 1 || backend[0] != "working" {
+		t.Errorf("Expected %s to be 'working', but got %v", HEADER_X_FAULTMONKEY_BACKEND, backend)
+	}
+	if tried := w.Header().Get(HEADER_X_FAULTMONKEY_BACKENDS_TRIED); tried != "failing,working" {
+		t.Errorf("Expected %s to be 'failing,working', but got '%s'", HEADER_X_FAULTMONKEY_BACKENDS_TRIED, tried)
+	}
+}
+
+func TestFailoverWhenHedged(t *testing.T) {
+	upstream := newFailoverTestUpstream(t, &FailoverImpl{}, http.StatusServiceUnavailable)
+	upstream.Hedge = &HedgeImpl{
+		DelayMillis: 1000,
+	}
+	if err := upstream.Backpatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The 503 comes back before the hedge delay, and fails over
+	// rather than winning
+	w := doFailoverTestRequest(upstream, http.MethodPut, "wibble")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, but got %d", w.Code)
+	}
+	if w.Body.String() != "wibble" {
+		t.Errorf("Expected the body to be replayed, but got '%s'", w.Body.String())
+	}
+	if backend := w.Header().Values(HEADER_X_FAULTMONKEY_BACKEND); len(backend) != 1 || backend[0] != "working" {
+		t.Errorf("Expected %s to be 'working', but got %v", HEADER_X_FAULTMONKEY_BACKEND, backend)
+	}
+	if tried := w.Header().Get(HEADER_X_FAULTMONKEY_BACKENDS_TRIED); tried != "failing,working" {
+		t.Errorf("Expected %s to be 'failing,working', but got '%s'", HEADER_X_FAULTMONKEY_BACKENDS_TRIED, tried)
+	}
+	if hedge := w.Header().Get(HEADER_X_FAULTMONKEY_HEDGE); hedge != "" {
+		t.Errorf("Expected no hedge, but got '%s'", hedge)
+	}
+}
+
+func TestNoFailoverForIneligibleStatus(t *testing.T) {
+	upstream := newFailoverTestUpstream(t, &FailoverImpl{}, http.StatusInternalServerError)
+
+	w := doFailoverTestRequest(upstream, http.MethodGet, "")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected HTTP 500, but got %d", w.Code)
+	}
+	if tried := w.Header().Get(HEADER_X_FAULTMONKEY_BACKENDS_TRIED); tried != "failing" {
+		t.Errorf("Expected %s to be 'failing', but got '%s'", HEADER_X_FAULTMONKEY_BACKENDS_TRIED, tried)
+	}
+}
+
+func TestNoFailoverForNonIdempotent(t *testing.T) {
+	upstream := newFailoverTestUpstream(t, &FailoverImpl{}, http.StatusServiceUnavailable)
+
+	w := doFailoverTestRequest(upstream, http.MethodPost, "wibble")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected HTTP 503, but got %d", w.Code)
+	}
+
+	upstream = newFailoverTestUpstream(t, &FailoverImpl{NonIdempotent: true}, http.StatusServiceUnavailable)
+	w = doFailoverTestRequest(upstream, http.MethodPost, "wibble")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, but got %d", w.Code)
+	}
+}
+
+func TestShouldFailoverErrorClasses(t *testing.T) {
+	failover := &FailoverImpl{
+		ErrorClasses: []string{"dns"},
+	}
+	if err := failover.Backpatch("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if should, _ := failover.ShouldFailover(nil, NewBackendError(http.StatusBadGateway, "dns", io.EOF)); !should {
+		t.Error("Expected to fail over on a dns error")
+	}
+	if should, _ := failover.ShouldFailover(nil, NewBackendError(http.StatusBadGateway, "connreset", io.EOF)); should {
+		t.Error("Expected not to fail over on a connreset error")
+	}
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var faultInjections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "fault_injections",
+		Help:      "The number of proxied requests that were answered by a pathology instead, keyed by what injected it (upstream, upstream.backend or gateway.domain), profile and pathology",
+	},
+	[]string{"name", "profile", "pathology"},
+)
+
+const (
+	// The proportion of the requests that get the pathology when
+	// pathology_percent isn't set
+	DEFAULT_PATHOLOGY_PERCENT = 100
+)
+
+// FaultInjection applies a pathology profile to real traffic (for an
+// upstream, a backend or a gateway domain), e.g.
+//
+//	pathology: flaky
+//	pathology_percent: 5
+//
+// A sample of the requests (pathology_percent, 100 if it isn't set)
+// get the response, delay or error of a pathology chosen from the
+// profile instead of going anywhere.  The rest are sent on as normal.
+//
+// Responses from a pathology have an X-Faultmonkey-Pathology header.
+type FaultInjection struct {
+	name    string
+	profile PathologyProfile
+	percent float64
+	rng     *rand.Rand
+}
+
+// NewFaultInjection looks up the pathology profile (in the registry
+// for this generation of the config).  There is no fault injection
+// (nil) if there is no profile
+func NewFaultInjection(name string, profileName string, percent float64, registry ProfileRegistry) (*FaultInjection, error) {
+	if profileName == "" {
+		if percent != 0 {
+			return nil, fmt.Errorf("Backpatch(%s): pathology_percent needs a pathology", name)
+		}
+		return nil, nil
+	}
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("Backpatch(%s): pathology_percent must be between 0 and 100, but is %v", name, percent)
+	}
+	if percent == 0 {
+		percent = DEFAULT_PATHOLOGY_PERCENT
+	}
+	profile := registry.GetPathologyProfile(profileName)
+	if profile == nil {
+		return nil, fmt.Errorf("Backpatch(%s): no such pathology profile '%s'", name, profileName)
+	}
+
+	return &FaultInjection{
+		name:    name,
+		profile: profile,
+		percent: percent,
+		rng:     NewLockedRand(time.Now().UnixNano()),
+	}, nil
+}
+
+// Do answers a sample of the requests with a pathology from the
+// profile.  If the request isn't chosen, then injected is false and
+// the caller carries on as normal.
+//
+// If there is an error, then it is a *BackendError
+func (f *FaultInjection) Do(ctx context.Context, req *http.Request) (resp *http.Response, injected bool, err error) {
+	if f == nil || f.rng.Float64()*100 >= f.percent {
+		return nil, false, nil
+	}
+	pathology := f.profile.GetPathology()
+	if pathology == nil {
+		log.Printf("%s: pathology profile '%s' is empty", f.name, f.profile.GetName())
+		return nil, false, nil
+	}
+	faultInjections.WithLabelValues(f.name, f.profile.GetName(), pathology.GetName()).Inc()
+
+	resp, err = pathology.Do(ctx, req)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if ctx.Err() != nil {
+			statusCode = http.StatusGatewayTimeout
+		}
+		err = fmt.Errorf("%s: %s", f.name, err.Error())
+		log.Println(err)
+		return nil, true, NewBackendError(statusCode, "pathology", err)
+	}
+	resp.Header.Set(HEADER_X_FAULTMONKEY_PATHOLOGY, fmt.Sprintf("%s.%s", pathology.GetProfileName(), pathology.GetName()))
+
+	return resp, true, nil
+}
+
+// Handle writes the response from a pathology to a sample of the
+// requests, and returns true if it did
+func (f *FaultInjection) Handle(c *gin.Context) bool {
+	resp, injected, err := f.Do(c.Request.Context(), c.Request)
+	if !injected {
+		return false
+	}
+	WriteResponse(c, resp, err)
+	return true
+}
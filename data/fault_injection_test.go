@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const faultInjectionTestConfig = `
+config:
+  pathologies:
+    broken:
+      unavailable:
+        weight: 1
+        responses:
+          503:
+            weight: 1
+            body: broken
+    slow:
+      timeout:
+        weight: 1
+        duration: 10s
+        responses:
+          200:
+            weight: 1
+  broker:
+    upstream:
+      search:
+        pathology: %s
+        rule: random
+        backends:
+          bing:
+            url: %s
+            weight: 1
+            pathology: %s
+  gateway:
+    domains:
+      google.com:
+        pathology: broken
+`
+
+func newFaultInjectionTestConfig(t *testing.T, upstreamPathology string, backendPathology string) *AppConfig {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "bing")
+	}))
+	t.Cleanup(server.Close)
+
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	config := fmt.Sprintf(faultInjectionTestConfig, upstreamPathology, server.URL, backendPathology)
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	appConfig, err := BuildConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return appConfig
+}
+
+func TestFaultInjectionUpstream(t *testing.T) {
+	appConfig := newFaultInjectionTestConfig(t, "broken", "")
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/search", nil)
+	appConfig.Config.Broker.UpstreamFromConfig["search"].Handle(c)
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "broken" {
+		t.Errorf("Expected the pathology's response, but got %d %s", w.Code, w.Body.String())
+	}
+	if pathology := w.Header().Get(HEADER_X_FAULTMONKEY_PATHOLOGY); pathology != "broken.unavailable" {
+		t.Errorf("Expected the response to say it came from broken.unavailable, but got '%s'", pathology)
+	}
+}
+
+func TestFaultInjectionBackend(t *testing.T) {
+	appConfig := newFaultInjectionTestConfig(t, "", "broken")
+	bing := appConfig.Config.Broker.UpstreamFromConfig["search"].Backends["bing"]
+	resp, err := bing.Do(context.Background(), httptest.NewRequest(http.MethodGet, "/search", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "broken" {
+		t.Errorf("Expected the pathology's response, but got %d %s", resp.StatusCode, string(body))
+	}
+	if _, samples := bing.GetErrorRate(); bing.GetInflight() != 0 || samples != 0 {
+		t.Error("Expected the pathology not to count against the backend")
+	}
+
+	// The delay gives up with the caller
+	appConfig = newFaultInjectionTestConfig(t, "", "slow")
+	bing = appConfig.Config.Broker.UpstreamFromConfig["search"].Backends["bing"]
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = bing.Do(ctx, httptest.NewRequest(http.MethodGet, "/search", nil))
+	if backendError, isBackendError := err.(*BackendError); !isBackendError || backendError.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected a 504, but got %v", err)
+	}
+}
+
+func TestFaultInjectionPercent(t *testing.T) {
+	registry := NewProfileRegistry()
+	registry.Register(&PathologyProfileImpl{name: "broken"})
+
+	faultInjection, err := NewFaultInjection("search", "broken", 0.0001, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faultInjection.percent = 0
+	if _, injected, _ := faultInjection.Do(context.Background(), httptest.NewRequest(http.MethodGet, "/", nil)); injected {
+		t.Error("Expected none of the requests to get the pathology")
+	}
+
+	if faultInjection, _ := NewFaultInjection("search", "", 0, registry); faultInjection != nil {
+		t.Error("Expected no fault injection without a pathology")
+	}
+	if _, err := NewFaultInjection("search", "wibble", 0, registry); err == nil {
+		t.Error("Expected an error for an unknown pathology profile")
+	}
+	if _, err := NewFaultInjection("search", "broken", 101, registry); err == nil {
+		t.Error("Expected an error for a percent over 100")
+	}
+	if _, err := NewFaultInjection("search", "", 10, registry); err == nil {
+		t.Error("Expected an error for a percent without a pathology")
+	}
+}
+
+func TestFaultInjectionGateway(t *testing.T) {
+	gateway := newFaultInjectionTestConfig(t, "", "").Config.GetGateway()
+	if gateway.GetFaultInjection("www.google.com:443") == nil {
+		t.Error("Expected www.google.com to get the google.com pathology")
+	}
+	if gateway.GetFaultInjection("bing.com") != nil {
+		t.Error("Expected bing.com not to get a pathology")
+	}
+}
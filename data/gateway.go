@@ -17,6 +17,24 @@ import (
 //	bool	true == retry (only applies if success is false)
 type SuccessFunc func(resp *http.Response) (bool, bool)
 
+// DefaultSuccess is used when a client has not been given any
+// SuccessFunc of its own.
+//
+// Anything below 400 is a success.  Timeouts, throttling and
+// server errors are worth retrying, everything else is not.
+func DefaultSuccess(resp *http.Response) (bool, bool) {
+	if resp.StatusCode < 400 {
+		return true, false
+	}
+
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false, true
+	}
+
+	return false, resp.StatusCode >= 500
+}
+
 type GatewayBase struct {
 	// For tracing
 	Id string `json:"id"`
@@ -36,6 +54,9 @@ type GatewayBase struct {
 
 	// Request body (if any)
 	Body []byte `json:"body,omitempty"`
+
+	// If this is set, then only the start of the body was recorded
+	BodyTruncated bool `json:"body_truncated,omitempty"`
 }
 
 func (g *GatewayBase) GetUrl() *url.URL {
@@ -115,7 +136,19 @@ type GatewayResponse struct {
 	Error          error  `json:"error,omitempty"`
 	Backend        string `json:"backend,omitempty"`
 	Upstream       string `json:"upstream,omitempty"`
-	resp           *http.Response
+
+	// When the recorder streams the body to a file of its own
+	// (alongside this one) rather than holding on to it.  BodyBytes
+	// is how much of the body was recorded, wherever it went
+	BodyFile  string `json:"body_file,omitempty"`
+	BodyBytes int64  `json:"body_bytes,omitempty"`
+
+	// The number of attempts it took to get this response, and
+	// the round-trip time (in millis) of each of them
+	Attempts              int     `json:"attempts,omitempty"`
+	AttemptDurationMillis []int64 `json:"attempt_duration_millis,omitempty"`
+
+	resp *http.Response
 }
 
 func (r *GatewayResponse) GetResponse() *http.Response {
@@ -0,0 +1,151 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// GatewayImpl is the gateway section of the config
+type GatewayImpl struct {
+	Listen string        `yaml:"listen" json:"listen"`
+	Record *RecorderImpl `yaml:"record,omitempty" json:"record,omitempty"`
+
+	// The attenuator used for any domain that does not have one
+	// of its own
+	Attenuator string `yaml:"attenuator,omitempty" json:"attenuator,omitempty"`
+
+	// Per-domain settings.  A domain also applies to its subdomains,
+	// so 'google.com' covers 'www.google.com'
+	Domains map[string]*GatewayDomain `yaml:"domains,omitempty" json:"domains,omitempty"`
+
+	// The attenuators and pathology profiles come from here.  These
+	// are backpatched (the live registries if they aren't set)
+	throttleRegistry ThrottleRegistry
+	profileRegistry  ProfileRegistry
+}
+
+type GatewayDomain struct {
+	Attenuator string `yaml:"attenuator,omitempty" json:"attenuator,omitempty"`
+
+	// A sample of the requests to the domain (pathology_percent) get
+	// the pathology instead.  See FaultInjection
+	Pathology        string  `yaml:"pathology,omitempty" json:"pathology,omitempty"`
+	PathologyPercent float64 `yaml:"pathology_percent,omitempty" json:"pathology_percent,omitempty"`
+
+	// This is backpatched
+	faultInjection *FaultInjection
+}
+
+func (g *GatewayImpl) Backpatch() error {
+	if g == nil {
+		return nil
+	}
+
+	// Make sure that the attenuators exist
+	for domain, settings := range g.Domains {
+		if settings == nil {
+			continue
+		}
+		if _, err := g.getThrottleRegistry().ResolveThrottle(settings.Attenuator, g.Attenuator); err != nil {
+			return fmt.Errorf("Backpatch(gateway.domains.%s): %s", domain, err.Error())
+		}
+		faultInjection, err := NewFaultInjection("gateway.domains."+domain, settings.Pathology, settings.PathologyPercent, g.getProfileRegistry())
+		if err != nil {
+			return err
+		}
+		settings.faultInjection = faultInjection
+	}
+	if _, err := g.getThrottleRegistry().ResolveThrottle(g.Attenuator); err != nil {
+		return fmt.Errorf("Backpatch(gateway): %s", err.Error())
+	}
+
+	return nil
+}
+
+// GetThrottle returns the attenuator for the host, falling back to
+// the gateway attenuator and then the default attenuator
+func (g *GatewayImpl) GetThrottle(host string) Throttle {
+	if g == nil {
+		throttle, _ := GetThrottleRegistry().ResolveThrottle()
+		return throttle
+	}
+
+	throttle, err := g.getThrottleRegistry().ResolveThrottle(g.getDomainAttenuator(host), g.Attenuator)
+	if err != nil {
+		log.Printf("GetThrottle(%s): %s", host, err.Error())
+	}
+	return throttle
+}
+
+// GetFaultInjection returns the fault injection for the host (nil
+// if there isn't one)
+func (g *GatewayImpl) GetFaultInjection(host string) *FaultInjection {
+	if g == nil {
+		return nil
+	}
+
+	settings := g.getDomain(host, func(settings *GatewayDomain) bool {
+		return settings.faultInjection != nil
+	})
+	if settings == nil {
+		return nil
+	}
+	return settings.faultInjection
+}
+
+// getThrottleRegistry returns the registry for this generation of
+// the config
+func (g *GatewayImpl) getThrottleRegistry() ThrottleRegistry {
+	if g == nil || g.throttleRegistry == nil {
+		return GetThrottleRegistry()
+	}
+	return g.throttleRegistry
+}
+
+// getProfileRegistry returns the pathology profiles for this
+// generation of the config
+func (g *GatewayImpl) getProfileRegistry() ProfileRegistry {
+	if g == nil || g.profileRegistry == nil {
+		return GetProfileRegistry()
+	}
+	return g.profileRegistry
+}
+
+// getDomainAttenuator finds the attenuator for the most specific
+// domain that matches the host
+func (g *GatewayImpl) getDomainAttenuator(host string) string {
+	settings := g.getDomain(host, func(settings *GatewayDomain) bool {
+		return settings.Attenuator != ""
+	})
+	if settings == nil {
+		return ""
+	}
+	return settings.Attenuator
+}
+
+// getDomain finds the settings for the most specific domain that
+// matches the host and has what we are looking for
+func (g *GatewayImpl) getDomain(host string, has func(settings *GatewayDomain) bool) *GatewayDomain {
+	if len(g.Domains) == 0 {
+		return nil
+	}
+
+	domain := strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		domain = h
+	}
+	for domain != "" {
+		if settings, exists := g.Domains[domain]; exists && settings != nil && has(settings) {
+			return settings
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+
+	return nil
+}
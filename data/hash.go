@@ -0,0 +1,114 @@
+package data
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HASH_KEY_CUSTOMER  = "customer"
+	HASH_KEY_CLIENT_IP = "client_ip"
+	HASH_KEY_HEADER    = "header:"
+	HASH_KEY_QUERY     = "query:"
+)
+
+// HasName is used by the hash rule to tell things apart
+type HasName interface {
+	GetName() string
+}
+
+// ChooseHashed uses (weighted) rendezvous hashing to choose an item
+// for the key.
+//
+// The same key always gets the same item and, when an item is added,
+// removed or becomes unavailable, only the keys of that item move
+func ChooseHashed(key string, items []HasCDF) HasCDF {
+	if len(items) == 0 {
+		return nil
+	}
+	items = filterAvailable(items)
+	if len(items) == 0 {
+		return nil
+	}
+
+	// If nothing has a weight, then everything is equal
+	totalWeight := 0
+	for _, item := range items {
+		totalWeight += item.GetWeight()
+	}
+
+	var choice HasCDF
+	bestScore := math.Inf(-1)
+	for _, item := range items {
+		weight := float64(item.GetWeight())
+		if totalWeight <= 0 {
+			weight = 1
+		}
+		if weight <= 0 {
+			continue
+		}
+		name := ""
+		if n, hasName := item.(HasName); hasName {
+			name = n.GetName()
+		}
+
+		// A uniformly distributed number in (0, 1) for this key
+		// and item ...
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(name))
+		u := (float64(h.Sum64()>>11) + 0.5) / float64(uint64(1)<<53)
+
+		// ... which is scaled by the weight
+		score := -weight / math.Log(u)
+		if score > bestScore {
+			bestScore = score
+			choice = item
+		}
+	}
+
+	return choice
+}
+
+// validateHashKey makes sure that the hash_key of an upstream is
+// something we understand
+func validateHashKey(upstreamName string, hashKey string) error {
+	switch {
+	case hashKey == "", hashKey == HASH_KEY_CUSTOMER, hashKey == HASH_KEY_CLIENT_IP:
+		return nil
+
+	case strings.HasPrefix(hashKey, HASH_KEY_HEADER) && len(hashKey) > len(HASH_KEY_HEADER):
+		return nil
+
+	case strings.HasPrefix(hashKey, HASH_KEY_QUERY) && len(hashKey) > len(HASH_KEY_QUERY):
+		return nil
+	}
+
+	return fmt.Errorf("%s: hash_key must be '%s', '%s', '%s<name>' or '%s<name>', but is '%s'", upstreamName, HASH_KEY_CUSTOMER, HASH_KEY_CLIENT_IP, HASH_KEY_HEADER, HASH_KEY_QUERY, hashKey)
+}
+
+// getHashKey extracts the key used by the hash rule from the request
+func (u *UpstreamImpl) getHashKey(c *gin.Context) string {
+	if u.Rule != "hash" {
+		return ""
+	}
+
+	switch {
+	case u.HashKey == HASH_KEY_CLIENT_IP:
+		return c.ClientIP()
+
+	case strings.HasPrefix(u.HashKey, HASH_KEY_HEADER):
+		return c.Request.Header.Get(u.HashKey[len(HASH_KEY_HEADER):])
+
+	case strings.HasPrefix(u.HashKey, HASH_KEY_QUERY):
+		return c.Request.URL.Query().Get(u.HashKey[len(HASH_KEY_QUERY):])
+
+	default:
+		return c.Request.Header.Get(HEADER_X_FAULTMONKEY_API_CUSTOMER)
+	}
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newHashTestBackends(weights map[string]int) []HasCDF {
+	items := make([]HasCDF, 0, len(weights))
+	for name, weight := range weights {
+		items = append(items, &UpstreamBackendImpl{backendName: name, Weight: weight})
+	}
+	return items
+}
+
+func TestChooseHashedIsSticky(t *testing.T) {
+	items := newHashTestBackends(map[string]int{"a": 1, "b": 1, "c": 1})
+	rng := rand.New(rand.NewSource(1))
+
+	// Without a key, we still get a backend
+	if choice := Choose("hash", items, rng); choice == nil {
+		t.Fatal("Expected a backend without a hash key")
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("customer-%d", i)
+		choice := ChooseWithKey("hash", key, items, rng)
+		for j := 0; j < 10; j++ {
+			if again := ChooseWithKey("hash", key, items, rng); again != choice {
+				t.Fatalf("Expected '%s' to stick to the same backend", key)
+			}
+		}
+	}
+}
+
+func TestChooseHashedHonoursWeights(t *testing.T) {
+	items := newHashTestBackends(map[string]int{"heavy": 3, "light": 1, "none": 0})
+	chosen := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		chosen[ChooseHashed(fmt.Sprintf("customer-%d", i), items).(*UpstreamBackendImpl).GetName()]++
+	}
+	if chosen["none"] != 0 {
+		t.Errorf("Expected a backend with no weight never to be chosen, but it was chosen %d times", chosen["none"])
+	}
+	ratio := float64(chosen["heavy"]) / float64(chosen["light"])
+	if ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("Expected the heavy backend to get 3x the keys, but got heavy=%d, light=%d", chosen["heavy"], chosen["light"])
+	}
+}
+
+func TestChooseHashedMovesFewKeys(t *testing.T) {
+	items := newHashTestBackends(map[string]int{"a": 1, "b": 1, "c": 1, "d": 1})
+	before := make(map[string]HasCDF)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("customer-%d", i)
+		before[key] = ChooseHashed(key, items)
+	}
+
+	// Only the keys of an unhealthy backend move ...
+	unhealthy := items[0].(*UpstreamBackendImpl)
+	unhealthy.SetState(UNHEALTHY)
+	for key, choice := range before {
+		after := ChooseHashed(key, items)
+		if after == unhealthy {
+			t.Fatalf("Expected '%s' to move off the unhealthy backend", key)
+		}
+		if choice != unhealthy && after != choice {
+			t.Fatalf("Expected '%s' to stay on '%s', but it moved to '%s'", key, choice.(*UpstreamBackendImpl).GetName(), after.(*UpstreamBackendImpl).GetName())
+		}
+	}
+	unhealthy.SetState(HEALTHY)
+
+	// ... and adding a backend only takes keys from the others
+	added := &UpstreamBackendImpl{backendName: "e", Weight: 1}
+	items = append(items, added)
+	moved := 0
+	for key, choice := range before {
+		after := ChooseHashed(key, items)
+		if after != choice {
+			if after != added {
+				t.Fatalf("Expected '%s' to stay on '%s' or move to 'e', but it moved to '%s'", key, choice.(*UpstreamBackendImpl).GetName(), after.(*UpstreamBackendImpl).GetName())
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 300 {
+		t.Errorf("Expected about 200 of the keys to move to the new backend, but %d moved", moved)
+	}
+}
+
+func TestUpstreamHashKey(t *testing.T) {
+	upstream := newTestUpstream(t, "hash", &UpstreamImpl{
+		Rule:    "hash",
+		HashKey: "query:account",
+		Backends: map[string]*UpstreamBackendImpl{
+			"a": {Url: "https://a.com", Weight: 1},
+			"b": {Url: "https://b.com", Weight: 1},
+		},
+	})
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/broker/hash?account=12345", nil)
+	if key := upstream.getHashKey(c); key != "12345" {
+		t.Fatalf("Expected the hash key to be '12345', but got '%s'", key)
+	}
+	choice := upstream.ChooseBackend("", "12345")
+	for i := 0; i < 10; i++ {
+		if again := upstream.ChooseBackend("", "12345"); again != choice {
+			t.Fatalf("Expected '12345' to stick to '%s', but got '%s'", choice.GetName(), again.GetName())
+		}
+	}
+
+	upstream.HashKey = "cookie:account"
+	if err := upstream.Backpatch(); err == nil {
+		t.Errorf("Expected an error for hash_key '%s'", upstream.HashKey)
+	}
+}
@@ -14,15 +14,50 @@ const (
 	// which handled the request
 	HEADER_X_FAULTMONKEY_BACKEND = "X-Faultmonkey-Backend"
 
+	// This is a response header that indicates the cost (the total of
+	// all of the coins) of the request to the backend that handled it
+	HEADER_X_FAULTMONKEY_BACKEND_COST = "X-Faultmonkey-Backend-Cost"
+
+	// This is a response header that lists the backends that were
+	// tried (in order) when the broker failed over
+	HEADER_X_FAULTMONKEY_BACKENDS_TRIED = "X-Faultmonkey-Backends-Tried"
+
+	// This is a response header that is set when the broker hedged
+	// the request, and names the backend the hedge was sent to
+	HEADER_X_FAULTMONKEY_HEDGE = "X-Faultmonkey-Hedge"
+
 	// This is a response header that indicates the round-trip
 	// latency of the backend that handled the request
 	// (in millis)
 	HEADER_X_FAULTMONKEY_BACKEND_LATENCY = "X-Faultmonkey-Backend-Latency"
 
+	// This is a response header that is set when the response came
+	// from a pathology rather than the real thing, and names it
+	// (profile.pathology)
+	HEADER_X_FAULTMONKEY_PATHOLOGY = "X-Faultmonkey-Pathology"
+
+	// This is a response header that names the asynchronous job a
+	// response belongs to (from a poll, or to a callback)
+	HEADER_X_FAULTMONKEY_JOB = "X-Faultmonkey-Job"
+
+	// This is a header on the callback of an asynchronous job, and is
+	// the status code of the response that the upstream sent back
+	HEADER_X_FAULTMONKEY_JOB_STATUS_CODE = "X-Faultmonkey-Job-Status-Code"
+
+	// Clients can use this request header (or ?callback=) to have the
+	// response to an asynchronous request POSTed to them
+	HEADER_X_FAULTMONKEY_CALLBACK = "X-Faultmonkey-Callback"
+
 	// If clients want to send particular request IDs (e.g.
 	// to help with tracing) then this is the request header
 	// to use.
 	//
 	// If it is provided, then it is also returned in the response
 	HEADER_X_REQUEST_ID = "X-Request-Id"
+
+	// These response headers tell us how long to back off for
+	// when we get a 429 (or 503)
+	HEADER_RETRY_AFTER      = "Retry-After"
+	HEADER_X_BACKOFF_MILLIS = "X-Backoff-Millis"
+	HEADER_RATELIMIT_RESET  = "RateLimit-Reset"
 )
@@ -0,0 +1,223 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	// How often a backend is checked
+	DEFAULT_HEALTHCHECK_INTERVAL_MILLIS = 10000
+
+	// How long a check can take before it counts as a failure
+	DEFAULT_HEALTHCHECK_TIMEOUT_MILLIS = 5000
+
+	// The number of results that are kept for each backend
+	DEFAULT_HEALTHCHECK_HISTORY = 20
+)
+
+// HealthcheckSettingsImpl says how often a backend is checked, and
+// how many checks in a row it takes to change its state, e.g.
+//
+//	healthcheck_settings:
+//	  interval_millis: 5000
+//	  timeout_millis: 1000
+//	  jitter_millis: 500
+//	  healthy_threshold: 2
+//	  unhealthy_threshold: 3
+type HealthcheckSettingsImpl struct {
+	IntervalMillis int64 `yaml:"interval_millis,omitempty" json:"interval_millis,omitempty"`
+	TimeoutMillis  int64 `yaml:"timeout_millis,omitempty" json:"timeout_millis,omitempty"`
+
+	// Up to this much is added to each interval, so that the
+	// backends aren't all checked at the same time
+	JitterMillis int64 `yaml:"jitter_millis,omitempty" json:"jitter_millis,omitempty"`
+
+	// The number of checks in a row that have to pass (rise) before
+	// the backend is HEALTHY, or fail (fall) before it is UNHEALTHY
+	HealthyThreshold   int `yaml:"healthy_threshold,omitempty" json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int `yaml:"unhealthy_threshold,omitempty" json:"unhealthy_threshold,omitempty"`
+
+	// The number of results that are kept (for the admin API)
+	History int `yaml:"history,omitempty" json:"history,omitempty"`
+}
+
+func (h *HealthcheckSettingsImpl) Backpatch(name string) error {
+	if h.IntervalMillis < 0 || h.TimeoutMillis < 0 || h.JitterMillis < 0 {
+		return fmt.Errorf("Backpatch(%s): healthcheck durations can't be negative", name)
+	}
+	if h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 || h.History < 0 {
+		return fmt.Errorf("Backpatch(%s): healthcheck thresholds can't be negative", name)
+	}
+	if h.IntervalMillis == 0 {
+		h.IntervalMillis = DEFAULT_HEALTHCHECK_INTERVAL_MILLIS
+	}
+	if h.TimeoutMillis == 0 {
+		h.TimeoutMillis = DEFAULT_HEALTHCHECK_TIMEOUT_MILLIS
+	}
+	if h.HealthyThreshold == 0 {
+		h.HealthyThreshold = 1
+	}
+	if h.UnhealthyThreshold == 0 {
+		h.UnhealthyThreshold = 1
+	}
+	if h.History == 0 {
+		h.History = DEFAULT_HEALTHCHECK_HISTORY
+	}
+	return nil
+}
+
+// nextInterval is how long to wait before the next check
+func (h *HealthcheckSettingsImpl) nextInterval() time.Duration {
+	interval := h.IntervalMillis
+	if h.JitterMillis > 0 {
+		interval += rand.Int63n(h.JitterMillis + 1)
+	}
+	return time.Duration(interval) * time.Millisecond
+}
+
+// HealthcheckResult is one of the results in the history of a
+// backend
+type HealthcheckResult struct {
+	WhenMillis     int64  `json:"timestamp"`
+	DurationMillis int64  `json:"duration_millis"`
+	Error          string `json:"error,omitempty"`
+
+	// The state the healthcheck put the backend in
+	State string `json:"state"`
+}
+
+func (u *UpstreamBackendImpl) SetHealthcheck(healthcheck EVT) {
+	u.healthCheckImpl = healthcheck
+}
+
+func (u *UpstreamBackendImpl) Start() {
+	u.stateMutex.Lock()
+	defer u.stateMutex.Unlock()
+	if u.healthcheckStop != nil {
+		// Already running
+		return
+	}
+	u.healthcheckStop = make(chan interface{})
+	go u.healthcheckWorker(u.healthcheckStop)
+}
+
+// Stop stops the healthcheck (if it is running) without waiting for
+// it to finish
+func (u *UpstreamBackendImpl) Stop() {
+	u.stateMutex.Lock()
+	defer u.stateMutex.Unlock()
+	if u.healthcheckStop != nil {
+		close(u.healthcheckStop)
+		u.healthcheckStop = nil
+	}
+}
+
+// GetHealthcheckHistory returns the most recent healthcheck results
+// (oldest first)
+func (u *UpstreamBackendImpl) GetHealthcheckHistory() []HealthcheckResult {
+	u.stateMutex.RLock()
+	defer u.stateMutex.RUnlock()
+	history := make([]HealthcheckResult, len(u.healthcheckHistory))
+	copy(history, u.healthcheckHistory)
+	return history
+}
+
+func (u *UpstreamBackendImpl) getHealthcheckSettings() *HealthcheckSettingsImpl {
+	u.stateMutex.RLock()
+	defer u.stateMutex.RUnlock()
+	if u.healthcheckSettings == nil {
+		settings := &HealthcheckSettingsImpl{}
+		settings.Backpatch(u.GetName())
+		return settings
+	}
+	return u.healthcheckSettings
+}
+
+func (u *UpstreamBackendImpl) healthcheckWorker(stop chan interface{}) {
+	if u.healthCheckImpl == nil {
+		return
+	}
+	log.Printf("%s: starting healthcheck '%s'", u.GetName(), u.Healthcheck)
+	defer func() {
+		log.Printf("%s: terminating healthcheck '%s'", u.GetName(), u.Healthcheck)
+	}()
+	settings := u.getHealthcheckSettings()
+	for {
+		if !isAdminState(u.getHealthState()) {
+			u.recordHealthcheck(u.runHealthcheck(settings), settings)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(settings.nextInterval()):
+		}
+	}
+}
+
+// runHealthcheck runs the healthcheck, giving up (and failing) if it
+// takes too long
+func (u *UpstreamBackendImpl) runHealthcheck(settings *HealthcheckSettingsImpl) EVTResult {
+	timeout := time.Duration(settings.TimeoutMillis) * time.Millisecond
+	ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
+	defer cancelFunc()
+	if withContext, ok := u.healthCheckImpl.(EVTWithContext); ok {
+		return withContext.RunContext(ctx)
+	}
+
+	// Don't close the channel, the healthcheck may still finish
+	// after we have given up on it
+	resultChan := make(chan EVTResult, 1)
+	go func() {
+		resultChan <- u.healthCheckImpl.Run()
+	}()
+	select {
+	case result := <-resultChan:
+		return result
+	case <-ctx.Done():
+		return NewEVTResult(
+			fmt.Errorf("%s.%s: healthcheck timed out after %dms", u.upstreamName, u.GetName(), settings.TimeoutMillis),
+			settings.TimeoutMillis,
+		)
+	}
+}
+
+// recordHealthcheck counts the passes (or failures) in a row, and
+// changes the state once there have been enough of them
+func (u *UpstreamBackendImpl) recordHealthcheck(result EVTResult, settings *HealthcheckSettingsImpl) {
+	u.stateMutex.Lock()
+	if result.Error() == nil {
+		u.healthcheckPasses++
+		u.healthcheckFailures = 0
+	} else {
+		u.healthcheckPasses = 0
+		u.healthcheckFailures++
+	}
+	if u.healthcheckPasses >= settings.HealthyThreshold {
+		u.healthcheckState = HEALTHY
+	} else if u.healthcheckFailures >= settings.UnhealthyThreshold {
+		u.healthcheckState = UNHEALTHY
+	}
+	state := u.healthcheckState
+
+	entry := HealthcheckResult{
+		WhenMillis:     time.Now().UTC().UnixMilli(),
+		DurationMillis: result.GetDuration(),
+		State:          state.String(),
+	}
+	if result.Error() != nil {
+		entry.Error = result.Error().Error()
+	}
+	u.healthcheckHistory = append(u.healthcheckHistory, entry)
+	if len(u.healthcheckHistory) > settings.History {
+		u.healthcheckHistory = u.healthcheckHistory[len(u.healthcheckHistory)-settings.History:]
+	}
+	u.stateMutex.Unlock()
+
+	if state != UNKNOWN {
+		u.setHealthcheckState(state)
+	}
+}
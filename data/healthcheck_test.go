@@ -0,0 +1,137 @@
+package data
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEVT passes (or fails) when it is told to
+type fakeEVT struct {
+	EVTImpl
+	mutex sync.Mutex
+	fail  bool
+	delay time.Duration
+}
+
+func (e *fakeEVT) GetName() string {
+	return "fake"
+}
+
+func (e *fakeEVT) setFail(fail bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.fail = fail
+}
+
+func (e *fakeEVT) Run() EVTResult {
+	e.mutex.Lock()
+	fail, delay := e.fail, e.delay
+	e.mutex.Unlock()
+	time.Sleep(delay)
+	if fail {
+		return NewEVTResult(fmt.Errorf("fake: failed"), delay.Milliseconds())
+	}
+	return NewEVTResult(nil, delay.Milliseconds())
+}
+
+func newHealthcheckTestBackend(t *testing.T, settings *HealthcheckSettingsImpl, healthcheck EVT) *UpstreamBackendImpl {
+	upstream := newTestUpstream(t, "healthcheck", &UpstreamImpl{
+		Rule:                "weighted",
+		HealthcheckSettings: settings,
+		Backends: map[string]*UpstreamBackendImpl{
+			"backend": {Url: "http://backend", Weight: 1},
+		},
+	})
+	backend := upstream.Backends["backend"]
+	backend.SetHealthcheck(healthcheck)
+	return backend
+}
+
+func waitForState(t *testing.T, backend *UpstreamBackendImpl, state BackendState) {
+	deadline := time.Now().Add(time.Second)
+	for backend.GetState() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s, but got %s", state, backend.GetState())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthcheckThresholds(t *testing.T) {
+	healthcheck := &fakeEVT{}
+	backend := newHealthcheckTestBackend(t, &HealthcheckSettingsImpl{
+		IntervalMillis:     10,
+		HealthyThreshold:   3,
+		UnhealthyThreshold: 2,
+		History:            5,
+	}, healthcheck)
+	backend.Start()
+	defer backend.Stop()
+
+	waitForState(t, backend, HEALTHY)
+	history := backend.GetHealthcheckHistory()
+	if len(history) < 3 || history[0].State != "UNKNOWN" || history[1].State != "UNKNOWN" {
+		t.Errorf("Expected the backend to need 3 passes to become HEALTHY, but got %v", history)
+	}
+
+	healthcheck.setFail(true)
+	waitForState(t, backend, UNHEALTHY)
+	history = backend.GetHealthcheckHistory()
+	if len(history) > 5 {
+		t.Errorf("Expected at most 5 results in the history, but got %d", len(history))
+	}
+	last := history[len(history)-1]
+	if last.Error == "" || last.State != "UNHEALTHY" {
+		t.Errorf("Expected the last result to be a failure, but got %v", last)
+	}
+	if previous := history[len(history)-2]; previous.Error == "" || previous.State != "HEALTHY" {
+		t.Errorf("Expected one failure to leave the backend HEALTHY, but got %v", previous)
+	}
+}
+
+func TestHealthcheckTimeout(t *testing.T) {
+	healthcheck := &fakeEVT{delay: 100 * time.Millisecond}
+	backend := newHealthcheckTestBackend(t, &HealthcheckSettingsImpl{
+		IntervalMillis: 10,
+		TimeoutMillis:  10,
+	}, healthcheck)
+	backend.Start()
+	defer backend.Stop()
+
+	waitForState(t, backend, UNHEALTHY)
+}
+
+func TestHealthcheckStopWithoutHealthcheck(t *testing.T) {
+	backend := newHealthcheckTestBackend(t, nil, nil)
+
+	stopped := make(chan bool)
+	go func() {
+		backend.Stop()
+		backend.Start()
+		backend.Stop()
+		backend.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Stop() not to block when there is no healthcheck")
+	}
+}
+
+func TestHealthcheckSettingsBackpatch(t *testing.T) {
+	settings := &HealthcheckSettingsImpl{}
+	if err := settings.Backpatch("test"); err != nil {
+		t.Fatal(err)
+	}
+	if settings.IntervalMillis != DEFAULT_HEALTHCHECK_INTERVAL_MILLIS || settings.HealthyThreshold != 1 || settings.UnhealthyThreshold != 1 {
+		t.Errorf("Expected the defaults, but got %+v", settings)
+	}
+
+	settings = &HealthcheckSettingsImpl{UnhealthyThreshold: -1}
+	if err := settings.Backpatch("test"); err == nil {
+		t.Error("Expected an error for a negative threshold")
+	}
+}
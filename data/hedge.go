@@ -0,0 +1,282 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamHedges = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_hedges",
+		Help:      "The number of hedged requests sent, keyed by upstream and the backend the hedge was sent to",
+	},
+	[]string{"upstream", "backend"},
+)
+var upstreamHedgeWins = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_hedge_wins",
+		Help:      "The number of hedged requests that answered before the original request, keyed by upstream and backend",
+	},
+	[]string{"upstream", "backend"},
+)
+var upstreamHedgeWastedCost = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_hedge_wasted_cost",
+		Help:      "The cost of the requests that lost the hedge and were cancelled, keyed by upstream, backend and coin",
+	},
+	[]string{"upstream", "backend", "coin"},
+)
+
+const (
+	// How long we wait before hedging if there is no delay_millis
+	DEFAULT_HEDGE_DELAY_MILLIS = 100
+)
+
+// The methods which can safely be sent more than once
+var idempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+// HedgeImpl is the hedging config of an upstream.
+//
+// If the backend has not answered within the delay, then we send the
+// same request to another backend and use whichever answers first
+type HedgeImpl struct {
+	// The fixed delay before we send the hedge
+	DelayMillis int64 `yaml:"delay_millis" json:"delay_millis"`
+
+	// If this is set (e.g. 95) then the delay is this percentile of
+	// the recent latencies of the backend.  We use delay_millis until
+	// we have seen enough requests
+	Percentile float64 `yaml:"percentile" json:"percentile"`
+
+	// The methods that can be hedged (the default is the idempotent ones,
+	// because the request is sent more than once)
+	Methods []string `yaml:"methods" json:"methods"`
+
+	// This is backpatched
+	methods map[string]bool
+}
+
+func (h *HedgeImpl) Backpatch(upstreamName string) error {
+	if h.Percentile < 0 || h.Percentile > 100 {
+		return fmt.Errorf("%s: hedge percentile must be between 0 and 100, but is %.2f", upstreamName, h.Percentile)
+	}
+	if h.DelayMillis <= 0 {
+		h.DelayMillis = DEFAULT_HEDGE_DELAY_MILLIS
+	}
+	if len(h.Methods) == 0 {
+		h.Methods = idempotentMethods
+	}
+	h.methods = make(map[string]bool)
+	for _, method := range h.Methods {
+		h.methods[strings.ToUpper(method)] = true
+	}
+
+	return nil
+}
+
+func (h *HedgeImpl) CanHedge(method string) bool {
+	return h.methods[strings.ToUpper(method)]
+}
+
+// IsIdempotent is true for the methods that can safely be sent more
+// than once
+func IsIdempotent(method string) bool {
+	for _, m := range idempotentMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDelay is how long we wait for the backend before hedging
+func (h *HedgeImpl) GetDelay(backend UpstreamBackend) time.Duration {
+	if h.Percentile > 0 {
+		if millis, ok := backend.GetLatencyPercentile(h.Percentile); ok {
+			return time.Duration(millis) * time.Millisecond
+		}
+	}
+	return time.Duration(h.DelayMillis) * time.Millisecond
+}
+
+type hedgeResult struct {
+	backend    UpstreamBackend
+	resp       *http.Response
+	err        error
+	cancelFunc context.CancelFunc
+	done       bool
+}
+
+// close lets go of a result that we aren't going to use
+func (r *hedgeResult) close() {
+	if r.resp != nil {
+		r.resp.Body.Close()
+	}
+	r.cancelFunc()
+}
+
+// hedgeFailed returns whether or not a result has failed and, if the
+// upstream fails over as well, whether it is worth trying on another
+// backend (and if so, why)
+func (u *UpstreamImpl) hedgeFailed(method string, result *hedgeResult) (bool, string) {
+	if u.Failover != nil && u.Failover.CanFailover(method) {
+		if shouldFailover, reason := u.Failover.ShouldFailover(result.resp, result.err); shouldFailover {
+			return true, reason
+		}
+	}
+	return result.err != nil, ""
+}
+
+// handleHedged sends the request to the primary backend and, if it
+// hasn't answered within the hedge delay, to a second backend.
+//
+// The first successful response wins, and the loser is cancelled.  If
+// the upstream fails over as well, then a failure (including a status
+// code that we fail over on) is sent on to another backend straight
+// away, rather than winning or ending the hedge
+func (u *UpstreamImpl) handleHedged(c *gin.Context, primary UpstreamBackend, hashKey string) {
+	body, err := ReadBody(c.Request)
+	if err != nil {
+		err = fmt.Errorf("Handle(%s): %s", c.Request.URL, err.Error())
+		log.Println(err)
+		WriteResponse(c, nil, NewBackendError(http.StatusBadRequest, "body", err))
+		return
+	}
+
+	results := make(chan *hedgeResult, 2)
+	sent := make([]*hedgeResult, 0, 2)
+	tried := make([]UpstreamBackend, 0, 2)
+	send := func(backend UpstreamBackend) {
+		tried = append(tried, backend)
+		ctx, cancelFunc := context.WithCancel(c.Request.Context())
+		req := CloneRequest(c.Request.WithContext(ctx), body)
+		req.Header.Set(HEADER_X_FAULTMONKEY_BACKEND, backend.GetName())
+		result := &hedgeResult{
+			backend:    backend,
+			cancelFunc: cancelFunc,
+		}
+		sent = append(sent, result)
+		go func() {
+			result.resp, result.err = backend.Do(ctx, req)
+			results <- result
+		}()
+	}
+
+	send(primary)
+	timer := time.NewTimer(u.Hedge.GetDelay(primary))
+	defer timer.Stop()
+
+	var hedge UpstreamBackend
+	var winner *hedgeResult
+	var lastFailure *hedgeResult
+	failovers := 0
+	pending := 1
+	for pending > 0 && winner == nil {
+		select {
+		case <-timer.C:
+			hedge = u.chooseBackendExcluding(hashKey, tried...)
+			if hedge == nil {
+				// There is nothing else to send it to
+				continue
+			}
+			upstreamHedges.WithLabelValues(u.GetName(), hedge.GetName()).Inc()
+			send(hedge)
+			pending++
+
+		case result := <-results:
+			pending--
+			result.done = true
+			failed, reason := u.hedgeFailed(c.Request.Method, result)
+			if !failed {
+				winner = result
+				continue
+			}
+			if lastFailure != nil {
+				lastFailure.close()
+			}
+			lastFailure = result
+			if reason == "" || failovers >= u.Failover.MaxAttempts || c.Request.Context().Err() != nil {
+				continue
+			}
+
+			next := u.chooseBackendExcluding(hashKey, tried...)
+			if next == nil {
+				continue
+			}
+			log.Printf("%s: %s failed (%s), failing over to %s", u.GetName(), result.backend.GetName(), reason, next.GetName())
+			upstreamFailovers.WithLabelValues(u.GetName(), result.backend.GetName(), reason).Inc()
+			upstreamRequests.WithLabelValues(
+				c.Request.Header.Get(HEADER_X_FAULTMONKEY_TAG),
+				u.GetName(),
+				next.GetName(),
+				c.Request.Method,
+			).Inc()
+			failovers++
+			send(next)
+			pending++
+		}
+	}
+
+	if failovers > 0 {
+		triedNames := make([]string, 0, len(tried))
+		for _, backend := range tried {
+			triedNames = append(triedNames, backend.GetName())
+		}
+		c.Writer.Header().Set(HEADER_X_FAULTMONKEY_BACKENDS_TRIED, strings.Join(triedNames, ","))
+	}
+	if winner == nil {
+		// Every backend failed, so the caller gets the last failure
+		defer lastFailure.cancelFunc()
+		WriteResponse(c, lastFailure.resp, lastFailure.err)
+		return
+	}
+	if lastFailure != nil {
+		lastFailure.close()
+	}
+	defer winner.cancelFunc()
+
+	// Cancel whatever is still in flight, it has lost
+	for _, result := range sent {
+		if result.done {
+			continue
+		}
+		result.cancelFunc()
+		for coin, amount := range result.backend.GetCost().GetCoins() {
+			upstreamHedgeWastedCost.WithLabelValues(u.GetName(), result.backend.GetName(), coin).Add(float64(amount))
+		}
+	}
+	if pending > 0 {
+		go func() {
+			for i := 0; i < pending; i++ {
+				if result := <-results; result.resp != nil {
+					result.resp.Body.Close()
+				}
+			}
+		}()
+	}
+
+	if hedge != nil {
+		winner.resp.Header.Set(HEADER_X_FAULTMONKEY_HEDGE, hedge.GetName())
+		if winner.backend == hedge {
+			upstreamHedgeWins.WithLabelValues(u.GetName(), hedge.GetName()).Inc()
+		}
+	}
+	WriteResponse(c, winner.resp, nil)
+}
@@ -0,0 +1,119 @@
+package data
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newHedgeTestUpstream(t *testing.T, slowMillis int64) (*UpstreamImpl, *int32) {
+	var slowCancelled int32
+	slow := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Duration(slowMillis) * time.Millisecond):
+			w.Write([]byte("slow"))
+		case <-r.Context().Done():
+			atomic.AddInt32(&slowCancelled, 1)
+		}
+	})
+	fast := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	})
+	upstream := newTestUpstream(t, "hedge", &UpstreamImpl{
+		Rule: "weighted",
+		Hedge: &HedgeImpl{
+			DelayMillis: 50,
+		},
+		Backends: map[string]*UpstreamBackendImpl{
+			// The slow backend is always chosen first
+			"slow": {
+				Url:    slow,
+				Weight: 1,
+				Cost:   CostFromConfig{"hedge": 2},
+			},
+			"fast": {
+				Url:    fast,
+				Weight: 0,
+			},
+		},
+	})
+	return upstream, &slowCancelled
+}
+
+func doHedgeTestRequest(upstream *UpstreamImpl, method string) *httptest.ResponseRecorder {
+	return doTestRequest(upstream, method, "/api/v1/broker/hedge", "")
+}
+
+func TestHedgeWins(t *testing.T) {
+	upstream, slowCancelled := newHedgeTestUpstream(t, 2000)
+
+	w := doHedgeTestRequest(upstream, http.MethodGet)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, but got %d", w.Code)
+	}
+	if w.Body.String() != "fast" {
+		t.Errorf("Expected the hedge to win, but got '%s'", w.Body.String())
+	}
+	if hedge := w.Header().Get(HEADER_X_FAULTMONKEY_HEDGE); hedge != "fast" {
+		t.Errorf("Expected %s to be 'fast', but got '%s'", HEADER_X_FAULTMONKEY_HEDGE, hedge)
+	}
+	if backend := w.Header().Get(HEADER_X_FAULTMONKEY_BACKEND); backend != "fast" {
+		t.Errorf("Expected %s to be 'fast', but got '%s'", HEADER_X_FAULTMONKEY_BACKEND, backend)
+	}
+
+	// The loser gets cancelled
+	for i := 0; i < 100 && atomic.LoadInt32(slowCancelled) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(slowCancelled) == 0 {
+		t.Error("Expected the slow request to be cancelled")
+	}
+}
+
+func TestNoHedgeWhenFastEnough(t *testing.T) {
+	upstream, _ := newHedgeTestUpstream(t, 0)
+
+	w := doHedgeTestRequest(upstream, http.MethodGet)
+	if w.Body.String() != "slow" {
+		t.Errorf("Expected the original request to win, but got '%s'", w.Body.String())
+	}
+	if hedge := w.Header().Get(HEADER_X_FAULTMONKEY_HEDGE); hedge != "" {
+		t.Errorf("Expected no hedge, but got '%s'", hedge)
+	}
+}
+
+func TestNoHedgeForNonIdempotentMethods(t *testing.T) {
+	upstream, _ := newHedgeTestUpstream(t, 200)
+
+	w := doHedgeTestRequest(upstream, http.MethodPost)
+	if w.Body.String() != "slow" {
+		t.Errorf("Expected POST not to be hedged, but got '%s'", w.Body.String())
+	}
+}
+
+func TestHedgeDelayPercentile(t *testing.T) {
+	hedge := &HedgeImpl{
+		DelayMillis: 50,
+		Percentile:  95,
+	}
+	if err := hedge.Backpatch("test"); err != nil {
+		t.Fatal(err)
+	}
+	backend := &UpstreamBackendImpl{
+		latencies: NewLatencyHistory(DEFAULT_LATENCY_HISTORY_SIZE),
+	}
+
+	// Not enough samples, so we use the fixed delay
+	if delay := hedge.GetDelay(backend); delay != 50*time.Millisecond {
+		t.Errorf("Expected a delay of 50ms, but got %s", delay)
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		backend.recordLatency(i)
+	}
+	if delay := hedge.GetDelay(backend); delay != 95*time.Millisecond {
+		t.Errorf("Expected a delay of 95ms, but got %s", delay)
+	}
+}
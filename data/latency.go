@@ -0,0 +1,68 @@
+package data
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	// The number of latencies we keep for each backend
+	DEFAULT_LATENCY_HISTORY_SIZE = 100
+
+	// We don't trust a percentile until we have this many latencies
+	MIN_LATENCY_SAMPLES = 20
+)
+
+// LatencyHistory keeps the most recent latencies of something, so
+// that we can work out percentiles
+type LatencyHistory struct {
+	mutex   sync.Mutex
+	samples []int64
+	next    int
+	count   int
+}
+
+func NewLatencyHistory(size int) *LatencyHistory {
+	if size <= 0 {
+		size = DEFAULT_LATENCY_HISTORY_SIZE
+	}
+	return &LatencyHistory{
+		samples: make([]int64, size),
+	}
+}
+
+func (h *LatencyHistory) Record(millis int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.samples[h.next] = millis
+	h.next = (h.next + 1) % len(h.samples)
+	if h.count < len(h.samples) {
+		h.count++
+	}
+}
+
+// Percentile returns the p'th percentile (0 < p <= 100) of the
+// latencies, or false if we don't have enough of them yet
+func (h *LatencyHistory) Percentile(p float64) (int64, bool) {
+	h.mutex.Lock()
+	if h.count < MIN_LATENCY_SAMPLES {
+		h.mutex.Unlock()
+		return 0, false
+	}
+	sorted := make([]int64, h.count)
+	copy(sorted, h.samples[:h.count])
+	h.mutex.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	index := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index], true
+}
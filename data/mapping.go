@@ -0,0 +1,240 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The sources a mapped param or header can come from.  A mapping can
+// have several of them separated by '|', in which case the first one
+// that isn't empty wins (so the last one is the default), e.g.
+//
+//	q: param:query | param:q | value:cats
+const (
+	MAPPING_PARAM    = "param:"
+	MAPPING_HEADER   = "header:"
+	MAPPING_VALUE    = "value:"
+	MAPPING_UUID     = "uuid"
+	MAPPING_NOW      = "now"
+	MAPPING_CUSTOMER = "customer"
+
+	// Removes a header
+	MAPPING_DROP = "-"
+)
+
+// RequestMapping changes the params and headers of a request so that
+// it suits a particular backend.
+//
+// The params say exactly which params the backend gets (anything
+// else is dropped), where a bare name is the name of the caller's
+// param, e.g.
+//
+//	params:
+//	  q: q
+//	  count: param:limit | value:10
+//
+// The headers are added to (or override) the caller's headers, where
+// a bare value is sent as it is, and '-' removes the header, e.g.
+//
+//	headers:
+//	  X-Alizee: wiggle
+//	  X-Correlation-Id: header:X-Request-Id | uuid
+//	  Cookie: -
+type RequestMapping struct {
+	params  []mappedValue
+	headers []mappedValue
+}
+
+// mappedValue is one param (or header) and where it comes from
+type mappedValue struct {
+	name    string
+	drop    bool
+	sources []mappingSource
+}
+
+type mappingSource struct {
+	kind string
+	arg  string
+}
+
+// NewRequestMapping parses the params and headers of a backend.  If
+// there aren't any, then there is nothing to do and it returns nil
+func NewRequestMapping(name string, params map[string]string, headers map[string]string) (*RequestMapping, error) {
+	if len(params) == 0 && len(headers) == 0 {
+		return nil, nil
+	}
+
+	mapping := &RequestMapping{}
+	for _, param := range sortedKeys(params) {
+		mapped, err := parseMappedValue(name, param, params[param], MAPPING_PARAM)
+		if err != nil {
+			return nil, err
+		}
+		if mapped.drop {
+			// Params that aren't mapped are dropped anyway
+			continue
+		}
+		mapping.params = append(mapping.params, mapped)
+	}
+	for _, header := range sortedKeys(headers) {
+		mapped, err := parseMappedValue(name, http.CanonicalHeaderKey(header), headers[header], MAPPING_VALUE)
+		if err != nil {
+			return nil, err
+		}
+		mapping.headers = append(mapping.headers, mapped)
+	}
+	return mapping, nil
+}
+
+// parseMappedValue parses 'source | source ...', where a source
+// without a prefix is a bareKind
+func parseMappedValue(name string, key string, spec string, bareKind string) (mappedValue, error) {
+	mapped := mappedValue{name: key}
+	spec = strings.TrimSpace(spec)
+	if spec == MAPPING_DROP {
+		mapped.drop = true
+		return mapped, nil
+	}
+
+	for _, source := range strings.Split(spec, "|") {
+		source = strings.TrimSpace(source)
+		switch {
+		case source == MAPPING_UUID, source == MAPPING_NOW, source == MAPPING_CUSTOMER:
+			mapped.sources = append(mapped.sources, mappingSource{kind: source})
+
+		case strings.HasPrefix(source, MAPPING_PARAM) && len(source) > len(MAPPING_PARAM):
+			mapped.sources = append(mapped.sources, mappingSource{kind: MAPPING_PARAM, arg: source[len(MAPPING_PARAM):]})
+
+		case strings.HasPrefix(source, MAPPING_HEADER) && len(source) > len(MAPPING_HEADER):
+			mapped.sources = append(mapped.sources, mappingSource{kind: MAPPING_HEADER, arg: source[len(MAPPING_HEADER):]})
+
+		case strings.HasPrefix(source, MAPPING_VALUE):
+			mapped.sources = append(mapped.sources, mappingSource{kind: MAPPING_VALUE, arg: source[len(MAPPING_VALUE):]})
+
+		case source == "":
+			return mapped, fmt.Errorf("Backpatch(%s): '%s: %s' has an empty source", name, key, spec)
+
+		default:
+			mapped.sources = append(mapped.sources, mappingSource{kind: bareKind, arg: source})
+		}
+	}
+	return mapped, nil
+}
+
+// Apply maps the params and headers of the request.
+//
+// The request must be a copy, as the headers (and the body of a
+// form) are replaced rather than changed
+func (m *RequestMapping) Apply(req *http.Request) error {
+	if m == nil {
+		return nil
+	}
+
+	// The caller's params come from the query and (for a form) the
+	// body
+	callerParams := req.URL.Query()
+	isForm := isFormRequest(req)
+	if isForm {
+		body, err := ReadBody(req)
+		if err != nil {
+			return fmt.Errorf("%s: reading the form: %s", req.URL.String(), err.Error())
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return fmt.Errorf("%s: parsing the form: %s", req.URL.String(), err.Error())
+		}
+		for param, values := range form {
+			callerParams[param] = append(callerParams[param], values...)
+		}
+	}
+	callerHeaders := req.Header
+	req.Header = req.Header.Clone()
+
+	if len(m.params) > 0 {
+		params := make(url.Values)
+		for _, mapped := range m.params {
+			if values := mapped.resolve(callerParams, callerHeaders); len(values) > 0 {
+				params[mapped.name] = values
+			}
+		}
+		if isForm {
+			encoded := params.Encode()
+			req.Body = io.NopCloser(bytes.NewReader([]byte(encoded)))
+			req.ContentLength = int64(len(encoded))
+			req.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
+			req.URL.RawQuery = ""
+		} else {
+			req.URL.RawQuery = params.Encode()
+		}
+	}
+
+	for _, mapped := range m.headers {
+		if mapped.drop {
+			req.Header.Del(mapped.name)
+			continue
+		}
+		if values := mapped.resolve(callerParams, callerHeaders); len(values) > 0 {
+			req.Header[mapped.name] = values
+		}
+	}
+	return nil
+}
+
+// resolve returns the values from the first source that has any
+func (m mappedValue) resolve(params url.Values, headers http.Header) []string {
+	for _, source := range m.sources {
+		var values []string
+		switch source.kind {
+		case MAPPING_PARAM:
+			values = params[source.arg]
+
+		case MAPPING_HEADER:
+			values = headers.Values(source.arg)
+
+		case MAPPING_VALUE:
+			values = []string{source.arg}
+
+		case MAPPING_UUID:
+			values = []string{uuid.NewString()}
+
+		case MAPPING_NOW:
+			values = []string{fmt.Sprint(time.Now().UTC().UnixMilli())}
+
+		case MAPPING_CUSTOMER:
+			if customer := headers.Get(HEADER_X_FAULTMONKEY_API_CUSTOMER); customer != "" {
+				values = []string{customer}
+			}
+		}
+		if len(values) > 0 && (len(values) > 1 || values[0] != "") {
+			return values
+		}
+	}
+	return nil
+}
+
+func isFormRequest(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded"
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,117 @@
+package data
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestMappingParams(t *testing.T) {
+	mapping, err := NewRequestMapping("search.bing", map[string]string{
+		"q":      "q",
+		"query":  "param:search | param:q",
+		"count":  "param:limit | value:10",
+		"market": "header:Accept-Language",
+		"id":     "uuid",
+		"dropme": "-",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/search?q=cats&secret=1", nil)
+	req.Header.Set("Accept-Language", "en-GB")
+	if err := mapping.Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	query := req.URL.Query()
+	expected := map[string]string{"q": "cats", "query": "cats", "count": "10", "market": "en-GB"}
+	for param, value := range expected {
+		if query.Get(param) != value {
+			t.Errorf("Expected %s=%s, but got '%s'", param, value, query.Get(param))
+		}
+	}
+	if query.Get("id") == "" {
+		t.Error("Expected a uuid for 'id'")
+	}
+	if query.Has("secret") || query.Has("dropme") {
+		t.Errorf("Expected the params that aren't mapped to be dropped, but got %s", req.URL.RawQuery)
+	}
+}
+
+func TestRequestMappingForm(t *testing.T) {
+	mapping, err := NewRequestMapping("search.bing", map[string]string{
+		"text": "param:q",
+		"page": "page",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/search?page=2", strings.NewReader("q=cats&secret=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := mapping.Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != "page=2&text=cats" {
+		t.Errorf("Expected the form to be 'page=2&text=cats', but got '%s'", string(body))
+	}
+	if req.ContentLength != int64(len(body)) {
+		t.Errorf("Expected a Content-Length of %d, but got %d", len(body), req.ContentLength)
+	}
+	if req.URL.RawQuery != "" {
+		t.Errorf("Expected the params to be sent in the form, but got a query of '%s'", req.URL.RawQuery)
+	}
+}
+
+func TestRequestMappingHeaders(t *testing.T) {
+	mapping, err := NewRequestMapping("search.bing", nil, map[string]string{
+		"X-Alizee":         "wiggle",
+		"x-correlation-id": "header:X-Request-Id | uuid",
+		"X-Customer":       "customer",
+		"X-Static":         "value:a|b",
+		"Cookie":           "-",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := http.Header{}
+	original.Set("Cookie", "secret")
+	original.Set("X-Request-Id", "abc")
+	original.Set(HEADER_X_FAULTMONKEY_API_CUSTOMER, "acme")
+	original.Set("X-Alizee", "moi")
+	req := httptest.NewRequest(http.MethodGet, "/search?q=cats", nil)
+	req.Header = original
+	if err := mapping.Apply(req); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"X-Alizee": "wiggle", "X-Correlation-Id": "abc", "X-Customer": "acme", "X-Static": "a"}
+	for header, value := range expected {
+		if req.Header.Get(header) != value {
+			t.Errorf("Expected %s: %s, but got '%s'", header, value, req.Header.Get(header))
+		}
+	}
+	if req.Header.Get("Cookie") != "" {
+		t.Error("Expected the Cookie header to be removed")
+	}
+	if original.Get("Cookie") != "secret" || original.Get("X-Alizee") != "moi" {
+		t.Error("Expected the caller's headers to be left alone")
+	}
+	if req.URL.RawQuery != "q=cats" {
+		t.Errorf("Expected the query to be left alone without any params, but got '%s'", req.URL.RawQuery)
+	}
+}
+
+func TestRequestMappingErrors(t *testing.T) {
+	if mapping, err := NewRequestMapping("search.bing", nil, nil); mapping != nil || err != nil {
+		t.Error("Expected no mapping without any params or headers")
+	}
+	if _, err := NewRequestMapping("search.bing", map[string]string{"q": "param:q | "}, nil); err == nil {
+		t.Error("Expected an error for an empty source")
+	}
+}
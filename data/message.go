@@ -1,6 +1,7 @@
 package data
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/google/uuid"
@@ -40,8 +41,11 @@ func NewMessageBuilder() MessageBuilder {
 	}
 }
 
-func (b *MessageBuilderImpl) MessageBuilderFromJson([]byte) (MessageBuilder, error) {
-	return b, fmt.Errorf("TODO(john): implement MessageBuilder.MessageBuilderFromJson()")
+func (b *MessageBuilderImpl) MessageBuilderFromJson(rawJson []byte) (MessageBuilder, error) {
+	if err := json.Unmarshal(rawJson, &b.impl); err != nil {
+		return b, fmt.Errorf("MessageBuilderFromJson(): %s", err.Error())
+	}
+	return b, nil
 }
 
 func (b *MessageBuilderImpl) Id(id string) MessageBuilder {
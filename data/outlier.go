@@ -0,0 +1,311 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamOutlierEjections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_outlier_ejections",
+		Help:      "The number of times a backend has been ejected by outlier detection, keyed by upstream/backend and reason",
+	},
+	[]string{"upstream", "backend", "reason"},
+)
+var upstreamOutlierEjectionsSkipped = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_outlier_ejections_skipped",
+		Help:      "The number of outliers that were not ejected because too many backends were already ejected, keyed by upstream/backend",
+	},
+	[]string{"upstream", "backend"},
+)
+
+const (
+	DEFAULT_OUTLIER_CONSECUTIVE_5XX      = 5
+	DEFAULT_OUTLIER_WINDOW               = 100
+	DEFAULT_OUTLIER_MIN_REQUESTS         = 20
+	DEFAULT_OUTLIER_SUCCESS_RATE_DELTA   = 0.3
+	DEFAULT_OUTLIER_BASE_EJECTION_MILLIS = 30000
+	DEFAULT_OUTLIER_MAX_EJECTION_MILLIS  = 300000
+	DEFAULT_OUTLIER_MAX_EJECTION_PERCENT = 50
+	OUTLIER_REASON_CONSECUTIVE_5XX       = "consecutive_5xx"
+	OUTLIER_REASON_SUCCESS_RATE          = "success_rate"
+)
+
+// OutlierDetectionImpl ejects backends that are failing the requests
+// that are sent to them (whatever their healthcheck says), e.g.
+//
+//	outlier_detection:
+//	  consecutive_5xx: 5
+//	  success_rate_delta: 0.3
+//	  base_ejection_millis: 30000
+//	  max_ejection_percent: 50
+//
+// A 5xx or an error (e.g. connection refused) is a failure.
+type OutlierDetectionImpl struct {
+	// Eject a backend after this many failures in a row
+	Consecutive5xx int `yaml:"consecutive_5xx,omitempty" json:"consecutive_5xx,omitempty"`
+
+	// ... or when its success rate (over the last 'window' requests)
+	// is this much lower than the average of the other backends.
+	//
+	// We need at least 'min_requests' in the window before we take
+	// any notice of the success rate
+	SuccessRateDelta float64 `yaml:"success_rate_delta,omitempty" json:"success_rate_delta,omitempty"`
+	Window           int     `yaml:"window,omitempty" json:"window,omitempty"`
+	MinRequests      int     `yaml:"min_requests,omitempty" json:"min_requests,omitempty"`
+
+	// A backend is ejected for base_ejection_millis, multiplied by
+	// the number of times it has been ejected (up to
+	// max_ejection_millis).  The count is forgotten once the backend
+	// has been back for max_ejection_millis
+	BaseEjectionMillis int64 `yaml:"base_ejection_millis,omitempty" json:"base_ejection_millis,omitempty"`
+	MaxEjectionMillis  int64 `yaml:"max_ejection_millis,omitempty" json:"max_ejection_millis,omitempty"`
+
+	// No more than this percentage of the backends are ejected at
+	// any one time (and never all of them)
+	MaxEjectionPercent int `yaml:"max_ejection_percent,omitempty" json:"max_ejection_percent,omitempty"`
+
+	// These are backpatched
+	upstream *UpstreamImpl
+	mutex    sync.Mutex
+	backends map[string]*outlierState
+}
+
+// outlierState is what we know about a backend
+type outlierState struct {
+	consecutiveFailures int
+
+	// The outcomes of the last 'window' requests
+	outcomes  []bool
+	next      int
+	successes int
+
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func (o *OutlierDetectionImpl) Backpatch(upstream *UpstreamImpl) error {
+	if o.Consecutive5xx < 0 || o.Window < 0 || o.MinRequests < 0 {
+		return fmt.Errorf("Backpatch(%s): outlier detection counts can't be negative", upstream.GetName())
+	}
+	if o.SuccessRateDelta < 0 || o.SuccessRateDelta > 1 {
+		return fmt.Errorf("Backpatch(%s): success_rate_delta must be between 0 and 1", upstream.GetName())
+	}
+	if o.BaseEjectionMillis < 0 || o.MaxEjectionMillis < 0 {
+		return fmt.Errorf("Backpatch(%s): outlier ejection times can't be negative", upstream.GetName())
+	}
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return fmt.Errorf("Backpatch(%s): max_ejection_percent must be between 0 and 100", upstream.GetName())
+	}
+	if o.Consecutive5xx == 0 {
+		o.Consecutive5xx = DEFAULT_OUTLIER_CONSECUTIVE_5XX
+	}
+	if o.SuccessRateDelta == 0 {
+		o.SuccessRateDelta = DEFAULT_OUTLIER_SUCCESS_RATE_DELTA
+	}
+	if o.Window == 0 {
+		o.Window = DEFAULT_OUTLIER_WINDOW
+	}
+	if o.MinRequests == 0 {
+		o.MinRequests = DEFAULT_OUTLIER_MIN_REQUESTS
+	}
+	if o.MinRequests > o.Window {
+		o.MinRequests = o.Window
+	}
+	if o.BaseEjectionMillis == 0 {
+		o.BaseEjectionMillis = DEFAULT_OUTLIER_BASE_EJECTION_MILLIS
+	}
+	if o.MaxEjectionMillis == 0 {
+		o.MaxEjectionMillis = DEFAULT_OUTLIER_MAX_EJECTION_MILLIS
+	}
+	if o.MaxEjectionMillis < o.BaseEjectionMillis {
+		o.MaxEjectionMillis = o.BaseEjectionMillis
+	}
+	if o.MaxEjectionPercent == 0 {
+		o.MaxEjectionPercent = DEFAULT_OUTLIER_MAX_EJECTION_PERCENT
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.upstream = upstream
+	o.backends = make(map[string]*outlierState)
+	return nil
+}
+
+// IsEjected is true if the backend has been ejected (and hasn't
+// come back yet)
+func (o *OutlierDetectionImpl) IsEjected(backendName string) bool {
+	if o == nil {
+		return false
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	state, exists := o.backends[backendName]
+	return exists && state.isEjected(time.Now())
+}
+
+// Record takes note of the outcome of a request to the backend, and
+// ejects it if it is an outlier
+func (o *OutlierDetectionImpl) Record(backend *UpstreamBackendImpl, success bool) {
+	if o == nil {
+		return
+	}
+	backendName := backend.GetName()
+	now := time.Now()
+
+	o.mutex.Lock()
+	state := o.getState(backendName)
+	if state.isEjected(now) {
+		// It only gets traffic in panic mode, which doesn't count
+		o.mutex.Unlock()
+		return
+	}
+	state.record(success)
+
+	reason := ""
+	if state.consecutiveFailures >= o.Consecutive5xx {
+		reason = OUTLIER_REASON_CONSECUTIVE_5XX
+	} else if o.isSuccessRateOutlier(backendName, state) {
+		reason = OUTLIER_REASON_SUCCESS_RATE
+	}
+	if reason == "" {
+		o.mutex.Unlock()
+		return
+	}
+	if !o.canEject(now) {
+		o.mutex.Unlock()
+		upstreamOutlierEjectionsSkipped.WithLabelValues(o.upstream.GetName(), backendName).Inc()
+		return
+	}
+
+	// The back-off grows every time the backend is ejected, until it
+	// has stayed healthy for long enough
+	if now.Sub(state.ejectedUntil) > time.Duration(o.MaxEjectionMillis)*time.Millisecond {
+		state.ejections = 0
+	}
+	state.ejections++
+	ejectionMillis := o.BaseEjectionMillis * int64(state.ejections)
+	if ejectionMillis > o.MaxEjectionMillis {
+		ejectionMillis = o.MaxEjectionMillis
+	}
+	ejection := time.Duration(ejectionMillis) * time.Millisecond
+	state.ejectedUntil = now.Add(ejection)
+
+	// It gets a clean slate when it comes back
+	state.consecutiveFailures = 0
+	state.outcomes = state.outcomes[:0]
+	state.next = 0
+	state.successes = 0
+	o.mutex.Unlock()
+
+	log.Printf("%s.%s: ejecting outlier (%s) for %dms", o.upstream.GetName(), backendName, reason, ejectionMillis)
+	upstreamOutlierEjections.WithLabelValues(o.upstream.GetName(), backendName, reason).Inc()
+	o.changed(backend)
+	time.AfterFunc(ejection, func() {
+		o.changed(backend)
+	})
+}
+
+// changed tells everybody that the backend has been ejected (or has
+// come back)
+func (o *OutlierDetectionImpl) changed(backend *UpstreamBackendImpl) {
+	backend.updateStateGauge()
+	o.upstream.updateEligible()
+}
+
+func (o *OutlierDetectionImpl) getState(backendName string) *outlierState {
+	state, exists := o.backends[backendName]
+	if !exists {
+		state = &outlierState{
+			outcomes: make([]bool, 0, o.Window),
+		}
+		o.backends[backendName] = state
+	}
+	return state
+}
+
+// isSuccessRateOutlier is true if the success rate of the backend is
+// too far below the average of the others
+func (o *OutlierDetectionImpl) isSuccessRateOutlier(backendName string, state *outlierState) bool {
+	if len(state.outcomes) < o.MinRequests {
+		return false
+	}
+
+	now := time.Now()
+	othersSuccessRate := float64(0)
+	others := 0
+	for otherName, other := range o.backends {
+		if otherName == backendName || other.isEjected(now) || len(other.outcomes) < o.MinRequests {
+			continue
+		}
+		othersSuccessRate += other.getSuccessRate()
+		others++
+	}
+	if others == 0 {
+		return false
+	}
+	othersSuccessRate /= float64(others)
+
+	return state.getSuccessRate() < othersSuccessRate-o.SuccessRateDelta
+}
+
+// canEject is false if ejecting another backend would take us over
+// max_ejection_percent (or leave no backends at all)
+func (o *OutlierDetectionImpl) canEject(now time.Time) bool {
+	total := len(o.upstream.Backends)
+	maxEjected := total * o.MaxEjectionPercent / 100
+	if maxEjected == 0 {
+		maxEjected = 1
+	}
+	if maxEjected >= total {
+		maxEjected = total - 1
+	}
+
+	ejected := 0
+	for _, state := range o.backends {
+		if state.isEjected(now) {
+			ejected++
+		}
+	}
+	return ejected < maxEjected
+}
+
+func (s *outlierState) isEjected(now time.Time) bool {
+	return now.Before(s.ejectedUntil)
+}
+
+func (s *outlierState) record(success bool) {
+	if success {
+		s.consecutiveFailures = 0
+		s.successes++
+	} else {
+		s.consecutiveFailures++
+	}
+
+	if len(s.outcomes) < cap(s.outcomes) {
+		s.outcomes = append(s.outcomes, success)
+		return
+	}
+
+	// Forget the oldest outcome
+	if s.outcomes[s.next] {
+		s.successes--
+	}
+	s.outcomes[s.next] = success
+	s.next = (s.next + 1) % len(s.outcomes)
+}
+
+func (s *outlierState) getSuccessRate() float64 {
+	if len(s.outcomes) == 0 {
+		return 1
+	}
+	return float64(s.successes) / float64(len(s.outcomes))
+}
@@ -0,0 +1,152 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func newOutlierTestUpstream(t *testing.T, outlierDetection *OutlierDetectionImpl) *UpstreamImpl {
+	return newTestUpstream(t, "outlier", &UpstreamImpl{
+		Rule: "random",
+		Backends: map[string]*UpstreamBackendImpl{
+			"aws":    {Url: "http://aws", Weight: 1},
+			"azure":  {Url: "http://azure", Weight: 1},
+			"google": {Url: "http://google", Weight: 1},
+			"ibm":    {Url: "http://ibm", Weight: 1},
+		},
+		OutlierDetection: outlierDetection,
+	})
+}
+
+func TestOutlierConsecutive5xx(t *testing.T) {
+	upstream := newOutlierTestUpstream(t, &OutlierDetectionImpl{
+		Consecutive5xx:     3,
+		BaseEjectionMillis: 100,
+	})
+	od := upstream.OutlierDetection
+	aws := upstream.Backends["aws"]
+
+	// A success resets the count
+	od.Record(aws, false)
+	od.Record(aws, false)
+	od.Record(aws, true)
+	od.Record(aws, false)
+	od.Record(aws, false)
+	if aws.GetState() == EJECTED {
+		t.Fatal("Expected the backend not to be ejected after 2 failures in a row")
+	}
+
+	od.Record(aws, false)
+	if state := aws.GetState(); state != EJECTED {
+		t.Fatalf("Expected the backend to be ejected after 3 failures in a row, but it is %s", state.String())
+	}
+	if aws.IsAvailable() {
+		t.Error("Expected an ejected backend not to be available")
+	}
+	for i := 0; i < 100; i++ {
+		if backend := upstream.ChooseBackend("", ""); backend.GetName() == "aws" {
+			t.Fatal("Expected an ejected backend not to be chosen")
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if state := aws.GetState(); state == EJECTED {
+		t.Fatal("Expected the backend to come back once the ejection has expired")
+	}
+	chosen := false
+	for i := 0; i < 100 && !chosen; i++ {
+		chosen = upstream.ChooseBackend("", "").GetName() == "aws"
+	}
+	if !chosen {
+		t.Error("Expected the backend to be chosen again once the ejection has expired")
+	}
+}
+
+func TestOutlierSuccessRate(t *testing.T) {
+	upstream := newOutlierTestUpstream(t, &OutlierDetectionImpl{
+		Consecutive5xx:   100,
+		SuccessRateDelta: 0.3,
+		Window:           10,
+		MinRequests:      10,
+	})
+	od := upstream.OutlierDetection
+	for _, name := range []string{"aws", "azure", "google"} {
+		for i := 0; i < 10; i++ {
+			od.Record(upstream.Backends[name], true)
+		}
+	}
+
+	// 80% is within 0.3 of 100%...
+	ibm := upstream.Backends["ibm"]
+	for i := 0; i < 10; i++ {
+		od.Record(ibm, i%5 < 4)
+	}
+	if ibm.GetState() == EJECTED {
+		t.Fatal("Expected a backend with an 80% success rate not to be ejected")
+	}
+
+	// ... but 60% isn't
+	od.Record(ibm, false)
+	od.Record(ibm, false)
+	if state := ibm.GetState(); state != EJECTED {
+		t.Errorf("Expected a backend with a 60%% success rate to be ejected, but it is %s", state.String())
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	upstream := newOutlierTestUpstream(t, &OutlierDetectionImpl{
+		Consecutive5xx:     1,
+		BaseEjectionMillis: 10000,
+		MaxEjectionPercent: 50,
+	})
+	od := upstream.OutlierDetection
+	for _, backend := range upstream.Backends {
+		od.Record(backend, false)
+	}
+
+	ejected := 0
+	for _, backend := range upstream.Backends {
+		if backend.GetState() == EJECTED {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("Expected 50%% of the 4 backends to be ejected, but %d were", ejected)
+	}
+}
+
+func TestOutlierBackoff(t *testing.T) {
+	upstream := newOutlierTestUpstream(t, &OutlierDetectionImpl{
+		Consecutive5xx:     1,
+		BaseEjectionMillis: 50,
+		MaxEjectionMillis:  120,
+	})
+	od := upstream.OutlierDetection
+	aws := upstream.Backends["aws"]
+
+	expected := []time.Duration{50, 100, 120}
+	for _, millis := range expected {
+		start := time.Now()
+		od.Record(aws, false)
+		ejectedUntil := od.backends["aws"].ejectedUntil
+		if got := ejectedUntil.Sub(start).Round(10 * time.Millisecond); got != millis*time.Millisecond {
+			t.Fatalf("Expected an ejection of %dms, but got %s", millis, got)
+		}
+		time.Sleep(time.Until(ejectedUntil) + 5*time.Millisecond)
+	}
+}
+
+func TestOutlierDetectionBackpatch(t *testing.T) {
+	od := &OutlierDetectionImpl{}
+	if err := od.Backpatch(&UpstreamImpl{serviceName: "outlier"}); err != nil {
+		t.Fatal(err)
+	}
+	if od.Consecutive5xx != DEFAULT_OUTLIER_CONSECUTIVE_5XX || od.MaxEjectionPercent != DEFAULT_OUTLIER_MAX_EJECTION_PERCENT {
+		t.Errorf("Expected the defaults, but got %+v", od)
+	}
+
+	od = &OutlierDetectionImpl{SuccessRateDelta: 1.5}
+	if err := od.Backpatch(&UpstreamImpl{serviceName: "outlier"}); err == nil {
+		t.Error("Expected an error for a success_rate_delta > 1")
+	}
+}
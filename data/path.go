@@ -0,0 +1,162 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches the {1}, {2} ... placeholders in a backend URL, which are
+// replaced by the segments of the path the caller asked for
+var pathTemplateRegexp = regexp.MustCompile(`\{([0-9]+)\}`)
+
+// ErrDotSegment is returned for a request path that has a . or ..
+// segment (even an escaped one), which could get out of the backend
+// path
+var ErrDotSegment = errors.New("the path has a '.' or '..' segment")
+
+// How many times a segment is unescaped, looking for dot segments
+// that have been escaped more than once (e.g. %252e%252e)
+const maxPathUnescapes = 3
+
+// StripPathSegments returns a copy of the URL without the first n
+// segments of the path (empty segments don't count), keeping any
+// escaping (e.g. %2F) in the rest of the path
+func StripPathSegments(u *url.URL, n int) *url.URL {
+	segments := strings.Split(u.EscapedPath(), "/")
+	for n > 0 && len(segments) > 0 {
+		if segments[0] != "" {
+			n--
+		}
+		segments = segments[1:]
+	}
+
+	stripped := *u
+	setEscapedPath(&stripped, "/"+strings.Join(segments, "/"))
+	return &stripped
+}
+
+// BuildBackendURL works out where a request goes, given the URL of
+// the backend and the URL (relative to the upstream) of the request.
+//
+// The path is stripped of stripPrefix, and then either fills in the
+// {n} placeholders in the backend path or is joined on to the end of
+// it.  The query is the backend query plus the request query
+func BuildBackendURL(backendURL *url.URL, stripPrefix string, requestURL *url.URL) (*url.URL, error) {
+	requestPath := requestURL.EscapedPath()
+	if stripPrefix = strings.TrimSuffix(stripPrefix, "/"); stripPrefix != "" {
+		// Only whole segments are stripped, so /v1 doesn't strip /v10
+		if requestPath == stripPrefix || strings.HasPrefix(requestPath, stripPrefix+"/") {
+			requestPath = strings.TrimPrefix(requestPath, stripPrefix)
+		}
+	}
+	if hasDotSegment(requestPath) {
+		return nil, fmt.Errorf("%s: %w", requestPath, ErrDotSegment)
+	}
+
+	target := *backendURL
+	if pathTemplateRegexp.MatchString(backendURL.Path) {
+		expanded, err := expandPathTemplate(backendURL.Path, requestPath)
+		if err != nil {
+			return nil, err
+		}
+		setEscapedPath(&target, expanded)
+	} else {
+		setEscapedPath(&target, joinURLPath(backendURL.EscapedPath(), requestPath))
+	}
+
+	target.RawQuery = mergeQuery(backendURL.RawQuery, requestURL.RawQuery)
+	target.Fragment = ""
+	target.RawFragment = ""
+	return &target, nil
+}
+
+// validatePathTemplate makes sure the placeholders (if any) in a
+// backend URL make sense
+func validatePathTemplate(name string, backendURL *url.URL) error {
+	for _, match := range pathTemplateRegexp.FindAllStringSubmatch(backendURL.Path, -1) {
+		if index, _ := strconv.Atoi(match[1]); index < 1 {
+			return fmt.Errorf("Backpatch(%s): path placeholders start at {1}, but got %s", name, match[0])
+		}
+	}
+	return nil
+}
+
+// expandPathTemplate replaces {n} with segment n (starting at 1) of
+// the request path
+func expandPathTemplate(template string, requestPath string) (string, error) {
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(requestPath, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	var err error
+	expanded := pathTemplateRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		index, _ := strconv.Atoi(placeholder[1 : len(placeholder)-1])
+		if index < 1 || index > len(segments) {
+			err = fmt.Errorf("%s: the path '%s' has no segment %d", template, requestPath, index)
+			return placeholder
+		}
+		return segments[index-1]
+	})
+	return expanded, err
+}
+
+// hasDotSegment returns whether any segment of the escaped path is .
+// or .., once it has been unescaped (escaped slashes and backslashes
+// split the segment, as the backend might decode them)
+func hasDotSegment(escapedPath string) bool {
+	for _, segment := range strings.Split(escapedPath, "/") {
+		for i := 0; i < maxPathUnescapes; i++ {
+			for _, part := range strings.FieldsFunc(segment, func(r rune) bool { return r == '/' || r == '\\' }) {
+				if part == "." || part == ".." {
+					return true
+				}
+			}
+			unescaped, err := url.PathUnescape(segment)
+			if err != nil || unescaped == segment {
+				break
+			}
+			segment = unescaped
+		}
+	}
+	return false
+}
+
+// joinURLPath joins the two paths with exactly one slash between
+// them, keeping a trailing slash (if any) on the request path
+func joinURLPath(basePath string, requestPath string) string {
+	if requestPath == "" || requestPath == "/" {
+		if basePath == "" {
+			return "/"
+		}
+		return basePath
+	}
+	return strings.TrimSuffix(basePath, "/") + "/" + strings.TrimPrefix(requestPath, "/")
+}
+
+// mergeQuery puts the request query after the backend query, so that
+// the backend gets both
+func mergeQuery(backendQuery string, requestQuery string) string {
+	if backendQuery == "" || requestQuery == "" {
+		return backendQuery + requestQuery
+	}
+	return backendQuery + "&" + requestQuery
+}
+
+// setEscapedPath sets the path from its escaped form
+func setEscapedPath(u *url.URL, escapedPath string) {
+	unescaped, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		u.Path = escapedPath
+		u.RawPath = ""
+		return
+	}
+	u.Path = unescaped
+	u.RawPath = escapedPath
+}
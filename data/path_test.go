@@ -0,0 +1,127 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestStripPathSegments(t *testing.T) {
+	tests := map[string]string{
+		"/api/v1/broker/search":               "/",
+		"/api/v1/broker/search/foo":           "/foo",
+		"/api/v1/broker/search/foo/":          "/foo/",
+		"/api/v1/broker//search/a%2Fb?q=bar":  "/a%2Fb",
+		"/api/v1/broker/search/foo/bar?q=bar": "/foo/bar",
+	}
+	for path, expected := range tests {
+		u, _ := url.Parse(path)
+		stripped := StripPathSegments(u, 4)
+		if stripped.EscapedPath() != expected {
+			t.Errorf("%s: expected '%s', but got '%s'", path, expected, stripped.EscapedPath())
+		}
+		if stripped.RawQuery != u.RawQuery {
+			t.Errorf("%s: expected the query to be kept, but got '%s'", path, stripped.RawQuery)
+		}
+	}
+}
+
+func TestBuildBackendURL(t *testing.T) {
+	tests := []struct {
+		backend     string
+		stripPrefix string
+		request     string
+		expected    string
+	}{
+		{"https://api.x.com", "", "/", "https://api.x.com/"},
+		{"https://api.x.com", "", "/foo?q=bar", "https://api.x.com/foo?q=bar"},
+		{"https://api.x.com/v2/", "", "/foo/", "https://api.x.com/v2/foo/"},
+		{"https://api.x.com/v2?key=abc", "", "/foo?q=bar", "https://api.x.com/v2/foo?key=abc&q=bar"},
+		{"https://api.x.com/v2", "", "/a%2Fb", "https://api.x.com/v2/a%2Fb"},
+		{"https://api.x.com/v2", "/v1", "/v1/foo", "https://api.x.com/v2/foo"},
+		{"https://api.x.com/v2", "/v1/", "/v1", "https://api.x.com/v2"},
+		{"https://api.x.com/v2", "/v1", "/v10/foo", "https://api.x.com/v2/v10/foo"},
+		{"https://api.x.com/v2/items/{1}", "", "/42?q=bar", "https://api.x.com/v2/items/42?q=bar"},
+		{"https://api.x.com/v2/{2}/{1}", "/items", "/items/42/colour", "https://api.x.com/v2/colour/42"},
+	}
+	for _, test := range tests {
+		backendURL, _ := url.Parse(test.backend)
+		requestURL, _ := url.Parse(test.request)
+		target, err := BuildBackendURL(backendURL, test.stripPrefix, requestURL)
+		if err != nil {
+			t.Errorf("%s + %s: %s", test.backend, test.request, err.Error())
+			continue
+		}
+		if target.String() != test.expected {
+			t.Errorf("%s + %s: expected '%s', but got '%s'", test.backend, test.request, test.expected, target.String())
+		}
+	}
+
+	backendURL, _ := url.Parse("https://api.x.com/v2/items/{2}")
+	requestURL, _ := url.Parse("/42")
+	if _, err := BuildBackendURL(backendURL, "", requestURL); err == nil {
+		t.Error("Expected an error for a missing path segment")
+	}
+}
+
+func TestBuildBackendURLDotSegments(t *testing.T) {
+	for _, backend := range []string{"https://api.x.com/v2", "https://api.x.com/v2/items/{1}"} {
+		for _, request := range []string{"/..", "/../admin", "/foo/./bar", "/%2e%2e/admin", "/%2E%2e", "/a%2F..%2Fadmin", "/a%5C..%5Cadmin", "/%252e%252e/admin"} {
+			backendURL, _ := url.Parse(backend)
+			requestURL, _ := url.Parse(request)
+			if target, err := BuildBackendURL(backendURL, "", requestURL); !errors.Is(err, ErrDotSegment) {
+				t.Errorf("%s + %s: expected ErrDotSegment, but got %v (%v)", backend, request, target, err)
+			}
+		}
+	}
+
+	// Dots that aren't whole segments are fine
+	backendURL, _ := url.Parse("https://api.x.com/v2")
+	requestURL, _ := url.Parse("/v1.2/..foo/a..b/.well-known")
+	if target, err := BuildBackendURL(backendURL, "", requestURL); err != nil || target.Path != "/v2/v1.2/..foo/a..b/.well-known" {
+		t.Errorf("Expected the dots to be kept, but got %v (%v)", target, err)
+	}
+}
+
+func TestDoForwardsPathAndQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer server.Close()
+
+	upstream := &UpstreamImpl{
+		serviceName: "search",
+		Rule:        "random",
+		Backends: map[string]*UpstreamBackendImpl{
+			"items": {Url: server.URL + "/v2/items/{1}?key=abc", Weight: 1},
+			"bad":   {Url: server.URL + "/{0}", Weight: 1},
+		},
+	}
+	if err := upstream.Backpatch(); err == nil {
+		t.Error("Expected an error for a {0} placeholder")
+	}
+	delete(upstream.Backends, "bad")
+	if err := upstream.Backpatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/42?q=bar", nil)
+	resp, err := upstream.Backends["items"].Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "/v2/items/42?key=abc&q=bar" {
+		t.Errorf("Expected the backend to get '/v2/items/42?key=abc&q=bar', but it got '%s'", string(body))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := upstream.Backends["items"].Do(context.Background(), req); err == nil {
+		t.Error("Expected an error when the path has no segment for {1}")
+	}
+}
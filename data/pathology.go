@@ -1,9 +1,12 @@
 package data
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net/http"
 	"strings"
 	"time"
 
@@ -20,6 +23,7 @@ type Pathology interface {
 	HasCDF
 	GetProfileName() string
 	SelectResponse() *HttpResponse
+	Do(ctx context.Context, req *http.Request) (*http.Response, error)
 }
 
 type PathologyImpl struct {
@@ -133,3 +137,74 @@ func (p *PathologyImpl) Handle(c *gin.Context) {
 	// Response body
 	c.Writer.Write([]byte(resp.Body))
 }
+
+// Do is the same as Handle, but returns the response instead of
+// writing it (e.g. so that a broker backend can pretend that it came
+// from the real thing).  The delay gives up when the context is
+// done
+func (p *PathologyImpl) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp := p.SelectResponse()
+	if resp == nil {
+		pathologyErrors.WithLabelValues(
+			p.profile,                 // profile
+			p.name,                    // pathology
+			strings.ToLower(req.Host), // host
+			req.Method,                // method
+			"",                        // code
+		).Inc()
+		return nil, fmt.Errorf("%s.Do(%s): no response configured", p.name, req.URL.String())
+	}
+	pathologyRequests.WithLabelValues(
+		p.profile,                 // profile
+		p.name,                    // pathology
+		strings.ToLower(req.Host), // host
+		req.Method,                // method
+		fmt.Sprint(resp.Code),     // code
+	).Inc()
+
+	now := time.Now().UTC().UnixMilli()
+	defer func(now int64) {
+		pathologyLatency.WithLabelValues(
+			p.profile,                 // profile
+			p.name,                    // pathology
+			strings.ToLower(req.Host), // host
+			req.Method,                // method
+			fmt.Sprint(resp.Code),     // code
+		).Add(float64(time.Now().UTC().UnixMilli() - now))
+	}(now)
+
+	// delay for the configured amount of time
+	if resp.GetDuration() != nil && resp.GetDuration().Milliseconds() > 0 {
+		timer := time.NewTimer(*resp.GetDuration())
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	pathologyResponses.WithLabelValues(
+		p.profile,                 // profile
+		p.name,                    // pathology
+		strings.ToLower(req.Host), // host
+		req.Method,                // method
+		fmt.Sprint(resp.Code),     // code
+	).Inc()
+
+	headers := resp.Headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", resp.Code, http.StatusText(resp.Code)),
+		StatusCode:    resp.Code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        headers,
+		Body:          io.NopCloser(strings.NewReader(resp.Body)),
+		ContentLength: int64(len(resp.Body)),
+		Request:       req,
+	}, nil
+}
@@ -2,20 +2,38 @@ package data
 
 import (
 	"strings"
+	"sync"
 )
 
 var profileRegistry ProfileRegistry
+var profileRegistryMutex sync.RWMutex
 
 func init() {
-	profileRegistry = &ProfileRegistryImpl{
+	profileRegistry = NewProfileRegistry()
+}
+
+// NewProfileRegistry returns an empty registry
+func NewProfileRegistry() ProfileRegistry {
+	return &ProfileRegistryImpl{
 		pathologiesByName: make(map[string]PathologyProfile),
 	}
 }
 
+// GetProfileRegistry returns the live registry (i.e. the one from
+// the config that is currently active)
 func GetProfileRegistry() ProfileRegistry {
+	profileRegistryMutex.RLock()
+	defer profileRegistryMutex.RUnlock()
 	return profileRegistry
 }
 
+// setProfileRegistry makes the registry the live one
+func setProfileRegistry(registry ProfileRegistry) {
+	profileRegistryMutex.Lock()
+	defer profileRegistryMutex.Unlock()
+	profileRegistry = registry
+}
+
 type ProfileRegistry interface {
 	Register(profile PathologyProfile)
 	GetPathologyProfile(name string) PathologyProfile
@@ -37,9 +55,7 @@ func (hr *ProfileRegistryImpl) Register(profile PathologyProfile) {
 // from the provided config
 func LoadRegistryFromConfig(appConfig *AppConfig) error {
 	// Instantiate the registry
-	profileRegistry = &ProfileRegistryImpl{
-		pathologiesByName: make(map[string]PathologyProfile),
-	}
+	setProfileRegistry(NewProfileRegistry())
 
 	// Parse and validate the config
 
@@ -0,0 +1,187 @@
+package data
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamActivePriority = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_active_priority",
+		Help:      "The priority tier that the priority rule is sending traffic to, keyed by upstream",
+	},
+	[]string{"upstream"},
+)
+
+const (
+	// How long a better tier has to be available before we go back
+	// to it
+	DEFAULT_PRIORITY_RECOVERY_MILLIS = 30000
+)
+
+// HasPriority is used by the priority rule to group things into
+// tiers.  Lower is better
+type HasPriority interface {
+	GetPriority() int
+}
+
+func getPriority(item HasCDF) int {
+	if p, hasPriority := item.(HasPriority); hasPriority {
+		return p.GetPriority()
+	}
+	return 0
+}
+
+// priorityTiers groups the items by priority, best (lowest) first
+func priorityTiers(items []HasCDF) [][]HasCDF {
+	sorted := make([]HasCDF, len(items))
+	copy(sorted, items)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return getPriority(sorted[i]) < getPriority(sorted[j])
+	})
+
+	tiers := make([][]HasCDF, 0)
+	for i, item := range sorted {
+		if i == 0 || getPriority(item) != getPriority(sorted[i-1]) {
+			tiers = append(tiers, make([]HasCDF, 0))
+		}
+		tiers[len(tiers)-1] = append(tiers[len(tiers)-1], item)
+	}
+	return tiers
+}
+
+// ChoosePriority chooses (by weight) from the available items in the
+// best tier that has any.  If nothing is available, it chooses from
+// the best tier anyway.
+//
+// It has no memory, so it goes back to a better tier straight away.
+// Upstreams use PriorityImpl instead, which waits for the better tier
+// to recover
+func ChoosePriority(items []HasCDF, rng *rand.Rand) HasCDF {
+	if len(items) == 0 {
+		return nil
+	}
+
+	tiers := priorityTiers(items)
+	for _, tier := range tiers {
+		available := onlyAvailable(tier)
+		if len(available) > 0 {
+			return ChooseWeighted(rng.Float64(), available)
+		}
+	}
+
+	return ChooseWeighted(rng.Float64(), tiers[0])
+}
+
+// PriorityImpl remembers which tier the priority rule is using, so
+// that we don't flap back to a better tier the moment it looks
+// healthy again
+type PriorityImpl struct {
+	upstreamName string
+	recovery     time.Duration
+
+	mutex          sync.Mutex
+	hasActive      bool
+	activePriority int
+
+	// When each tier became available (the zero time if it is not)
+	availableSince map[int]time.Time
+}
+
+func NewPriority(upstreamName string, recoveryMillis int64) *PriorityImpl {
+	if recoveryMillis <= 0 {
+		recoveryMillis = DEFAULT_PRIORITY_RECOVERY_MILLIS
+	}
+	return &PriorityImpl{
+		upstreamName:   upstreamName,
+		recovery:       time.Duration(recoveryMillis) * time.Millisecond,
+		availableSince: make(map[int]time.Time),
+	}
+}
+
+// Choose chooses (by weight) from the available items in the best
+// tier that has any.  A tier that is better than the one we are using
+// has to have been available for the recovery period before we go
+// back to it.
+//
+// The items are the candidates that are left, so a tier that isn't
+// in them (e.g. because its backends are unhealthy, or their circuits
+// are open) isn't available, and has to recover all over again.
+//
+// If update is false (e.g. when we are failing over or hedging, and
+// the items are missing the ones we have already tried), then we
+// don't change tiers
+func (p *PriorityImpl) Choose(items []HasCDF, rng *rand.Rand, update bool) HasCDF {
+	if len(items) == 0 {
+		return nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	tiers := priorityTiers(items)
+	if update {
+		p.updateAvailable(tiers, now)
+	}
+	for _, tier := range tiers {
+		priority := getPriority(tier[0])
+		available := onlyAvailable(tier)
+		if len(available) == 0 {
+			continue
+		}
+
+		since, seen := p.availableSince[priority]
+		if !seen {
+			since = now
+		}
+
+		// Wait for a better tier to recover before we go back to it
+		if p.hasActive && priority < p.activePriority && now.Sub(since) < p.recovery {
+			continue
+		}
+
+		if update && (!p.hasActive || p.activePriority != priority) {
+			p.hasActive = true
+			p.activePriority = priority
+			upstreamActivePriority.WithLabelValues(p.upstreamName).Set(float64(priority))
+		}
+		return ChooseWeighted(rng.Float64(), available)
+	}
+
+	return ChooseWeighted(rng.Float64(), tiers[0])
+}
+
+// updateAvailable notes when each tier became available, and forgets
+// the tiers that aren't
+func (p *PriorityImpl) updateAvailable(tiers [][]HasCDF, now time.Time) {
+	available := make(map[int]bool)
+	for _, tier := range tiers {
+		if len(onlyAvailable(tier)) > 0 {
+			available[getPriority(tier[0])] = true
+		}
+	}
+	for priority := range p.availableSince {
+		if !available[priority] {
+			delete(p.availableSince, priority)
+		}
+	}
+	for priority := range available {
+		if _, seen := p.availableSince[priority]; !seen {
+			p.availableSince[priority] = now
+		}
+	}
+}
+
+// GetActivePriority returns the tier that we are using (if any)
+func (p *PriorityImpl) GetActivePriority() (int, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.activePriority, p.hasActive
+}
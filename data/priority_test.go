@@ -0,0 +1,102 @@
+package data
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestChoosePriority(t *testing.T) {
+	aws := &UpstreamBackendImpl{backendName: "aws", Weight: 1}
+	azure := &UpstreamBackendImpl{backendName: "azure", Weight: 1, Priority: 1}
+	google := &UpstreamBackendImpl{backendName: "google", Weight: 1, Priority: 1}
+	items := []HasCDF{google, azure, aws}
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+		if choice := Choose("priority", items, rng); choice != aws {
+			t.Fatalf("Expected 'aws', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+		}
+	}
+
+	// When the best tier is down, the next tier shares the load
+	aws.SetState(UNHEALTHY)
+	chosen := make(map[HasCDF]int)
+	for i := 0; i < 100; i++ {
+		chosen[Choose("priority", items, rng)]++
+	}
+	if chosen[aws] != 0 || chosen[azure] == 0 || chosen[google] == 0 {
+		t.Errorf("Expected azure and google to share the load, but got aws=%d, azure=%d, google=%d", chosen[aws], chosen[azure], chosen[google])
+	}
+}
+
+func TestPriorityRecovery(t *testing.T) {
+	aws := &UpstreamBackendImpl{backendName: "aws", Weight: 1}
+	azure := &UpstreamBackendImpl{backendName: "azure", Weight: 1, Priority: 1}
+	items := []HasCDF{aws, azure}
+	rng := rand.New(rand.NewSource(1))
+	priority := NewPriority("test", 50)
+
+	if choice := priority.Choose(items, rng, true); choice != aws {
+		t.Fatalf("Expected 'aws', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+
+	aws.SetState(CIRCUIT_OPEN)
+	if choice := priority.Choose(items, rng, true); choice != azure {
+		t.Fatalf("Expected 'azure', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+
+	// We don't go back to aws until it has recovered ...
+	aws.SetState(HEALTHY)
+	if choice := priority.Choose(items, rng, true); choice != azure {
+		t.Fatalf("Expected to stay on 'azure', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+
+	// ... and failing over doesn't change the tier
+	time.Sleep(60 * time.Millisecond)
+	if choice := priority.Choose([]HasCDF{aws}, rng, false); choice != aws {
+		t.Fatalf("Expected 'aws', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+	if active, _ := priority.GetActivePriority(); active != 1 {
+		t.Fatalf("Expected the active priority to be 1, but got %d", active)
+	}
+
+	if choice := priority.Choose(items, rng, true); choice != aws {
+		t.Fatalf("Expected to go back to 'aws', but got '%s'", choice.(*UpstreamBackendImpl).GetName())
+	}
+	if active, _ := priority.GetActivePriority(); active != 0 {
+		t.Errorf("Expected the active priority to be 0, but got %d", active)
+	}
+}
+
+func TestPriorityRecoveryThroughUpstream(t *testing.T) {
+	upstream := newTestUpstream(t, "priority", &UpstreamImpl{
+		Rule:                   "priority",
+		PriorityRecoveryMillis: 50,
+		Backends: map[string]*UpstreamBackendImpl{
+			"aws":   {Url: "http://aws", Weight: 1},
+			"azure": {Url: "http://azure", Weight: 1, Priority: 1},
+		},
+	})
+	if backend := upstream.ChooseBackend("", ""); backend.GetName() != "aws" {
+		t.Fatalf("Expected 'aws', but got '%s'", backend.GetName())
+	}
+
+	// aws drops out of the candidates altogether ...
+	upstream.Backends["aws"].SetState(UNHEALTHY)
+	if backend := upstream.ChooseBackend("", ""); backend.GetName() != "azure" {
+		t.Fatalf("Expected 'azure', but got '%s'", backend.GetName())
+	}
+	time.Sleep(80 * time.Millisecond)
+
+	// ... so it has to recover from when it came back, not from
+	// when it was first seen
+	upstream.Backends["aws"].SetState(HEALTHY)
+	if backend := upstream.ChooseBackend("", ""); backend.GetName() != "azure" {
+		t.Fatalf("Expected to stay on 'azure', but got '%s'", backend.GetName())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if backend := upstream.ChooseBackend("", ""); backend.GetName() != "aws" {
+		t.Errorf("Expected to go back to 'aws', but got '%s'", backend.GetName())
+	}
+}
@@ -1,12 +1,15 @@
 package data
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -15,16 +18,45 @@ import (
 type Recorder interface {
 	SaveRequest(req *GatewayRequest) error
 	SaveResponse(resp *GatewayResponse) error
+	SaveDiff(diff *ShadowDiff) error
+	SaveTranscript(transcript *WebSocketTranscript) error
 }
 
+const (
+	DEFAULT_RECORDER_MAX_BODY_BYTES = 10 * 1024 * 1024
+
+	// A response body of up to this size (that isn't streamed) is
+	// recorded in the response itself, rather than a file of its own
+	RECORDER_INLINE_BODY_BYTES = 64 * 1024
+)
+
 type RecorderImpl struct {
-	Requests      string `yaml:"requests" json:"requests"`
-	Responses     string `yaml:"responses" json:"responses"`
-	requestsChan  chan *GatewayRequest
-	responsesChan chan *GatewayResponse
+	Requests  string `yaml:"requests" json:"requests"`
+	Responses string `yaml:"responses" json:"responses"`
+
+	// Only this much of a body is recorded (10MB if it isn't set)
+	MaxBodyBytes int64 `yaml:"max_body_bytes,omitempty" json:"max_body_bytes,omitempty"`
+
+	requestsChan    chan *GatewayRequest
+	responsesChan   chan *GatewayResponse
+	diffsChan       chan *ShadowDiff
+	transcriptsChan chan *WebSocketTranscript
+
+	// The worker is only started once (the recorder can be shared,
+	// and backpatched more than once), and is stopped when the
+	// config is reloaded
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan interface{}
 }
 
 func (r *RecorderImpl) Backpatch() error {
+	if r.MaxBodyBytes < 0 {
+		return fmt.Errorf("Backpatch(recorder): max_body_bytes can't be negative, but is %d", r.MaxBodyBytes)
+	}
+	if r.MaxBodyBytes == 0 {
+		r.MaxBodyBytes = DEFAULT_RECORDER_MAX_BODY_BYTES
+	}
 	if r.Requests != "" {
 		os.MkdirAll(r.Requests, 0755)
 	}
@@ -34,22 +66,211 @@ func (r *RecorderImpl) Backpatch() error {
 		}
 	}
 
-	r.requestsChan = make(chan *GatewayRequest, 100)
-	r.responsesChan = make(chan *GatewayResponse, 100)
-	go r.saveWorker()
+	r.startOnce.Do(func() {
+		r.requestsChan = make(chan *GatewayRequest, 100)
+		r.responsesChan = make(chan *GatewayResponse, 100)
+		r.diffsChan = make(chan *ShadowDiff, 100)
+		r.transcriptsChan = make(chan *WebSocketTranscript, 100)
+		r.stop = make(chan interface{})
+		go r.saveWorker()
+	})
 	return nil
 }
 
+// Stop saves whatever has been queued, and then stops the worker.
+// Anything saved after that is dropped
+func (r *RecorderImpl) Stop() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		if r.stop != nil {
+			close(r.stop)
+		}
+	})
+}
+
+// isStopped is true if the recorder has been stopped
+func (r *RecorderImpl) isStopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 func (r *RecorderImpl) SaveRequest(req *GatewayRequest) error {
-	if req != nil {
-		r.requestsChan <- req
+	if req == nil {
+		return nil
+	}
+	if max := r.getMaxBodyBytes(); int64(len(req.Body)) > max {
+		req.Body = req.Body[:max]
+		req.BodyTruncated = true
+	}
+	if r.isStopped() {
+		return fmt.Errorf("SaveRequest(%s): the recorder has been stopped", req.Id)
+	}
+	select {
+	case r.requestsChan <- req:
+	case <-r.stop:
+		return fmt.Errorf("SaveRequest(%s): the recorder has been stopped", req.Id)
 	}
 	return nil
 }
 
 func (r *RecorderImpl) SaveResponse(resp *GatewayResponse) error {
-	if resp != nil {
-		r.responsesChan <- resp
+	if resp == nil {
+		return nil
+	}
+	if r.isStopped() {
+		return fmt.Errorf("SaveResponse(%s): the recorder has been stopped", resp.Id)
+	}
+	select {
+	case r.responsesChan <- resp:
+	case <-r.stop:
+		return fmt.Errorf("SaveResponse(%s): the recorder has been stopped", resp.Id)
+	}
+	return nil
+}
+
+// SaveTranscript saves the frames that went back and forth over a
+// WebSocket (alongside the responses)
+func (r *RecorderImpl) SaveTranscript(transcript *WebSocketTranscript) error {
+	if transcript == nil {
+		return nil
+	}
+	if r.isStopped() {
+		return fmt.Errorf("SaveTranscript(%s): the recorder has been stopped", transcript.Id)
+	}
+	select {
+	case r.transcriptsChan <- transcript:
+	case <-r.stop:
+		return fmt.Errorf("SaveTranscript(%s): the recorder has been stopped", transcript.Id)
+	}
+	return nil
+}
+
+// RecordResponse saves the response once its body has been closed.
+//
+// A small body (up to 64KB) whose length is known up front is kept
+// in the response, as it always was.  Anything else is copied to
+// ${ID}-response.body (up to max_body_bytes) as the caller reads it,
+// so that a stream gets to the caller as it arrives
+func (r *RecorderImpl) RecordResponse(resp *GatewayResponse, body io.ReadCloser, inline bool) io.ReadCloser {
+	if resp == nil || body == nil {
+		return body
+	}
+
+	recording := &recordingBody{
+		ReadCloser: body,
+		recorder:   r,
+		resp:       resp,
+		remaining:  r.getMaxBodyBytes(),
+	}
+	if r.Responses == "" {
+		return recording
+	}
+	if inline {
+		recording.buffer = &bytes.Buffer{}
+		recording.sink = recording.buffer
+		return recording
+	}
+
+	saveDir := r.getResponseDir(resp)
+	os.MkdirAll(saveDir, 0755)
+	resp.BodyFile = fmt.Sprintf("%s-response.body", resp.Id)
+	file, err := os.Create(filepath.Join(saveDir, resp.BodyFile))
+	if err != nil {
+		log.Printf("RecordResponse(%s): %s", resp.Id, err.Error())
+		resp.BodyFile = ""
+		return recording
+	}
+	recording.file = file
+	recording.sink = file
+	return recording
+}
+
+// recordingBody tees the body of a response to a file (or a buffer)
+// as it is read
+type recordingBody struct {
+	io.ReadCloser
+	recorder  *RecorderImpl
+	resp      *GatewayResponse
+	sink      io.Writer
+	file      *os.File
+	buffer    *bytes.Buffer
+	remaining int64
+	closeOnce sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.sink != nil {
+		recorded := int64(n)
+		if recorded > b.remaining {
+			recorded = b.remaining
+			b.resp.BodyTruncated = true
+		}
+		if recorded > 0 {
+			if _, writeErr := b.sink.Write(p[:recorded]); writeErr != nil {
+				log.Printf("RecordResponse(%s): %s", b.resp.Id, writeErr.Error())
+				b.remaining = 0
+			} else {
+				b.remaining -= recorded
+				b.resp.BodyBytes += recorded
+			}
+		}
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.closeOnce.Do(func() {
+		if b.file != nil {
+			b.file.Close()
+		}
+		if b.buffer != nil {
+			b.resp.Body = b.buffer.Bytes()
+		}
+		if saveErr := b.recorder.SaveResponse(b.resp); saveErr != nil {
+			log.Println(saveErr)
+		}
+	})
+	return err
+}
+
+func (r *RecorderImpl) getMaxBodyBytes() int64 {
+	if r.MaxBodyBytes <= 0 {
+		return DEFAULT_RECORDER_MAX_BODY_BYTES
+	}
+	return r.MaxBodyBytes
+}
+
+func (r *RecorderImpl) getResponseDir(resp *GatewayResponse) string {
+	return makeDirectoryHierarchy(
+		r.Responses,
+		resp.Headers.Get(HEADER_X_FAULTMONKEY_API_CUSTOMER),
+		resp.Headers.Get(HEADER_X_FAULTMONKEY_TAG),
+		resp.Headers.Get(HEADER_X_FAULTMONKEY_UPSTREAM),
+		resp.Headers.Get(HEADER_X_FAULTMONKEY_BACKEND),
+	)
+}
+
+// SaveDiff saves the differences between the responses of the
+// primary and the shadow backend (alongside the responses)
+func (r *RecorderImpl) SaveDiff(diff *ShadowDiff) error {
+	if diff == nil {
+		return nil
+	}
+	if r.isStopped() {
+		return fmt.Errorf("SaveDiff(%s): the recorder has been stopped", diff.Id)
+	}
+	select {
+	case r.diffsChan <- diff:
+	case <-r.stop:
+		return fmt.Errorf("SaveDiff(%s): the recorder has been stopped", diff.Id)
 	}
 	return nil
 }
@@ -65,7 +286,7 @@ var filesSaved = promauto.NewCounterVec(
 	prometheus.CounterOpts{
 		Namespace: "faultmonkey",
 		Name:      "files_saved",
-		Help:      "The number of files saved, keyed by upstream/backend and type (request/response)",
+		Help:      "The number of files saved, keyed by upstream/backend and type (request/response/diff/websocket)",
 	},
 	[]string{"upstream", "backend", "type"},
 )
@@ -73,7 +294,7 @@ var filesSavedErrors = promauto.NewCounterVec(
 	prometheus.CounterOpts{
 		Namespace: "faultmonkey",
 		Name:      "files_saved_errors",
-		Help:      "The number of files saved, keyed by upstream/backend and type (request/response)",
+		Help:      "The number of files saved, keyed by upstream/backend and type (request/response/diff/websocket)",
 	},
 	[]string{"upstream", "backend", "type"},
 )
@@ -102,60 +323,130 @@ func (r *RecorderImpl) saveWorker() {
 		fileSaveWorkers.Dec()
 	}()
 	for {
-		var upstream string
-		var backend string
-		var id string
 		select {
 		case req := <-r.requestsChan:
-			id = req.Id
-			upstream = req.Headers.Get(HEADER_X_FAULTMONKEY_UPSTREAM)
-			backend = req.Headers.Get(HEADER_X_FAULTMONKEY_BACKEND)
-			filesSaved.WithLabelValues(upstream, backend, "request").Inc()
-			jsonBytes, err := json.MarshalIndent(req, "", "  ")
-			if err != nil {
-				filesSavedErrors.WithLabelValues(upstream, backend, "request").Inc()
-				log.Printf("saveWorker(): request %s: %s", id, jsonBytes)
-				continue
-			}
-			saveDir := makeDirectoryHierarchy(
-				r.Requests,
-				req.Headers.Get(HEADER_X_FAULTMONKEY_API_CUSTOMER),
-				req.Headers.Get(HEADER_X_FAULTMONKEY_TAG),
-				req.Headers.Get(HEADER_X_FAULTMONKEY_UPSTREAM),
-				req.Headers.Get(HEADER_X_FAULTMONKEY_BACKEND),
-			)
-			os.MkdirAll(saveDir, 0755)
-			filename := filepath.Join(saveDir, fmt.Sprintf("%s-request.json", id))
-			err = os.WriteFile(filename, jsonBytes, 0644)
-			if err != nil {
-				filesSavedErrors.WithLabelValues(upstream, backend, "request").Inc()
-				log.Printf("saveWorker(): request %s: %s", id, jsonBytes)
-				continue
-			}
+			r.saveRequest(req)
 
 		case resp := <-r.responsesChan:
-			id = resp.Id
-			jsonBytes, err := json.MarshalIndent(resp, "", "  ")
-			if err != nil {
-				log.Printf("saveWorker(): response %s: %s", id, jsonBytes)
-				continue
-			}
-			filesSaved.WithLabelValues(upstream, backend, "response").Inc()
-			saveDir := makeDirectoryHierarchy(
-				r.Responses,
-				resp.Headers.Get(HEADER_X_FAULTMONKEY_API_CUSTOMER),
-				resp.Headers.Get(HEADER_X_FAULTMONKEY_TAG),
-				resp.Headers.Get(HEADER_X_FAULTMONKEY_UPSTREAM),
-				resp.Headers.Get(HEADER_X_FAULTMONKEY_BACKEND),
-			)
-			os.MkdirAll(saveDir, 0755)
-			filename := filepath.Join(saveDir, fmt.Sprintf("%s-response.json", id))
-			err = os.WriteFile(filename, jsonBytes, 0644)
-			if err != nil {
-				filesSavedErrors.WithLabelValues(upstream, backend, "response").Inc()
-				log.Printf("saveWorker(): response %s: %s", id, jsonBytes)
-				continue
+			r.saveResponse(resp)
+
+		case diff := <-r.diffsChan:
+			r.saveDiff(diff)
+
+		case transcript := <-r.transcriptsChan:
+			r.saveTranscript(transcript)
+
+		case <-r.stop:
+			// Save whatever is still queued
+			for {
+				select {
+				case req := <-r.requestsChan:
+					r.saveRequest(req)
+				case resp := <-r.responsesChan:
+					r.saveResponse(resp)
+				case diff := <-r.diffsChan:
+					r.saveDiff(diff)
+				case transcript := <-r.transcriptsChan:
+					r.saveTranscript(transcript)
+				default:
+					return
+				}
 			}
 		}
 	}
 }
+
+func (r *RecorderImpl) saveRequest(req *GatewayRequest) {
+	id := req.Id
+	upstream := req.Headers.Get(HEADER_X_FAULTMONKEY_UPSTREAM)
+	backend := req.Headers.Get(HEADER_X_FAULTMONKEY_BACKEND)
+	filesSaved.WithLabelValues(upstream, backend, "request").Inc()
+	jsonBytes, err := json.MarshalIndent(req, "", "  ")
+	if err != nil {
+		filesSavedErrors.WithLabelValues(upstream, backend, "request").Inc()
+		log.Printf("saveWorker(): request %s: %s", id, jsonBytes)
+		return
+	}
+	saveDir := makeDirectoryHierarchy(
+		r.Requests,
+		req.Headers.Get(HEADER_X_FAULTMONKEY_API_CUSTOMER),
+		req.Headers.Get(HEADER_X_FAULTMONKEY_TAG),
+		req.Headers.Get(HEADER_X_FAULTMONKEY_UPSTREAM),
+		req.Headers.Get(HEADER_X_FAULTMONKEY_BACKEND),
+	)
+	os.MkdirAll(saveDir, 0755)
+	filename := filepath.Join(saveDir, fmt.Sprintf("%s-request.json", id))
+	err = os.WriteFile(filename, jsonBytes, 0644)
+	if err != nil {
+		filesSavedErrors.WithLabelValues(upstream, backend, "request").Inc()
+		log.Printf("saveWorker(): request %s: %s", id, jsonBytes)
+	}
+}
+
+func (r *RecorderImpl) saveResponse(resp *GatewayResponse) {
+	id := resp.Id
+	upstream := resp.Headers.Get(HEADER_X_FAULTMONKEY_UPSTREAM)
+	backend := resp.Headers.Get(HEADER_X_FAULTMONKEY_BACKEND)
+	jsonBytes, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		log.Printf("saveWorker(): response %s: %s", id, jsonBytes)
+		return
+	}
+	filesSaved.WithLabelValues(upstream, backend, "response").Inc()
+	saveDir := r.getResponseDir(resp)
+	os.MkdirAll(saveDir, 0755)
+	filename := filepath.Join(saveDir, fmt.Sprintf("%s-response.json", id))
+	err = os.WriteFile(filename, jsonBytes, 0644)
+	if err != nil {
+		filesSavedErrors.WithLabelValues(upstream, backend, "response").Inc()
+		log.Printf("saveWorker(): response %s: %s", id, jsonBytes)
+	}
+}
+
+func (r *RecorderImpl) saveDiff(diff *ShadowDiff) {
+	id := diff.Id
+	jsonBytes, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		log.Printf("saveWorker(): diff %s: %s", id, err.Error())
+		return
+	}
+	filesSaved.WithLabelValues(diff.Upstream, diff.Shadow, "diff").Inc()
+	saveDir := makeDirectoryHierarchy(
+		r.Responses,
+		diff.Headers.Get(HEADER_X_FAULTMONKEY_API_CUSTOMER),
+		diff.Headers.Get(HEADER_X_FAULTMONKEY_TAG),
+		diff.Upstream,
+		diff.Shadow,
+	)
+	os.MkdirAll(saveDir, 0755)
+	filename := filepath.Join(saveDir, fmt.Sprintf("%s-diff.json", id))
+	err = os.WriteFile(filename, jsonBytes, 0644)
+	if err != nil {
+		filesSavedErrors.WithLabelValues(diff.Upstream, diff.Shadow, "diff").Inc()
+		log.Printf("saveWorker(): diff %s: %s", id, err.Error())
+	}
+}
+
+func (r *RecorderImpl) saveTranscript(transcript *WebSocketTranscript) {
+	id := transcript.Id
+	jsonBytes, err := json.MarshalIndent(transcript, "", "  ")
+	if err != nil {
+		log.Printf("saveWorker(): websocket %s: %s", id, err.Error())
+		return
+	}
+	filesSaved.WithLabelValues(transcript.Upstream, transcript.Backend, "websocket").Inc()
+	saveDir := makeDirectoryHierarchy(
+		r.Responses,
+		transcript.Headers.Get(HEADER_X_FAULTMONKEY_API_CUSTOMER),
+		transcript.Headers.Get(HEADER_X_FAULTMONKEY_TAG),
+		transcript.Upstream,
+		transcript.Backend,
+	)
+	os.MkdirAll(saveDir, 0755)
+	filename := filepath.Join(saveDir, fmt.Sprintf("%s-websocket.json", id))
+	err = os.WriteFile(filename, jsonBytes, 0644)
+	if err != nil {
+		filesSavedErrors.WithLabelValues(transcript.Upstream, transcript.Backend, "websocket").Inc()
+		log.Printf("saveWorker(): websocket %s: %s", id, err.Error())
+	}
+}
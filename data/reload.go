@@ -0,0 +1,171 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Stoppable is anything with background work that has to be
+// stopped when its config is replaced (e.g. a client.Attenuator)
+type Stoppable interface {
+	Stop()
+}
+
+// Activatable is anything that is built with its config, but only
+// takes over from the old one when the config becomes the live one
+// (e.g. the pulse of a client.Attenuator)
+type Activatable interface {
+	Activate()
+}
+
+// Activate makes this config the live one, i.e. the attenuators and
+// pathology profiles that are looked up by name come from it.
+//
+// Anything that was backpatched from the old config (e.g. requests
+// that are already in flight) carries on using the old one
+func (a *AppConfig) Activate() {
+	for _, throttle := range a.getThrottles() {
+		if activatable, ok := throttle.(Activatable); ok {
+			activatable.Activate()
+		}
+	}
+	setThrottleRegistry(a.Config.Attenuators.registry)
+	setProfileRegistry(a.Config.profileRegistry)
+}
+
+// CarryOver copies the state that somebody asked for at runtime from
+// the live config (old) to this one, for the backends that are in
+// both (with the same upstream and backend name).
+//
+// Disabled (and draining) backends stay disabled, and a weight that
+// was changed at runtime is kept (unless the config changes it too).
+// Everything else (rollouts, circuit breakers, ejections and
+// healthchecks) starts again, which is logged
+func (a *AppConfig) CarryOver(old *AppConfig) {
+	oldUpstreams := old.getUpstreams()
+	for upstreamName, upstream := range a.getUpstreams() {
+		oldUpstream, exists := oldUpstreams[upstreamName]
+		if !exists {
+			continue
+		}
+		for backendName, backend := range upstream.Backends {
+			if oldBackend, exists := oldUpstream.Backends[backendName]; exists {
+				upstream.carryOver(backend, oldUpstream, oldBackend)
+			}
+		}
+	}
+}
+
+func (u *UpstreamImpl) carryOver(backend *UpstreamBackendImpl, oldUpstream *UpstreamImpl, oldBackend *UpstreamBackendImpl) {
+	name := fmt.Sprintf("%s.%s", u.GetName(), backend.GetName())
+
+	// Nothing is in flight to the new backend, so one that was
+	// draining is drained
+	if state := oldBackend.getHealthState(); isAdminState(state) {
+		backend.SetState(DISABLED)
+		log.Printf("CarryOver(%s): was %s, so stays %s", name, state, DISABLED)
+	}
+
+	if oldUpstream.isRollingOut(oldBackend.GetName()) {
+		log.Printf("CarryOver(%s): the rollout has been stopped at weight %d", name, oldBackend.GetWeight())
+	}
+	if weight := oldBackend.GetWeight(); weight != oldBackend.configWeight {
+		if backend.configWeight == oldBackend.configWeight {
+			u.setWeight(backend, weight)
+			log.Printf("CarryOver(%s): keeping weight %d", name, weight)
+		} else {
+			log.Printf("CarryOver(%s): weight %d (from the config) replaces weight %d", name, backend.configWeight, weight)
+		}
+	}
+
+	if oldBackend.isEjected() {
+		log.Printf("CarryOver(%s): was ejected, and is back in service", name)
+	}
+	if oldBackend.CircuitBreaker != nil {
+		if state := oldBackend.CircuitBreaker.GetState(); state != CLOSED {
+			log.Printf("CarryOver(%s): the circuit breaker was %s, and is %s again", name, state, CLOSED)
+		}
+	}
+}
+
+// GetInflight returns the number of broker requests that are in
+// flight to the backends of this config
+func (a *AppConfig) GetInflight() int64 {
+	inflight := int64(0)
+	for _, upstream := range a.getUpstreams() {
+		for _, backend := range upstream.Backends {
+			inflight += backend.GetInflight()
+		}
+	}
+	return inflight
+}
+
+// Retire stops the background work of a config once it has been
+// replaced by a new one.
+//
+// The rollouts and healthchecks stop straight away.  The recorders
+// and attenuators keep going until the requests in flight have
+// finished (or the timeout), so they are still recorded and
+// attenuated
+func (a *AppConfig) Retire(timeout time.Duration) {
+	upstreams := a.getUpstreams()
+	for _, upstream := range upstreams {
+		upstream.StopRollouts()
+		for _, backend := range upstream.Backends {
+			backend.Stop()
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for a.GetInflight() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	if inflight := a.GetInflight(); inflight > 0 {
+		log.Printf("Retire(): giving up on %d requests in flight", inflight)
+	}
+
+	for _, upstream := range upstreams {
+		upstream.Recorder.Stop()
+		for _, backend := range upstream.Backends {
+			backend.Recorder.Stop()
+		}
+	}
+	for _, throttle := range a.getThrottles() {
+		stopThrottle(throttle)
+	}
+}
+
+// getThrottles returns the attenuators of the config, i.e. the ones in
+// the attenuator section, and the ones the backends have of their own
+func (a *AppConfig) getThrottles() []Throttle {
+	throttles := make([]Throttle, 0)
+	if a.Config.Attenuators.registry != nil {
+		for _, throttle := range a.Config.Attenuators.registry.GetThrottles() {
+			throttles = append(throttles, throttle)
+		}
+	}
+	for _, upstream := range a.getUpstreams() {
+		for _, backend := range upstream.Backends {
+			if throttle := backend.GetThrottle(); throttle != nil {
+				throttles = append(throttles, throttle)
+			}
+		}
+	}
+	return throttles
+}
+
+func (a *AppConfig) getUpstreams() map[string]*UpstreamImpl {
+	if a.Config.Broker == nil {
+		return nil
+	}
+	return a.Config.Broker.UpstreamFromConfig
+}
+
+// stopThrottle stops the attenuator (if it can be stopped).  The
+// attenuator only stops its pulse if the new config doesn't share it
+func stopThrottle(throttle Throttle) {
+	if stoppable, ok := throttle.(Stoppable); ok {
+		stoppable.Stop()
+	}
+}
@@ -0,0 +1,147 @@
+package data
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const reloadTestConfig = `
+config:
+  pathologies:
+    reloaded:
+      httpcode:
+        weight: 1
+        responses:
+          200:
+            weight: 1
+  attenuator:
+    reloaded:
+      hertz: 5
+  broker:
+    upstream:
+      search:
+        recorder:
+          requests: %s
+        backends:
+          google:
+            url: https://www.google.com
+`
+
+func writeReloadTestConfig(t *testing.T) string {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yml")
+	configBytes := []byte(fmt.Sprintf(reloadTestConfig, filepath.Join(dir, "requests")))
+	if err := os.WriteFile(configFile, configBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+func TestBuildConfigIsNotLive(t *testing.T) {
+	liveThrottles := GetThrottleRegistry()
+	liveProfiles := GetProfileRegistry()
+	t.Cleanup(func() {
+		setThrottleRegistry(liveThrottles)
+		setProfileRegistry(liveProfiles)
+	})
+
+	appConfig, err := BuildConfig(writeReloadTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appConfig.Retire(0)
+	if GetProfileRegistry().GetPathologyProfile("reloaded") != nil {
+		t.Error("Expected the profile to stay out of the live registry until the config is activated")
+	}
+	if _, exists := GetThrottleRegistry().LookupThrottle("reloaded"); exists {
+		t.Error("Expected the attenuator to stay out of the live registry until the config is activated")
+	}
+
+	appConfig.Activate()
+	if GetProfileRegistry().GetPathologyProfile("reloaded") == nil {
+		t.Error("Expected the profile to be live once the config is activated")
+	}
+	if _, exists := GetThrottleRegistry().LookupThrottle("reloaded"); !exists {
+		t.Error("Expected the attenuator to be live once the config is activated")
+	}
+}
+
+func TestBuildConfigRejectsBadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	badConfig := "config:\n  broker:\n    upstream:\n      search:\n        no_healthy_backends: wibble\n"
+	if err := os.WriteFile(configFile, []byte(badConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildConfig(configFile); err == nil {
+		t.Error("Expected an error for a bad no_healthy_backends")
+	}
+}
+
+func TestCarryOver(t *testing.T) {
+	configFile := writeReloadTestConfig(t)
+	for _, state := range []BackendState{DISABLED, DRAINING} {
+		oldConfig, err := BuildConfig(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer oldConfig.Retire(0)
+		oldUpstream := oldConfig.Config.Broker.UpstreamFromConfig["search"]
+		oldUpstream.Backends["google"].SetState(state)
+		if err := oldUpstream.SetWeight("google", 7); err != nil {
+			t.Fatal(err)
+		}
+
+		newConfig, err := BuildConfig(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer newConfig.Retire(0)
+		newConfig.CarryOver(oldConfig)
+		backend := newConfig.Config.Broker.UpstreamFromConfig["search"].Backends["google"]
+		if backend.GetState() != DISABLED {
+			t.Errorf("Expected a %s backend to be %s after a reload, but got %s", state, DISABLED, backend.GetState())
+		}
+		if backend.GetWeight() != 7 {
+			t.Errorf("Expected the weight to be kept, but got %d", backend.GetWeight())
+		}
+	}
+}
+
+func TestRetire(t *testing.T) {
+	appConfig, err := BuildConfig(writeReloadTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := appConfig.Config.Broker.UpstreamFromConfig["search"].Backends["google"]
+	recorder := appConfig.Config.Broker.UpstreamFromConfig["search"].Recorder
+
+	// Stopping a healthcheck that was never started doesn't block
+	backend.Stop()
+
+	// A request in flight holds up the recorder
+	backend.inflight.Add(1)
+	retired := make(chan bool)
+	go func() {
+		appConfig.Retire(time.Second)
+		close(retired)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	req := &GatewayRequest{GatewayBase: GatewayBase{Id: "inflight", Headers: http.Header{}}}
+	if err := recorder.SaveRequest(req); err != nil {
+		t.Errorf("Expected the recorder to keep going while requests are in flight, but got %s", err.Error())
+	}
+
+	backend.inflight.Add(-1)
+	select {
+	case <-retired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Retire() to finish once nothing is in flight")
+	}
+	if err := recorder.SaveRequest(req); err == nil {
+		t.Error("Expected the recorder to be stopped once the config is retired")
+	}
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The bodies a backend can be sent
+	BODY_FORMAT_JSON      = "json"
+	BODY_FORMAT_FORM      = "form"
+	BODY_FORMAT_MULTIPART = "multipart"
+)
+
+// RequestBodyImpl turns the body of the caller's request into the
+// body that a backend expects, e.g.
+//
+//	body:
+//	  format: json
+//	  fields:
+//	    config.language_code: {from: body.language, default: en-US}
+//	    media.uri: body.url
+//	    max_seconds: {from: body.max_millis, convert: scale, scale: 0.001}
+//	    customer: customer
+//
+// The fields are the same as those of a ResponseTransformImpl, where
+// the source is
+//
+//	body:     the caller's JSON (or form)
+//	params:   the caller's query
+//	headers:  the caller's headers (e.g. headers.X-Request-Id)
+//	customer: X-Faultmonkey-Api-Customer
+//
+// For a form (or multipart), an object is sent as JSON.
+type RequestBodyImpl struct {
+	// json (the default), form or multipart
+	Format string                   `yaml:"format,omitempty" json:"format,omitempty"`
+	Fields map[string]*FieldMapping `yaml:"fields" json:"fields"`
+}
+
+func (b *RequestBodyImpl) Backpatch(name string) error {
+	switch b.Format {
+	case "":
+		b.Format = BODY_FORMAT_JSON
+
+	case BODY_FORMAT_JSON, BODY_FORMAT_FORM, BODY_FORMAT_MULTIPART:
+
+	default:
+		return fmt.Errorf("Backpatch(%s): body format must be '%s', '%s' or '%s', but is '%s'", name, BODY_FORMAT_JSON, BODY_FORMAT_FORM, BODY_FORMAT_MULTIPART, b.Format)
+	}
+	if len(b.Fields) == 0 {
+		return fmt.Errorf("Backpatch(%s): a body template needs some fields", name)
+	}
+	return backpatchFields(name, b.Fields)
+}
+
+// Apply replaces the body of the request (which must be a copy, as
+// the headers are changed) with the one built from the template
+func (b *RequestBodyImpl) Apply(req *http.Request) error {
+	if b == nil {
+		return nil
+	}
+
+	source, err := getRequestBodySource(req)
+	if err != nil {
+		return err
+	}
+	fields, err := mapFields(b.Fields, source, "")
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	var contentType string
+	switch b.Format {
+	case BODY_FORMAT_FORM:
+		form := make(url.Values)
+		for _, name := range sortedFieldNames(fields) {
+			form[name] = formValues(fields[name])
+		}
+		body = []byte(form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+
+	case BODY_FORMAT_MULTIPART:
+		var buffer bytes.Buffer
+		writer := multipart.NewWriter(&buffer)
+		for _, name := range sortedFieldNames(fields) {
+			for _, value := range formValues(fields[name]) {
+				if err := writer.WriteField(name, value); err != nil {
+					return err
+				}
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		body = buffer.Bytes()
+		contentType = writer.FormDataContentType()
+
+	default:
+		body, err = json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.Header = req.Header.Clone()
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// getRequestBodySource is what the fields of the template can refer
+// to
+func getRequestBodySource(req *http.Request) (map[string]interface{}, error) {
+	headers := make(map[string]interface{})
+	for header, values := range req.Header {
+		if len(values) > 0 {
+			headers[header] = values[0]
+		}
+	}
+	params := make(map[string]interface{})
+	for param, values := range req.URL.Query() {
+		if len(values) > 0 {
+			params[param] = values[0]
+		}
+	}
+	source := map[string]interface{}{
+		"headers": headers,
+		"params":  params,
+	}
+	if customer := req.Header.Get(HEADER_X_FAULTMONKEY_API_CUSTOMER); customer != "" {
+		source["customer"] = customer
+	}
+
+	body, err := ReadBody(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading the body: %s", req.URL.String(), err.Error())
+	}
+	if len(body) == 0 {
+		return source, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: parsing the form: %s", req.URL.String(), err.Error())
+		}
+		fields := make(map[string]interface{})
+		for field, values := range form {
+			fields[field] = values[0]
+		}
+		source["body"] = fields
+
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"), mediaType == "":
+		var fields interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return nil, fmt.Errorf("%s: the body is not JSON: %s", req.URL.String(), err.Error())
+		}
+		source["body"] = fields
+
+	default:
+		return nil, fmt.Errorf("%s: can't build a body from '%s'", req.URL.String(), mediaType)
+	}
+	return source, nil
+}
+
+// formValues turns a field into form values (an array is repeated,
+// and an object is sent as JSON)
+func formValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, element := range v {
+			values = append(values, formValues(element)...)
+		}
+		return values
+
+	case map[string]interface{}:
+		encoded, _ := json.Marshal(v)
+		return []string{string(encoded)}
+	}
+	return []string{fmt.Sprint(value)}
+}
+
+func sortedFieldNames(fields map[string]interface{}) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,150 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const requestBodyTestConfig = `
+fields:
+  config.language_code: {from: body.language, default: en-US}
+  config.sample_rate: {from: body.sample_rate, convert: integer}
+  media.uri: body.url
+  max_seconds: {from: body.max_millis, convert: scale, scale: 0.001}
+  start: {from: body.start_millis, convert: timestamp, to: iso8601}
+  request_id: {from: headers.X-Request-Id, convert: string}
+  customer: customer
+`
+
+func newTestRequestBody(t *testing.T, format string) *RequestBodyImpl {
+	body := &RequestBodyImpl{}
+	if err := yaml.Unmarshal([]byte(requestBodyTestConfig), body); err != nil {
+		t.Fatal(err)
+	}
+	body.Format = format
+	if err := body.Backpatch("transcribe.aws.body"); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func newTestTranscribeRequest() *http.Request {
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/",
+		strings.NewReader(`{"url": "s3://bucket/video.mp4", "sample_rate": "16000", "max_millis": 90000, "start_millis": 1677672000000}`),
+	)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-Id", "abc")
+	req.Header.Set(HEADER_X_FAULTMONKEY_API_CUSTOMER, "acme")
+	return req
+}
+
+func TestRequestBodyJSON(t *testing.T) {
+	req := newTestTranscribeRequest()
+	if err := newTestRequestBody(t, "").Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if req.ContentLength != int64(len(body)) || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a JSON body of %d bytes, but got %d bytes of %s", len(body), req.ContentLength, req.Header.Get("Content-Type"))
+	}
+
+	var got interface{}
+	json.Unmarshal(body, &got)
+	var expected interface{}
+	json.Unmarshal([]byte(`{
+		"config": {"language_code": "en-US", "sample_rate": 16000},
+		"media": {"uri": "s3://bucket/video.mp4"},
+		"max_seconds": 90,
+		"start": "2023-03-01T12:00:00Z",
+		"request_id": "abc",
+		"customer": "acme"
+	}`), &expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, but got %v", expected, got)
+	}
+}
+
+func TestRequestBodyForm(t *testing.T) {
+	req := newTestTranscribeRequest()
+	if err := newTestRequestBody(t, BODY_FORMAT_FORM).Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		t.Errorf("Expected a form, but got %s", req.Header.Get("Content-Type"))
+	}
+	req.ParseForm()
+	if req.PostForm.Get("max_seconds") != "90" || req.PostForm.Get("media") != `{"uri":"s3://bucket/video.mp4"}` {
+		t.Errorf("Expected the fields in the form, but got %v", req.PostForm)
+	}
+}
+
+func TestRequestBodyMultipart(t *testing.T) {
+	req := newTestTranscribeRequest()
+	if err := newTestRequestBody(t, BODY_FORMAT_MULTIPART).Apply(req); err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		t.Fatalf("Expected multipart/form-data, but got %s", mediaType)
+	}
+	form, err := multipart.NewReader(req.Body, params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := form.Value["customer"]; len(values) != 1 || values[0] != "acme" {
+		t.Errorf("Expected the customer in the form, but got %v", form.Value)
+	}
+}
+
+func TestRequestBodyErrors(t *testing.T) {
+	if err := (&RequestBodyImpl{Format: "xml", Fields: map[string]*FieldMapping{"a": {}}}).Backpatch("transcribe.aws.body"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("<xml/>"))
+	req.Header.Set("Content-Type", "text/xml")
+	if err := newTestRequestBody(t, "").Apply(req); err == nil {
+		t.Error("Expected an error for a body we can't read")
+	}
+}
+
+func TestDoRecordsRewrittenBody(t *testing.T) {
+	var received []byte
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	})
+	upstream := newTestUpstream(t, "transcribe", &UpstreamImpl{
+		Rule: "random",
+		Backends: map[string]*UpstreamBackendImpl{
+			"aws": {Url: server, Weight: 1, Body: newTestRequestBody(t, "")},
+		},
+	})
+	aws := upstream.Backends["aws"]
+	aws.Recorder = &RecorderImpl{
+		requestsChan:  make(chan *GatewayRequest, 1),
+		responsesChan: make(chan *GatewayResponse, 1),
+		stop:          make(chan interface{}),
+	}
+
+	resp, err := aws.Do(context.Background(), newTestTranscribeRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	recorded := <-aws.Recorder.requestsChan
+	if string(recorded.Body) != string(received) || !strings.Contains(string(received), `"max_seconds":90`) {
+		t.Errorf("Expected the rewritten body to be sent and recorded, but sent %s and recorded %s", string(received), string(recorded.Body))
+	}
+}
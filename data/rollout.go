@@ -0,0 +1,271 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamRollbacks = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_rollbacks",
+		Help:      "The number of rollouts that were rolled back because of errors, keyed by upstream/backend",
+	},
+	[]string{"upstream", "backend"},
+)
+
+const (
+	// How often a rollout changes the weight (and checks whether it
+	// needs rolling back)
+	DEFAULT_ROLLOUT_STEP_MILLIS = 10000
+
+	// How much worse the error rate of the canary can be than the
+	// baseline before we roll back
+	DEFAULT_ROLLBACK_MAX_ERROR_RATE_DELTA = 0.05
+)
+
+// RollbackImpl says when a rollout is rolled back (i.e. the weight
+// of the canary goes back to zero)
+type RollbackImpl struct {
+	// The backend to compare the canary to.  If this is not set,
+	// then we compare it to the average of the other backends
+	Baseline string `yaml:"baseline,omitempty" json:"baseline,omitempty"`
+
+	// Roll back if the error rate of the canary is more than this
+	// much higher than the baseline (e.g. 0.05 is 5%)
+	MaxErrorRateDelta float64 `yaml:"max_error_rate_delta,omitempty" json:"max_error_rate_delta,omitempty"`
+
+	// The number of requests the canary has to have had (since the
+	// rollout started) before we judge it
+	MinRequests int64 `yaml:"min_requests,omitempty" json:"min_requests,omitempty"`
+}
+
+// RolloutImpl changes the weight of a backend, either straight away
+// or gradually (e.g. from 5 to 50 over 30 minutes)
+type RolloutImpl struct {
+	// The weight to start from (the current weight if this is not
+	// set)
+	From *int `yaml:"from,omitempty" json:"from,omitempty"`
+
+	// The weight to end up with
+	To int `yaml:"to" json:"to"`
+
+	// How long it takes to get from From to To (0 is straight away)
+	DurationMillis int64 `yaml:"duration_millis,omitempty" json:"duration_millis,omitempty"`
+
+	// How often the weight changes
+	StepMillis int64 `yaml:"step_millis,omitempty" json:"step_millis,omitempty"`
+
+	// How long to keep checking for a rollback once we have got to
+	// To
+	WatchMillis int64 `yaml:"watch_millis,omitempty" json:"watch_millis,omitempty"`
+
+	// If this is set, then the rollout is rolled back if the backend
+	// has too many errors
+	Rollback *RollbackImpl `yaml:"rollback,omitempty" json:"rollback,omitempty"`
+}
+
+func (r *RolloutImpl) Backpatch(upstream *UpstreamImpl, backendName string) error {
+	if r.To < 0 || (r.From != nil && *r.From < 0) {
+		return fmt.Errorf("Rollout(%s.%s): weights can't be negative", upstream.GetName(), backendName)
+	}
+	if r.DurationMillis < 0 || r.StepMillis < 0 || r.WatchMillis < 0 {
+		return fmt.Errorf("Rollout(%s.%s): durations can't be negative", upstream.GetName(), backendName)
+	}
+	if r.StepMillis == 0 {
+		r.StepMillis = DEFAULT_ROLLOUT_STEP_MILLIS
+	}
+	if r.DurationMillis > 0 && r.StepMillis > r.DurationMillis {
+		r.StepMillis = r.DurationMillis
+	}
+
+	if r.Rollback == nil {
+		return nil
+	}
+	if r.Rollback.Baseline != "" {
+		if r.Rollback.Baseline == backendName {
+			return fmt.Errorf("Rollout(%s.%s): a backend can't be its own baseline", upstream.GetName(), backendName)
+		}
+		if upstream.GetBackend(r.Rollback.Baseline) == nil {
+			return fmt.Errorf("Rollout(%s.%s): unknown baseline '%s'", upstream.GetName(), backendName, r.Rollback.Baseline)
+		}
+	}
+	if r.Rollback.MaxErrorRateDelta <= 0 {
+		r.Rollback.MaxErrorRateDelta = DEFAULT_ROLLBACK_MAX_ERROR_RATE_DELTA
+	}
+	if r.Rollback.MinRequests <= 0 {
+		r.Rollback.MinRequests = MIN_LATENCY_SAMPLES
+	}
+
+	return nil
+}
+
+// weightAt works out the weight at a point in the rollout
+func (r *RolloutImpl) weightAt(from int, elapsed time.Duration) int {
+	duration := time.Duration(r.DurationMillis) * time.Millisecond
+	if elapsed >= duration {
+		return r.To
+	}
+	return from + int(float64(r.To-from)*float64(elapsed)/float64(duration))
+}
+
+// SetWeight changes the weight of a backend straight away (stopping
+// any rollout), and rebuilds the CDF
+func (u *UpstreamImpl) SetWeight(backendName string, weight int) error {
+	return u.Rollout(backendName, &RolloutImpl{To: weight})
+}
+
+// Rollout changes the weight of a backend according to the rollout,
+// replacing any rollout that is already running for the backend
+func (u *UpstreamImpl) Rollout(backendName string, rollout *RolloutImpl) error {
+	backend, exists := u.Backends[backendName]
+	if !exists {
+		return fmt.Errorf("Rollout(%s.%s): No such backend", u.GetName(), backendName)
+	}
+	if err := rollout.Backpatch(u, backendName); err != nil {
+		return err
+	}
+
+	u.rolloutMutex.Lock()
+	defer u.rolloutMutex.Unlock()
+	if cancelFunc, isRunning := u.rollouts[backendName]; isRunning {
+		cancelFunc()
+		delete(u.rollouts, backendName)
+	}
+
+	from := backend.GetWeight()
+	if rollout.From != nil {
+		from = *rollout.From
+	}
+	if rollout.DurationMillis == 0 {
+		from = rollout.To
+	}
+	u.setWeight(backend, from)
+	if rollout.DurationMillis == 0 && (rollout.Rollback == nil || rollout.WatchMillis == 0) {
+		// Nothing else to do
+		return nil
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	if u.rollouts == nil {
+		u.rollouts = make(map[string]context.CancelFunc)
+	}
+	u.rollouts[backendName] = cancelFunc
+	_, startSamples := backend.GetErrorRate()
+	go u.runRollout(ctx, backend, rollout, from, startSamples)
+
+	return nil
+}
+
+// StopRollouts stops all of the rollouts, leaving the weights as
+// they are
+func (u *UpstreamImpl) StopRollouts() {
+	u.rolloutMutex.Lock()
+	defer u.rolloutMutex.Unlock()
+	for backendName, cancelFunc := range u.rollouts {
+		cancelFunc()
+		delete(u.rollouts, backendName)
+	}
+}
+
+// isRollingOut is true if a rollout is changing the weight of the
+// backend
+func (u *UpstreamImpl) isRollingOut(backendName string) bool {
+	u.rolloutMutex.Lock()
+	defer u.rolloutMutex.Unlock()
+	_, isRunning := u.rollouts[backendName]
+	return isRunning
+}
+
+// setWeight changes the weight of a backend, and rebuilds the CDF
+func (u *UpstreamImpl) setWeight(backend *UpstreamBackendImpl, weight int) {
+	if backend.GetWeight() == weight {
+		return
+	}
+	backend.setWeight(weight)
+	u.updateEligible()
+}
+
+// runRollout changes the weight at every step.  The canary is only
+// judged on the requests since startSamples
+func (u *UpstreamImpl) runRollout(ctx context.Context, backend *UpstreamBackendImpl, rollout *RolloutImpl, from int, startSamples int64) {
+	log.Printf("%s.%s: rolling out weight %d -> %d over %dms", u.GetName(), backend.GetName(), from, rollout.To, rollout.DurationMillis)
+	defer u.finishRollout(ctx, backend.GetName())
+
+	start := time.Now()
+	end := start.Add(time.Duration(rollout.DurationMillis+rollout.WatchMillis) * time.Millisecond)
+	ticker := time.NewTicker(time.Duration(rollout.StepMillis) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		if err := u.checkRollback(backend, rollout.Rollback, startSamples); err != nil {
+			log.Printf("%s.%s: rolling back: %s", u.GetName(), backend.GetName(), err.Error())
+			upstreamRollbacks.WithLabelValues(u.GetName(), backend.GetName()).Inc()
+			u.setWeight(backend, 0)
+			return
+		}
+
+		now := time.Now()
+		u.setWeight(backend, rollout.weightAt(from, now.Sub(start)))
+		if !now.Before(end) || (rollout.Rollback == nil && backend.GetWeight() == rollout.To) {
+			log.Printf("%s.%s: rolled out weight %d", u.GetName(), backend.GetName(), backend.GetWeight())
+			return
+		}
+	}
+}
+
+// finishRollout forgets about a rollout (unless it has already been
+// replaced by another one)
+func (u *UpstreamImpl) finishRollout(ctx context.Context, backendName string) {
+	u.rolloutMutex.Lock()
+	defer u.rolloutMutex.Unlock()
+	if ctx.Err() == nil {
+		u.rollouts[backendName]()
+		delete(u.rollouts, backendName)
+	}
+}
+
+// checkRollback returns an error if the error rate of the canary is
+// too much worse than the baseline
+func (u *UpstreamImpl) checkRollback(canary *UpstreamBackendImpl, rollback *RollbackImpl, startSamples int64) error {
+	if rollback == nil {
+		return nil
+	}
+	canaryErrorRate, canarySamples := canary.GetErrorRate()
+	if canarySamples-startSamples < rollback.MinRequests {
+		return nil
+	}
+
+	// Compare to the baseline, or the average of everything else
+	baselineErrorRate := float64(0)
+	baselines := 0
+	for backendName, backend := range u.Backends {
+		if backend == canary || (rollback.Baseline != "" && backendName != rollback.Baseline) {
+			continue
+		}
+		if errorRate, samples := backend.GetErrorRate(); samples > 0 {
+			baselineErrorRate += errorRate
+			baselines++
+		}
+	}
+	if baselines == 0 {
+		return nil
+	}
+	baselineErrorRate /= float64(baselines)
+
+	if canaryErrorRate-baselineErrorRate > rollback.MaxErrorRateDelta {
+		return fmt.Errorf("error rate %.3f is more than %.3f worse than the baseline %.3f", canaryErrorRate, rollback.MaxErrorRateDelta, baselineErrorRate)
+	}
+	return nil
+}
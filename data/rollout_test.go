@@ -0,0 +1,113 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func newRolloutTestUpstream(t *testing.T) *UpstreamImpl {
+	return newTestUpstream(t, "rollout", &UpstreamImpl{
+		Rule: "weighted",
+		Backends: map[string]*UpstreamBackendImpl{
+			"stable": {Url: "http://stable", Weight: 100},
+			"canary": {Url: "http://canary", Weight: 0},
+		},
+	})
+}
+
+func TestSetWeight(t *testing.T) {
+	upstream := newRolloutTestUpstream(t)
+	for i := 0; i < 100; i++ {
+		if backend := upstream.ChooseBackend("", ""); backend.GetName() != "stable" {
+			t.Fatalf("Expected 'stable', but got '%s'", backend.GetName())
+		}
+	}
+
+	if err := upstream.SetWeight("stable", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := upstream.SetWeight("canary", 10); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if backend := upstream.ChooseBackend("", ""); backend.GetName() != "canary" {
+			t.Fatalf("Expected 'canary', but got '%s'", backend.GetName())
+		}
+	}
+
+	if err := upstream.SetWeight("wibble", 10); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+	if err := upstream.SetWeight("canary", -1); err == nil {
+		t.Error("Expected an error for a negative weight")
+	}
+}
+
+func TestRolloutRamp(t *testing.T) {
+	upstream := newRolloutTestUpstream(t)
+	from := 10
+	err := upstream.Rollout("canary", &RolloutImpl{
+		From:           &from,
+		To:             50,
+		DurationMillis: 100,
+		StepMillis:     10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	canary := upstream.Backends["canary"]
+	if weight := canary.GetWeight(); weight != 10 {
+		t.Fatalf("Expected the rollout to start at 10, but got %d", weight)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if weight := canary.GetWeight(); weight <= 10 || weight >= 50 {
+		t.Errorf("Expected the weight to be on its way to 50, but got %d", weight)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if weight := canary.GetWeight(); weight != 50 {
+		t.Errorf("Expected the rollout to end at 50, but got %d", weight)
+	}
+}
+
+func TestRolloutRollback(t *testing.T) {
+	upstream := newRolloutTestUpstream(t)
+	stable := upstream.Backends["stable"]
+	canary := upstream.Backends["canary"]
+	for i := 0; i < 10; i++ {
+		stable.ewma.Start()
+		stable.ewma.Done(10, true)
+	}
+
+	err := upstream.Rollout("canary", &RolloutImpl{
+		To:          20,
+		StepMillis:  10,
+		WatchMillis: 1000,
+		Rollback: &RollbackImpl{
+			Baseline:    "stable",
+			MinRequests: 5,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weight := canary.GetWeight(); weight != 20 {
+		t.Fatalf("Expected the weight to be 20, but got %d", weight)
+	}
+
+	// The canary is broken
+	for i := 0; i < 10; i++ {
+		canary.ewma.Start()
+		canary.ewma.Done(10, false)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if weight := canary.GetWeight(); weight != 0 {
+		t.Errorf("Expected the canary to be rolled back to 0, but got %d", weight)
+	}
+
+	err = upstream.Rollout("canary", &RolloutImpl{To: 20, Rollback: &RollbackImpl{Baseline: "canary"}})
+	if err == nil {
+		t.Error("Expected an error when the canary is its own baseline")
+	}
+}
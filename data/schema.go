@@ -0,0 +1,133 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	SCHEMA_OBJECT  = "object"
+	SCHEMA_ARRAY   = "array"
+	SCHEMA_STRING  = "string"
+	SCHEMA_NUMBER  = "number"
+	SCHEMA_INTEGER = "integer"
+	SCHEMA_BOOLEAN = "boolean"
+)
+
+// SchemaImpl is the shape of the JSON an upstream sends back (a small
+// subset of JSON schema), e.g.
+//
+//	schema:
+//	  type: object
+//	  required: [results]
+//	  properties:
+//	    results:
+//	      type: array
+//	      items:
+//	        type: object
+//	        required: [title]
+//
+// An empty type is anything at all.
+type SchemaImpl struct {
+	Type       string                 `yaml:"type,omitempty" json:"type,omitempty"`
+	Properties map[string]*SchemaImpl `yaml:"properties,omitempty" json:"properties,omitempty"`
+	Required   []string               `yaml:"required,omitempty" json:"required,omitempty"`
+	Items      *SchemaImpl            `yaml:"items,omitempty" json:"items,omitempty"`
+}
+
+func (s *SchemaImpl) Backpatch(name string) error {
+	switch s.Type {
+	case "", SCHEMA_OBJECT, SCHEMA_ARRAY, SCHEMA_STRING, SCHEMA_NUMBER, SCHEMA_INTEGER, SCHEMA_BOOLEAN:
+	default:
+		return fmt.Errorf("Backpatch(%s): unknown schema type '%s'", name, s.Type)
+	}
+	for property, schema := range s.Properties {
+		if schema == nil {
+			continue
+		}
+		if err := schema.Backpatch(name + "." + property); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.Backpatch(name + ".items")
+	}
+	return nil
+}
+
+// ValidateJSON checks that the body matches the schema
+func (s *SchemaImpl) ValidateJSON(body []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("the response is not JSON: %s", err.Error())
+	}
+	return s.Validate(value, "$")
+}
+
+// Validate checks that the (decoded) JSON matches the schema
+func (s *SchemaImpl) Validate(value interface{}, path string) error {
+	if s == nil {
+		return nil
+	}
+
+	switch s.Type {
+	case SCHEMA_OBJECT:
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("%s: expected an object", path)
+		}
+		for _, required := range s.Required {
+			if _, exists := object[required]; !exists {
+				return fmt.Errorf("%s: '%s' is missing", path, required)
+			}
+		}
+
+		// Sorted, so that the errors are the same every time
+		properties := make([]string, 0, len(s.Properties))
+		for property := range s.Properties {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+		for _, property := range properties {
+			if propertyValue, exists := object[property]; exists {
+				if err := s.Properties[property].Validate(propertyValue, path+"."+property); err != nil {
+					return err
+				}
+			}
+		}
+
+	case SCHEMA_ARRAY:
+		array, isArray := value.([]interface{})
+		if !isArray {
+			return fmt.Errorf("%s: expected an array", path)
+		}
+		for i, element := range array {
+			if err := s.Items.Validate(element, fmt.Sprintf("%s.%d", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case SCHEMA_STRING:
+		if _, isString := value.(string); !isString {
+			return fmt.Errorf("%s: expected a string", path)
+		}
+
+	case SCHEMA_NUMBER:
+		if _, isNumber := value.(float64); !isNumber {
+			return fmt.Errorf("%s: expected a number", path)
+		}
+
+	case SCHEMA_INTEGER:
+		if number, isNumber := value.(float64); !isNumber || number != math.Trunc(number) {
+			return fmt.Errorf("%s: expected an integer", path)
+		}
+
+	case SCHEMA_BOOLEAN:
+		if _, isBool := value.(bool); !isBool {
+			return fmt.Errorf("%s: expected a boolean", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamShadowRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_shadow_requests",
+		Help:      "The number of requests mirrored to a shadow backend, keyed by upstream/backend and result (match/mismatch/skipped)",
+	},
+	[]string{"upstream", "backend", "result"},
+)
+var upstreamShadowMismatches = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_shadow_mismatches",
+		Help:      "The number of shadow responses that did not match the primary, keyed by upstream/backend and reason (status/body/error)",
+	},
+	[]string{"upstream", "backend", "reason"},
+)
+var upstreamShadowLatency = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_shadow_latency",
+		Help:      "The latency of the mirrored requests, keyed by upstream/backend and side (primary/shadow)",
+	},
+	[]string{"upstream", "backend", "side"},
+)
+
+const (
+	DEFAULT_SHADOW_TIMEOUT_MILLIS = 30000
+	DEFAULT_SHADOW_MAX_INFLIGHT   = 100
+	DEFAULT_SHADOW_RECORD_PERCENT = 10
+	DEFAULT_SHADOW_MAX_BODY_BYTES = 1 << 20
+
+	// The most differences that are kept in a diff
+	MAX_SHADOW_DIFFERENCES = 20
+
+	// Why a shadow response didn't match
+	SHADOW_MISMATCH_STATUS = "status"
+	SHADOW_MISMATCH_BODY   = "body"
+	SHADOW_MISMATCH_ERROR  = "error"
+)
+
+// ShadowImpl mirrors a sample of the traffic of an upstream to a
+// (candidate) backend, and compares its responses with those of the
+// backend that handled the request, e.g.
+//
+//	shadow:
+//	  backend: whisper
+//	  percent: 10
+//
+// The caller only ever sees the response of the primary.  Give the
+// shadow backend a weight of 0 so that it only gets mirrored traffic.
+type ShadowImpl struct {
+	Backend string  `yaml:"backend" json:"backend"`
+	Percent float64 `yaml:"percent" json:"percent"`
+
+	// How long we wait for the shadow backend, and how many mirrored
+	// requests can be in flight (the rest aren't mirrored)
+	TimeoutMillis int64 `yaml:"timeout_millis,omitempty" json:"timeout_millis,omitempty"`
+	MaxInflight   int64 `yaml:"max_inflight,omitempty" json:"max_inflight,omitempty"`
+
+	// The (dotted) fields of the JSON that are expected to differ,
+	// e.g. a request id or a timestamp
+	IgnoreFields []string `yaml:"ignore_fields,omitempty" json:"ignore_fields,omitempty"`
+
+	// The percentage of the mismatches that are written to the
+	// recorder, and how much of each body is compared (bodies that
+	// are bigger aren't compared)
+	RecordPercent float64 `yaml:"record_percent,omitempty" json:"record_percent,omitempty"`
+	MaxBodyBytes  int     `yaml:"max_body_bytes,omitempty" json:"max_body_bytes,omitempty"`
+
+	// These are backpatched
+	upstream *UpstreamImpl
+	backend  *UpstreamBackendImpl
+	inflight atomic.Int64
+}
+
+// ShadowDiff is what the recorder saves about a mismatch
+type ShadowDiff struct {
+	Id         string      `json:"id"`
+	WhenMillis int64       `json:"timestamp"`
+	DisplayUrl string      `json:"url"`
+	Headers    http.Header `json:"headers"`
+	Upstream   string      `json:"upstream"`
+	Primary    string      `json:"primary"`
+	Shadow     string      `json:"shadow"`
+	Reasons    []string    `json:"reasons"`
+
+	// The (dotted) fields that differ
+	Differences []string `json:"differences,omitempty"`
+
+	PrimaryStatus        int         `json:"primary_status"`
+	ShadowStatus         int         `json:"shadow_status"`
+	PrimaryLatencyMillis int64       `json:"primary_latency_millis"`
+	ShadowLatencyMillis  int64       `json:"shadow_latency_millis"`
+	PrimaryBody          interface{} `json:"primary_body,omitempty"`
+	ShadowBody           interface{} `json:"shadow_body,omitempty"`
+	ShadowError          string      `json:"shadow_error,omitempty"`
+}
+
+func (s *ShadowImpl) Backpatch(upstream *UpstreamImpl) error {
+	backend, exists := upstream.Backends[s.Backend]
+	if !exists {
+		return fmt.Errorf("Backpatch(%s): unknown shadow backend '%s'", upstream.GetName(), s.Backend)
+	}
+	if s.Percent < 0 || s.Percent > 100 || s.RecordPercent < 0 || s.RecordPercent > 100 {
+		return fmt.Errorf("Backpatch(%s): shadow percentages must be between 0 and 100", upstream.GetName())
+	}
+	if s.TimeoutMillis < 0 || s.MaxInflight < 0 || s.MaxBodyBytes < 0 {
+		return fmt.Errorf("Backpatch(%s): shadow limits can't be negative", upstream.GetName())
+	}
+	if s.TimeoutMillis == 0 {
+		s.TimeoutMillis = DEFAULT_SHADOW_TIMEOUT_MILLIS
+	}
+	if s.MaxInflight == 0 {
+		s.MaxInflight = DEFAULT_SHADOW_MAX_INFLIGHT
+	}
+	if s.RecordPercent == 0 {
+		s.RecordPercent = DEFAULT_SHADOW_RECORD_PERCENT
+	}
+	if s.MaxBodyBytes == 0 {
+		s.MaxBodyBytes = DEFAULT_SHADOW_MAX_BODY_BYTES
+	}
+	s.upstream = upstream
+	s.backend = backend
+	return nil
+}
+
+// shadowResult is what a backend (primary or shadow) sent back
+type shadowResult struct {
+	status        int
+	latencyMillis int64
+	body          []byte
+	truncated     bool
+	err           error
+}
+
+// shadowRequest is a request that has been mirrored
+type shadowRequest struct {
+	shadow      *ShadowImpl
+	primary     string
+	req         *http.Request
+	writer      *shadowWriter
+	startMillis int64
+	result      chan shadowResult
+}
+
+// start mirrors the request to the shadow backend (if it is in the
+// sample).  Call finish() on the result once the primary has written
+// its response
+func (s *ShadowImpl) start(c *gin.Context, primary UpstreamBackend) *shadowRequest {
+	if s == nil || primary.GetName() == s.Backend || s.upstream.rng.Float64()*100 >= s.Percent {
+		return nil
+	}
+	if s.inflight.Add(1) > s.MaxInflight {
+		s.inflight.Add(-1)
+		upstreamShadowRequests.WithLabelValues(s.upstream.GetName(), s.Backend, "skipped").Inc()
+		return nil
+	}
+
+	body, err := ReadBody(c.Request)
+	if err != nil {
+		s.inflight.Add(-1)
+		log.Printf("%s: not mirroring to %s: %s", s.upstream.GetName(), s.Backend, err.Error())
+		upstreamShadowRequests.WithLabelValues(s.upstream.GetName(), s.Backend, "skipped").Inc()
+		return nil
+	}
+
+	// The shadow doesn't care if the caller goes away
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Duration(s.TimeoutMillis)*time.Millisecond)
+	req := CloneRequest(c.Request, body).WithContext(ctx)
+	req.Header.Set(HEADER_X_FAULTMONKEY_BACKEND, s.Backend)
+
+	shadow := &shadowRequest{
+		shadow:      s,
+		primary:     primary.GetName(),
+		req:         req,
+		writer:      newShadowWriter(c.Writer, s.MaxBodyBytes),
+		startMillis: time.Now().UTC().UnixMilli(),
+		result:      make(chan shadowResult, 1),
+	}
+	c.Writer = shadow.writer
+
+	go func() {
+		defer cancelFunc()
+		result := shadowResult{}
+		resp, err := s.backend.Do(ctx, req)
+		if err != nil {
+			result.err = err
+			result.status = http.StatusBadGateway
+			if backendError, isBackendError := err.(*BackendError); isBackendError {
+				result.status = backendError.StatusCode
+			}
+		} else {
+			result.status = resp.StatusCode
+			result.body, result.truncated = readShadowBody(resp.Body, s.MaxBodyBytes)
+			resp.Body.Close()
+		}
+		result.latencyMillis = time.Now().UTC().UnixMilli() - shadow.startMillis
+		shadow.result <- result
+	}()
+	return shadow
+}
+
+// finish compares the responses (without holding up the caller) once
+// the shadow has answered
+func (r *shadowRequest) finish() {
+	primary := shadowResult{
+		status:        r.writer.Status(),
+		latencyMillis: time.Now().UTC().UnixMilli() - r.startMillis,
+		body:          r.writer.body.Bytes(),
+		truncated:     r.writer.truncated,
+	}
+	go func() {
+		defer r.shadow.inflight.Add(-1)
+		r.compare(primary, <-r.result)
+	}()
+}
+
+func (r *shadowRequest) compare(primary shadowResult, shadow shadowResult) {
+	s := r.shadow
+	upstreamName := s.upstream.GetName()
+	upstreamShadowLatency.WithLabelValues(upstreamName, s.Backend, "primary").Add(float64(primary.latencyMillis))
+	upstreamShadowLatency.WithLabelValues(upstreamName, s.Backend, "shadow").Add(float64(shadow.latencyMillis))
+
+	diff := &ShadowDiff{
+		Id:                   r.req.Header.Get(HEADER_X_REQUEST_ID),
+		WhenMillis:           r.startMillis,
+		DisplayUrl:           r.req.URL.String(),
+		Headers:              r.req.Header,
+		Upstream:             upstreamName,
+		Primary:              r.primary,
+		Shadow:               s.Backend,
+		PrimaryStatus:        primary.status,
+		ShadowStatus:         shadow.status,
+		PrimaryLatencyMillis: primary.latencyMillis,
+		ShadowLatencyMillis:  shadow.latencyMillis,
+	}
+	primaryBody := decodeShadowBody(primary.body)
+	shadowBody := decodeShadowBody(shadow.body)
+
+	switch {
+	case shadow.err != nil:
+		diff.Reasons = append(diff.Reasons, SHADOW_MISMATCH_ERROR)
+		diff.ShadowError = shadow.err.Error()
+
+	case primary.status != shadow.status:
+		diff.Reasons = append(diff.Reasons, SHADOW_MISMATCH_STATUS)
+
+	case !primary.truncated && !shadow.truncated:
+		for _, field := range s.IgnoreFields {
+			removeField(primaryBody, field)
+			removeField(shadowBody, field)
+		}
+		diffJSON(primaryBody, shadowBody, "$", &diff.Differences)
+		if len(diff.Differences) > 0 {
+			diff.Reasons = append(diff.Reasons, SHADOW_MISMATCH_BODY)
+		}
+	}
+
+	if len(diff.Reasons) == 0 {
+		upstreamShadowRequests.WithLabelValues(upstreamName, s.Backend, "match").Inc()
+		return
+	}
+	upstreamShadowRequests.WithLabelValues(upstreamName, s.Backend, "mismatch").Inc()
+	for _, reason := range diff.Reasons {
+		upstreamShadowMismatches.WithLabelValues(upstreamName, s.Backend, reason).Inc()
+	}
+
+	if s.backend.Recorder != nil && s.upstream.rng.Float64()*100 < s.RecordPercent {
+		diff.PrimaryBody = primaryBody
+		diff.ShadowBody = shadowBody
+		if err := s.backend.Recorder.SaveDiff(diff); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// readShadowBody reads up to max bytes of the body
+func readShadowBody(body io.Reader, max int) ([]byte, bool) {
+	read, _ := io.ReadAll(io.LimitReader(body, int64(max)+1))
+	if len(read) > max {
+		return read[:max], true
+	}
+	return read, false
+}
+
+// decodeShadowBody decodes a JSON body (anything else is compared as
+// a string)
+func decodeShadowBody(body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return string(body)
+	}
+	return decoded
+}
+
+// removeField removes a (dotted) field from the JSON
+func removeField(value interface{}, field string) {
+	keys := strings.Split(field, ".")
+	for _, key := range keys[:len(keys)-1] {
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return
+		}
+		value = object[key]
+	}
+	if object, isObject := value.(map[string]interface{}); isObject {
+		delete(object, keys[len(keys)-1])
+	}
+}
+
+// diffJSON adds the paths where the two differ (up to
+// MAX_SHADOW_DIFFERENCES of them)
+func diffJSON(a interface{}, b interface{}, path string, differences *[]string) {
+	if len(*differences) >= MAX_SHADOW_DIFFERENCES {
+		return
+	}
+
+	aObject, aIsObject := a.(map[string]interface{})
+	bObject, bIsObject := b.(map[string]interface{})
+	if aIsObject && bIsObject {
+		keys := make([]string, 0, len(aObject)+len(bObject))
+		for key := range aObject {
+			keys = append(keys, key)
+		}
+		for key := range bObject {
+			if _, exists := aObject[key]; !exists {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diffJSON(aObject[key], bObject[key], path+"."+key, differences)
+		}
+		return
+	}
+
+	aArray, aIsArray := a.([]interface{})
+	bArray, bIsArray := b.([]interface{})
+	if aIsArray && bIsArray && len(aArray) == len(bArray) {
+		for i := range aArray {
+			diffJSON(aArray[i], bArray[i], fmt.Sprintf("%s.%d", path, i), differences)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*differences = append(*differences, path)
+	}
+}
+
+// shadowWriter keeps a copy of (the start of) the response that the
+// primary writes to the caller
+type shadowWriter struct {
+	gin.ResponseWriter
+	body      bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func newShadowWriter(writer gin.ResponseWriter, max int) *shadowWriter {
+	return &shadowWriter{
+		ResponseWriter: writer,
+		max:            max,
+	}
+}
+
+func (w *shadowWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *shadowWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *shadowWriter) capture(data []byte) {
+	if w.truncated {
+		return
+	}
+	if w.body.Len()+len(data) > w.max {
+		w.truncated = true
+		return
+	}
+	w.body.Write(data)
+}
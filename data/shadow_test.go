@@ -0,0 +1,113 @@
+package data
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newShadowTestUpstream(t *testing.T, shadowStatus int) *UpstreamImpl {
+	primary := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id": "primary", "result": "cats", "count": 2}`)
+	})
+	shadow := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(shadowStatus)
+		if r.URL.Path == "/dogs" {
+			io.WriteString(w, `{"id": "shadow", "result": "dogs", "count": 2}`)
+			return
+		}
+		io.WriteString(w, `{"id": "shadow", "result": "cats", "count": 2}`)
+	})
+	upstream := newTestUpstream(t, "shadow", &UpstreamImpl{
+		Rule: "weighted",
+		Backends: map[string]*UpstreamBackendImpl{
+			"primary":   {Url: primary, Weight: 1},
+			"candidate": {Url: shadow, Weight: 0},
+		},
+		Shadow: &ShadowImpl{
+			Backend:       "candidate",
+			Percent:       100,
+			RecordPercent: 100,
+			IgnoreFields:  []string{"id"},
+		},
+	})
+	upstream.Backends["candidate"].Recorder = &RecorderImpl{
+		requestsChan:  make(chan *GatewayRequest, 10),
+		responsesChan: make(chan *GatewayResponse, 10),
+		diffsChan:     make(chan *ShadowDiff, 10),
+		stop:          make(chan interface{}),
+	}
+	return upstream
+}
+
+func doShadowTestRequest(t *testing.T, upstream *UpstreamImpl, path string) {
+	w := doTestRequest(upstream, http.MethodGet, path, "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"id": "primary", "result": "cats", "count": 2}` {
+		t.Fatalf("Expected the caller to get the primary response, but got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func waitForShadows(t *testing.T, upstream *UpstreamImpl) {
+	for i := 0; i < 100 && upstream.Shadow.inflight.Load() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if upstream.Shadow.inflight.Load() > 0 {
+		t.Fatal("Expected the shadow requests to finish")
+	}
+}
+
+func TestShadowMatch(t *testing.T) {
+	upstream := newShadowTestUpstream(t, http.StatusOK)
+	doShadowTestRequest(t, upstream, "/cats")
+	waitForShadows(t, upstream)
+	select {
+	case diff := <-upstream.Backends["candidate"].Recorder.diffsChan:
+		t.Errorf("Expected the responses to match (apart from the id), but got %+v", diff)
+	default:
+	}
+}
+
+func TestShadowMismatch(t *testing.T) {
+	upstream := newShadowTestUpstream(t, http.StatusOK)
+	doShadowTestRequest(t, upstream, "/dogs")
+	waitForShadows(t, upstream)
+	select {
+	case diff := <-upstream.Backends["candidate"].Recorder.diffsChan:
+		if !reflect.DeepEqual(diff.Reasons, []string{SHADOW_MISMATCH_BODY}) || !reflect.DeepEqual(diff.Differences, []string{"$.result"}) {
+			t.Errorf("Expected $.result to differ, but got %v %v", diff.Reasons, diff.Differences)
+		}
+		if diff.Primary != "primary" || diff.Shadow != "candidate" {
+			t.Errorf("Expected a diff of primary and candidate, but got %s and %s", diff.Primary, diff.Shadow)
+		}
+	default:
+		t.Error("Expected a diff to be recorded")
+	}
+
+	upstream = newShadowTestUpstream(t, http.StatusInternalServerError)
+	doShadowTestRequest(t, upstream, "/cats")
+	waitForShadows(t, upstream)
+	select {
+	case diff := <-upstream.Backends["candidate"].Recorder.diffsChan:
+		if diff.PrimaryStatus != http.StatusOK || diff.ShadowStatus != http.StatusInternalServerError {
+			t.Errorf("Expected a 200 and a 500, but got %d and %d", diff.PrimaryStatus, diff.ShadowStatus)
+		}
+	default:
+		t.Error("Expected a diff to be recorded")
+	}
+}
+
+func TestShadowBackpatch(t *testing.T) {
+	upstream := &UpstreamImpl{
+		serviceName: "shadow",
+		Rule:        "random",
+		Backends: map[string]*UpstreamBackendImpl{
+			"primary": {Url: "http://primary", Weight: 1},
+		},
+		Shadow: &ShadowImpl{Backend: "wibble", Percent: 10},
+	}
+	if err := upstream.Backpatch(); err == nil {
+		t.Error("Expected an error for an unknown shadow backend")
+	}
+}
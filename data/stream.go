@@ -0,0 +1,61 @@
+package data
+
+import (
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// How much of a streamed body we read before passing it on
+	STREAM_BUFFER_SIZE = 32 * 1024
+)
+
+// IsEventStream is true for server-sent events
+func IsEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// IsStreaming is true for a response that arrives a bit at a time,
+// i.e. server-sent events, or a (chunked) body whose length we don't
+// know up front
+func IsStreaming(resp *http.Response) bool {
+	return IsEventStream(resp.Header) || resp.ContentLength < 0
+}
+
+// CopyResponseBody sends the body of the response to the caller
+// (once the status and headers have been set).
+//
+// A streamed response is flushed as each chunk (or event) arrives,
+// rather than when the buffers fill up.  It stops as soon as the
+// caller goes away, and it is up to whoever closes the body to cancel
+// the request
+func CopyResponseBody(w gin.ResponseWriter, resp *http.Response) error {
+	if !IsStreaming(resp) {
+		w.WriteHeaderNow()
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+
+	// Let the caller know that the response has started
+	w.Flush()
+	buffer := make([]byte, STREAM_BUFFER_SIZE)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				return writeErr
+			}
+			w.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package data
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newStreamTestBroker proxies everything to an upstream whose backend
+// sends an event, and then waits for release before sending another
+func newStreamTestBroker(t *testing.T, release chan interface{}, gone chan interface{}) *httptest.Server {
+	backend := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			io.WriteString(w, "data: 2\n\n")
+
+		case <-r.Context().Done():
+			close(gone)
+		}
+	})
+	upstream := newTestUpstream(t, "llm", &UpstreamImpl{
+		Rule: "random",
+		Backends: map[string]*UpstreamBackendImpl{
+			"openai": {Url: backend, Weight: 1},
+		},
+	})
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/*path", upstream.Handle)
+	broker := httptest.NewServer(engine)
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+func TestStreamEvents(t *testing.T) {
+	release := make(chan interface{})
+	broker := newStreamTestBroker(t, release, make(chan interface{}))
+
+	resp, err := http.Get(broker.URL + "/chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first event arrives before the backend has finished
+	reader := bufio.NewReader(resp.Body)
+	event, err := reader.ReadString('\n')
+	if err != nil || event != "data: 1\n" {
+		t.Fatalf("Expected the first event, but got '%s' (%v)", event, err)
+	}
+	close(release)
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != "\ndata: 2\n\n" {
+		t.Errorf("Expected the second event, but got '%s'", string(rest))
+	}
+}
+
+func TestStreamCallerGoesAway(t *testing.T) {
+	gone := make(chan interface{})
+	broker := newStreamTestBroker(t, make(chan interface{}), gone)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, broker.URL+"/chat", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufio.NewReader(resp.Body).ReadString('\n')
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-gone:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the request to the backend to be cancelled")
+	}
+}
+
+func TestRecordResponseStream(t *testing.T) {
+	recorder := &RecorderImpl{
+		Responses:     t.TempDir(),
+		MaxBodyBytes:  5,
+		responsesChan: make(chan *GatewayResponse, 1),
+		stop:          make(chan interface{}),
+	}
+	headers := make(http.Header)
+	headers.Set(HEADER_X_FAULTMONKEY_UPSTREAM, "llm")
+	gwr := NewGatewayResponse("abc", http.StatusOK, nil, headers, nil)
+	body := recorder.RecordResponse(gwr, io.NopCloser(strings.NewReader("hello world")), false)
+
+	read, _ := io.ReadAll(body)
+	if string(read) != "hello world" {
+		t.Errorf("Expected the caller to get all of the body, but got '%s'", string(read))
+	}
+	select {
+	case <-recorder.responsesChan:
+		t.Fatal("Expected the response to be saved once the body is closed")
+	default:
+	}
+	body.Close()
+	body.Close()
+
+	saved := <-recorder.responsesChan
+	if saved.BodyFile != "abc-response.body" || saved.BodyBytes != 5 || !saved.BodyTruncated {
+		t.Errorf("Expected 5 bytes in abc-response.body, but got %d in '%s' (truncated: %v)", saved.BodyBytes, saved.BodyFile, saved.BodyTruncated)
+	}
+	recorded, err := os.ReadFile(filepath.Join(recorder.Responses, "llm", "abc-response.body"))
+	if err != nil || string(recorded) != "hello" {
+		t.Errorf("Expected 'hello' to be recorded, but got '%s' (%v)", string(recorded), err)
+	}
+	if len(recorder.responsesChan) != 0 {
+		t.Error("Expected the response to be saved once")
+	}
+}
+
+func TestRecordResponseInline(t *testing.T) {
+	recorder := &RecorderImpl{
+		Responses:     t.TempDir(),
+		MaxBodyBytes:  DEFAULT_RECORDER_MAX_BODY_BYTES,
+		responsesChan: make(chan *GatewayResponse, 1),
+		stop:          make(chan interface{}),
+	}
+	gwr := NewGatewayResponse("abc", http.StatusOK, nil, make(http.Header), nil)
+	body := recorder.RecordResponse(gwr, io.NopCloser(strings.NewReader("hello world")), true)
+	io.ReadAll(body)
+	body.Close()
+
+	saved := <-recorder.responsesChan
+	if saved.BodyFile != "" || string(saved.Body) != "hello world" {
+		t.Errorf("Expected the body to be kept in the response, but got '%s' (file '%s')", string(saved.Body), saved.BodyFile)
+	}
+	if _, err := os.Stat(filepath.Join(recorder.Responses, "abc-response.body")); err == nil {
+		t.Error("Expected no body file for a small response")
+	}
+}
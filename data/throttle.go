@@ -0,0 +1,304 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Used when neither the attenuator section nor an individual
+	// attenuator say how many requests can be in flight
+	DEFAULT_ATTENUATOR_MAX_INFLIGHT = 100
+
+	// The attenuator that applies to everything which does not
+	// name one of its own
+	DEFAULT_ATTENUATOR_NAME = "default"
+)
+
+// Throttle is what the broker and gateway need from an attenuator
+// (i.e. a client.Attenuator).
+//
+// It is declared here (rather than importing client) because client
+// imports data.
+type Throttle interface {
+	GetName() string
+
+	// WaitForGreen blocks until we are allowed to send the next request
+	WaitForGreen(ctx context.Context, cancelFunc context.CancelFunc) error
+
+	// So we can back off when told to
+	Pausable
+}
+
+// Saturable is a Throttle that can tell (without waiting) that the
+// next request would have to wait, e.g. because it has been paused or
+// its queue is full
+type Saturable interface {
+	IsSaturated() bool
+}
+
+// ThrottleFactory builds an attenuator
+type ThrottleFactory func(name string, maxHertz float64, maxInflight int) (Throttle, error)
+
+var throttleFactory ThrottleFactory
+var throttleFactoryMutex sync.RWMutex
+
+// SetThrottleFactory is backpatched at startup (this avoids an
+// import loop with client)
+func SetThrottleFactory(factory ThrottleFactory) {
+	throttleFactoryMutex.Lock()
+	defer throttleFactoryMutex.Unlock()
+	throttleFactory = factory
+}
+
+// NewThrottle builds an attenuator, or returns nil if there is no
+// throttle factory
+func NewThrottle(name string, maxHertz float64, maxInflight int) (Throttle, error) {
+	throttleFactoryMutex.RLock()
+	defer throttleFactoryMutex.RUnlock()
+	if throttleFactory == nil {
+		return nil, nil
+	}
+	if maxInflight <= 0 {
+		maxInflight = DEFAULT_ATTENUATOR_MAX_INFLIGHT
+	}
+	return throttleFactory(name, maxHertz, maxInflight)
+}
+
+// WaitForThrottle waits for a green light from the attenuator (if any)
+func WaitForThrottle(ctx context.Context, throttle Throttle) error {
+	if throttle == nil {
+		return nil
+	}
+	return throttle.WaitForGreen(ctx, nil)
+}
+
+// AttenuatorFromConfig is a named entry in the attenuator section
+type AttenuatorFromConfig struct {
+	Hertz float64 `yaml:"hertz" json:"hertz"`
+
+	// Overrides the max_inflight of the attenuator section
+	MaxInflight int `yaml:"max_inflight,omitempty" json:"max_inflight,omitempty"`
+}
+
+// AttenuatorsFromConfig is the attenuator section, e.g.
+//
+//	attenuator:
+//	  "google":
+//	    hertz: 1.0
+//	  default: google
+//	  max_inflight: 100
+//
+// 'default' (if present) names the attenuator that is used by
+// everything that does not name one of its own
+type AttenuatorsFromConfig struct {
+	Default     string                           `json:"default,omitempty"`
+	MaxInflight int                              `json:"max_inflight,omitempty"`
+	Attenuators map[string]*AttenuatorFromConfig `json:"attenuators,omitempty"`
+
+	// The registry the attenuators are registered in.  This is
+	// backpatched (the live registry if it isn't set)
+	registry ThrottleRegistry
+}
+
+func (a *AttenuatorsFromConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("UnmarshalYAML(attenuator): line %d: expected a mapping", value.Line)
+	}
+
+	a.Attenuators = make(map[string]*AttenuatorFromConfig)
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key := value.Content[i].Value
+		var err error
+		switch key {
+		case "max_inflight":
+			err = value.Content[i+1].Decode(&a.MaxInflight)
+
+		case DEFAULT_ATTENUATOR_NAME:
+			if value.Content[i+1].Kind == yaml.ScalarNode {
+				err = value.Content[i+1].Decode(&a.Default)
+				break
+			}
+			fallthrough
+
+		default:
+			attenuator := &AttenuatorFromConfig{}
+			err = value.Content[i+1].Decode(attenuator)
+			a.Attenuators[key] = attenuator
+		}
+		if err != nil {
+			return fmt.Errorf("UnmarshalYAML(attenuator.%s): %s", key, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (a AttenuatorsFromConfig) MarshalYAML() (interface{}, error) {
+	asMap := make(map[string]interface{})
+	for name, attenuator := range a.Attenuators {
+		asMap[name] = attenuator
+	}
+	if a.Default != "" {
+		asMap[DEFAULT_ATTENUATOR_NAME] = a.Default
+	}
+	if a.MaxInflight > 0 {
+		asMap["max_inflight"] = a.MaxInflight
+	}
+	return asMap, nil
+}
+
+// Backpatch builds the attenuators and registers them
+func (a *AttenuatorsFromConfig) Backpatch() error {
+	if a.registry == nil {
+		a.registry = GetThrottleRegistry()
+	}
+	registry := a.registry
+	registry.Clear()
+	for name, attenuator := range a.Attenuators {
+		maxInflight := attenuator.MaxInflight
+		if maxInflight <= 0 {
+			maxInflight = a.MaxInflight
+		}
+		throttle, err := NewThrottle(name, attenuator.Hertz, maxInflight)
+		if err != nil {
+			return fmt.Errorf("Backpatch(attenuator.%s): %s", name, err.Error())
+		}
+		registry.RegisterThrottle(name, throttle)
+	}
+
+	defaultName := a.Default
+	if defaultName == "" {
+		if _, exists := a.Attenuators[DEFAULT_ATTENUATOR_NAME]; exists {
+			defaultName = DEFAULT_ATTENUATOR_NAME
+		}
+	}
+	if defaultName != "" {
+		if _, exists := registry.LookupThrottle(defaultName); !exists {
+			return fmt.Errorf("Backpatch(attenuator.default): no attenuator called '%s'", defaultName)
+		}
+	}
+	registry.SetDefault(defaultName)
+
+	return nil
+}
+
+// ThrottleRegistry holds the attenuators from the attenuator section
+type ThrottleRegistry interface {
+	// GetThrottle returns the named attenuator (nil if there isn't one)
+	GetThrottle(name string) Throttle
+
+	// LookupThrottle is like GetThrottle, but also tells us whether
+	// the attenuator was declared at all (it can be declared but nil
+	// when there is no throttle factory)
+	LookupThrottle(name string) (Throttle, bool)
+
+	// ResolveThrottle returns the first of the named attenuators that
+	// is set, falling back to the default one
+	ResolveThrottle(names ...string) (Throttle, error)
+
+	// GetThrottles returns a copy of the attenuators, keyed by name
+	GetThrottles() map[string]Throttle
+
+	RegisterThrottle(name string, throttle Throttle)
+	SetDefault(name string)
+	Clear()
+}
+
+var throttleRegistry ThrottleRegistry = NewThrottleRegistry()
+var throttleRegistryMutex sync.RWMutex
+
+// NewThrottleRegistry returns an empty registry
+func NewThrottleRegistry() ThrottleRegistry {
+	return &throttleRegistryImpl{
+		throttles: make(map[string]Throttle),
+	}
+}
+
+// GetThrottleRegistry returns the live registry (i.e. the one from
+// the config that is currently active)
+func GetThrottleRegistry() ThrottleRegistry {
+	throttleRegistryMutex.RLock()
+	defer throttleRegistryMutex.RUnlock()
+	return throttleRegistry
+}
+
+// setThrottleRegistry makes the registry the live one
+func setThrottleRegistry(registry ThrottleRegistry) {
+	throttleRegistryMutex.Lock()
+	defer throttleRegistryMutex.Unlock()
+	throttleRegistry = registry
+}
+
+type throttleRegistryImpl struct {
+	mutex       sync.RWMutex
+	throttles   map[string]Throttle
+	defaultName string
+}
+
+func (tr *throttleRegistryImpl) GetThrottle(name string) Throttle {
+	throttle, _ := tr.LookupThrottle(name)
+	return throttle
+}
+
+func (tr *throttleRegistryImpl) LookupThrottle(name string) (Throttle, bool) {
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	throttle, exists := tr.throttles[strings.ToLower(strings.TrimSpace(name))]
+	return throttle, exists
+}
+
+func (tr *throttleRegistryImpl) ResolveThrottle(names ...string) (Throttle, error) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		throttle, exists := tr.LookupThrottle(name)
+		if !exists {
+			return nil, fmt.Errorf("ResolveThrottle(%s): no such attenuator", name)
+		}
+		return throttle, nil
+	}
+
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	if tr.defaultName == "" {
+		return nil, nil
+	}
+	return tr.throttles[tr.defaultName], nil
+}
+
+func (tr *throttleRegistryImpl) GetThrottles() map[string]Throttle {
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	throttles := make(map[string]Throttle, len(tr.throttles))
+	for name, throttle := range tr.throttles {
+		throttles[name] = throttle
+	}
+	return throttles
+}
+
+func (tr *throttleRegistryImpl) RegisterThrottle(name string, throttle Throttle) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.throttles[strings.ToLower(strings.TrimSpace(name))] = throttle
+	log.Printf("INFO|RegisterThrottle()|Registering attenuator '%s'|", name)
+}
+
+func (tr *throttleRegistryImpl) SetDefault(name string) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.defaultName = strings.ToLower(strings.TrimSpace(name))
+}
+
+func (tr *throttleRegistryImpl) Clear() {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.throttles = make(map[string]Throttle)
+	tr.defaultName = ""
+}
@@ -0,0 +1,178 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type fakeThrottle struct {
+	name        string
+	maxHertz    float64
+	maxInflight int
+	pauseUntil  time.Time
+}
+
+func (f *fakeThrottle) GetName() string {
+	return f.name
+}
+
+func (f *fakeThrottle) WaitForGreen(ctx context.Context, cancelFunc context.CancelFunc) error {
+	return nil
+}
+
+func (f *fakeThrottle) SetPauseUntil(wallclock time.Time) {
+	f.pauseUntil = wallclock
+}
+
+const throttleTestConfig = `
+attenuator:
+  google:
+    hertz: 1.0
+  bing:
+    hertz: 0.5
+    max_inflight: 5
+  default: google
+  max_inflight: 100
+broker:
+  upstream:
+    search:
+      attenuator: bing
+      backends:
+        bing:
+          url: https://www.bing.com
+        google:
+          url: https://www.google.com
+          attenuator: google
+        yahoo:
+          url: https://www.yahoo.com
+          circuitbreaker:
+            max_hertz: 2
+    other:
+      backends:
+        ddg:
+          url: https://duckduckgo.com
+gateway:
+  attenuator: bing
+  domains:
+    google.com:
+      attenuator: google
+`
+
+func loadThrottleTestConfig(t *testing.T) *Config {
+	SetThrottleFactory(func(name string, maxHertz float64, maxInflight int) (Throttle, error) {
+		return &fakeThrottle{name: name, maxHertz: maxHertz, maxInflight: maxInflight}, nil
+	})
+	t.Cleanup(func() {
+		SetThrottleFactory(nil)
+		GetThrottleRegistry().Clear()
+	})
+
+	config := Config{}
+	if err := yaml.Unmarshal([]byte(throttleTestConfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Attenuators.Backpatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Broker.Backpatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Gateway.Backpatch(); err != nil {
+		t.Fatal(err)
+	}
+	return &config
+}
+
+func throttleName(throttle Throttle) string {
+	if throttle == nil {
+		return ""
+	}
+	return throttle.GetName()
+}
+
+func TestAttenuatorsFromConfig(t *testing.T) {
+	config := loadThrottleTestConfig(t)
+
+	if config.Attenuators.Default != "google" {
+		t.Errorf("Expected default attenuator 'google', but got '%s'", config.Attenuators.Default)
+	}
+	if len(config.Attenuators.Attenuators) != 2 {
+		t.Fatalf("Expected 2 attenuators, but got %d", len(config.Attenuators.Attenuators))
+	}
+
+	google := GetThrottleRegistry().GetThrottle("google").(*fakeThrottle)
+	if google.maxHertz != 1.0 || google.maxInflight != 100 {
+		t.Errorf("Expected google to be 1Hz/100, but got %.2fHz/%d", google.maxHertz, google.maxInflight)
+	}
+	bing := GetThrottleRegistry().GetThrottle("bing").(*fakeThrottle)
+	if bing.maxHertz != 0.5 || bing.maxInflight != 5 {
+		t.Errorf("Expected bing to be 0.5Hz/5, but got %.2fHz/%d", bing.maxHertz, bing.maxInflight)
+	}
+}
+
+func TestBackendThrottleFallback(t *testing.T) {
+	config := loadThrottleTestConfig(t)
+	search := config.Broker.UpstreamFromConfig["search"]
+	other := config.Broker.UpstreamFromConfig["other"]
+
+	expected := map[string]string{
+		// upstream
+		"bing": "bing",
+		// backend
+		"google": "google",
+		// circuit breaker max_hertz
+		"yahoo": "search.yahoo",
+	}
+	for backendName, attenuatorName := range expected {
+		if actual := throttleName(search.Backends[backendName].GetThrottle()); actual != attenuatorName {
+			t.Errorf("%s: expected attenuator '%s', but got '%s'", backendName, attenuatorName, actual)
+		}
+	}
+
+	// global
+	if actual := throttleName(other.Backends["ddg"].GetThrottle()); actual != "google" {
+		t.Errorf("ddg: expected attenuator 'google', but got '%s'", actual)
+	}
+}
+
+func TestGatewayThrottle(t *testing.T) {
+	config := loadThrottleTestConfig(t)
+
+	expected := map[string]string{
+		"www.google.com":     "google",
+		"google.com:443":     "google",
+		"www.bing.com":       "bing",
+		"notgoogle.com":      "bing",
+		"mail.google.com.au": "bing",
+	}
+	for host, attenuatorName := range expected {
+		if actual := throttleName(config.GetGateway().GetThrottle(host)); actual != attenuatorName {
+			t.Errorf("%s: expected attenuator '%s', but got '%s'", host, attenuatorName, actual)
+		}
+	}
+
+	// No gateway config means the default attenuator
+	var noGateway *GatewayImpl
+	if actual := throttleName(noGateway.GetThrottle("www.bing.com")); actual != "google" {
+		t.Errorf("Expected attenuator 'google', but got '%s'", actual)
+	}
+}
+
+func TestUnknownAttenuator(t *testing.T) {
+	loadThrottleTestConfig(t)
+
+	upstream := &UpstreamImpl{
+		Backends: map[string]*UpstreamBackendImpl{
+			"wibble": {
+				Url:        "https://wibble.com",
+				Attenuator: "wobble",
+			},
+		},
+	}
+	if err := upstream.Backpatch(); err == nil {
+		t.Fatal("Expected an error for an unknown attenuator, but got nil")
+	}
+}
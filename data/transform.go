@@ -0,0 +1,450 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+var upstreamTransformErrors = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_transform_errors",
+		Help:      "The number of responses that could not be transformed (or did not match the schema), keyed by upstream/backend and reason",
+	},
+	[]string{"upstream", "backend", "reason"},
+)
+
+const (
+	// The converters a field can use
+	CONVERT_TIMESTAMP = "timestamp"
+	CONVERT_SCALE     = "scale"
+	CONVERT_ENUM      = "enum"
+	CONVERT_STRING    = "string"
+	CONVERT_NUMBER    = "number"
+	CONVERT_INTEGER   = "integer"
+	CONVERT_BOOLEAN   = "boolean"
+
+	// The units of a timestamp (which is guessed if there is no unit,
+	// and is millis if it isn't converted 'to' anything)
+	TIMESTAMP_SECONDS = "seconds"
+	TIMESTAMP_MILLIS  = "millis"
+	TIMESTAMP_ISO8601 = "iso8601"
+
+	// Bigger than this, and a timestamp is in millis (this many
+	// seconds is the year 5138)
+	TIMESTAMP_MILLIS_THRESHOLD = 1e11
+
+	// The reasons a response can't be normalised (which are also the
+	// error classes, for failover)
+	TRANSFORM_ERROR_TRANSFORM = "transform"
+	TRANSFORM_ERROR_SCHEMA    = "schema"
+)
+
+// ResponseTransformImpl turns the JSON that a backend sends back into
+// the JSON that the upstream promises, e.g.
+//
+//	response:
+//	  fields:
+//	    total: webPages.totalEstimatedMatches
+//	    results:
+//	      from: webPages.value
+//	      fields:
+//	        title: name
+//	        crawled: {from: dateLastCrawled, convert: timestamp}
+//
+// Only the fields that are listed end up in the response.
+type ResponseTransformImpl struct {
+	Fields map[string]*FieldMapping `yaml:"fields" json:"fields"`
+}
+
+// FieldMapping says where a field of the response comes from, and how
+// it is converted.  A plain string is short for 'from'
+type FieldMapping struct {
+	// The path of the field in the backend response (e.g. a.b.0.c),
+	// where '$' is the whole thing.  If this is empty, then the field
+	// has the same name in the backend response
+	From string `yaml:"from,omitempty" json:"from,omitempty"`
+
+	// If this is set, then the field is always this value
+	Value interface{} `yaml:"value,omitempty" json:"value,omitempty"`
+
+	// timestamp (to millis, or 'to'), scale (multiply by 'scale'),
+	// enum (look the value up in 'enum'), or one of the types string,
+	// number, integer or boolean
+	Convert string            `yaml:"convert,omitempty" json:"convert,omitempty"`
+	Unit    string            `yaml:"unit,omitempty" json:"unit,omitempty"`
+	To      string            `yaml:"to,omitempty" json:"to,omitempty"`
+	Scale   float64           `yaml:"scale,omitempty" json:"scale,omitempty"`
+	Enum    map[string]string `yaml:"enum,omitempty" json:"enum,omitempty"`
+
+	// Used if the field is missing (or isn't in the enum).  Otherwise,
+	// a required field that is missing means the transform fails
+	Default  interface{} `yaml:"default,omitempty" json:"default,omitempty"`
+	Required bool        `yaml:"required,omitempty" json:"required,omitempty"`
+
+	// If this is set, then the field is mapped in turn (or each of
+	// its elements, if it is an array)
+	Fields map[string]*FieldMapping `yaml:"fields,omitempty" json:"fields,omitempty"`
+}
+
+func (f *FieldMapping) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		f.From = value.Value
+		return nil
+	}
+
+	// Avoid recursing into this function
+	type plainFieldMapping FieldMapping
+	return value.Decode((*plainFieldMapping)(f))
+}
+
+func (r *ResponseTransformImpl) Backpatch(name string) error {
+	if len(r.Fields) == 0 {
+		return fmt.Errorf("Backpatch(%s): a response transform needs some fields", name)
+	}
+	return backpatchFields(name, r.Fields)
+}
+
+func backpatchFields(name string, fields map[string]*FieldMapping) error {
+	for field, mapping := range fields {
+		if mapping == nil {
+			return fmt.Errorf("Backpatch(%s.%s): the field has no mapping", name, field)
+		}
+		switch mapping.Convert {
+		case "":
+
+		case CONVERT_STRING, CONVERT_NUMBER, CONVERT_INTEGER, CONVERT_BOOLEAN:
+
+		case CONVERT_TIMESTAMP:
+			for _, unit := range []string{mapping.Unit, mapping.To} {
+				switch unit {
+				case "", TIMESTAMP_SECONDS, TIMESTAMP_MILLIS, TIMESTAMP_ISO8601:
+				default:
+					return fmt.Errorf("Backpatch(%s.%s): timestamp unit must be '%s', '%s' or '%s', but is '%s'", name, field, TIMESTAMP_SECONDS, TIMESTAMP_MILLIS, TIMESTAMP_ISO8601, unit)
+				}
+			}
+
+		case CONVERT_SCALE:
+			if mapping.Scale == 0 {
+				return fmt.Errorf("Backpatch(%s.%s): scale needs a (non-zero) 'scale'", name, field)
+			}
+
+		case CONVERT_ENUM:
+			if len(mapping.Enum) == 0 {
+				return fmt.Errorf("Backpatch(%s.%s): enum needs an 'enum'", name, field)
+			}
+
+		default:
+			return fmt.Errorf("Backpatch(%s.%s): convert must be '%s', '%s', '%s' or a type, but is '%s'", name, field, CONVERT_TIMESTAMP, CONVERT_SCALE, CONVERT_ENUM, mapping.Convert)
+		}
+		if mapping.Fields != nil {
+			if err := backpatchFields(name+"."+field, mapping.Fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Transform turns the body of the backend response into the body of
+// the upstream response
+func (r *ResponseTransformImpl) Transform(body []byte) ([]byte, error) {
+	var source interface{}
+	if err := json.Unmarshal(body, &source); err != nil {
+		return nil, fmt.Errorf("the response is not JSON: %s", err.Error())
+	}
+	transformed, err := mapFields(r.Fields, source, "")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(transformed)
+}
+
+// mapFields builds an object out of the source
+func mapFields(fields map[string]*FieldMapping, source interface{}, path string) (map[string]interface{}, error) {
+	// Sorted, so that the errors are the same every time
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make(map[string]interface{})
+	for _, name := range names {
+		value, exists, err := fields[name].resolve(source, name, path+name)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			setField(result, name, value)
+		}
+	}
+	return result, nil
+}
+
+// resolve finds (and converts) the value of the field
+func (f *FieldMapping) resolve(source interface{}, name string, path string) (interface{}, bool, error) {
+	if f.Value != nil {
+		return f.Value, true, nil
+	}
+	from := f.From
+	if from == "" {
+		from = name
+	}
+	value, exists := lookupField(source, from)
+	if !exists || value == nil {
+		if f.Default != nil {
+			return f.Default, true, nil
+		}
+		if f.Required {
+			return nil, false, fmt.Errorf("%s: '%s' is missing", path, from)
+		}
+		return nil, false, nil
+	}
+
+	if f.Fields != nil {
+		switch v := value.(type) {
+		case []interface{}:
+			mapped := make([]interface{}, len(v))
+			for i, element := range v {
+				m, err := mapFields(f.Fields, element, fmt.Sprintf("%s.%d.", path, i))
+				if err != nil {
+					return nil, false, err
+				}
+				mapped[i] = m
+			}
+			return mapped, true, nil
+
+		case map[string]interface{}:
+			m, err := mapFields(f.Fields, v, path+".")
+			return m, err == nil, err
+
+		default:
+			return nil, false, fmt.Errorf("%s: '%s' is not an object or an array", path, from)
+		}
+	}
+
+	converted, err := f.convert(value)
+	if err != nil {
+		if f.Default != nil {
+			return f.Default, true, nil
+		}
+		return nil, false, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return converted, true, nil
+}
+
+func (f *FieldMapping) convert(value interface{}) (interface{}, error) {
+	switch f.Convert {
+	case CONVERT_TIMESTAMP:
+		millis, err := convertTimestamp(value, f.Unit)
+		if err != nil {
+			return nil, err
+		}
+		switch f.To {
+		case TIMESTAMP_SECONDS:
+			return float64(millis) / 1000, nil
+
+		case TIMESTAMP_ISO8601:
+			return time.UnixMilli(millis).UTC().Format(time.RFC3339Nano), nil
+		}
+		return millis, nil
+
+	case CONVERT_STRING:
+		if s, isString := value.(string); isString {
+			return s, nil
+		}
+		if number, isNumber := value.(float64); isNumber {
+			return strconv.FormatFloat(number, 'f', -1, 64), nil
+		}
+		return fmt.Sprint(value), nil
+
+	case CONVERT_NUMBER:
+		return toNumber(value)
+
+	case CONVERT_INTEGER:
+		number, err := toNumber(value)
+		if err != nil {
+			return nil, err
+		}
+		return int64(math.Round(number)), nil
+
+	case CONVERT_BOOLEAN:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not a boolean", v)
+			}
+			return b, nil
+
+		case float64:
+			return v != 0, nil
+		}
+		return nil, fmt.Errorf("'%v' is not a boolean", value)
+
+	case CONVERT_SCALE:
+		number, err := toNumber(value)
+		if err != nil {
+			return nil, err
+		}
+		return number * f.Scale, nil
+
+	case CONVERT_ENUM:
+		if mapped, exists := f.Enum[fmt.Sprint(value)]; exists {
+			return mapped, nil
+		}
+		return nil, fmt.Errorf("'%v' is not in the enum", value)
+	}
+	return value, nil
+}
+
+// convertTimestamp turns epoch seconds, epoch millis or an ISO-8601
+// timestamp into epoch millis
+func convertTimestamp(value interface{}, unit string) (int64, error) {
+	if s, isString := value.(string); isString && unit != TIMESTAMP_SECONDS && unit != TIMESTAMP_MILLIS {
+		if _, err := strconv.ParseFloat(s, 64); err != nil || unit == TIMESTAMP_ISO8601 {
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+				if t, err := time.Parse(layout, s); err == nil {
+					return t.UnixMilli(), nil
+				}
+			}
+			return 0, fmt.Errorf("'%s' is not an ISO-8601 timestamp", s)
+		}
+	}
+
+	number, err := toNumber(value)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case unit == TIMESTAMP_MILLIS:
+		return int64(math.Round(number)), nil
+
+	case unit == TIMESTAMP_SECONDS, unit == "" && math.Abs(number) < TIMESTAMP_MILLIS_THRESHOLD:
+		return int64(math.Round(number * 1000)), nil
+	}
+	return int64(math.Round(number)), nil
+}
+
+func toNumber(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+
+	case int:
+		return float64(v), nil
+
+	case int64:
+		return float64(v), nil
+
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("'%s' is not a number", v)
+		}
+		return number, nil
+	}
+	return 0, fmt.Errorf("'%v' is not a number", value)
+}
+
+// lookupField follows the (dotted) path through the objects and
+// arrays of the source
+func lookupField(source interface{}, path string) (interface{}, bool) {
+	if path == "$" {
+		return source, true
+	}
+	value := source
+	for _, key := range strings.Split(strings.TrimPrefix(path, "$."), ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, exists := v[key]
+			if !exists {
+				return nil, false
+			}
+			value = next
+
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// setField sets the (dotted) field, creating the objects on the way
+func setField(result map[string]interface{}, name string, value interface{}) {
+	keys := strings.Split(name, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, isObject := result[key].(map[string]interface{})
+		if !isObject {
+			next = make(map[string]interface{})
+			result[key] = next
+		}
+		result = next
+	}
+	result[keys[len(keys)-1]] = value
+}
+
+// normaliseResponse transforms the body of a successful response (and
+// checks it against the schema of the upstream).
+//
+// If that doesn't work, then the response is left as it was and the
+// error is a *BackendError
+func (u *UpstreamBackendImpl) normaliseResponse(resp *http.Response) error {
+	if (u.Response == nil && u.schema == nil) || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil
+	}
+
+	// We can't wait for the end of a stream of events
+	if IsEventStream(resp.Header) {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	reason := TRANSFORM_ERROR_TRANSFORM
+	normalised := body
+	if err == nil && u.Response != nil {
+		normalised, err = u.Response.Transform(body)
+	}
+	if err == nil && u.schema != nil {
+		reason = TRANSFORM_ERROR_SCHEMA
+		err = u.schema.ValidateJSON(normalised)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s.%s: %s: %s", u.upstreamName, u.GetName(), reason, err.Error())
+		log.Println(err)
+		upstreamTransformErrors.WithLabelValues(u.upstreamName, u.GetName(), reason).Inc()
+		return NewBackendError(http.StatusBadGateway, reason, err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(normalised))
+	resp.ContentLength = int64(len(normalised))
+	resp.Header.Set("Content-Length", fmt.Sprint(len(normalised)))
+	resp.Header.Set("Content-Type", "application/json")
+	return nil
+}
@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const transformTestConfig = `
+fields:
+  total: webPages.totalEstimatedMatches
+  meta.provider: {value: bing}
+  results:
+    from: webPages.value
+    required: true
+    fields:
+      title: name
+      crawled: {from: dateLastCrawled, convert: timestamp}
+      size_kb: {from: bytes, convert: scale, scale: 0.001}
+      status:
+        from: state
+        convert: enum
+        enum: {ok: ACTIVE, gone: DELETED}
+        default: UNKNOWN
+`
+
+func newTestResponseTransform(t *testing.T) *ResponseTransformImpl {
+	transform := &ResponseTransformImpl{}
+	if err := yaml.Unmarshal([]byte(transformTestConfig), transform); err != nil {
+		t.Fatal(err)
+	}
+	if err := transform.Backpatch("search.bing.response"); err != nil {
+		t.Fatal(err)
+	}
+	return transform
+}
+
+func TestResponseTransform(t *testing.T) {
+	transform := newTestResponseTransform(t)
+	body := `{
+		"webPages": {
+			"totalEstimatedMatches": 2,
+			"value": [
+				{"name": "cats", "dateLastCrawled": "2023-03-01T12:00:00Z", "bytes": 2000, "state": "ok"},
+				{"name": "dogs", "dateLastCrawled": 1677672000, "state": "wibble", "extra": true}
+			]
+		}
+	}`
+	transformed, err := transform.Transform([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got interface{}
+	json.Unmarshal(transformed, &got)
+	var expected interface{}
+	json.Unmarshal([]byte(`{
+		"total": 2,
+		"meta": {"provider": "bing"},
+		"results": [
+			{"title": "cats", "crawled": 1677672000000, "size_kb": 2, "status": "ACTIVE"},
+			{"title": "dogs", "crawled": 1677672000000, "status": "UNKNOWN"}
+		]
+	}`), &expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, but got %v", expected, got)
+	}
+
+	if _, err := transform.Transform([]byte(`{"webPages": {}}`)); err == nil {
+		t.Error("Expected an error for a missing required field")
+	}
+	if _, err := transform.Transform([]byte(`<html>`)); err == nil {
+		t.Error("Expected an error for a body that isn't JSON")
+	}
+}
+
+func TestConvertTimestamp(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		unit     string
+		expected int64
+	}{
+		{float64(1677672000), "", 1677672000000},
+		{float64(1677672000123), "", 1677672000123},
+		{float64(1677672000), TIMESTAMP_MILLIS, 1677672000},
+		{"1677672000", "", 1677672000000},
+		{"1677672000", TIMESTAMP_SECONDS, 1677672000000},
+		{"2023-03-01T12:00:00.123Z", "", 1677672000123},
+		{"2023-03-01T13:00:00+01:00", TIMESTAMP_ISO8601, 1677672000000},
+	}
+	for _, test := range tests {
+		got, err := convertTimestamp(test.value, test.unit)
+		if err != nil {
+			t.Errorf("%v (%s): %s", test.value, test.unit, err.Error())
+		} else if got != test.expected {
+			t.Errorf("%v (%s): expected %d, but got %d", test.value, test.unit, test.expected, got)
+		}
+	}
+	if _, err := convertTimestamp("yesterday", ""); err == nil {
+		t.Error("Expected an error for a timestamp we can't parse")
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema := &SchemaImpl{
+		Type:     SCHEMA_OBJECT,
+		Required: []string{"results"},
+		Properties: map[string]*SchemaImpl{
+			"total": {Type: SCHEMA_INTEGER},
+			"results": {
+				Type:  SCHEMA_ARRAY,
+				Items: &SchemaImpl{Type: SCHEMA_OBJECT, Required: []string{"title"}},
+			},
+		},
+	}
+	if err := schema.Backpatch("search.schema"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		`{"results": [{"title": "cats"}], "total": 1}`: true,
+		`{"results": []}`:                 true,
+		`{"total": 1}`:                    false,
+		`{"results": [{"name": "cats"}]}`: false,
+		`{"results": [], "total": 1.5}`:   false,
+		`[]`:                              false,
+	}
+	for body, valid := range tests {
+		err := schema.ValidateJSON([]byte(body))
+		if valid && err != nil {
+			t.Errorf("%s: expected it to be valid, but got %s", body, err.Error())
+		}
+		if !valid && err == nil {
+			t.Errorf("%s: expected it not to be valid", body)
+		}
+	}
+
+	if err := (&SchemaImpl{Type: "wibble"}).Backpatch("search.schema"); err == nil {
+		t.Error("Expected an error for an unknown type")
+	}
+}
+
+func TestDoNormalisesResponse(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good":
+			io.WriteString(w, `{"webPages": {"value": [{"name": "cats"}]}}`)
+		case "/bad":
+			io.WriteString(w, `{"error": "wibble"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "not found")
+		}
+	})
+
+	for _, onTransformError := range []string{ON_TRANSFORM_ERROR_PASS, ON_TRANSFORM_ERROR_FAIL} {
+		upstream := newTestUpstream(t, "search", &UpstreamImpl{
+			Rule:             "random",
+			OnTransformError: onTransformError,
+			Schema:           &SchemaImpl{Type: SCHEMA_OBJECT, Required: []string{"results"}},
+			Backends: map[string]*UpstreamBackendImpl{
+				"bing": {Url: server, Weight: 1, Response: newTestResponseTransform(t)},
+			},
+		})
+		bing := upstream.Backends["bing"]
+
+		resp, err := bing.Do(context.Background(), httptest.NewRequest(http.MethodGet, "/good", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != `{"meta":{"provider":"bing"},"results":[{"status":"UNKNOWN","title":"cats"}]}` {
+			t.Errorf("%s: expected the response to be transformed, but got %s", onTransformError, string(body))
+		}
+
+		// Errors aren't transformed
+		resp, err = bing.Do(context.Background(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "not found" {
+			t.Errorf("%s: expected an error response to be left alone, but got %s", onTransformError, string(body))
+		}
+
+		resp, err = bing.Do(context.Background(), httptest.NewRequest(http.MethodGet, "/bad", nil))
+		if onTransformError == ON_TRANSFORM_ERROR_PASS {
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != `{"error": "wibble"}` {
+				t.Errorf("Expected the response to be passed on as it is, but got %s", string(body))
+			}
+			continue
+		}
+		backendError, isBackendError := err.(*BackendError)
+		if !isBackendError || backendError.Class != TRANSFORM_ERROR_TRANSFORM || backendError.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected a 502 transform error, but got %v", err)
+		}
+	}
+}
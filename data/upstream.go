@@ -1,10 +1,14 @@
 package data
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -46,9 +50,51 @@ var upstreamResponses = promauto.NewCounterVec(
 	[]string{"tag", "upstream", "backend", "method", "code"},
 )
 
+var upstreamEligibleBackends = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_eligible_backends",
+		Help:      "The number of backends that are healthy enough to get traffic, keyed by upstream",
+	},
+	[]string{"upstream"},
+)
+var upstreamPanics = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_panics",
+		Help:      "The number of requests sent to any backend because no backend was healthy, keyed by upstream",
+	},
+	[]string{"upstream"},
+)
+
+const (
+	// What to do when no backend is healthy
+	NO_HEALTHY_BACKENDS_FAIL_FAST = "fail_fast"
+	NO_HEALTHY_BACKENDS_PANIC     = "panic"
+
+	// What to do with a response that can't be transformed (or
+	// doesn't match the schema)
+	ON_TRANSFORM_ERROR_PASS = "pass"
+	ON_TRANSFORM_ERROR_FAIL = "fail"
+)
+
 type Upstream interface {
 	Handler
-	ChooseBackend(preferredBackend string) UpstreamBackend
+	ChooseBackend(preferredBackend string, hashKey string) UpstreamBackend
+	GetBackend(backendName string) UpstreamBackend
+	GetStatus() UpstreamStatus
+
+	// Dynamic config
+	SetWeight(backendName string, weight int) error
+	Rollout(backendName string, rollout *RolloutImpl) error
+}
+
+// UpstreamStatus is what the admin API says about an upstream
+type UpstreamStatus struct {
+	Name     string                   `json:"name"`
+	Rule     string                   `json:"rule"`
+	Eligible int                      `json:"eligible"`
+	Backends map[string]BackendStatus `json:"backends"`
 }
 
 type UpstreamImpl struct {
@@ -57,20 +103,87 @@ type UpstreamImpl struct {
 	Cost        CostFromConfig                  `yaml:"cost" json:"cost"`
 	Backends    map[string]*UpstreamBackendImpl `yaml:"backends" json:"backends"`
 	Rule        string                          `yaml:"rule" json:"rule"`
+	HashKey     string                          `yaml:"hash_key,omitempty" json:"hash_key,omitempty"`
 	Pathology   string                          `yaml:"pathology" json:"pathology"`
 	Recorder    *RecorderImpl                   `yaml:"recorder" json:"recorder"`
 
+	// The proportion of the requests (0-100) that get the pathology
+	// instead of going to a backend.  See FaultInjection
+	PathologyPercent float64 `yaml:"pathology_percent,omitempty" json:"pathology_percent,omitempty"`
+
+	// The attenuator for the backends that don't have one of their own
+	Attenuator string `yaml:"attenuator,omitempty" json:"attenuator,omitempty"`
+
+	// How quickly the least_latency rule forgets old latencies
+	EWMADecayMillis int64 `yaml:"ewma_decay_millis,omitempty" json:"ewma_decay_millis,omitempty"`
+
+	// How long the priority rule waits for a better tier to stay
+	// available before it goes back to it
+	PriorityRecoveryMillis int64 `yaml:"priority_recovery_millis,omitempty" json:"priority_recovery_millis,omitempty"`
+
+	// If this is set, then backends whose health we don't know yet
+	// (i.e. they have no healthcheck, or it hasn't run) get no traffic
+	ExcludeUnknown bool `yaml:"exclude_unknown,omitempty" json:"exclude_unknown,omitempty"`
+
+	// What to do when no backend is healthy: fail_fast (503) or
+	// panic (send the request to any backend that isn't disabled or
+	// draining)
+	NoHealthyBackends string `yaml:"no_healthy_backends,omitempty" json:"no_healthy_backends,omitempty"`
+
+	// The healthcheck settings for the backends that don't have
+	// their own
+	HealthcheckSettings *HealthcheckSettingsImpl `yaml:"healthcheck_settings,omitempty" json:"healthcheck_settings,omitempty"`
+
+	// If this is set, then backends that fail too many requests are
+	// ejected for a while
+	OutlierDetection *OutlierDetectionImpl `yaml:"outlier_detection,omitempty" json:"outlier_detection,omitempty"`
+
+	// The shape of the JSON that the backends send back (once it has
+	// been through their response transforms)
+	Schema *SchemaImpl `yaml:"schema,omitempty" json:"schema,omitempty"`
+
+	// What to do with a response that can't be transformed (or
+	// doesn't match the schema): pass (send it on as it is) or fail (a
+	// 502, which fails over if there is a failover)
+	OnTransformError string `yaml:"on_transform_error,omitempty" json:"on_transform_error,omitempty"`
+
+	// If this is set, then a sample of the requests are mirrored to
+	// another backend, and the responses compared
+	Shadow *ShadowImpl `yaml:"shadow,omitempty" json:"shadow,omitempty"`
+
+	// If this is set, then slow requests are hedged
+	Hedge *HedgeImpl `yaml:"hedge,omitempty" json:"hedge,omitempty"`
+
+	// If this is set, then failed requests are sent to another backend
+	Failover *FailoverImpl `yaml:"failover,omitempty" json:"failover,omitempty"`
+
 	// These are backpatched
-	backendCDF []HasCDF
-	cost       Cost
-	rng        *rand.Rand
+	backendCDF     []HasCDF
+	cost           Cost
+	rng            *rand.Rand
+	priority       *PriorityImpl
+	faultInjection *FaultInjection
+
+	// The attenuators and pathology profiles come from here (the
+	// live registries if they aren't set)
+	throttleRegistry ThrottleRegistry
+	profileRegistry  ProfileRegistry
+
+	// The backends that are healthy enough to get traffic (with their
+	// CDF), which is updated whenever a backend changes state
+	mutex       sync.RWMutex
+	eligibleCDF []HasCDF
+
+	// The rollouts that are changing the weights of the backends
+	rolloutMutex sync.Mutex
+	rollouts     map[string]context.CancelFunc
 
 	// this is backpatched to use the service broker
-	HandlerFunc func(c *gin.Context)
+	HandlerFunc func(c *gin.Context) `yaml:"-" json:"-"`
 }
 
 func (u *UpstreamImpl) Backpatch() error {
-	u.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	u.rng = NewLockedRand(time.Now().UnixNano())
 
 	// Backpatch the cost
 	u.cost = &CostImpl{
@@ -81,28 +194,96 @@ func (u *UpstreamImpl) Backpatch() error {
 	var err error
 	if u.Recorder != nil {
 		err = u.Recorder.Backpatch()
+		if err != nil {
+			return err
+		}
+	}
+
+	u.priority = nil
+	if u.Rule == "priority" {
+		u.priority = NewPriority(u.GetName(), u.PriorityRecoveryMillis)
+	}
+	switch u.NoHealthyBackends {
+	case "":
+		u.NoHealthyBackends = NO_HEALTHY_BACKENDS_FAIL_FAST
+
+	case NO_HEALTHY_BACKENDS_FAIL_FAST, NO_HEALTHY_BACKENDS_PANIC:
+
+	default:
+		return fmt.Errorf("Backpatch(%s): no_healthy_backends must be '%s' or '%s', but is '%s'", u.GetName(), NO_HEALTHY_BACKENDS_FAIL_FAST, NO_HEALTHY_BACKENDS_PANIC, u.NoHealthyBackends)
+	}
+	if u.Rule == "hash" {
+		err = validateHashKey(u.GetName(), u.HashKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch u.OnTransformError {
+	case "":
+		u.OnTransformError = ON_TRANSFORM_ERROR_PASS
+
+	case ON_TRANSFORM_ERROR_PASS, ON_TRANSFORM_ERROR_FAIL:
+
+	default:
+		return fmt.Errorf("Backpatch(%s): on_transform_error must be '%s' or '%s', but is '%s'", u.GetName(), ON_TRANSFORM_ERROR_PASS, ON_TRANSFORM_ERROR_FAIL, u.OnTransformError)
+	}
+	u.faultInjection, err = NewFaultInjection(u.GetName(), u.Pathology, u.PathologyPercent, u.getProfileRegistry())
+	if err != nil {
+		return err
+	}
+	if u.Schema != nil {
+		err = u.Schema.Backpatch(u.GetName() + ".schema")
+		if err != nil {
+			return err
+		}
+	}
+	if u.Shadow != nil {
+		err = u.Shadow.Backpatch(u)
+		if err != nil {
+			return err
+		}
+	}
+	if u.OutlierDetection != nil {
+		err = u.OutlierDetection.Backpatch(u)
+		if err != nil {
+			return err
+		}
+	}
+	if u.Hedge != nil {
+		err = u.Hedge.Backpatch(u.GetName())
+		if err != nil {
+			return err
+		}
+	}
+	if u.Failover != nil {
+		err = u.Failover.Backpatch(u.GetName())
+		if err != nil {
+			return err
+		}
 	}
 
 	// Backpatch the backends CDF
-	totalWeight := 0
+	backendCDF := make([]HasCDF, 0, len(u.Backends))
 	for backendName, upstreamBackend := range u.Backends {
-		upstreamBackend.backendName = backendName
-		upstreamBackend.upstreamName = u.GetName()
-		totalWeight += upstreamBackend.Weight
-	}
-	u.backendCDF = make([]HasCDF, 0)
-	for _, upstreamBackend := range u.Backends {
-		upstreamBackend.cdf = float64(upstreamBackend.Weight) / float64(totalWeight)
-		u.backendCDF = append(u.backendCDF, upstreamBackend)
+		err = upstreamBackend.Backpatch(u, backendName)
+		if err != nil {
+			return err
+		}
+		backendCDF = append(backendCDF, upstreamBackend)
 	}
+	u.mutex.Lock()
+	u.backendCDF = backendCDF
+	u.mutex.Unlock()
+	u.updateEligible()
 
 	// Backends can have their own recorder.
 	// If they don't have one specified, it uses the one from the upstream parent
 	for _, upstreamBackend := range u.Backends {
 		if upstreamBackend.Recorder == nil {
 			upstreamBackend.Recorder = u.Recorder
-		} else {
-			upstreamBackend.Recorder.Backpatch()
+		} else if err = upstreamBackend.Recorder.Backpatch(); err != nil {
+			return err
 		}
 	}
 
@@ -113,6 +294,24 @@ func (u *UpstreamImpl) GetName() string {
 	return u.serviceName
 }
 
+// getThrottleRegistry returns the registry for this generation of
+// the config
+func (u *UpstreamImpl) getThrottleRegistry() ThrottleRegistry {
+	if u.throttleRegistry == nil {
+		return GetThrottleRegistry()
+	}
+	return u.throttleRegistry
+}
+
+// getProfileRegistry returns the pathology profiles for this
+// generation of the config
+func (u *UpstreamImpl) getProfileRegistry() ProfileRegistry {
+	if u.profileRegistry == nil {
+		return GetProfileRegistry()
+	}
+	return u.profileRegistry
+}
+
 func (u *UpstreamImpl) Handle(c *gin.Context) {
 	// Make sure the varz get updated
 	nowMillis := time.Now().UTC().UnixMilli()
@@ -128,12 +327,27 @@ func (u *UpstreamImpl) Handle(c *gin.Context) {
 		).Add(float64(time.Now().UTC().UnixMilli() - nowMillis))
 	}()
 
+	// A sample of the requests get a pathology instead
+	if u.faultInjection.Handle(c) {
+		responseCodeAsString = fmt.Sprint(c.Writer.Status())
+		return
+	}
+
 	// Select a backend
-	backend = u.ChooseBackend(c.GetHeader(HEADER_X_FAULTMONKEY_BACKEND))
+	preferredBackend := c.GetHeader(HEADER_X_FAULTMONKEY_BACKEND)
+	hashKey := u.getHashKey(c)
+	backend = u.ChooseBackend(preferredBackend, hashKey)
 	if backend == nil {
+		// Either there is no such backend, or none of them are
+		// healthy
+		statusCode := http.StatusBadGateway
 		err := fmt.Errorf("Handle(%s): No backend for '%s.%s'", c.Request.URL, u.serviceName, u.GetName())
+		if preferredBackend == "" {
+			statusCode = http.StatusServiceUnavailable
+			err = fmt.Errorf("Handle(%s): No healthy backend for '%s'", c.Request.URL, u.GetName())
+		}
 		log.Println(err)
-		responseCodeAsString = fmt.Sprint(http.StatusBadGateway)
+		responseCodeAsString = fmt.Sprint(statusCode)
 		upstreamErrors.WithLabelValues(
 			c.Request.Header.Get(HEADER_X_FAULTMONKEY_TAG),
 			u.GetName(),
@@ -141,7 +355,8 @@ func (u *UpstreamImpl) Handle(c *gin.Context) {
 			c.Request.Method,
 			responseCodeAsString,
 		).Inc()
-		c.AbortWithError(http.StatusBadGateway, err)
+		c.Writer.Header().Add(HEADER_X_FAULTMONKEY_ERROR, err.Error())
+		c.AbortWithError(statusCode, err)
 
 		return
 	}
@@ -163,21 +378,195 @@ func (u *UpstreamImpl) Handle(c *gin.Context) {
 		c.Request.Method,
 	).Inc()
 
+	// A WebSocket stays with the backend it is given (it can't be
+	// mirrored, hedged or failed over)
+	if IsWebSocketUpgrade(c.Request) {
+		backend.Handle(c)
+		return
+	}
+
+	// Mirror a sample of the requests to the shadow backend, which
+	// is compared with whatever the caller gets
+	if shadow := u.Shadow.start(c, backend); shadow != nil {
+		defer shadow.finish()
+	}
+
+	// Hedge the request if it is slow (unless the caller has asked
+	// for a particular backend).  This fails over as well, if the
+	// upstream has a failover
+	if u.Hedge != nil && preferredBackend == "" && u.Hedge.CanHedge(c.Request.Method) {
+		u.handleHedged(c, backend, hashKey)
+		return
+	}
+
+	// Fail over to other backends (unless the caller has asked for
+	// a particular backend)
+	if u.Failover != nil && preferredBackend == "" && u.Failover.CanFailover(c.Request.Method) {
+		u.handleFailover(c, backend, hashKey)
+		return
+	}
+
 	// Delegate to the handler function
 	backend.Handle(c)
 }
 
-func (u *UpstreamImpl) ChooseBackend(preferredBackend string) UpstreamBackend {
+// GetBackend returns the named backend (or nil)
+func (u *UpstreamImpl) GetBackend(backendName string) UpstreamBackend {
+	if backend, exists := u.Backends[backendName]; exists {
+		return backend
+	}
+	// Avoid handing out a non-nil interface wrapping a nil pointer
+	return nil
+}
+
+// GetStatus returns the state of the upstream and its backends
+func (u *UpstreamImpl) GetStatus() UpstreamStatus {
+	u.mutex.RLock()
+	eligible := len(u.eligibleCDF)
+	u.mutex.RUnlock()
+
+	status := UpstreamStatus{
+		Name:     u.GetName(),
+		Rule:     u.Rule,
+		Eligible: eligible,
+		Backends: make(map[string]BackendStatus),
+	}
+	for backendName, backend := range u.Backends {
+		status.Backends[backendName] = backend.GetStatus()
+	}
+	return status
+}
+
+// ChooseBackend chooses a backend according to the rule. The hashKey
+// is only used by the hash rule
+func (u *UpstreamImpl) ChooseBackend(preferredBackend string, hashKey string) UpstreamBackend {
 	if preferredBackend != "" {
 		// The caller has specified that there is a specific backend they want
 		// to use
-		return u.Backends[preferredBackend]
+		return u.GetBackend(preferredBackend)
 	}
 
-	backend := Choose(u.Rule, u.backendCDF, u.rng)
+	return u.chooseBackendExcluding(hashKey)
+}
+
+// chooseBackendExcluding chooses a backend according to the rule,
+// ignoring the excluded backends
+func (u *UpstreamImpl) chooseBackendExcluding(hashKey string, excluded ...UpstreamBackend) UpstreamBackend {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	// Don't send anything to a backend whose circuit is open
+	candidates := make([]HasCDF, 0, len(u.eligibleCDF))
+	for _, backend := range u.eligibleCDF {
+		if backend.(UpstreamBackend).GetState() == CIRCUIT_OPEN || isExcluded(backend.(UpstreamBackend), excluded) {
+			continue
+		}
+		candidates = append(candidates, backend)
+	}
+
+	if len(candidates) == 0 {
+		if u.NoHealthyBackends != NO_HEALTHY_BACKENDS_PANIC {
+			return nil
+		}
+
+		// Panic mode: anything (that hasn't been disabled or
+		// drained) is better than nothing
+		for _, backend := range u.backendCDF {
+			if isAdminState(backend.(UpstreamBackend).GetState()) || isExcluded(backend.(UpstreamBackend), excluded) {
+				continue
+			}
+			candidates = append(candidates, backend)
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		upstreamPanics.WithLabelValues(u.GetName()).Inc()
+	}
+
+	var backend HasCDF
+	switch {
+	case u.priority != nil:
+		// Only move between tiers when we are choosing the first
+		// backend for a request
+		backend = u.priority.Choose(candidates, u.rng, len(excluded) == 0)
+
+	case u.Rule == "weighted" && len(candidates) == len(u.eligibleCDF):
+		// Nothing has been left out, so the CDF is up to date
+		backend = ChooseFromCDF(u.rng.Float64(), candidates)
+
+	default:
+		backend = ChooseWithKey(u.Rule, hashKey, candidates, u.rng)
+	}
 	if backend == nil {
 		return nil
 	}
 
 	return backend.(UpstreamBackend)
 }
+
+// updateEligible works out which backends are healthy enough to get
+// traffic, and recomputes their CDF.  It is called whenever a backend
+// changes state
+func (u *UpstreamImpl) updateEligible() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	eligible := make([]HasCDF, 0, len(u.backendCDF))
+	for _, backend := range u.backendCDF {
+		if backend.(*UpstreamBackendImpl).isEjected() {
+			continue
+		}
+		switch backend.(*UpstreamBackendImpl).getHealthState() {
+		case HEALTHY:
+			eligible = append(eligible, backend)
+
+		case UNKNOWN:
+			if !u.ExcludeUnknown {
+				eligible = append(eligible, backend)
+			}
+		}
+	}
+	BackpatchCDF(eligible)
+	u.eligibleCDF = eligible
+	upstreamEligibleBackends.WithLabelValues(u.GetName()).Set(float64(len(eligible)))
+}
+
+func isExcluded(backend UpstreamBackend, excluded []UpstreamBackend) bool {
+	for _, e := range excluded {
+		if e == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadBody buffers the body of the request, so that it can be sent
+// more than once
+func ReadBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// CloneRequest makes a copy of the request (including the headers)
+// with its own copy of the buffered body
+func CloneRequest(req *http.Request, body []byte) *http.Request {
+	clone := req.Clone(req.Context())
+	if body == nil {
+		clone.Body = http.NoBody
+		return clone
+	}
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	clone.ContentLength = int64(len(body))
+	clone.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return clone
+}
@@ -2,12 +2,16 @@ package data
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"http-attenuator/util"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -24,19 +28,48 @@ var upstreamBackends = promauto.NewGaugeVec(
 	[]string{"upstream", "backend", "state"},
 )
 
+var upstreamBackendWeight = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "faultmonkey",
+		Name:      "upstream_backend_weight",
+		Help:      "The weight of a backend, keyed by upstream/backend",
+	},
+	[]string{"upstream", "backend"},
+)
+
 type UpstreamBackend interface {
 	HasCDF
 	Handler
 	GetCost() Cost
 	GetURL() *url.URL
 
+	// Do sends the request to the backend without writing the
+	// response to the caller
+	Do(ctx context.Context, req *http.Request) (*http.Response, error)
+
+	// The p'th percentile of the recent latencies of this backend
+	// (false if we have not seen enough requests yet)
+	GetLatencyPercentile(p float64) (int64, bool)
+
 	// Dynamic config
 	Disable() error
 	Enable() error
 
+	// Drain stops new traffic going to the backend, and waits for
+	// the requests in flight to finish before disabling it
+	Drain(ctx context.Context) error
+
+	// The number of requests in flight to this backend
+	GetInflight() int64
+
+	// What the admin API says about this backend
+	GetStatus() BackendStatus
+	GetHealthcheckHistory() []HealthcheckResult
+
 	// For keeping state up to date
 	GetState() BackendState
 	SetState(state BackendState)
+	GetCircuitBreaker() CircuitBreaker
 
 	// For starting and stopping the healthcheck.
 	// TODO(john): these should be a separate interface
@@ -44,6 +77,16 @@ type UpstreamBackend interface {
 	Stop()
 }
 
+// BackendStatus is what the admin API says about a backend
+type BackendStatus struct {
+	Name     string `json:"name"`
+	Url      string `json:"url"`
+	State    string `json:"state"`
+	Weight   int    `json:"weight"`
+	Priority int    `json:"priority"`
+	Inflight int64  `json:"inflight"`
+}
+
 type UpstreamBackendImplFromConfig map[string]*UpstreamBackendImpl
 
 type BackendState int
@@ -53,6 +96,27 @@ const (
 	HEALTHY
 	UNHEALTHY
 	DISABLED
+
+	// Not getting any new traffic, and will be DISABLED once the
+	// requests in flight have finished
+	DRAINING
+
+	// Taken out of service for a while by outlier detection, which
+	// takes precedence over the healthcheck and circuit breaker
+	EJECTED
+
+	// These reflect the state of the circuit breaker, which
+	// takes precedence over the healthcheck
+	CIRCUIT_OPEN
+	CIRCUIT_HALF_OPEN
+)
+
+var allBackendStates = []BackendState{UNKNOWN, HEALTHY, UNHEALTHY, DISABLED, DRAINING, EJECTED, CIRCUIT_OPEN, CIRCUIT_HALF_OPEN}
+
+const (
+	// How often Drain() checks whether the requests in flight have
+	// finished
+	drainPollInterval = 10 * time.Millisecond
 )
 
 func (s BackendState) String() string {
@@ -66,6 +130,18 @@ func (s BackendState) String() string {
 	case DISABLED:
 		return "DISABLED"
 
+	case DRAINING:
+		return "DRAINING"
+
+	case EJECTED:
+		return "EJECTED"
+
+	case CIRCUIT_OPEN:
+		return "CIRCUIT_OPEN"
+
+	case CIRCUIT_HALF_OPEN:
+		return "CIRCUIT_HALF_OPEN"
+
 	default:
 		return "UNKNOWN"
 	}
@@ -78,27 +154,91 @@ type UpstreamBackendImpl struct {
 	Impl         string        `yaml:"impl" json:"impl"`
 	Url          string        `yaml:"url" json:"url"`
 	Weight       int           `yaml:"weight" json:"weight"`
+	Priority     int           `yaml:"priority,omitempty" json:"priority,omitempty"`
 	Pathology    string        `yaml:"pathology" json:"pathology"`
 	Recorder     *RecorderImpl `yaml:"recorder" json:"recorder"`
 
+	// The proportion of the requests (0-100) to this backend that
+	// get the pathology instead.  See FaultInjection
+	PathologyPercent float64 `yaml:"pathology_percent,omitempty" json:"pathology_percent,omitempty"`
+
+	// The broker sends the rest of the path (after the name of the
+	// upstream) and the query on to the backend.  The url can use {1},
+	// {2} ... for the segments of that path instead of having it added
+	// on to the end, and strip_prefix is taken off the path first
+	StripPrefix string `yaml:"strip_prefix,omitempty" json:"strip_prefix,omitempty"`
+
+	// Which params the backend gets, and the headers that are added
+	// (or removed).  See RequestMapping
+	Params  map[string]string `yaml:"params,omitempty" json:"params,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+
+	// Builds the body that the backend expects out of the caller's
+	// request
+	Body *RequestBodyImpl `yaml:"body,omitempty" json:"body,omitempty"`
+
+	// Turns the (JSON) response into what the upstream promises
+	Response *ResponseTransformImpl `yaml:"response,omitempty" json:"response,omitempty"`
+
 	// This is used to override the default cost for this upstream.
 	//
 	// It allows us to (for instance) implement some kind of
 	// ChooseCheapest()
-	Cost Cost `yaml:"cost,omitempty" json:"impl,omitempty"`
-
-	// This is backpatched
-	cdf float64
+	Cost CostFromConfig `yaml:"cost,omitempty" json:"cost,omitempty"`
+
+	// The circuit breaker for this backend (if any)
+	CircuitBreaker *CircuitBreakerImpl `yaml:"circuitbreaker,omitempty" json:"circuitbreaker,omitempty"`
+
+	// The attenuator for this backend.  If this is not set, then we
+	// use the circuit breaker max_hertz, then the upstream attenuator
+	// and then the default attenuator
+	Attenuator string `yaml:"attenuator,omitempty" json:"attenuator,omitempty"`
+
+	// These are backpatched
+	cdf              float64
+	cost             Cost
+	throttle         Throttle
+	latencies        *LatencyHistory
+	ewma             *LatencyEWMA
+	outlierDetection *OutlierDetectionImpl
+	requestMapping   *RequestMapping
+	schema           *SchemaImpl
+	onTransformError string
+	faultInjection   *FaultInjection
+
+	// The weight in the config, so that a reload can tell if the
+	// weight has been changed since
+	configWeight int
+
+	// State of this backend (as determined by the healthcheck).
+	//
+	// The healthcheck writes this from its own goroutine, so use
+	// GetState() and SetState() rather than touching it directly
+	State         BackendState
+	stateMutex    sync.RWMutex
+	onStateChange func()
 
-	// State of this backend
-	State BackendState
+	// The requests in flight (until the body of the response has been
+	// closed)
+	inflight atomic.Int64
 
 	// The healthcheck spec and implementation
-	Healthcheck         string `yaml:"healthcheck" json:"healthcheck"`
-	healthCheckImpl     EVT
-	healthCheckInterval *time.Duration
-	healthcheckResult   EVTResult
-	healthcheckStop     chan interface{}
+	Healthcheck     string `yaml:"healthcheck" json:"healthcheck"`
+	healthCheckImpl EVT
+	healthcheckStop chan interface{}
+
+	// How often the healthcheck runs etc (the upstream's settings if
+	// this is not set)
+	HealthcheckSettings *HealthcheckSettingsImpl `yaml:"healthcheck_settings,omitempty" json:"healthcheck_settings,omitempty"`
+
+	// These are backpatched, and guarded by the stateMutex.  The
+	// healthcheckState is what the healthcheck thinks, whatever
+	// the state has been set to
+	healthcheckSettings *HealthcheckSettingsImpl
+	healthcheckState    BackendState
+	healthcheckPasses   int
+	healthcheckFailures int
+	healthcheckHistory  []HealthcheckResult
 }
 
 func (u *UpstreamBackendImpl) GetName() string {
@@ -114,11 +254,83 @@ func (u *UpstreamBackendImpl) SetCDF(cdf float64) {
 }
 
 func (u *UpstreamBackendImpl) GetWeight() int {
+	u.stateMutex.RLock()
+	defer u.stateMutex.RUnlock()
 	return u.Weight
 }
 
+// setWeight changes the weight.  Use UpstreamImpl.SetWeight() so that
+// the CDF is rebuilt
+func (u *UpstreamBackendImpl) setWeight(weight int) {
+	u.stateMutex.Lock()
+	u.Weight = weight
+	u.stateMutex.Unlock()
+	upstreamBackendWeight.WithLabelValues(u.upstreamName, u.GetName()).Set(float64(weight))
+}
+
+// GetErrorRate returns the average error rate of the backend, and
+// how many requests it is based on
+func (u *UpstreamBackendImpl) GetErrorRate() (float64, int64) {
+	if u.ewma == nil {
+		return 0, 0
+	}
+	return u.ewma.GetErrorRate()
+}
+
+// GetPriority is used by the priority rule.  Lower is better
+func (u *UpstreamBackendImpl) GetPriority() int {
+	return u.Priority
+}
+
 func (u *UpstreamBackendImpl) GetCost() Cost {
-	return u.Cost
+	return u.cost
+}
+
+func (u *UpstreamBackendImpl) GetLatencyPercentile(p float64) (int64, bool) {
+	if u.latencies == nil {
+		return 0, false
+	}
+	return u.latencies.Percentile(p)
+}
+
+// GetCostPerRequest is used by the cheapest rule
+func (u *UpstreamBackendImpl) GetCostPerRequest() int {
+	return u.Cost.GetTotal()
+}
+
+// IsAvailable is used by the cheapest, hash and priority rules.  A backend is not
+// available if it is unhealthy, its circuit is open, it is at
+// max_concurrent, its attenuator is saturated or it has told us to
+// back off
+func (u *UpstreamBackendImpl) IsAvailable() bool {
+	switch u.GetState() {
+	case UNHEALTHY, DISABLED, DRAINING, EJECTED, CIRCUIT_OPEN:
+		return false
+	}
+	if u.CircuitBreaker != nil && u.CircuitBreaker.IsSaturated() {
+		return false
+	}
+	if throttle, isSaturable := u.GetThrottle().(Saturable); isSaturable && throttle.IsSaturated() {
+		return false
+	}
+	if parsedUrl := u.GetURL(); parsedUrl != nil && IsBackingOff(parsedUrl.Host) {
+		return false
+	}
+	return true
+}
+
+// GetLatencyScore is used by the least_latency rule
+func (u *UpstreamBackendImpl) GetLatencyScore() float64 {
+	if u.ewma == nil {
+		return 0
+	}
+	return u.ewma.GetLatencyScore()
+}
+
+func (u *UpstreamBackendImpl) recordLatency(millis int64) {
+	if u.latencies != nil {
+		u.latencies.Record(millis)
+	}
 }
 
 func (u *UpstreamBackendImpl) GetURL() *url.URL {
@@ -126,78 +338,435 @@ func (u *UpstreamBackendImpl) GetURL() *url.URL {
 	return parsedUrl
 }
 
+// Disable stops all traffic to the backend straight away (the
+// healthcheck keeps running, but can't change the state)
 func (u *UpstreamBackendImpl) Disable() error {
+	u.SetState(DISABLED)
 	return nil
 }
 
+// Enable puts a disabled (or draining) backend back into service,
+// in whatever state the healthcheck says it is in (UNKNOWN if there
+// is no healthcheck, or it hasn't made up its mind)
 func (u *UpstreamBackendImpl) Enable() error {
+	u.stateMutex.RLock()
+	state := u.healthcheckState
+	u.stateMutex.RUnlock()
+
+	u.setState(state, func(current BackendState) bool {
+		return isAdminState(current)
+	})
 	return nil
 }
 
-func (u *UpstreamBackendImpl) SetHealthcheck(healthcheck EVT) {
-	u.healthCheckImpl = healthcheck
+// Drain stops new traffic going to the backend, and waits for the
+// requests in flight to finish before disabling it.
+//
+// If the context is done first, then the backend carries on draining
+func (u *UpstreamBackendImpl) Drain(ctx context.Context) error {
+	u.SetState(DRAINING)
+
+	drained := make(chan interface{})
+	go func() {
+		defer close(drained)
+		for u.GetInflight() > 0 {
+			if u.getHealthState() != DRAINING {
+				// Somebody has changed their mind
+				return
+			}
+			time.Sleep(drainPollInterval)
+		}
+		u.setState(DISABLED, func(current BackendState) bool {
+			return current == DRAINING
+		})
+	}()
+
+	select {
+	case <-drained:
+		if state := u.getHealthState(); state != DISABLED {
+			return fmt.Errorf("Drain(%s.%s): stopped draining, state is %s", u.upstreamName, u.GetName(), state)
+		}
+		return nil
 
-	// TODO(john): get this from config
-	d := time.Duration(time.Second * 10)
-	u.healthCheckInterval = &d
+	case <-ctx.Done():
+		return fmt.Errorf("Drain(%s.%s): %d requests still in flight: %s", u.upstreamName, u.GetName(), u.GetInflight(), ctx.Err().Error())
+	}
 }
 
-func (u *UpstreamBackendImpl) Start() {
-	u.healthcheckStop = make(chan interface{})
-	go u.healthcheckWorker()
+func (u *UpstreamBackendImpl) GetInflight() int64 {
+	return u.inflight.Load()
 }
 
-func (u *UpstreamBackendImpl) Stop() {
-	u.healthcheckStop <- true
+func (u *UpstreamBackendImpl) GetStatus() BackendStatus {
+	return BackendStatus{
+		Name:     u.GetName(),
+		Url:      u.Url,
+		State:    u.GetState().String(),
+		Weight:   u.GetWeight(),
+		Priority: u.GetPriority(),
+		Inflight: u.GetInflight(),
+	}
 }
 
+func (u *UpstreamBackendImpl) Backpatch(upstream *UpstreamImpl, backendName string) error {
+	upstreamName := upstream.GetName()
+	u.upstreamName = upstreamName
+	u.backendName = backendName
+	u.configWeight = u.Weight
+	u.cost = NewCost(u.Cost)
+	u.latencies = NewLatencyHistory(DEFAULT_LATENCY_HISTORY_SIZE)
+	u.ewma = NewLatencyEWMA(upstreamName, backendName, upstream.EWMADecayMillis)
+	u.outlierDetection = upstream.OutlierDetection
+	parsedUrl, err := url.Parse(u.Url)
+	if err != nil {
+		return fmt.Errorf("Backpatch(%s.%s): bad url '%s': %s", upstreamName, backendName, u.Url, err.Error())
+	}
+	if err := validatePathTemplate(fmt.Sprintf("%s.%s", upstreamName, backendName), parsedUrl); err != nil {
+		return err
+	}
+	u.requestMapping, err = NewRequestMapping(fmt.Sprintf("%s.%s", upstreamName, backendName), u.Params, u.Headers)
+	if err != nil {
+		return err
+	}
+	if u.Body != nil {
+		if err := u.Body.Backpatch(fmt.Sprintf("%s.%s.body", upstreamName, backendName)); err != nil {
+			return err
+		}
+	}
+	if u.Response != nil {
+		if err := u.Response.Backpatch(fmt.Sprintf("%s.%s.response", upstreamName, backendName)); err != nil {
+			return err
+		}
+	}
+	u.faultInjection, err = NewFaultInjection(fmt.Sprintf("%s.%s", upstreamName, backendName), u.Pathology, u.PathologyPercent, upstream.getProfileRegistry())
+	if err != nil {
+		return err
+	}
+	u.schema = upstream.Schema
+	u.onTransformError = upstream.OnTransformError
+	healthcheckSettings := u.HealthcheckSettings
+	if healthcheckSettings == nil {
+		healthcheckSettings = upstream.HealthcheckSettings
+	}
+	if healthcheckSettings == nil {
+		healthcheckSettings = &HealthcheckSettingsImpl{}
+	}
+	if err := healthcheckSettings.Backpatch(fmt.Sprintf("%s.%s", upstreamName, backendName)); err != nil {
+		return err
+	}
+	u.stateMutex.Lock()
+	u.onStateChange = upstream.updateEligible
+	u.healthcheckSettings = healthcheckSettings
+	u.stateMutex.Unlock()
+	if u.CircuitBreaker != nil {
+		err := u.CircuitBreaker.Backpatch(
+			fmt.Sprintf("%s.%s", upstreamName, backendName),
+			func(state CircuitState) {
+				u.updateStateGauge()
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	u.updateStateGauge()
+	upstreamBackendWeight.WithLabelValues(upstreamName, backendName).Set(float64(u.GetWeight()))
+
+	return u.backpatchThrottle(upstream)
+}
+
+// backpatchThrottle works out which attenuator this backend uses
+func (u *UpstreamBackendImpl) backpatchThrottle(upstream *UpstreamImpl) error {
+	var err error
+	if u.Attenuator == "" && u.CircuitBreaker != nil && u.CircuitBreaker.MaxHertz > 0 {
+		u.throttle, err = NewThrottle(
+			fmt.Sprintf("%s.%s", upstream.GetName(), u.GetName()),
+			u.CircuitBreaker.MaxHertz,
+			u.CircuitBreaker.MaxConcurrent,
+		)
+	} else {
+		u.throttle, err = upstream.getThrottleRegistry().ResolveThrottle(u.Attenuator, upstream.Attenuator)
+	}
+	if err != nil {
+		return fmt.Errorf("Backpatch(%s.%s): %s", upstream.GetName(), u.GetName(), err.Error())
+	}
+
+	return nil
+}
+
+// GetThrottle returns the attenuator for this backend (nil if there
+// is no attenuation)
+func (u *UpstreamBackendImpl) GetThrottle() Throttle {
+	return u.throttle
+}
+
+// GetState returns the state of the backend.
+//
+// A disabled (or draining) backend is always DISABLED (or DRAINING).
+// Otherwise, an ejected outlier, or an open (or
+// half-open) circuit breaker trumps whatever the healthcheck says
 func (u *UpstreamBackendImpl) GetState() BackendState {
+	state := u.getHealthState()
+	if isAdminState(state) {
+		return state
+	}
+	if u.isEjected() {
+		return EJECTED
+	}
+	if u.CircuitBreaker == nil {
+		return state
+	}
+
+	switch u.CircuitBreaker.GetState() {
+	case OPEN:
+		return CIRCUIT_OPEN
+
+	case HALF_OPEN:
+		return CIRCUIT_HALF_OPEN
+	}
+
+	return state
+}
+
+// isEjected is true if outlier detection has taken the backend out
+// of service
+func (u *UpstreamBackendImpl) isEjected() bool {
+	return u.outlierDetection.IsEjected(u.GetName())
+}
+
+// getHealthState returns the state without taking the circuit
+// breaker (or outlier detection) into account
+func (u *UpstreamBackendImpl) getHealthState() BackendState {
+	u.stateMutex.RLock()
+	defer u.stateMutex.RUnlock()
 	return u.State
 }
 
 func (u *UpstreamBackendImpl) SetState(state BackendState) {
+	u.setState(state, nil)
+}
+
+// isAdminState is true for the states that somebody has asked for
+// (rather than the healthcheck deciding)
+func isAdminState(state BackendState) bool {
+	return state == DISABLED || state == DRAINING
+}
+
+// setHealthcheckState is used by the healthcheck, which never
+// overrides somebody disabling (or draining) the backend
+func (u *UpstreamBackendImpl) setHealthcheckState(state BackendState) {
+	u.setState(state, func(current BackendState) bool {
+		return !isAdminState(current)
+	})
+}
+
+// setState changes the state (if allowed is nil, or says that it
+// can be changed from the current state) and tells the upstream if it
+// has changed
+func (u *UpstreamBackendImpl) setState(state BackendState, allowed func(current BackendState) bool) {
+	u.stateMutex.Lock()
+	if allowed != nil && !allowed(u.State) {
+		u.stateMutex.Unlock()
+		return
+	}
+	changed := u.State != state
 	u.State = state
-	upstreamBackends.WithLabelValues(u.upstreamName, u.GetName(), state.String()).Set(1)
+	onStateChange := u.onStateChange
+	u.stateMutex.Unlock()
+
+	u.updateStateGauge()
+	if changed && onStateChange != nil {
+		onStateChange()
+	}
 }
 
-func (u *UpstreamBackendImpl) healthcheckWorker() {
-	if u.healthCheckImpl == nil {
+func (u *UpstreamBackendImpl) GetCircuitBreaker() CircuitBreaker {
+	if u.CircuitBreaker == nil {
+		// Avoid handing out a non-nil interface wrapping a nil pointer
+		return nil
+	}
+	return u.CircuitBreaker
+}
+
+// updateStateGauge makes sure that only the current state of
+// this backend is set in the gauge
+func (u *UpstreamBackendImpl) updateStateGauge() {
+	current := u.GetState()
+	for _, state := range allBackendStates {
+		value := float64(0)
+		if state == current {
+			value = 1
+		}
+		upstreamBackends.WithLabelValues(u.upstreamName, u.GetName(), state.String()).Set(value)
+	}
+}
+
+func (u *UpstreamBackendImpl) Handle(c *gin.Context) {
+	resp, err := u.Do(c.Request.Context(), c.Request)
+	if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		u.proxyWebSocket(c, c.Request, resp)
 		return
 	}
-	log.Printf("%s: starting healthcheck '%s'", u.GetName(), u.Healthcheck)
+	WriteResponse(c, resp, err)
+}
+
+// Do sends the request to the backend, returning the response
+// without writing anything to the caller.
+//
+// The caller must close the body of the response.  If there is an
+// error, then it is a *BackendError
+func (u *UpstreamBackendImpl) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	tag := req.Header.Get(HEADER_X_FAULTMONKEY_TAG)
+	callerCtx := ctx
+
+	// Nothing new goes to a backend that has been disabled (or is
+	// draining), even if the caller asked for it by name
+	if state := u.getHealthState(); isAdminState(state) {
+		err := fmt.Errorf("%s.%s: backend is %s", u.upstreamName, u.GetName(), state)
+		log.Println(err)
+		upstreamErrors.WithLabelValues(
+			tag,
+			u.upstreamName,
+			u.GetName(),
+			req.Method,
+			"state",
+		).Inc()
+		return nil, NewBackendError(http.StatusServiceUnavailable, "state", err)
+	}
+
+	// Work out where the request is going (and what it looks like)
+	// before it counts for anything
+	var err error
+	errorClass := ""
+	if u.requestMapping != nil || u.Body != nil {
+		req = req.Clone(req.Context())
+		if err = u.requestMapping.Apply(req); err != nil {
+			errorClass = "mapping"
+		} else if err = u.Body.Apply(req); err != nil {
+			errorClass = "body"
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%s.%s: %s", u.upstreamName, u.GetName(), err.Error())
+		log.Println(err)
+		upstreamErrors.WithLabelValues(
+			tag,
+			u.upstreamName,
+			u.GetName(),
+			req.Method,
+			errorClass,
+		).Inc()
+		return nil, NewBackendError(http.StatusBadRequest, errorClass, err)
+	}
+	targetURL, err := BuildBackendURL(u.GetURL(), u.StripPrefix, req.URL)
+	if err != nil {
+		status := http.StatusNotFound
+		if errors.Is(err, ErrDotSegment) {
+			status = http.StatusBadRequest
+		}
+		err = fmt.Errorf("%s.%s: %s", u.upstreamName, u.GetName(), err.Error())
+		log.Println(err)
+		upstreamErrors.WithLabelValues(
+			tag,
+			u.upstreamName,
+			u.GetName(),
+			req.Method,
+			"path",
+		).Inc()
+		return nil, NewBackendError(status, "path", err)
+	}
+
+	// A sample of the requests get a pathology instead, which
+	// doesn't count against the backend
+	if resp, injected, err := u.faultInjection.Do(ctx, req); injected {
+		return resp, err
+	}
+
+	// Make sure the circuit breaker lets us through, and that it
+	// knows about the outcome
+	if u.CircuitBreaker != nil {
+		if !u.CircuitBreaker.Allow() {
+			err := fmt.Errorf("%s.%s: circuit breaker is %s", u.upstreamName, u.GetName(), u.CircuitBreaker.GetState())
+			log.Println(err)
+			upstreamErrors.WithLabelValues(
+				tag,
+				u.upstreamName,
+				u.GetName(),
+				req.Method,
+				"circuitbreaker",
+			).Inc()
+			return nil, NewBackendError(http.StatusServiceUnavailable, "circuitbreaker", err)
+		}
+	}
+
+	// Keep track of the requests in flight until the caller has
+	// finished with the response, so that we can drain the backend
+	u.inflight.Add(1)
+	var releaseOnce sync.Once
+	release := func() {
+		releaseOnce.Do(func() {
+			u.inflight.Add(-1)
+		})
+	}
+
+	success := false
+	cancelled := false
+	sentMillis := int64(0)
+	u.ewma.Start()
 	defer func() {
-		log.Printf("%s: terminating healthcheck '%s'", u.GetName(), u.Healthcheck)
-	}()
-	for {
-		select {
-		case <-u.healthcheckStop:
+		// Keep track of the latency and error rate for the
+		// least_latency rule
+		if cancelled || sentMillis == 0 {
+			u.ewma.Cancel()
+		} else {
+			u.ewma.Done(time.Now().UTC().UnixMilli()-sentMillis, success)
+			u.outlierDetection.Record(u, success)
+		}
+
+		if u.CircuitBreaker == nil {
 			return
-		default:
-			// Health check is still active
 		}
-		if u.State != DISABLED {
-			u.healthcheckResult = u.healthCheckImpl.Run()
-			if u.healthcheckResult.Error() != nil {
-				u.SetState(UNHEALTHY)
-			} else {
-				u.SetState(HEALTHY)
-			}
+		if cancelled {
+			// The caller gave up on us, which says nothing
+			// about the health of the backend
+			u.CircuitBreaker.Cancel()
+			return
 		}
-		time.Sleep(*u.healthCheckInterval)
+		u.CircuitBreaker.Done(success)
+	}()
+
+	var cancelFunc context.CancelFunc
+	if u.CircuitBreaker != nil && u.CircuitBreaker.TimeoutMillis > 0 {
+		ctx, cancelFunc = context.WithTimeout(ctx, time.Duration(u.CircuitBreaker.TimeoutMillis)*time.Millisecond)
+	} else {
+		ctx, cancelFunc = context.WithCancel(ctx)
 	}
-}
+	// The context is cancelled when the caller closes the body
+	// of the response (or straight away if there is an error)
+	keepContext := false
+	defer func() {
+		if !keepContext {
+			cancelFunc()
+			release()
+		}
+	}()
 
-func (u *UpstreamBackendImpl) Handle(c *gin.Context) {
-	request := *c.Request
-	request.URL = u.GetURL()
-	request.Host = u.GetURL().Host
+	request := *req.WithContext(ctx)
+	request.URL = WebSocketURL(targetURL)
+	request.Host = targetURL.Host
+
+	// We can only transform a body that we can read
+	if u.Response != nil || u.schema != nil {
+		request.Header = request.Header.Clone()
+		request.Header.Del("Accept-Encoding")
+	}
 
 	//http: Request.RequestURI can't be set in client requests.
 	//http://golang.org/src/pkg/net/http/client.go
 	request.RequestURI = ""
 	now := time.Now().UTC().UnixMilli()
 
-	if u.Recorder != nil {
+	if u.Recorder != nil && request.Body != nil {
 		// TODO(john): this is ugly and inefficient.  Implement something more elegant
 		requestBody, _ := io.ReadAll(request.Body)
 		request.Body.Close()
@@ -220,34 +789,69 @@ func (u *UpstreamBackendImpl) Handle(c *gin.Context) {
 	requestHeaders.Add(HEADER_X_FAULTMONKEY_UPSTREAM, request.Header.Get(HEADER_X_FAULTMONKEY_UPSTREAM))
 	requestHeaders.Add(HEADER_X_FAULTMONKEY_TAG, request.Header.Get(HEADER_X_FAULTMONKEY_TAG))
 
+	// Don't hit the backend if it has told us to back off
+	if err := WaitForHost(ctx, request.URL.Host); err != nil {
+		cancelled = true
+		err = fmt.Errorf("%s: waiting for backoff: %s", request.URL.String(), err.Error())
+		log.Println(err)
+		upstreamErrors.WithLabelValues(
+			tag,
+			u.upstreamName,
+			u.GetName(),
+			req.Method,
+			"backoff",
+		).Inc()
+		return nil, NewBackendError(http.StatusServiceUnavailable, "backoff", err)
+	}
+
+	// Wait on the attenuator
+	if err := WaitForThrottle(ctx, u.throttle); err != nil {
+		cancelled = true
+		err = fmt.Errorf("%s: waiting for attenuator: %s", request.URL.String(), err.Error())
+		log.Println(err)
+		upstreamErrors.WithLabelValues(
+			tag,
+			u.upstreamName,
+			u.GetName(),
+			req.Method,
+			"attenuator",
+		).Inc()
+		return nil, NewBackendError(http.StatusServiceUnavailable, "attenuator", err)
+	}
+
 	// Make the request
-	//
-	// TODO(john): put it through the attenuator / circuit breaker etc
-	client := util.GetHttpClient(nil)
+	client := util.GetStreamingHttpClient(nil)
+	sentMillis = time.Now().UTC().UnixMilli()
 	resp, err := client.Do(&request)
 	if err != nil {
+		if callerCtx.Err() != nil {
+			// It was the caller that gave up
+			cancelled = true
+		}
 		log.Printf("%s: %s", request.URL.String(), err.Error())
-		c.Writer.Header().Add(HEADER_X_FAULTMONKEY_ERROR, err.Error())
 		upstreamResponses.WithLabelValues(
-			c.Request.Header.Get(HEADER_X_FAULTMONKEY_TAG),
+			tag,
+			u.upstreamName,
 			u.GetName(),
-			c.Request.Header.Get(HEADER_X_FAULTMONKEY_BACKEND),
-			c.Request.Method,
+			req.Method,
 			fmt.Sprint(http.StatusBadGateway),
 		).Inc()
 
 		errorClass := GetErrorClassifier().Classify(err)
 		upstreamErrors.WithLabelValues(
-			c.Request.Header.Get(HEADER_X_FAULTMONKEY_TAG),
+			tag,
+			u.upstreamName,
 			u.GetName(),
-			c.Request.Header.Get(HEADER_X_FAULTMONKEY_BACKEND),
-			c.Request.Method,
+			req.Method,
 			errorClass,
 		).Inc()
-		c.AbortWithError(http.StatusBadGateway, err)
-		return
+		return nil, NewBackendError(http.StatusBadGateway, errorClass, err)
 	}
 
+	// If the backend is telling us to back off, then everybody
+	// talking to it needs to back off
+	Backoff(request.URL.Host, resp.StatusCode, resp.Header, u.throttle)
+
 	// Propagatethe request headers into the response
 	for header, val := range requestHeaders {
 		if resp.Header.Get(header) == "" {
@@ -256,16 +860,20 @@ func (u *UpstreamBackendImpl) Handle(c *gin.Context) {
 	}
 
 	latency := time.Now().UTC().UnixMilli() - now
+	u.recordLatency(latency)
 	resp.Header.Add(HEADER_X_FAULTMONKEY_BACKEND_LATENCY, fmt.Sprint(latency))
+
+	// We pay for the request, whatever the response
+	resp.Header.Set(HEADER_X_FAULTMONKEY_BACKEND_COST, fmt.Sprint(u.GetCostPerRequest()))
+	for coin, amount := range u.Cost {
+		upstreamBackendCost.WithLabelValues(u.upstreamName, u.GetName(), coin).Add(float64(amount))
+	}
 	if u.Recorder != nil {
-		// TODO(john): this is ugly and inefficient.  Implement something more elegant
-		responseBody, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		resp.Body = io.NopCloser(bytes.NewReader(responseBody))
+		// The body is recorded as the caller reads it
 		gwr := NewGatewayResponse(
 			request.Header.Get(HEADER_X_REQUEST_ID),
 			resp.StatusCode,
-			responseBody,
+			nil,
 			resp.Header,
 			nil,
 		)
@@ -276,43 +884,58 @@ func (u *UpstreamBackendImpl) Handle(c *gin.Context) {
 		gwr.DisplayUrl = request.URL.String()
 		gwr.Backend = request.Header.Get(HEADER_X_FAULTMONKEY_BACKEND)
 		gwr.Upstream = request.Header.Get(HEADER_X_FAULTMONKEY_UPSTREAM)
-		u.Recorder.SaveResponse(gwr)
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// The body is the connection, whose frames are
+			// recorded as they go past
+			u.Recorder.SaveResponse(gwr)
+		} else {
+			inline := !IsStreaming(resp) && resp.ContentLength <= RECORDER_INLINE_BODY_BYTES
+			resp.Body = u.Recorder.RecordResponse(gwr, resp.Body, inline)
+		}
 	}
-	defer resp.Body.Close()
 
-	// Send the status
 	upstreamLatency.WithLabelValues(
-		c.Request.Header.Get(HEADER_X_FAULTMONKEY_TAG),
+		tag,
+		u.upstreamName,
 		u.GetName(),
-		c.Request.Header.Get(HEADER_X_FAULTMONKEY_BACKEND),
-		c.Request.Method,
+		req.Method,
 		fmt.Sprint(resp.StatusCode),
 	).Add(float64(latency))
 	upstreamResponses.WithLabelValues(
-		c.Request.Header.Get(HEADER_X_FAULTMONKEY_TAG),
+		tag,
+		u.upstreamName,
 		u.GetName(),
-		c.Request.Header.Get(HEADER_X_FAULTMONKEY_BACKEND),
-		c.Request.Method,
+		req.Method,
 		fmt.Sprint(resp.StatusCode),
 	).Inc()
 	if resp.StatusCode >= 400 {
 		upstreamErrors.WithLabelValues(
-			c.Request.Header.Get(HEADER_X_FAULTMONKEY_TAG),
+			tag,
+			u.upstreamName,
 			u.GetName(),
-			c.Request.Header.Get(HEADER_X_FAULTMONKEY_BACKEND),
-			c.Request.Method,
+			req.Method,
 			fmt.Sprint(resp.StatusCode),
 		).Inc()
 	}
-	c.Status(resp.StatusCode)
+	success = resp.StatusCode < 500
 
-	// Send the headers
-	for h, v := range resp.Header {
-		for _, headerVal := range v {
-			c.Writer.Header().Add(h, headerVal)
-		}
+	// Make the response look like every other backend's
+	if err := u.normaliseResponse(resp); err != nil && u.onTransformError == ON_TRANSFORM_ERROR_FAIL {
+		success = false
+		resp.Body.Close()
+		return nil, err
 	}
 
-	// Send the body
-	io.Copy(c.Writer, resp.Body)
+	keepContext = true
+	closeFunc := func() {
+		cancelFunc()
+		release()
+	}
+	if conn, isConn := resp.Body.(io.ReadWriteCloser); isConn && resp.StatusCode == http.StatusSwitchingProtocols {
+		// The caller needs to be able to write to it
+		resp.Body = &cancelOnCloseConn{ReadWriteCloser: conn, cancelFunc: closeFunc}
+		return resp, nil
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancelFunc: closeFunc}
+	return resp, nil
 }
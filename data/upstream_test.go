@@ -0,0 +1,256 @@
+package data
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestUpstream names the upstream (which only needs a rule, its
+// backends and whatever the test is about) and backpatches it
+func newTestUpstream(t *testing.T, serviceName string, upstream *UpstreamImpl) *UpstreamImpl {
+	upstream.serviceName = serviceName
+	if err := upstream.Backpatch(); err != nil {
+		t.Fatal(err)
+	}
+	return upstream
+}
+
+// newTestServer starts a backend that goes away at the end of the
+// test, and returns its URL
+func newTestServer(t *testing.T, handler http.HandlerFunc) string {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// doTestRequest sends a request straight to the upstream
+func doTestRequest(upstream *UpstreamImpl, method string, path string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, path, strings.NewReader(body))
+	upstream.Handle(c)
+	return w
+}
+
+func newHealthTestUpstream(t *testing.T, noHealthyBackends string) *UpstreamImpl {
+	return newTestUpstream(t, "health", &UpstreamImpl{
+		Rule:              "weighted",
+		NoHealthyBackends: noHealthyBackends,
+		Backends: map[string]*UpstreamBackendImpl{
+			"good": {Url: "http://good", Weight: 1},
+			"bad":  {Url: "http://bad", Weight: 100},
+		},
+	})
+}
+
+func TestChooseBackendSkipsUnhealthy(t *testing.T) {
+	upstream := newHealthTestUpstream(t, "")
+
+	for _, state := range []BackendState{UNHEALTHY, DISABLED} {
+		upstream.Backends["bad"].SetState(state)
+		for i := 0; i < 100; i++ {
+			backend := upstream.ChooseBackend("", "")
+			if backend == nil || backend.GetName() != "good" {
+				t.Fatalf("Expected 'good' to be chosen when 'bad' is %s, but got %v", state, backend)
+			}
+		}
+	}
+
+	// Once it is healthy again, it gets (most of) the traffic
+	upstream.Backends["bad"].SetState(HEALTHY)
+	chosen := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		chosen[upstream.ChooseBackend("", "").GetName()]++
+	}
+	if chosen["bad"] <= chosen["good"] {
+		t.Errorf("Expected 'bad' to get most of the traffic, but got good=%d, bad=%d", chosen["good"], chosen["bad"])
+	}
+
+	// Backends we know nothing about can be left out too
+	upstream.ExcludeUnknown = true
+	upstream.Backends["good"].SetState(UNKNOWN)
+	upstream.updateEligible()
+	for i := 0; i < 10; i++ {
+		if backend := upstream.ChooseBackend("", ""); backend == nil || backend.GetName() != "bad" {
+			t.Fatalf("Expected 'bad' to be chosen, but got %v", backend)
+		}
+	}
+}
+
+func TestChooseBackendUnknownPreferred(t *testing.T) {
+	upstream := newHealthTestUpstream(t, "")
+	if backend := upstream.ChooseBackend("wibble", ""); backend != nil {
+		t.Errorf("Expected nil for an unknown backend, but got %v", backend)
+	}
+}
+
+func TestPreferredBackendDisabled(t *testing.T) {
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	upstream := newTestUpstream(t, "preferred", &UpstreamImpl{
+		Rule: "weighted",
+		Backends: map[string]*UpstreamBackendImpl{
+			"good": {Url: server, Weight: 1},
+			"bad":  {Url: server, Weight: 1},
+		},
+	})
+	bad := upstream.Backends["bad"]
+
+	for _, state := range []BackendState{DISABLED, DRAINING} {
+		bad.SetState(state)
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/broker/preferred", nil)
+		c.Request.Header.Set(HEADER_X_FAULTMONKEY_BACKEND, "bad")
+		upstream.Handle(c)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected %d when asking for a %s backend, but got %d", http.StatusServiceUnavailable, state, w.Code)
+		}
+		if bad.GetInflight() != 0 {
+			t.Errorf("Expected nothing to be sent to a %s backend", state)
+		}
+	}
+
+	bad.SetState(HEALTHY)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/broker/preferred", nil)
+	c.Request.Header.Set(HEADER_X_FAULTMONKEY_BACKEND, "bad")
+	upstream.Handle(c)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected %d once it is enabled again, but got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestNoHealthyBackends(t *testing.T) {
+	// Fail fast ...
+	upstream := newHealthTestUpstream(t, NO_HEALTHY_BACKENDS_FAIL_FAST)
+	upstream.Backends["good"].SetState(UNHEALTHY)
+	upstream.Backends["bad"].SetState(UNHEALTHY)
+
+	w := doTestRequest(upstream, http.MethodGet, "/api/v1/broker/health", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d, but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	// ... or panic, and use anything that isn't disabled
+	upstream = newHealthTestUpstream(t, NO_HEALTHY_BACKENDS_PANIC)
+	upstream.Backends["good"].SetState(UNHEALTHY)
+	upstream.Backends["bad"].SetState(DISABLED)
+	for i := 0; i < 10; i++ {
+		if backend := upstream.ChooseBackend("", ""); backend == nil || backend.GetName() != "good" {
+			t.Fatalf("Expected 'good' to be chosen in panic mode, but got %v", backend)
+		}
+	}
+
+	upstream.NoHealthyBackends = "wibble"
+	if err := upstream.Backpatch(); err == nil {
+		t.Errorf("Expected an error for no_healthy_backends '%s'", upstream.NoHealthyBackends)
+	}
+}
+
+func TestChooseBackendConcurrentStateChanges(t *testing.T) {
+	upstream := newHealthTestUpstream(t, "")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if i%2 == 0 {
+				upstream.Backends["bad"].setHealthcheckState(UNHEALTHY)
+			} else {
+				upstream.Backends["bad"].setHealthcheckState(HEALTHY)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if upstream.ChooseBackend("", "") == nil {
+				t.Error("Expected a backend")
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// The healthcheck never overrides DISABLED
+	upstream.Backends["bad"].SetState(DISABLED)
+	upstream.Backends["bad"].setHealthcheckState(HEALTHY)
+	if state := upstream.Backends["bad"].GetState(); state != DISABLED {
+		t.Errorf("Expected DISABLED, but got %s", state)
+	}
+}
+
+func TestDisableEnableAndDrain(t *testing.T) {
+	release := make(chan interface{})
+	server := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	})
+	upstream := newTestUpstream(t, "drain", &UpstreamImpl{
+		Rule: "weighted",
+		Backends: map[string]*UpstreamBackendImpl{
+			"backend": {Url: server, Weight: 1},
+		},
+	})
+	backend := upstream.GetBackend("backend")
+
+	backend.Disable()
+	if upstream.ChooseBackend("", "") != nil || upstream.GetStatus().Eligible != 0 {
+		t.Fatal("Expected a disabled backend not to be chosen")
+	}
+	backend.Enable()
+	if state := backend.GetState(); state != UNKNOWN {
+		t.Fatalf("Expected an enabled backend without a healthcheck to be UNKNOWN, but got %s", state)
+	}
+
+	// Drain waits for the request in flight ...
+	done := make(chan interface{})
+	go func() {
+		defer close(done)
+		resp, err := backend.Do(context.Background(), httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}()
+	for backend.GetInflight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelFunc()
+	if err := backend.Drain(ctx); err == nil {
+		t.Fatal("Expected the drain to time out")
+	}
+	if state := backend.GetState(); state != DRAINING {
+		t.Fatalf("Expected DRAINING, but got %s", state)
+	}
+	if upstream.ChooseBackend("", "") != nil {
+		t.Fatal("Expected a draining backend not to be chosen")
+	}
+
+	// ... and disables the backend once it has finished
+	close(release)
+	<-done
+	if err := backend.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	status := backend.GetStatus()
+	if status.State != DISABLED.String() || status.Inflight != 0 {
+		t.Errorf("Expected DISABLED with nothing in flight, but got %s with %d in flight", status.State, status.Inflight)
+	}
+}
@@ -0,0 +1,368 @@
+package data
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var websocketConnections = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "faultmonkey",
+		Name:      "websocket_connections",
+		Help:      "The number of WebSockets that are open, keyed by what is proxying them (upstream.backend or gateway.host)",
+	},
+	[]string{"name"},
+)
+var websocketMessages = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "websocket_messages",
+		Help:      "The number of WebSocket messages, keyed by what is proxying them (upstream.backend or gateway.host) and direction (sent/received)",
+	},
+	[]string{"name", "direction"},
+)
+var websocketBytes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "websocket_bytes",
+		Help:      "The number of bytes of WebSocket payload, keyed by what is proxying them (upstream.backend or gateway.host) and direction (sent/received)",
+	},
+	[]string{"name", "direction"},
+)
+
+const (
+	// Sent is from the caller to the backend, and received is from
+	// the backend to the caller
+	WEBSOCKET_SENT     = "sent"
+	WEBSOCKET_RECEIVED = "received"
+
+	WEBSOCKET_OPCODE_CONTINUATION = 0x0
+	WEBSOCKET_OPCODE_TEXT         = 0x1
+	WEBSOCKET_OPCODE_BINARY       = 0x2
+	WEBSOCKET_OPCODE_CLOSE        = 0x8
+	WEBSOCKET_OPCODE_PING         = 0x9
+	WEBSOCKET_OPCODE_PONG         = 0xa
+)
+
+// WebSocketTranscript is what was said over a WebSocket, and is
+// saved by the recorder as ${ID}-websocket.json
+type WebSocketTranscript struct {
+	Id         string      `json:"id"`
+	WhenMillis int64       `json:"timestamp"`
+	DisplayUrl string      `json:"url"`
+	Headers    http.Header `json:"headers"`
+	Upstream   string      `json:"upstream,omitempty"`
+	Backend    string      `json:"backend,omitempty"`
+
+	// How long the WebSocket was open
+	DurationMillis int64            `json:"duration_millis"`
+	Frames         []WebSocketFrame `json:"frames"`
+
+	// Only max_body_bytes of payload are recorded, after which we
+	// just keep track of the lengths
+	Truncated bool `json:"truncated,omitempty"`
+
+	mutex     sync.Mutex
+	remaining int64
+}
+
+type WebSocketFrame struct {
+	WhenMillis int64  `json:"timestamp"`
+	Direction  string `json:"direction"`
+	Opcode     string `json:"opcode"`
+	Final      bool   `json:"final"`
+	Length     int64  `json:"length"`
+
+	// Text is sent as it is, anything else as base64
+	Text   string `json:"text,omitempty"`
+	Binary []byte `json:"binary,omitempty"`
+}
+
+// IsWebSocketUpgrade is true if the caller wants to switch the
+// connection over to a WebSocket
+func IsWebSocketUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") && strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocketURL returns the URL to dial for a ws:// (or wss://) URL,
+// as the handshake is just HTTP
+func WebSocketURL(u *url.URL) *url.URL {
+	switch strings.ToLower(u.Scheme) {
+	case "ws":
+		dialled := *u
+		dialled.Scheme = "http"
+		return &dialled
+
+	case "wss":
+		dialled := *u
+		dialled.Scheme = "https"
+		return &dialled
+	}
+	return u
+}
+
+// newWebSocketTranscript starts a transcript of the WebSocket that
+// the request is for, keeping up to max bytes of the payloads
+func newWebSocketTranscript(req *http.Request, max int64) *WebSocketTranscript {
+	return &WebSocketTranscript{
+		Id:         req.Header.Get(HEADER_X_REQUEST_ID),
+		WhenMillis: time.Now().UTC().UnixMilli(),
+		DisplayUrl: req.URL.String(),
+		Headers:    req.Header,
+		Upstream:   req.Header.Get(HEADER_X_FAULTMONKEY_UPSTREAM),
+		Backend:    req.Header.Get(HEADER_X_FAULTMONKEY_BACKEND),
+		Frames:     make([]WebSocketFrame, 0),
+		remaining:  max,
+	}
+}
+
+func (t *WebSocketTranscript) add(direction string, opcode byte, final bool, length int64, payload []byte) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	frame := WebSocketFrame{
+		WhenMillis: time.Now().UTC().UnixMilli(),
+		Direction:  direction,
+		Opcode:     websocketOpcodeName(opcode),
+		Final:      final,
+		Length:     length,
+	}
+	if int64(len(payload)) > t.remaining {
+		payload = payload[:t.remaining]
+	}
+	if int64(len(payload)) < length {
+		t.Truncated = true
+	}
+	t.remaining -= int64(len(payload))
+	if opcode == WEBSOCKET_OPCODE_TEXT && utf8.Valid(payload) {
+		frame.Text = string(payload)
+	} else if len(payload) > 0 {
+		frame.Binary = payload
+	}
+	t.Frames = append(t.Frames, frame)
+}
+
+// getPayloadLimit is how much more of a payload we want to keep
+func (t *WebSocketTranscript) getPayloadLimit() int64 {
+	if t == nil {
+		return 0
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.remaining
+}
+
+// isWebSocketDataFrame is true for a frame that is (part of) a
+// message, as opposed to a control frame (close, ping or pong)
+func isWebSocketDataFrame(opcode byte) bool {
+	return opcode&0x08 == 0
+}
+
+func websocketOpcodeName(opcode byte) string {
+	switch opcode {
+	case WEBSOCKET_OPCODE_CONTINUATION:
+		return "continuation"
+	case WEBSOCKET_OPCODE_TEXT:
+		return "text"
+	case WEBSOCKET_OPCODE_BINARY:
+		return "binary"
+	case WEBSOCKET_OPCODE_CLOSE:
+		return "close"
+	case WEBSOCKET_OPCODE_PING:
+		return "ping"
+	case WEBSOCKET_OPCODE_PONG:
+		return "pong"
+	}
+	return fmt.Sprintf("0x%x", opcode)
+}
+
+// ProxyWebSocket takes over the caller's connection once the backend
+// has agreed to the upgrade (resp is its 101, and the body is the
+// connection to the backend), and passes the frames back and forth
+// until either side goes away.
+//
+// The frames are counted (and added to the transcript, if there is
+// one) as they go past.  Any other upgrade is passed on as it is
+func ProxyWebSocket(c *gin.Context, name string, resp *http.Response, transcript *WebSocketTranscript) error {
+	defer resp.Body.Close()
+	backendConn, isConn := resp.Body.(io.ReadWriteCloser)
+	if !isConn {
+		err := fmt.Errorf("%s: the backend switched protocols without a connection", name)
+		WriteResponse(c, nil, NewBackendError(http.StatusBadGateway, "upgrade", err))
+		return err
+	}
+	callerConn, callerBuffer, err := c.Writer.Hijack()
+	if err != nil {
+		err = fmt.Errorf("%s: taking over the connection: %s", name, err.Error())
+		WriteResponse(c, nil, NewBackendError(http.StatusInternalServerError, "upgrade", err))
+		return err
+	}
+	defer callerConn.Close()
+
+	// Pass on the backend's side of the handshake
+	fmt.Fprintf(callerBuffer, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(callerBuffer)
+	callerBuffer.WriteString("\r\n")
+	if err := callerBuffer.Flush(); err != nil {
+		return err
+	}
+
+	websocketConnections.WithLabelValues(name).Inc()
+	defer websocketConnections.WithLabelValues(name).Dec()
+	websocket := strings.EqualFold(resp.Header.Get("Upgrade"), "websocket")
+	copyFrames := func(dst io.Writer, src io.Reader, direction string) error {
+		if !websocket {
+			_, err := io.Copy(dst, src)
+			return err
+		}
+		return copyWebSocketFrames(dst, src, func(opcode byte, final bool, length int64, payload []byte) {
+			websocketBytes.WithLabelValues(name, direction).Add(float64(length))
+			if final && isWebSocketDataFrame(opcode) {
+				websocketMessages.WithLabelValues(name, direction).Inc()
+			}
+			transcript.add(direction, opcode, final, length, payload)
+		}, transcript.getPayloadLimit)
+	}
+
+	// Whichever side goes first closes the other one
+	done := make(chan error, 2)
+	go func() {
+		done <- copyFrames(backendConn, callerBuffer.Reader, WEBSOCKET_SENT)
+	}()
+	go func() {
+		done <- copyFrames(callerConn, backendConn, WEBSOCKET_RECEIVED)
+	}()
+	err = <-done
+	callerConn.Close()
+	backendConn.Close()
+	<-done
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// copyWebSocketFrames copies the frames from src to dst as they are,
+// telling frame() about each one (with up to limit() bytes of its
+// payload, unmasked)
+func copyWebSocketFrames(dst io.Writer, src io.Reader, frame func(opcode byte, final bool, length int64, payload []byte), limit func() int64) error {
+	reader, isBuffered := src.(*bufio.Reader)
+	if !isBuffered {
+		reader = bufio.NewReader(src)
+	}
+	header := make([]byte, 14)
+	for {
+		// The opcode and the (first guess at the) length
+		if _, err := io.ReadFull(reader, header[:2]); err != nil {
+			return err
+		}
+		final := header[0]&0x80 != 0
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := int64(header[1] & 0x7f)
+		size := 2
+		switch length {
+		case 126:
+			size += 2
+		case 127:
+			size += 8
+		}
+		if masked {
+			size += 4
+		}
+		if _, err := io.ReadFull(reader, header[2:size]); err != nil {
+			return err
+		}
+		switch length {
+		case 126:
+			length = int64(binary.BigEndian.Uint16(header[2:4]))
+		case 127:
+			length = int64(binary.BigEndian.Uint64(header[2:10]))
+		}
+		if _, err := dst.Write(header[:size]); err != nil {
+			return err
+		}
+
+		// The payload goes straight through, apart from the bit we
+		// keep
+		kept := &limitedBuffer{max: limit()}
+		if _, err := io.CopyN(dst, io.TeeReader(reader, kept), length); err != nil {
+			return err
+		}
+		payload := kept.Bytes()
+		if masked {
+			key := header[size-4 : size]
+			for i := range payload {
+				payload[i] ^= key[i%4]
+			}
+		}
+		frame(opcode, final, length, payload)
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it
+type limitedBuffer struct {
+	buffer []byte
+	max    int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - int64(len(b.buffer)); room > 0 {
+		if int64(len(p)) > room {
+			b.buffer = append(b.buffer, p[:room]...)
+		} else {
+			b.buffer = append(b.buffer, p...)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buffer
+}
+
+// proxyWebSocket passes the WebSocket on to this backend, recording
+// the frames if it has a recorder
+func (u *UpstreamBackendImpl) proxyWebSocket(c *gin.Context, req *http.Request, resp *http.Response) {
+	var transcript *WebSocketTranscript
+	if u.Recorder != nil {
+		transcript = newWebSocketTranscript(req, u.Recorder.getMaxBodyBytes())
+	}
+	err := ProxyWebSocket(c, fmt.Sprintf("%s.%s", u.upstreamName, u.GetName()), resp, transcript)
+	if err != nil {
+		log.Printf("%s.%s: websocket: %s", u.upstreamName, u.GetName(), err.Error())
+	}
+	if transcript != nil {
+		transcript.DurationMillis = time.Now().UTC().UnixMilli() - transcript.WhenMillis
+		if err := u.Recorder.SaveTranscript(transcript); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package data
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func writeTestFrame(w io.Writer, opcode byte, payload []byte, masked bool) error {
+	header := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	default:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	}
+	if masked {
+		header[1] |= 0x80
+		key := []byte{1, 2, 3, 4}
+		header = append(header, key...)
+		maskedPayload := make([]byte, len(payload))
+		for i := range payload {
+			maskedPayload[i] = payload[i] ^ key[i%4]
+		}
+		payload = maskedPayload
+	}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func newWebSocketTestBroker(t *testing.T) (*httptest.Server, *UpstreamBackendImpl) {
+	backend := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if !IsWebSocketUpgrade(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buffer, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buffer.Flush()
+
+		// Echo whatever we are sent
+		for {
+			_, payload, err := readOneTestFrame(buffer.Reader)
+			if err != nil {
+				return
+			}
+			writeTestFrame(conn, WEBSOCKET_OPCODE_TEXT, append([]byte("echo: "), payload...), false)
+		}
+	})
+	upstream := newTestUpstream(t, "transcribe", &UpstreamImpl{
+		Rule: "random",
+		Backends: map[string]*UpstreamBackendImpl{
+			"deepgram": {Url: strings.Replace(backend, "http://", "ws://", 1), Weight: 1},
+		},
+	})
+	deepgram := upstream.Backends["deepgram"]
+	deepgram.Recorder = &RecorderImpl{
+		requestsChan:    make(chan *GatewayRequest, 1),
+		responsesChan:   make(chan *GatewayResponse, 1),
+		transcriptsChan: make(chan *WebSocketTranscript, 1),
+		stop:            make(chan interface{}),
+	}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/*path", upstream.Handle)
+	broker := httptest.NewServer(engine)
+	t.Cleanup(broker.Close)
+	return broker, deepgram
+}
+
+// readOneTestFrame reads a single frame
+func readOneTestFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(r, extended); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+	var key []byte
+	if header[1]&0x80 != 0 {
+		key = make([]byte, 4)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		if key != nil {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return header[0] & 0x0f, payload, nil
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	broker, deepgram := newWebSocketTestBroker(t)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(broker.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /listen HTTP/1.1\r\nHost: broker\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nX-Request-Id: abc\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected a 101, but got %d", resp.StatusCode)
+	}
+
+	long := strings.Repeat("a", 200)
+	for _, message := range []string{"hello", long} {
+		if err := writeTestFrame(conn, WEBSOCKET_OPCODE_TEXT, []byte(message), true); err != nil {
+			t.Fatal(err)
+		}
+		opcode, payload, err := readOneTestFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != WEBSOCKET_OPCODE_TEXT || string(payload) != "echo: "+message {
+			t.Errorf("Expected 'echo: %s', but got %d '%s'", message, opcode, string(payload))
+		}
+	}
+	conn.Close()
+
+	select {
+	case transcript := <-deepgram.Recorder.transcriptsChan:
+		if transcript.Id != "abc" || len(transcript.Frames) != 4 {
+			t.Fatalf("Expected 4 frames for abc, but got %d for '%s'", len(transcript.Frames), transcript.Id)
+		}
+		first := transcript.Frames[0]
+		if first.Direction != WEBSOCKET_SENT || first.Opcode != "text" || first.Text != "hello" {
+			t.Errorf("Expected 'hello' to be sent first, but got %+v", first)
+		}
+		last := transcript.Frames[3]
+		if last.Direction != WEBSOCKET_RECEIVED || last.Length != 206 || last.Text != "echo: "+long {
+			t.Errorf("Expected the long echo to be received last, but got %+v", last)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the transcript to be saved")
+	}
+	if deepgram.GetInflight() != 0 {
+		t.Error("Expected the WebSocket to have been released")
+	}
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "WebSocket")
+	if !IsWebSocketUpgrade(req) {
+		t.Error("Expected an upgrade")
+	}
+	req.Header.Set("Upgrade", "h2c")
+	if IsWebSocketUpgrade(req) {
+		t.Error("Expected h2c not to be a WebSocket")
+	}
+}
+
+func TestIsWebSocketDataFrame(t *testing.T) {
+	for _, opcode := range []byte{WEBSOCKET_OPCODE_CONTINUATION, WEBSOCKET_OPCODE_TEXT, WEBSOCKET_OPCODE_BINARY} {
+		if !isWebSocketDataFrame(opcode) {
+			t.Errorf("Expected a %s frame to be counted as a message", websocketOpcodeName(opcode))
+		}
+	}
+	for _, opcode := range []byte{WEBSOCKET_OPCODE_CLOSE, WEBSOCKET_OPCODE_PING, WEBSOCKET_OPCODE_PONG} {
+		if isWebSocketDataFrame(opcode) {
+			t.Errorf("Expected a %s frame not to be counted as a message", websocketOpcodeName(opcode))
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package evt
 
 import (
+	"context"
 	"fmt"
 	"http-attenuator/data"
 	"log"
@@ -29,6 +30,11 @@ func (d *DNSCheck) GetName() string {
 }
 
 func (d *DNSCheck) Run() data.EVTResult {
+	return d.RunContext(context.Background())
+}
+
+// RunContext gives up on the lookup when the context is done
+func (d *DNSCheck) RunContext(ctx context.Context) data.EVTResult {
 	// Do the lookup
 	// TODO(john): records other than A / AAAA
 	now := time.Now().UTC().UnixMilli()
@@ -38,7 +44,7 @@ func (d *DNSCheck) Run() data.EVTResult {
 			float64(time.Now().UTC().UnixMilli() - now),
 		)
 	}()
-	ips, err := net.LookupIP(d.name)
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", d.name)
 	if err != nil {
 		log.Printf("FAIL %s: %s", d.GetName(), err.Error())
 		evtErrors.WithLabelValues(d.GetType(), d.GetName(), data.GetErrorClassifier().Classify(err)).Inc()
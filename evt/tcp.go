@@ -1,6 +1,7 @@
 package evt
 
 import (
+	"context"
 	"fmt"
 	"http-attenuator/data"
 	"log"
@@ -26,6 +27,11 @@ func (e *TCPCheck) GetName() string {
 }
 
 func (e *TCPCheck) Run() data.EVTResult {
+	return e.RunContext(context.Background())
+}
+
+// RunContext gives up on the connect when the context is done
+func (e *TCPCheck) RunContext(ctx context.Context) data.EVTResult {
 	// Do the lookup
 	// TODO(john): records other than A / AAAA
 	now := time.Now().UTC().UnixMilli()
@@ -37,7 +43,8 @@ func (e *TCPCheck) Run() data.EVTResult {
 	}()
 
 	// Do the TCP connect
-	conn, err := net.Dial("tcp", e.hostPort)
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", e.hostPort)
 	if err != nil {
 		log.Printf("FAIL %s: %s", e.GetName(), err.Error())
 		evtErrors.WithLabelValues(e.GetType(), e.GetName(), data.GetErrorClassifier().Classify(err)).Inc()
@@ -1,7 +1,10 @@
 package facade
 
+import "time"
+
 type KeyValue interface {
 	Set(key string, value interface{}) error
+	SetWithExpiry(key string, value interface{}, expiry time.Duration) error
 	GetString(key string) (string, error)
 	GetInt(key string) (int64, error)
 	GetFloat(key string) (float64, error)
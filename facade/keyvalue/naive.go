@@ -1,19 +1,47 @@
 package facade
 
 import (
+	"container/heap"
 	"fmt"
 	"reflect"
 	"sync"
+	"time"
 )
 
 type NaiveKeyValue struct {
 	valuesByName map[string]any
+	expiresAt    map[string]time.Time
 	mutex        sync.RWMutex
+
+	// When the keys expire, soonest first.  A key that has been set
+	// again (or deleted) since can still be in here, so it is only
+	// forgotten if its expiry still matches
+	expiries expiryHeap
+}
+
+type keyExpiry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// expiryHeap is a min-heap of the expiries (see container/heap)
+type expiryHeap []keyExpiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(keyExpiry)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
 }
 
 func NewNaiveKeyValue() (KeyValue, error) {
 	return &NaiveKeyValue{
 		valuesByName: make(map[string]any),
+		expiresAt:    make(map[string]time.Time),
 	}, nil
 }
 
@@ -21,13 +49,48 @@ func (kv *NaiveKeyValue) Set(key string, value any) error {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
 	kv.valuesByName[key] = value
+	delete(kv.expiresAt, key)
 	return nil
 }
 
+func (kv *NaiveKeyValue) SetWithExpiry(key string, value any, expiry time.Duration) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	now := time.Now()
+	kv.expire(now)
+	expiresAt := now.Add(expiry)
+	kv.valuesByName[key] = value
+	kv.expiresAt[key] = expiresAt
+	heap.Push(&kv.expiries, keyExpiry{key: key, expiresAt: expiresAt})
+	return nil
+}
+
+// expire forgets about the keys that have expired, so that the map
+// doesn't grow forever.  The caller holds the (write) mutex
+func (kv *NaiveKeyValue) expire(now time.Time) {
+	for len(kv.expiries) > 0 && now.After(kv.expiries[0].expiresAt) {
+		expired := heap.Pop(&kv.expiries).(keyExpiry)
+		if expiresAt, expires := kv.expiresAt[expired.key]; expires && expiresAt.Equal(expired.expiresAt) {
+			delete(kv.valuesByName, expired.key)
+			delete(kv.expiresAt, expired.key)
+		}
+	}
+}
+
+// get returns the value of the key (or nil if it has expired).  The
+// caller holds the mutex
+func (kv *NaiveKeyValue) get(key string) any {
+	if expiresAt, expires := kv.expiresAt[key]; expires && time.Now().After(expiresAt) {
+		return nil
+	}
+	return kv.valuesByName[key]
+}
+
 func (kv *NaiveKeyValue) GetString(key string) (string, error) {
 	kv.mutex.RLock()
 	defer kv.mutex.RUnlock()
-	v := kv.valuesByName[key]
+	v := kv.get(key)
 	if v == nil {
 		return "", nil
 	}
@@ -37,7 +100,7 @@ func (kv *NaiveKeyValue) GetString(key string) (string, error) {
 func (kv *NaiveKeyValue) GetInt(key string) (int64, error) {
 	kv.mutex.RLock()
 	defer kv.mutex.RUnlock()
-	v := kv.valuesByName[key]
+	v := kv.get(key)
 	if v == nil {
 		return 0, nil
 	}
@@ -59,7 +122,7 @@ func (kv *NaiveKeyValue) GetInt(key string) (int64, error) {
 func (kv *NaiveKeyValue) GetFloat(key string) (float64, error) {
 	kv.mutex.RLock()
 	defer kv.mutex.RUnlock()
-	v := kv.valuesByName[key]
+	v := kv.get(key)
 	if v == nil {
 		return 0, nil
 	}
@@ -81,7 +144,7 @@ func (kv *NaiveKeyValue) GetFloat(key string) (float64, error) {
 func (kv *NaiveKeyValue) GetBool(key string) (bool, error) {
 	kv.mutex.RLock()
 	defer kv.mutex.RUnlock()
-	v := kv.valuesByName[key]
+	v := kv.get(key)
 	if v == nil {
 		return false, nil
 	}
@@ -93,6 +156,7 @@ func (kv *NaiveKeyValue) Delete(key string) error {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
 	delete(kv.valuesByName, key)
+	delete(kv.expiresAt, key)
 	return nil
 }
 
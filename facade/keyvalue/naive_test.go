@@ -0,0 +1,38 @@
+package facade
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNaiveKVExpiry(t *testing.T) {
+	kv, _ := NewNaiveKeyValue()
+	naive := kv.(*NaiveKeyValue)
+
+	kv.SetWithExpiry("short", "a", time.Millisecond)
+	kv.SetWithExpiry("renewed", "b", time.Millisecond)
+	kv.SetWithExpiry("renewed", "c", time.Hour)
+	kv.SetWithExpiry("persisted", "d", time.Millisecond)
+	kv.Set("persisted", "e")
+	time.Sleep(5 * time.Millisecond)
+
+	// Expired keys are gone as soon as they expire ...
+	if value, _ := kv.GetString("short"); value != "" {
+		t.Errorf("Expected 'short' to have expired, but got '%s'", value)
+	}
+
+	// ... and are forgotten on the next write, unless they have been
+	// set again since
+	kv.SetWithExpiry("next", "f", time.Hour)
+	if _, exists := naive.valuesByName["short"]; exists {
+		t.Error("Expected 'short' to have been forgotten")
+	}
+	for key, expected := range map[string]string{"renewed": "c", "persisted": "e", "next": "f"} {
+		if value, _ := kv.GetString(key); value != expected {
+			t.Errorf("Expected %s='%s', but got '%s'", key, expected, value)
+		}
+	}
+	if len(naive.expiries) != 2 {
+		t.Errorf("Expected only the expiries that haven't passed to be left, but got %d", len(naive.expiries))
+	}
+}
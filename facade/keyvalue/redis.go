@@ -54,6 +54,25 @@ func (kv *RedisKeyValue) Set(key string, value any) error {
 	return nil
 }
 
+func (kv *RedisKeyValue) SetWithExpiry(key string, value any, expiry time.Duration) error {
+	conn := kv.redisPool.Get()
+	if err := conn.Err(); err != nil {
+		return fmt.Errorf("redis.SetWithExpiry(%s): %s", key, err)
+	}
+	defer conn.Close()
+	_, err := conn.Do(
+		"SET",
+		key,
+		fmt.Sprint(value),
+		"PX",
+		expiry.Milliseconds(),
+	)
+	if err != nil {
+		return fmt.Errorf("redis.SetWithExpiry(%s): %s", key, err)
+	}
+	return nil
+}
+
 func (kv *RedisKeyValue) GetString(key string) (string, error) {
 	conn := kv.redisPool.Get()
 	if err := conn.Err(); err != nil {
@@ -67,6 +86,10 @@ func (kv *RedisKeyValue) GetString(key string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("redis.GetString(%s): %s", key, err)
 	}
+	if v == nil {
+		// Same as the naive store
+		return "", nil
+	}
 	return string(v.([]byte)), nil
 }
 
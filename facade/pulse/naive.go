@@ -1,6 +1,7 @@
 package facade
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
@@ -12,6 +13,7 @@ import (
 
 type PulseImpl struct {
 	name        string
+	impl        string
 	maxInflight int
 	maxHertz    float64
 	pulseChan   chan (bool)
@@ -23,10 +25,16 @@ type PulseImpl struct {
 	// This might be very useful for load testing
 	targetRateHertz float64
 
-	waitUntil *time.Time
+	// If we have been told to pause, this is when we can resume
+	waitUntil  *time.Time
+	pauseMutex sync.Mutex
 
 	// requests currently in flight
 	inflight chan bool
+
+	// closed when the pulse is stopped
+	stop     chan bool
+	stopOnce sync.Once
 }
 
 var pulses = promauto.NewCounterVec(
@@ -62,6 +70,31 @@ var pulseDrain = promauto.NewCounterVec(
 	[]string{"name", "type"},
 )
 
+var pulsePauses = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "pulse_pauses",
+		Help:      "Number of times a pulse has been paused (or had its pause extended)",
+	},
+	[]string{"name", "type"},
+)
+var pulsePausedMillis = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "faultmonkey",
+		Name:      "pulse_paused_millis",
+		Help:      "Time in millis that each pulse has spent paused",
+	},
+	[]string{"name", "type"},
+)
+var pulsePaused = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "faultmonkey",
+		Name:      "pulse_paused",
+		Help:      "Whether or not each pulse is currently paused",
+	},
+	[]string{"name", "type"},
+)
+
 var pulseRegistry map[string]Pulse = map[string]Pulse{}
 var prMutex sync.RWMutex
 
@@ -72,65 +105,144 @@ func GetPulse(name string) Pulse {
 }
 
 func NewPulse(name string, maxInflight int, maxHertz float64) (Pulse, error) {
-	prMutex.RLock()
+	prMutex.Lock()
+	defer prMutex.Unlock()
 	if _, exists := pulseRegistry[strings.ToLower(name)]; exists {
-		prMutex.RUnlock()
 		return nil, fmt.Errorf("Pulse '%s' already exists", name)
 	}
-	prMutex.RUnlock()
 
+	pulse := newPulseImpl(name, maxInflight, maxHertz)
+	pulseRegistry[strings.ToLower(name)] = pulse
+	return pulse, nil
+}
+
+// RegisterPulse registers the pulse in place of the one with the
+// same name (e.g. when a reloaded config that changes its hertz
+// becomes the live one).
+//
+// The old pulse keeps going until it is stopped, so anything that
+// is still using it is not affected
+func RegisterPulse(name string, pulse Pulse) {
+	prMutex.Lock()
+	defer prMutex.Unlock()
+	pulseRegistry[strings.ToLower(name)] = pulse
+}
+
+// NewUnregisteredPulse creates a pulse that isn't in the registry,
+// for pulses that are looked after somewhere else (e.g. the pulses
+// of the hosts we talk to)
+func NewUnregisteredPulse(name string, maxInflight int, maxHertz float64) Pulse {
+	return newPulseImpl(name, maxInflight, maxHertz)
+}
+
+func newPulseImpl(name string, maxInflight int, maxHertz float64) *PulseImpl {
 	pulse := &PulseImpl{
 		name:        name,
 		maxInflight: maxInflight,
 		maxHertz:    maxHertz,
 		pulseChan:   make(chan bool, 1),
-		inflight:    make(chan bool, maxInflight),
+		stop:        make(chan bool),
+	}
+	if maxInflight > 0 {
+		pulse.inflight = make(chan bool, maxInflight)
 	}
-	prMutex.Lock()
-	pulseRegistry[strings.ToLower(name)] = pulse
-	prMutex.Unlock()
 
 	// Kick off the pulse
-	go func(p *PulseImpl) {
-		if maxHertz <= 0 {
-			return
-		}
+	go pulse.beat()
+	return pulse
+}
 
-		sleepTimeMillis := 1000 / maxHertz
-		for {
-			if sleepTimeMillis <= 0 {
-				// always a green light
-				pulses.WithLabelValues(p.name, "naive", fmt.Sprintf("%.2f", p.maxHertz)).Inc()
-				p.pulseChan <- true
-				continue
+// beat emits the heartbeat until the pulse is stopped
+func (p *PulseImpl) beat() {
+	if p.maxHertz <= 0 {
+		return
+	}
+
+	sleepTimeMillis := 1000 / p.maxHertz
+	for {
+		if sleepTimeMillis <= 0 {
+			// always a green light
+			pulses.WithLabelValues(p.name, "naive", fmt.Sprintf("%.2f", p.maxHertz)).Inc()
+			if !p.send() {
+				return
 			}
+			continue
+		}
 
-			// If we are to wait until a specified time, then do so
-			if p.waitUntil != nil {
-				sleepDurationNano := p.waitUntil.UnixNano() - time.Now().UTC().UnixNano()
-				if sleepDurationNano > 0 {
-					time.Sleep(time.Duration(sleepDurationNano) * time.Nanosecond)
-				}
-				pulses.WithLabelValues(p.name, "naive", fmt.Sprintf("%.2f", p.maxHertz)).Inc()
-				p.pulseChan <- true
-				p.waitUntil = nil
-				continue
+		// If we are to wait until a specified time, then do so
+		if p.waitForPause() {
+			pulses.WithLabelValues(p.name, "naive", fmt.Sprintf("%.2f", p.maxHertz)).Inc()
+			if !p.send() {
+				return
 			}
+			continue
+		}
 
-			// wait for the heartbeat
-			time.Sleep(time.Duration(sleepTimeMillis) * time.Millisecond)
-			p.pulseChan <- true
+		// wait for the heartbeat
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(time.Duration(sleepTimeMillis) * time.Millisecond):
 		}
-	}(pulse)
-	return pulse, nil
+		if !p.send() {
+			return
+		}
+	}
+}
+
+// send emits a heartbeat, returning false if the pulse has been
+// stopped
+func (p *PulseImpl) send() bool {
+	select {
+	case <-p.stop:
+		return false
+	case p.pulseChan <- true:
+		return true
+	}
+}
+
+// Stop stops the heartbeat.  Anything waiting for the pulse (now or
+// later) gets a green light, so nothing hangs on a pulse that has
+// been replaced
+func (p *PulseImpl) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *PulseImpl) GetMaxHertz() float64 {
+	return p.maxHertz
+}
+
+func (p *PulseImpl) GetMaxInflight() int {
+	return p.maxInflight
+}
+
+// IsSaturated is true if the next request would have to wait for
+// more than the heartbeat, i.e. we have been paused or there are
+// already maxInflight requests waiting
+func (p *PulseImpl) IsSaturated() bool {
+	if waitUntil := p.getPauseUntil(); waitUntil != nil && waitUntil.After(time.Now().UTC()) {
+		return true
+	}
+	return p.inflight != nil && len(p.inflight) >= cap(p.inflight)
 }
 
 // startInflight waits until there are < maxInflight requests
-// currently in flight
-func (p *PulseImpl) startInflight() error {
+// currently in flight (or the context is done)
+func (p *PulseImpl) startInflight(ctx context.Context) error {
+	if p.inflight == nil {
+		// No limit on the number in flight
+		return nil
+	}
+
 	// this will block until an inflight slot is available
-	p.inflight <- true
-	return nil
+	select {
+	case p.inflight <- true:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // finishInflight notifies the pulse that an inflight
@@ -144,19 +256,116 @@ func (p *PulseImpl) finishInflight() error {
 }
 
 func (p *PulseImpl) WaitForNext() error {
+	return p.WaitForNextContext(context.Background())
+}
+
+// WaitForNextContext is WaitForNext, except that it gives up when the
+// context is done.  A caller that has given up doesn't hold on to a
+// slot, or use up a heartbeat, that somebody else is waiting for
+func (p *PulseImpl) WaitForNextContext(ctx context.Context) error {
 	// Wait until the number currently in flight is lower than
 	// the max allowed
+	if err := p.startInflight(ctx); err != nil {
+		return err
+	}
 	defer p.finishInflight()
-	p.startInflight()
-	<-p.pulseChan
+	if p.maxHertz <= 0 {
+		// There is no heartbeat, so it is always a green light
+		// unless we have been paused
+		_, err := p.waitForPauseContext(ctx)
+		return err
+	}
+	select {
+	case <-p.pulseChan:
+	case <-p.stop:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	return nil
 }
 
 func (p *PulseImpl) SetPauseForDuration(duration time.Duration) {
-	t := time.Now().UTC().Add(duration)
-	p.waitUntil = &t
+	p.SetPauseUntil(time.Now().UTC().Add(duration))
 }
 
+// SetPauseUntil pauses the pulse until the wallclock time.
+//
+// Pauses only ever get extended: if we are already paused until
+// later than the wallclock, then this does nothing
 func (p *PulseImpl) SetPauseUntil(wallclock time.Time) {
+	p.pauseMutex.Lock()
+	defer p.pauseMutex.Unlock()
+
+	now := time.Now().UTC()
+	if !wallclock.After(now) {
+		return
+	}
+	pausedFrom := now
+	if p.waitUntil != nil {
+		if !wallclock.After(*p.waitUntil) {
+			return
+		}
+		if p.waitUntil.After(now) {
+			pausedFrom = *p.waitUntil
+		}
+	}
+
+	// Only count the time that this pause adds on
+	pulsePauses.WithLabelValues(p.name, p.pulseType()).Inc()
+	pulsePausedMillis.WithLabelValues(p.name, p.pulseType()).Add(float64(wallclock.Sub(pausedFrom).Milliseconds()))
+	pulsePaused.WithLabelValues(p.name, p.pulseType()).Set(1)
 	p.waitUntil = &wallclock
 }
+
+// getPauseUntil returns the time we are paused until (if any)
+func (p *PulseImpl) getPauseUntil() *time.Time {
+	p.pauseMutex.Lock()
+	defer p.pauseMutex.Unlock()
+	return p.waitUntil
+}
+
+// waitForPause sleeps until the pulse is no longer paused.
+//
+// It returns true if it had to wait
+func (p *PulseImpl) waitForPause() bool {
+	waited, _ := p.waitForPauseContext(context.Background())
+	return waited
+}
+
+// waitForPauseContext is waitForPause, except that it gives up when
+// the context is done
+func (p *PulseImpl) waitForPauseContext(ctx context.Context) (bool, error) {
+	waited := false
+	for {
+		waitUntil := p.getPauseUntil()
+		if waitUntil == nil {
+			return waited, nil
+		}
+		sleepDuration := time.Until(*waitUntil)
+		if sleepDuration <= 0 {
+			// The pause may have been extended while we were asleep
+			p.pauseMutex.Lock()
+			if p.waitUntil != nil && !p.waitUntil.After(time.Now().UTC()) {
+				p.waitUntil = nil
+				pulsePaused.WithLabelValues(p.name, p.pulseType()).Set(0)
+			}
+			p.pauseMutex.Unlock()
+			continue
+		}
+		waited = true
+		timer := time.NewTimer(sleepDuration)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return waited, ctx.Err()
+		}
+	}
+}
+
+func (p *PulseImpl) pulseType() string {
+	if p.impl == "" {
+		return "naive"
+	}
+	return p.impl
+}
@@ -43,9 +43,11 @@ func NewRedisPulse(name string, numWorkers int, maxHertz float64, targetHertz fl
 	pulse := &RedisPulseImpl{
 		PulseImpl: PulseImpl{
 			name:            name,
+			impl:            "redis",
 			maxInflight:     numWorkers,
 			maxHertz:        maxHertz,
 			targetRateHertz: targetHertz,
+			stop:            make(chan bool),
 		},
 		redisHost: redisHost,
 		redisPool: util.NewRedisConnectionPool(redisHost, int(poolSize), time.Duration(timeout)*time.Millisecond),
@@ -75,14 +77,9 @@ func NewRedisPulse(name string, numWorkers int, maxHertz float64, targetHertz fl
 			}
 
 			// If we are to wait until a specified time, then do so
-			if p.waitUntil != nil {
-				sleepDurationNano := p.waitUntil.UnixNano() - time.Now().UTC().UnixNano()
-				if sleepDurationNano > 0 {
-					time.Sleep(time.Duration(sleepDurationNano) * time.Nanosecond)
-				}
+			if p.waitForPause() {
 				pulses.WithLabelValues(p.name, "redis", fmt.Sprintf("%.2f", p.maxHertz)).Inc()
 				p.sendPulse()
-				p.waitUntil = nil
 				continue
 			}
 
@@ -30,7 +30,11 @@ func (q *naiiveQueueManagerImpl) PutTopic(topic string, m data.Message, block bo
 }
 
 func (q *naiiveQueueManagerImpl) FetchTopic(topic string, block bool) (data.Message, error) {
-	if _, exists := q.topics[NormaliseQueueName(topic)]; !exists {
+	// Don't hold on to the lock while we wait for a message
+	q.mutex.Lock()
+	messages, exists := q.topics[NormaliseQueueName(topic)]
+	q.mutex.Unlock()
+	if !exists {
 		return nil, fmt.Errorf("ERROR|facade/queue/naiive|Topic %s does not exist|", topic)
 	}
 
@@ -42,11 +46,11 @@ func (q *naiiveQueueManagerImpl) FetchTopic(topic string, block bool) (data.Mess
 	}
 
 	if block {
-		return <-q.topics[NormaliseQueueName(topic)], nil
+		return <-messages, nil
 	}
 
 	select {
-	case m := <-q.topics[NormaliseQueueName(topic)]:
+	case m := <-messages:
 		return m, nil
 
 	default:
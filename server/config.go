@@ -20,6 +20,9 @@ func (b *ServerBuilderImpl) FromConfig(appConfig *data.AppConfig) (ServerBuilder
 	b.impl = appConfig.Config.Server
 
 	// Validate the config
+	if appConfig.Config.Broker == nil {
+		return b, nil
+	}
 	for _, u := range appConfig.Config.Broker.UpstreamFromConfig {
 		err := u.Backpatch()
 		if err != nil {
@@ -3,17 +3,22 @@ package server
 import (
 	"http-attenuator/data"
 	"strings"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 )
 
 type ServerImpl struct {
-	server *data.Server
+	server      *data.Server
+	serverMutex sync.RWMutex
 }
 
 type FaultMonkey interface {
 	data.Handler
 	ShouldHandle(c *gin.Context) (bool, *data.ServerHost)
+
+	// SetServer swaps in the server from a new config
+	SetServer(server *data.Server)
 }
 
 func NewFaultMonkey(server *data.Server) FaultMonkey {
@@ -23,7 +28,19 @@ func NewFaultMonkey(server *data.Server) FaultMonkey {
 }
 
 func (s *ServerImpl) GetName() string {
-	return s.server.Name
+	return s.getServer().Name
+}
+
+func (s *ServerImpl) SetServer(server *data.Server) {
+	s.serverMutex.Lock()
+	defer s.serverMutex.Unlock()
+	s.server = server
+}
+
+func (s *ServerImpl) getServer() *data.Server {
+	s.serverMutex.RLock()
+	defer s.serverMutex.RUnlock()
+	return s.server
 }
 
 // ShouldHandle is used by proxy / gateway / broker mode
@@ -33,10 +50,11 @@ func (s *ServerImpl) GetName() string {
 // TODO(john): a simple rules language around host selection would be nice
 func (s *ServerImpl) ShouldHandle(c *gin.Context) (bool, *data.ServerHost) {
 	// Check for a Host: header match
-	serverHost, hasHostMapping := s.server.Hosts[strings.ToLower(c.Request.Host)]
+	server := s.getServer()
+	serverHost, hasHostMapping := server.Hosts[strings.ToLower(c.Request.Host)]
 	if !hasHostMapping {
 		// Check for the default mapping
-		serverHost, hasHostMapping = s.server.Hosts["default"]
+		serverHost, hasHostMapping = server.Hosts["default"]
 	}
 	return hasHostMapping, serverHost
 }
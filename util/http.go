@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"syscall"
 	"time"
 )
 
@@ -15,6 +16,16 @@ var defaultDialer = &net.Dialer{
 }
 
 func GetHttpClient(localAddress net.Addr) *http.Client {
+	client := GetStreamingHttpClient(localAddress)
+	client.Timeout = time.Second * 120 // TODO(john): get this from config
+	return client
+}
+
+// GetStreamingHttpClient is the same as GetHttpClient, except that
+// only the wait for the response headers has a timeout.  Reading the
+// body can take as long as it likes (e.g. server-sent events), so the
+// request needs a context that is cancelled when the caller goes away
+func GetStreamingHttpClient(localAddress net.Addr) *http.Client {
 	dialer := defaultDialer
 	if localAddress != nil {
 		// So we can reuse local addresses to avoid running out of
@@ -22,16 +33,30 @@ func GetHttpClient(localAddress net.Addr) *http.Client {
 		dialer.LocalAddr = localAddress
 	}
 	tr := &http.Transport{
-		Dial:                dialer.Dial,
-		TLSHandshakeTimeout: 5 * time.Second, // TODO(john): get this from config
+		Dial:                  dialer.Dial,
+		TLSHandshakeTimeout:   5 * time.Second,   // TODO(john): get this from config
+		ResponseHeaderTimeout: time.Second * 120, // TODO(john): get this from config
 	}
 	client := http.Client{
 		Transport: tr,
-		Timeout:   time.Second * 120, // TODO(john): get this from config
 	}
 	return &client
 }
 
+// GetControlledHttpClient is the same as GetHttpClient, except that
+// control is called with the address of each connection before it is
+// made, and can refuse it (e.g. because of where the host resolved to)
+func GetControlledHttpClient(control func(network string, address string, c syscall.RawConn) error) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   defaultDialer.Timeout,
+		KeepAlive: defaultDialer.KeepAlive,
+		Control:   control,
+	}
+	client := GetHttpClient(nil)
+	client.Transport.(*http.Transport).Dial = dialer.Dial
+	return client
+}
+
 func HttpGet(url string, headers http.Header) (int, []byte, http.Header, error) {
 	request, err := http.NewRequest("GET", url, nil)
 	if err != nil {